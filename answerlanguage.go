@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/charmbracelet/huh"
+)
+
+const (
+	// answerLanguageAuto answers in the language of the question.
+	answerLanguageAuto = "auto"
+)
+
+// answerLanguage is a language the answers and the titles can be forced in.
+type answerLanguage struct {
+	code string
+	name string
+}
+
+var answerLanguages = []answerLanguage{
+	{answerLanguageAuto, "Auto"},
+	{"en", "English"},
+	{"de", "German"},
+	{"fr", "French"},
+	{"es", "Spanish"},
+	{"it", "Italian"},
+	{"pt", "Portuguese"},
+	{"nl", "Dutch"},
+	{"pl", "Polish"},
+	{"ru", "Russian"},
+	{"ja", "Japanese"},
+	{"zh", "Chinese"},
+	{"ko", "Korean"},
+}
+
+// answerLanguageName returns the name of the language of the code, the code
+// itself when it's unknown.
+func answerLanguageName(code string) string {
+	i := slices.IndexFunc(answerLanguages, func(l answerLanguage) bool { return l.code == code })
+	if i < 0 {
+		return code
+	}
+	return answerLanguages[i].name
+}
+
+func answerLanguageOptions() []huh.Option[string] {
+	options := make([]huh.Option[string], len(answerLanguages))
+	for i, l := range answerLanguages {
+		options[i] = huh.NewOption(l.name, l.code)
+	}
+	return options
+}
+
+// withAnswerLanguage appends the instruction to answer in the language to the
+// system prompt, which is in English whatever the language of the documents.
+func withAnswerLanguage(systemPrompt, code string) string {
+	instruction := "Answer in the language of the user's last message, whatever the language of the documents " +
+		"and of these instructions."
+	if code != answerLanguageAuto {
+		instruction = fmt.Sprintf("Always answer in %s, whatever the language of the question, of the documents "+
+			"and of these instructions.", answerLanguageName(code))
+	}
+	return systemPrompt + "\n\nLANGUAGE:\n" + instruction
+}
+
+// titleLanguageInstruction is the instruction of the title generation about
+// the language of the title.
+func titleLanguageInstruction(code string) string {
+	if code == answerLanguageAuto {
+		return "Write the title in the language of the user's messages."
+	}
+	return fmt.Sprintf("Write the title in %s, whatever the language of the conversation.", answerLanguageName(code))
+}
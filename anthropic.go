@@ -8,22 +8,44 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/charmbracelet/huh"
-	bolt "go.etcd.io/bbolt"
 )
 
 type anthropicProvider struct {
-	APIKey string `json:"apiKey"`
+	APIKey  string `json:"apiKey"`
+	Timeout string `json:"timeout"`
+	Proxy   string `json:"proxy"`
+	// Endpoint and APIVersion are set to use an LLM gateway that mirrors the
+	// Anthropic API, empty values use the Anthropic API.
+	Endpoint   string `json:"endpoint"`
+	APIVersion string `json:"apiVersion"`
+	// ThinkingBudget is the extended thinking budget in tokens, empty disables
+	// the extended thinking.
+	ThinkingBudget string `json:"thinkingBudget"`
+	// ModelMaxTokens holds the max output tokens of the models, as reported by
+	// the models API when the provider was saved.
+	ModelMaxTokens map[string]int `json:"modelMaxTokens,omitempty"`
+
+	rateLimitSettings
 }
 
 type anthropic struct {
-	apiKey      string
-	model       string
-	temperature float64
+	apiKey         string
+	endpoint       string
+	apiVersion     string
+	model          string
+	temperature    float64
+	topP           *float64
+	stopSequences  []string
+	thinkingBudget int
+	maxTokens      int
 
 	client *http.Client
 }
@@ -31,10 +53,30 @@ type anthropic struct {
 type anthropicChatRequest struct {
 	Model       string             `json:"model"`
 	Messages    []anthropicMessage `json:"messages"`
-	System      string             `json:"system,omitempty"`
+	System      []anthropicSystem  `json:"system,omitempty"`
 	MaxTokens   int                `json:"max_tokens,omitempty"`
 	Temperature float64            `json:"temperature"`
-	Stream      bool               `json:"stream"`
+	TopP        *float64           `json:"top_p,omitempty"`
+	// StopSequences are sent as custom stop sequences, the answer ends before
+	// them.
+	StopSequences []string           `json:"stop_sequences,omitempty"`
+	Stream        bool               `json:"stream"`
+	Thinking      *anthropicThinking `json:"thinking,omitempty"`
+}
+
+type anthropicThinking struct {
+	Type         string `json:"type"`
+	BudgetTokens int    `json:"budget_tokens"`
+}
+
+type anthropicSystem struct {
+	Type         string                 `json:"type"`
+	Text         string                 `json:"text"`
+	CacheControl *anthropicCacheControl `json:"cache_control,omitempty"`
+}
+
+type anthropicCacheControl struct {
+	Type string `json:"type"`
 }
 
 type anthropicMessage struct {
@@ -44,24 +86,124 @@ type anthropicMessage struct {
 
 type anthropicChatResponse struct {
 	Content []anthropicContent `json:"content"`
+	Usage   anthropicUsage     `json:"usage"`
+}
+
+type anthropicUsage struct {
+	InputTokens              int `json:"input_tokens"`
+	OutputTokens             int `json:"output_tokens"`
+	CacheCreationInputTokens int `json:"cache_creation_input_tokens"`
+	CacheReadInputTokens     int `json:"cache_read_input_tokens"`
 }
 
 type anthropicContent struct {
+	Type string `json:"type"`
 	Text string `json:"text"`
+	// Thinking is set on the thinking blocks of the extended thinking.
+	Thinking string `json:"thinking"`
+}
+
+type anthropicModelsResponse struct {
+	Data    []anthropicModelInfo `json:"data"`
+	HasMore bool                 `json:"has_more"`
+	LastID  string               `json:"last_id"`
+}
+
+type anthropicModelInfo struct {
+	ID string `json:"id"`
+	// MaxTokens is the max output tokens of the model, it's zero when the API, or
+	// the gateway in front of it, doesn't report it.
+	MaxTokens int `json:"max_tokens"`
 }
 
 type anthropicStreamResponse struct {
 	Type  string `json:"type"`
 	Delta struct {
-		Text string `json:"text"`
+		// Type of a content_block_delta is text_delta for the answer and
+		// thinking_delta for the extended thinking. The signature_delta that
+		// closes a thinking block is not needed, as the thinking is not sent
+		// back with the following messages.
+		Type     string `json:"type"`
+		Text     string `json:"text"`
+		Thinking string `json:"thinking"`
 	} `json:"delta"`
+	// Message is sent with the message_start event, with the usage of the prompt.
+	Message struct {
+		Usage anthropicUsage `json:"usage"`
+	} `json:"message"`
+	// Usage is sent with the message_delta event, with the output tokens so far.
+	Usage anthropicUsage `json:"usage"`
+	// Error is sent with the error event, when the request fails in the middle
+	// of the stream, e.g. when the API is overloaded.
+	Error *anthropicStreamError `json:"error"`
+}
+
+type anthropicStreamError struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
 }
 
 const (
-	anthropicAPIEndpoint = "https://api.anthropic.com/v1"
+	defaultAnthropicEndpoint   = "https://api.anthropic.com/v1"
+	defaultAnthropicAPIVersion = "2023-06-01"
+
+	// defaultClaudeMaxTokens is the max output tokens sent for the unknown
+	// models, every Claude model supports at least this many.
+	defaultClaudeMaxTokens = 4096
+
+	// anthropicCacheMinLength is roughly the minimum of 1024 tokens Anthropic
+	// caches a prompt for, shorter prompts aren't marked for caching.
+	anthropicCacheMinLength = 4096
+
+	// anthropicMinThinkingBudget is the smallest extended thinking budget the API
+	// accepts.
+	anthropicMinThinkingBudget = 1024
+
+	// anthropicMaxEventSize is the longest stream line accepted, a single delta
+	// can be longer than the default scanner buffer.
+	anthropicMaxEventSize = 4 * 1024 * 1024
 )
 
+// anthropicModels is used when the models can't be fetched from the API.
+var anthropicModels = []string{
+	"claude-3-7-sonnet-20250219",
+	"claude-3-5-sonnet-20241022",
+	"claude-3-5-haiku-20241022",
+	"claude-3-opus-20240229",
+	"claude-3-sonnet-20240229",
+	"claude-3-haiku-20240307",
+}
+
+// anthropicModelsCache holds the models fetched from the API for the session,
+// keyed by endpoint and API key, so the model select doesn't hit the API every time it's
+// rendered.
+// claudeModelMaxTokens holds the max output tokens of the known Claude model
+// families.
+var claudeModelMaxTokens = []struct {
+	prefix    string
+	maxTokens int
+}{
+	{"claude-sonnet-4", 64000},
+	{"claude-3-7-sonnet", 64000},
+	{"claude-opus-4", 32000},
+	{"claude-3-5-sonnet", 8192},
+	{"claude-3-5-haiku", 8192},
+	{"claude-3-opus", 4096},
+	{"claude-3-sonnet", 4096},
+	{"claude-3-haiku", 4096},
+}
+
+var anthropicModelsCache = struct {
+	sync.Mutex
+	models map[string][]string
+}{
+	models: make(map[string][]string),
+}
+
 func (a anthropic) chat(ctx context.Context, chats []chat) llmResponse {
+	if hasImages(chats) {
+		return llmResponse{err: errImagesUnsupported}
+	}
 	systemChat, cs := extractSystemChat(chats)
 
 	msgs := make([]anthropicMessage, len(cs))
@@ -73,13 +215,16 @@ func (a anthropic) chat(ctx context.Context, chats []chat) llmResponse {
 	}
 
 	reqBody := anthropicChatRequest{
-		Model:       a.model,
-		Messages:    msgs,
-		Temperature: a.temperature,
-		Stream:      false,
-		System:      systemChat,
-		MaxTokens:   a.maxTokens(),
+		Model:         a.model,
+		Messages:      msgs,
+		Temperature:   a.temperature,
+		TopP:          a.topP,
+		StopSequences: a.stopSequences,
+		Stream:        false,
+		System:        anthropicSystemPrompt(systemChat),
+		MaxTokens:     a.maxTokens,
 	}
+	a.setThinking(&reqBody)
 
 	jsonBody, err := json.Marshal(reqBody)
 	if err != nil {
@@ -88,7 +233,7 @@ func (a anthropic) chat(ctx context.Context, chats []chat) llmResponse {
 		}
 	}
 
-	req, err := http.NewRequestWithContext(ctx, "POST", anthropicAPIEndpoint+"/messages", bytes.NewBuffer(jsonBody))
+	req, err := http.NewRequestWithContext(ctx, "POST", a.endpoint+"/messages", bytes.NewBuffer(jsonBody))
 	if err != nil {
 		return llmResponse{
 			err: fmt.Errorf("error creating request: %w", err),
@@ -97,7 +242,7 @@ func (a anthropic) chat(ctx context.Context, chats []chat) llmResponse {
 
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("x-api-key", a.apiKey)
-	req.Header.Set("anthropic-version", "2023-06-01")
+	req.Header.Set("anthropic-version", a.apiVersion)
 
 	resp, err := a.client.Do(req)
 	if err != nil {
@@ -108,9 +253,8 @@ func (a anthropic) chat(ctx context.Context, chats []chat) llmResponse {
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
 		return llmResponse{
-			err: fmt.Errorf("unexpected status code: %d, body: %s", resp.StatusCode, string(body)),
+			err: newHTTPStatusError(resp),
 		}
 	}
 
@@ -127,8 +271,22 @@ func (a anthropic) chat(ctx context.Context, chats []chat) llmResponse {
 		}
 	}
 
+	// With the extended thinking the answer comes after the thinking blocks.
+	var content, thinking strings.Builder
+	for _, c := range response.Content {
+		switch c.Type {
+		case "text":
+			content.WriteString(c.Text)
+		case "thinking":
+			thinking.WriteString(c.Thinking)
+		}
+	}
+
 	return llmResponse{
-		content: response.Content[0].Text,
+		content:          content.String(),
+		thinking:         thinking.String(),
+		promptTokens:     response.Usage.promptTokens(),
+		completionTokens: response.Usage.OutputTokens,
 	}
 }
 
@@ -149,13 +307,16 @@ func (a anthropic) chatStream(ctx context.Context, chats []chat) <-chan llmRespo
 		}
 
 		reqBody := anthropicChatRequest{
-			Model:       a.model,
-			Messages:    msgs,
-			Temperature: a.temperature,
-			Stream:      true,
-			System:      systemChat,
-			MaxTokens:   a.maxTokens(),
+			Model:         a.model,
+			Messages:      msgs,
+			Temperature:   a.temperature,
+			TopP:          a.topP,
+			StopSequences: a.stopSequences,
+			Stream:        true,
+			System:        anthropicSystemPrompt(systemChat),
+			MaxTokens:     a.maxTokens,
 		}
+		a.setThinking(&reqBody)
 
 		jsonBody, err := json.Marshal(reqBody)
 		if err != nil {
@@ -165,7 +326,7 @@ func (a anthropic) chatStream(ctx context.Context, chats []chat) <-chan llmRespo
 			return
 		}
 
-		req, err := http.NewRequestWithContext(ctx, "POST", anthropicAPIEndpoint+"/messages", bytes.NewBuffer(jsonBody))
+		req, err := http.NewRequestWithContext(ctx, "POST", a.endpoint+"/messages", bytes.NewBuffer(jsonBody))
 		if err != nil {
 			responseChan <- llmResponse{
 				err: fmt.Errorf("error creating request: %w", err),
@@ -175,7 +336,7 @@ func (a anthropic) chatStream(ctx context.Context, chats []chat) <-chan llmRespo
 
 		req.Header.Set("Content-Type", "application/json")
 		req.Header.Set("x-api-key", a.apiKey)
-		req.Header.Set("anthropic-version", "2023-06-01")
+		req.Header.Set("anthropic-version", a.apiVersion)
 
 		resp, err := a.client.Do(req)
 		if err != nil {
@@ -190,14 +351,15 @@ func (a anthropic) chatStream(ctx context.Context, chats []chat) <-chan llmRespo
 		defer resp.Body.Close()
 
 		if resp.StatusCode != http.StatusOK {
-			body, _ := io.ReadAll(resp.Body)
 			responseChan <- llmResponse{
-				err: fmt.Errorf("unexpected status code: %d, body: %s", resp.StatusCode, string(body)),
+				err: newHTTPStatusError(resp),
 			}
 			return
 		}
 
+		var promptTokens int
 		scanner := bufio.NewScanner(resp.Body)
+		scanner.Buffer(make([]byte, 0, 64*1024), anthropicMaxEventSize)
 		for scanner.Scan() {
 			line := scanner.Text()
 			if !strings.HasPrefix(line, "data: ") {
@@ -220,9 +382,46 @@ func (a anthropic) chatStream(ctx context.Context, chats []chat) <-chan llmRespo
 				return
 			}
 
-			if streamResp.Type == "content_block_delta" && streamResp.Delta.Text != "" {
+			if streamResp.Type == "ping" {
+				continue
+			}
+
+			if streamResp.Type == "error" {
+				streamErr := streamResp.Error
+				if streamErr == nil {
+					streamErr = &anthropicStreamError{Type: "api_error", Message: data}
+				}
 				responseChan <- llmResponse{
-					content: streamResp.Delta.Text,
+					err: fmt.Errorf("error in stream: %w", streamErr),
+				}
+				return
+			}
+
+			if streamResp.Type == "message_start" {
+				promptTokens = streamResp.Message.Usage.promptTokens()
+			}
+
+			if streamResp.Type == "content_block_delta" {
+				switch streamResp.Delta.Type {
+				case "text_delta":
+					if streamResp.Delta.Text != "" {
+						responseChan <- llmResponse{
+							content: streamResp.Delta.Text,
+						}
+					}
+				case "thinking_delta":
+					if streamResp.Delta.Thinking != "" {
+						responseChan <- llmResponse{
+							thinking: streamResp.Delta.Thinking,
+						}
+					}
+				}
+			}
+
+			if streamResp.Type == "message_delta" {
+				responseChan <- llmResponse{
+					promptTokens:     promptTokens,
+					completionTokens: streamResp.Usage.OutputTokens,
 				}
 			}
 
@@ -237,18 +436,110 @@ func (a anthropic) chatStream(ctx context.Context, chats []chat) <-chan llmRespo
 					err: fmt.Errorf("error reading response: %w", err),
 				}
 			}
+			return
+		}
+
+		// The stream ends with message_stop, without it the answer is cut.
+		if ctx.Err() == nil {
+			responseChan <- llmResponse{
+				err: errors.New("stream ended before the message was complete"),
+			}
 		}
 	}()
 
 	return responseChan
 }
 
-func (a anthropic) maxTokens() int {
-	if strings.HasPrefix(a.model, "claude-3-5-sonnet") ||
-		strings.HasPrefix(a.model, "claude-3-5-haiku") {
-		return 8192
+// anthropicSystemPrompt returns the system blocks of the request. A long system
+// prompt, like the one with the retrieved documents, is marked for prompt
+// caching, so the following messages of the session don't pay for it again
+// while the same documents are retrieved.
+func anthropicSystemPrompt(systemChat string) []anthropicSystem {
+	if systemChat == "" {
+		return nil
 	}
-	return 4096
+
+	system := anthropicSystem{
+		Type: "text",
+		Text: systemChat,
+	}
+	if len(systemChat) >= anthropicCacheMinLength {
+		system.CacheControl = &anthropicCacheControl{Type: "ephemeral"}
+	}
+
+	return []anthropicSystem{system}
+}
+
+func (e *anthropicStreamError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Type, e.Message)
+}
+
+// HTTPStatusCode returns the status code of the error type, as the error
+// responses would have, so an error event before any content is retried.
+func (e *anthropicStreamError) HTTPStatusCode() int {
+	switch e.Type {
+	case "overloaded_error":
+		return 529
+	case "api_error":
+		return http.StatusInternalServerError
+	case "rate_limit_error":
+		return http.StatusTooManyRequests
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+// promptTokens returns all the input tokens, including the ones written to and
+// read from the prompt cache, which are not counted in InputTokens.
+func (u anthropicUsage) promptTokens() int {
+	return u.InputTokens + u.CacheCreationInputTokens + u.CacheReadInputTokens
+}
+
+// setThinking enables the extended thinking on the request when a budget is set
+// and the model supports it. The API requires a temperature of 1 and no top_p
+// with thinking, and a budget below the max tokens, as the thinking counts
+// towards them.
+func (a anthropic) setThinking(req *anthropicChatRequest) {
+	if a.thinkingBudget == 0 || !claudeSupportsThinking(a.model) {
+		return
+	}
+
+	budget := min(a.thinkingBudget, req.MaxTokens-1)
+	req.Thinking = &anthropicThinking{
+		Type:         "enabled",
+		BudgetTokens: budget,
+	}
+	req.Temperature = 1
+	req.TopP = nil
+}
+
+// claudeSupportsThinking reports whether the Claude model supports extended
+// thinking.
+func claudeSupportsThinking(model string) bool {
+	return strings.HasPrefix(model, "claude-3-7-sonnet") ||
+		strings.HasPrefix(model, "claude-sonnet-4") ||
+		strings.HasPrefix(model, "claude-opus-4")
+}
+
+// claudeMaxTokens returns the max output tokens of the given Claude model, or
+// defaultClaudeMaxTokens when the model isn't known.
+func claudeMaxTokens(model string) int {
+	if n, ok := knownClaudeMaxTokens(model); ok {
+		return n
+	}
+	return defaultClaudeMaxTokens
+}
+
+// knownClaudeMaxTokens returns the max output tokens of the Claude models that
+// were released when this was written, it's only used when the models API
+// doesn't report them.
+func knownClaudeMaxTokens(model string) (int, bool) {
+	for _, m := range claudeModelMaxTokens {
+		if strings.HasPrefix(model, m.prefix) {
+			return m.maxTokens, true
+		}
+	}
+	return 0, false
 }
 
 func (a anthropicProvider) Title() string {
@@ -270,13 +561,77 @@ func (a anthropicProvider) name() string {
 	return providerAnthropic
 }
 
-func (a anthropicProvider) availableModels() []string {
-	return []string{
-		"claude-3-5-sonnet-20241022",
-		"claude-3-5-haiku-20241022",
-		"claude-3-opus-20240229",
-		"claude-3-sonnet-20240229",
-		"claude-3-haiku-20240307",
+func (a anthropicProvider) availableModels() ([]string, error) {
+	if a.APIKey == "" {
+		return anthropicModels, nil
+	}
+
+	anthropicModelsCache.Lock()
+	defer anthropicModelsCache.Unlock()
+
+	cacheKey := a.endpoint() + "\x00" + a.APIKey
+	if models, ok := anthropicModelsCache.models[cacheKey]; ok {
+		return models, nil
+	}
+
+	infos, err := a.listModels(context.Background())
+	if err != nil || len(infos) == 0 {
+		// The failure isn't cached, so the next listing tries the API again.
+		slog.Warn("error listing anthropic models, using the default list", "error", err)
+		return anthropicModels, nil
+	}
+
+	models := make([]string, len(infos))
+	for i, m := range infos {
+		models[i] = m.ID
+	}
+
+	anthropicModelsCache.models[cacheKey] = models
+
+	return models, nil
+}
+
+// listModels returns the models fetched from the Anthropic models API.
+func (a anthropicProvider) listModels(ctx context.Context) ([]anthropicModelInfo, error) {
+	var models []anthropicModelInfo
+	afterID := ""
+	for {
+		url := a.endpoint() + "/models?limit=1000"
+		if afterID != "" {
+			url += "&after_id=" + afterID
+		}
+
+		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if err != nil {
+			return nil, fmt.Errorf("error creating request: %w", err)
+		}
+		req.Header.Set("x-api-key", a.APIKey)
+		req.Header.Set("anthropic-version", a.apiVersion())
+
+		resp, err := newProxyHTTPClient(a.Proxy).Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("error sending request: %w", err)
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+			resp.Body.Close()
+			return nil, fmt.Errorf("unexpected status code: %d, body: %s", resp.StatusCode, string(body))
+		}
+
+		var response anthropicModelsResponse
+		err = json.NewDecoder(resp.Body).Decode(&response)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error decoding response: %w", err)
+		}
+
+		models = append(models, response.Data...)
+
+		if !response.HasMore || response.LastID == "" {
+			return models, nil
+		}
+		afterID = response.LastID
 	}
 }
 
@@ -284,11 +639,56 @@ func (a anthropicProvider) isConfigured() bool {
 	return a.APIKey != ""
 }
 
+func (a anthropicProvider) testConnection() error {
+	_, err := a.listModels(context.Background())
+	return err
+}
+
+// fetchModelMaxTokens returns the max output tokens of the models reported by
+// the models API.
+func (a anthropicProvider) fetchModelMaxTokens() (map[string]int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), providerStatusTimeout)
+	defer cancel()
+
+	models, err := a.listModels(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(map[string]int)
+	for _, m := range models {
+		if m.MaxTokens > 0 {
+			res[m.ID] = m.MaxTokens
+		}
+	}
+	return res, nil
+}
+
+// maxTokens returns the max output tokens of the model, from the models API when
+// it reported them, or else from the known Claude models.
+func (a anthropicProvider) maxTokens(model string) int {
+	if n := a.ModelMaxTokens[model]; n > 0 {
+		return n
+	}
+	if n, ok := knownClaudeMaxTokens(model); ok {
+		return n
+	}
+	slog.Warn("unknown max output tokens of the anthropic model, using the default",
+		"model", model, "maxTokens", defaultClaudeMaxTokens)
+	return defaultClaudeMaxTokens
+}
+
 func (a anthropicProvider) form(width, height int, keymap *huh.KeyMap) *huh.Form {
+	timeout := a.Timeout
+	proxy := a.Proxy
+	thinkingBudget := a.ThinkingBudget
+	endpoint := a.Endpoint
+	apiVersion := a.APIVersion
 	apiKey := a.APIKey
 	if apiKey == "" {
 		apiKey = os.Getenv("ANTHROPIC_API_KEY")
 	}
+	rateLimit := a.rateLimitSettings
 	return huh.NewForm(
 		huh.NewGroup(
 			huh.NewInput().
@@ -297,6 +697,49 @@ func (a anthropicProvider) form(width, height int, keymap *huh.KeyMap) *huh.Form
 				Description("Enter the API key for anthropic.").
 				Placeholder("API Key").
 				Value(&apiKey),
+			huh.NewInput().
+				Key("anthropicTimeout").
+				Title("Timeout").
+				Description("Fail a request when anthropic sends nothing for this long, e.g. 120s or 5m.").
+				Placeholder(defaultRequestTimeout.String()).
+				Validate(func(s string) error {
+					_, err := parseRequestTimeout(s)
+					return err
+				}).
+				Value(&timeout),
+			huh.NewInput().
+				Key("anthropicThinkingBudget").
+				Title("Thinking Budget").
+				Description("Optional extended thinking budget in tokens for the models that support it, e.g. 4096.").
+				Placeholder("Disabled").
+				Validate(func(s string) error {
+					_, err := parseThinkingBudget(s)
+					return err
+				}).
+				Value(&thinkingBudget),
+			huh.NewInput().
+				Key("anthropicEndpoint").
+				Title("Endpoint").
+				Description("Optional URL of a gateway that mirrors the Anthropic API, the /messages path is appended to it.").
+				Placeholder(defaultAnthropicEndpoint).
+				Value(&endpoint),
+			huh.NewInput().
+				Key("anthropicAPIVersion").
+				Title("API Version").
+				Description("Optional anthropic-version header sent with the requests.").
+				Placeholder(defaultAnthropicAPIVersion).
+				Value(&apiVersion),
+			proxyField("anthropicProxy", "Anthropic", &proxy),
+			requestsPerMinuteField("anthropic", &rateLimit.RequestsPerMinute),
+			tokensPerMinuteField("anthropic", &rateLimit.TokensPerMinute),
+			testConnectionField("anthropicTest", func() error {
+				return anthropicProvider{
+					APIKey:     apiKey,
+					Proxy:      proxy,
+					Endpoint:   endpoint,
+					APIVersion: apiVersion,
+				}.testConnection()
+			}),
 			huh.NewConfirm().
 				Key("anthropicConfirm").
 				Title("Confirm").
@@ -313,32 +756,49 @@ func (a anthropicProvider) form(width, height int, keymap *huh.KeyMap) *huh.Form
 		WithShowHelp(true)
 }
 
-func (a anthropicProvider) saveForm(db *bolt.DB, form *huh.Form) (llmProvider, bool, error) {
+func (a anthropicProvider) saveForm(form *huh.Form) (llmProvider, bool) {
 	if !form.GetBool("anthropicConfirm") {
-		return a, false, nil
+		return a, false
 	}
 
 	apiKey := form.GetString("anthropicAPIKey")
 
 	if apiKey == "" {
-		return a, false, nil
+		return a, false
 	}
 
 	a.APIKey = apiKey
-
-	if err := saveAnthropicSettings(db, a); err != nil {
-		return a, false, fmt.Errorf("error saving anthropic settings: %w", err)
+	a.Timeout = form.GetString("anthropicTimeout")
+	a.Proxy = form.GetString("anthropicProxy")
+	a.ThinkingBudget = form.GetString("anthropicThinkingBudget")
+	a.Endpoint = form.GetString("anthropicEndpoint")
+	a.APIVersion = form.GetString("anthropicAPIVersion")
+
+	// The max output tokens are refreshed on every save, and the previous ones
+	// are kept when the models API can't be reached.
+	maxTokens, err := a.fetchModelMaxTokens()
+	if err != nil {
+		slog.Warn("error fetching the max output tokens of the anthropic models", "error", err)
+	} else {
+		a.ModelMaxTokens = maxTokens
 	}
+	a.rateLimitSettings = rateLimitSettingsFromForm(form, "anthropic")
 
-	return a, true, nil
+	return a, true
 }
 
 func (a anthropicProvider) new(setting llmSetting) llm {
 	return anthropic{
-		apiKey:      a.APIKey,
-		model:       setting.Model,
-		temperature: setting.Temperature,
-		client:      &http.Client{},
+		apiKey:         a.APIKey,
+		endpoint:       a.endpoint(),
+		apiVersion:     a.apiVersion(),
+		model:          setting.Model,
+		temperature:    setting.Temperature,
+		topP:           setting.TopP,
+		stopSequences:  setting.StopSequences,
+		thinkingBudget: thinkingBudget(a.ThinkingBudget),
+		maxTokens:      a.maxTokens(setting.Model),
+		client:         newTimeoutHTTPClient(requestTimeout(a.Timeout), a.Proxy),
 	}
 }
 
@@ -349,3 +809,39 @@ func (a anthropicProvider) supportEmbedding() bool {
 func (a anthropicProvider) newEmbedder(setting llmSetting) embedder {
 	return nil
 }
+
+func (a anthropicProvider) endpoint() string {
+	if a.Endpoint == "" {
+		return defaultAnthropicEndpoint
+	}
+	return strings.TrimRight(a.Endpoint, "/")
+}
+
+func (a anthropicProvider) apiVersion() string {
+	if a.APIVersion == "" {
+		return defaultAnthropicAPIVersion
+	}
+	return a.APIVersion
+}
+
+// parseThinkingBudget parses an extended thinking budget setting, an empty value
+// disables the thinking.
+func parseThinkingBudget(s string) (int, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+
+	budget, err := strconv.Atoi(s)
+	if err != nil || budget < anthropicMinThinkingBudget {
+		return 0, fmt.Errorf("invalid thinking budget %q, use at least %d tokens", s, anthropicMinThinkingBudget)
+	}
+	return budget, nil
+}
+
+// thinkingBudget returns the budget of the setting, an invalid budget disables
+// the thinking.
+func thinkingBudget(s string) int {
+	budget, _ := parseThinkingBudget(s)
+	return budget
+}
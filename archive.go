@@ -0,0 +1,242 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// archiveSeparator separates the path of an archive from the path of a file
+// inside it, like docs/archive.zip!/guide/intro.md.
+const archiveSeparator = "!/"
+
+const (
+	defaultMaxArchiveMB = 50
+	maxMaxArchiveMB     = 4096
+)
+
+func parseMaxArchiveMB(s string) (int, error) {
+	n, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || n < 1 || n > maxMaxArchiveMB {
+		return 0, fmt.Errorf("invalid archive size limit %q, use a number of MB from 1 to %d", s, maxMaxArchiveMB)
+	}
+	return n, nil
+}
+
+func (s ragSettings) maxArchiveMB() int {
+	if s.MaxArchiveMB == 0 {
+		return defaultMaxArchiveMB
+	}
+	return s.MaxArchiveMB
+}
+
+// isArchive reports whether the file is a zip or a gzipped tar archive by its
+// extension.
+func isArchive(name string) bool {
+	name = strings.ToLower(name)
+	return strings.HasSuffix(name, ".zip") || strings.HasSuffix(name, ".tar.gz") || strings.HasSuffix(name, ".tgz")
+}
+
+// archiveEntryStates groups the states of the files read from the archives by
+// the path of their archive.
+func archiveEntryStates(fileStates map[string]fileState) map[string][]string {
+	entries := make(map[string][]string)
+	for id := range fileStates {
+		if i := strings.Index(id, archiveSeparator); i > 0 {
+			entries[id[:i]] = append(entries[id[:i]], id)
+		}
+	}
+	return entries
+}
+
+// archiveUnchanged reports whether the archive has the modification time and
+// the size of the last scan of its files, entries.
+func archiveUnchanged(info os.FileInfo, entries []string, fileStates map[string]fileState) bool {
+	return len(entries) > 0 && !slices.ContainsFunc(entries, func(id string) bool {
+		return !unchangedSince(info, fileStates[id])
+	})
+}
+
+// archiveReader reads the files of the archives of a scan in memory, with the
+// limits of the files on the disk. The files of an archive are read until
+// their total size reaches maxArchiveBytes.
+type archiveReader struct {
+	maxFileBytes    int64
+	maxAudioBytes   int64
+	maxArchiveBytes int64
+	opts            extractOptions
+	exclusions      *scanExclusions
+	progress        chan<- documentScanLogMsg
+}
+
+// archiveFile is a file inside an archive, open reads it.
+type archiveFile struct {
+	name    string
+	size    int64
+	modTime time.Time
+	open    func() (io.Reader, func(), error)
+}
+
+// errArchiveFull stops the reading of an archive at its size limit.
+var errArchiveFull = errors.New("the archive size limit is reached")
+
+// read calls fn with the files of the archive read at p, their modification
+// time is the one of the archive when they don't have one. The archives inside
+// the archive are skipped.
+func (a archiveReader) read(
+	p string,
+	data []byte,
+	modTime time.Time,
+	fn func(name string, data []byte, modTime time.Time),
+) error {
+	var total int64
+	readFile := func(file archiveFile) error {
+		name := strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(file.name)), "/")
+		id := p + archiveSeparator + name
+		if isArchive(name) {
+			a.progress <- documentScanLogMsg{
+				content: fmt.Sprintf("Skipped %s: the archives inside the archives are not read", id),
+			}
+			return nil
+		}
+
+		ext := strings.ToLower(path.Ext(name))
+		_, isImage := imageMIMETypes[ext]
+		if isImage && a.opts.imageReader == nil {
+			return nil
+		}
+		isAudio := audioExtensions[ext]
+		if isAudio && a.opts.transcriber == nil {
+			return nil
+		}
+		limit := a.maxFileBytes
+		if isAudio {
+			limit = a.maxAudioBytes
+		}
+		if file.size > limit {
+			a.exclusions.oversizedEntries.Add(1)
+			a.progress <- documentScanLogMsg{
+				content: fmt.Sprintf("Warning: skipped %s: it's over the %d MB file size limit", id, limit>>20),
+			}
+			return nil
+		}
+		if total+file.size > a.maxArchiveBytes {
+			return errArchiveFull
+		}
+
+		r, closeFile, err := file.open()
+		if err != nil {
+			return err
+		}
+		defer closeFile()
+		// The sizes of the headers are not trusted, the files are read up to
+		// the limits.
+		fileData, err := io.ReadAll(io.LimitReader(r, min(limit, a.maxArchiveBytes-total)+1))
+		if err != nil {
+			return fmt.Errorf("error reading %s: %w", name, err)
+		}
+		if int64(len(fileData)) > limit {
+			a.exclusions.oversizedEntries.Add(1)
+			a.progress <- documentScanLogMsg{
+				content: fmt.Sprintf("Warning: skipped %s: it's over the %d MB file size limit", id, limit>>20),
+			}
+			return nil
+		}
+		total += int64(len(fileData))
+		if total > a.maxArchiveBytes {
+			return errArchiveFull
+		}
+
+		if file.modTime.IsZero() {
+			file.modTime = modTime
+		}
+		fn(name, fileData, file.modTime)
+		return nil
+	}
+
+	var err error
+	if strings.HasSuffix(strings.ToLower(p), ".zip") {
+		err = readZip(data, readFile)
+	} else {
+		err = readTarGz(data, readFile)
+	}
+	if errors.Is(err, errArchiveFull) {
+		a.progress <- documentScanLogMsg{
+			content: fmt.Sprintf("Warning: %s is over the %d MB archive size limit once extracted, its other files are skipped",
+				p, a.maxArchiveBytes>>20),
+		}
+		return nil
+	}
+	return err
+}
+
+func readZip(data []byte, readFile func(archiveFile) error) error {
+	r, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return fmt.Errorf("error opening the zip archive: %w", err)
+	}
+	for _, f := range r.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		err := readFile(archiveFile{
+			name:    f.Name,
+			size:    int64(f.UncompressedSize64),
+			modTime: f.Modified,
+			open: func() (io.Reader, func(), error) {
+				rc, err := f.Open()
+				if err != nil {
+					return nil, nil, fmt.Errorf("error opening %s: %w", f.Name, err)
+				}
+				return rc, func() { rc.Close() }, nil
+			},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readTarGz(data []byte, readFile func(archiveFile) error) error {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("error opening the tar archive: %w", err)
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error reading the tar archive: %w", err)
+		}
+		// The links and the directories have no content.
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		err = readFile(archiveFile{
+			name:    hdr.Name,
+			size:    hdr.Size,
+			modTime: hdr.ModTime,
+			open:    func() (io.Reader, func(), error) { return tr, func() {}, nil },
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+const (
+	rescanHourly = "hourly"
+	rescanDaily  = "daily"
+	rescanWeekly = "weekly"
+
+	// autoScanCheckInterval is the time between the checks of the documents
+	// due for their automatic rescan.
+	autoScanCheckInterval = time.Minute
+)
+
+// autoScanTickMsg checks the documents due for their automatic rescan.
+type autoScanTickMsg time.Time
+
+// autoScanMsg is a log message of an automatic rescan, it's shown in the
+// documents list instead of the scan view.
+type autoScanMsg documentScanLogMsg
+
+func autoScanTick() tea.Cmd {
+	return tea.Tick(autoScanCheckInterval, func(t time.Time) tea.Msg {
+		return autoScanTickMsg(t)
+	})
+}
+
+func (d document) rescanInterval() time.Duration {
+	switch d.RescanInterval {
+	case rescanHourly:
+		return time.Hour
+	case rescanDaily:
+		return 24 * time.Hour
+	case rescanWeekly:
+		return 7 * 24 * time.Hour
+	}
+	return 0
+}
+
+// rescanDue reports whether the automatic rescan of the document is due, an
+// interval after its last scan or its last failed automatic rescan.
+func (d document) rescanDue(now time.Time) bool {
+	interval := d.rescanInterval()
+	if interval == 0 || d.Path == "" {
+		return false
+	}
+	last := d.LastScanTime
+	if d.rescanFailedTime.After(last) {
+		last = d.rescanFailedTime
+	}
+	return !now.Before(last.Add(interval))
+}
+
+// startDueAutoScan starts the automatic rescan of the first document due or
+// changed since it's watched, the documents are rescanned one at a time and not
+// while a scan is running.
+func (m mainModel) startDueAutoScan(now time.Time) mainModel {
+	if m.rag == nil || m.autoScanDocumentID != 0 || m.documentScanDocumentID != 0 || len(m.documentScanQueue) > 0 {
+		return m
+	}
+	index := slices.IndexFunc(m.documents, func(d document) bool { return d.changed || d.rescanDue(now) })
+	if index < 0 {
+		return m
+	}
+	// The changes made during the rescan are synced by the next one.
+	m.autoScanSync = m.documents[index].changed
+	m.documents[index].changed = false
+
+	doc := m.documents[index]
+	fileStates, err := loadFileStates(m.db, doc.ID)
+	if err != nil {
+		// The files are all embedded again.
+		slog.Warn("Failed to load the file states", "error", err)
+		fileStates = nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	m.autoScanCancelFunc = cancel
+	m.autoScanDocumentID = doc.ID
+	m.autoScanStatus = scanProgress{filesStart: now}
+	slog.Info("Rescanning the document automatically", "document", doc.Name,
+		"interval", doc.RescanInterval, "changed", m.autoScanSync)
+
+	go m.rag.scanDocument(ctx, doc, fileStates, m.autoScanProgress)
+
+	return m.setRescanStatus(index, m.autoScanLabel())
+}
+
+// cancelAutoScan cancels the automatic rescan of the document, if it's the one
+// being rescanned.
+func (m mainModel) cancelAutoScan(id int) mainModel {
+	if m.autoScanDocumentID == id && m.autoScanCancelFunc != nil {
+		m.autoScanCancelFunc()
+		m.autoScanCancelFunc = nil
+	}
+	return m
+}
+
+func (m mainModel) handleAutoScanMsg(msg autoScanMsg) mainModel {
+	logMsg := documentScanLogMsg(msg)
+	index := slices.IndexFunc(m.documents, func(d document) bool { return d.ID == m.autoScanDocumentID })
+	finished := logMsg.err != nil || logMsg.done
+	if finished {
+		m.autoScanDocumentID = 0
+		m.autoScanCancelFunc = nil
+	}
+	if index < 0 {
+		// The document was deleted during its rescan.
+		return m
+	}
+	if logMsg.content != "" {
+		slog.Debug("Automatic rescan", "document", m.documents[index].Name, "log", logMsg.content)
+	}
+
+	if logMsg.discarded {
+		m = m.discardDocumentScan(index)
+	}
+	if logMsg.clearFileStates {
+		if err := saveFileStates(m.db, m.documents[index].ID, nil); err != nil {
+			slog.Error("Failed to delete the file states", "document", m.documents[index].Name, "error", err)
+		}
+	}
+
+	switch {
+	case logMsg.err != nil:
+		if errors.Is(logMsg.err, errScanCancelled) {
+			return m.setRescanStatus(index, "")
+		}
+		slog.Error("Automatic rescan failed", "document", m.documents[index].Name, "error", logMsg.err)
+		m.documents[index].rescanFailedTime = time.Now()
+		if m.autoScanSync {
+			return m.setRescanStatus(index, "Sync failed, see the log")
+		}
+		return m.setRescanStatus(index, "Automatic rescan failed, see the log")
+	case logMsg.done:
+		doc := m.documents[index].withScan(logMsg)
+		if err := saveDocument(m.db, &doc); err != nil {
+			slog.Error("Failed to save the rescanned document", "document", doc.Name, "error", err)
+		}
+		if err := saveFileStates(m.db, doc.ID, logMsg.fileStates); err != nil {
+			slog.Error("Failed to save the file states", "document", doc.Name, "error", err)
+		}
+		slog.Info("Rescanned the document automatically", "document", doc.Name,
+			"duration", time.Since(m.autoScanStatus.filesStart))
+		m.documents[index] = doc
+		m.documentsList.SetItem(index, doc)
+		return m.startDueAutoScan(time.Now())
+	}
+
+	m.autoScanStatus = m.autoScanStatus.update(logMsg)
+	return m.setRescanStatus(index, fmt.Sprintf("%s %d%%", m.autoScanLabel(), int(m.autoScanStatus.fraction()*100)))
+}
+
+// autoScanLabel names the running automatic rescan in the documents list.
+func (m mainModel) autoScanLabel() string {
+	if m.autoScanSync {
+		return "Syncing"
+	}
+	return "Rescanning"
+}
+
+// setRescanStatus shows the status of the automatic rescan of the document in
+// the documents list.
+func (m mainModel) setRescanStatus(index int, status string) mainModel {
+	if m.documents[index].rescanStatus == status {
+		return m
+	}
+	m.documents[index].rescanStatus = status
+	m.documentsList.SetItem(index, m.documents[index])
+	return m
+}
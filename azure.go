@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/charmbracelet/huh"
+	goopenai "github.com/sashabaranov/go-openai"
+)
+
+type azureOpenAIProvider struct {
+	Endpoint    string `json:"endpoint"`
+	APIKey      string `json:"apiKey"`
+	APIVersion  string `json:"apiVersion"`
+	Deployments string `json:"deployments"`
+	Proxy       string `json:"proxy"`
+
+	rateLimitSettings
+}
+
+type azureOpenAI struct {
+	openai
+
+	endpoint   string
+	apiVersion string
+}
+
+type azureDeploymentsResponse struct {
+	Data []struct {
+		ID string `json:"id"`
+	} `json:"data"`
+}
+
+const (
+	defaultAzureOpenAIAPIVersion = "2024-06-01"
+
+	// azureDeploymentsAPIVersion is the last data-plane API version that still
+	// exposes the deployments listing endpoint.
+	azureDeploymentsAPIVersion = "2022-12-01"
+)
+
+func (a azureOpenAIProvider) Title() string {
+	if a.isConfigured() {
+		return fmt.Sprintf("%s (configured)", providerAzureOpenAI)
+	}
+	return fmt.Sprintf("%s (not configured)", providerAzureOpenAI)
+}
+
+func (a azureOpenAIProvider) Description() string {
+	return "Configure Azure OpenAI connection"
+}
+
+func (a azureOpenAIProvider) FilterValue() string {
+	return providerAzureOpenAI
+}
+
+func (a azureOpenAIProvider) name() string {
+	return providerAzureOpenAI
+}
+
+// availableModels returns the deployments of the configured Azure resource.
+//
+// Azure only exposes deployment listing on an older data-plane API version, and
+// some resources disable it entirely, so the deployments entered in the form are
+// always included as well.
+func (a azureOpenAIProvider) availableModels() ([]string, error) {
+	models := a.configuredDeployments()
+
+	deployments, err := a.listDeployments()
+	if err != nil {
+		if len(models) > 0 {
+			return models, nil
+		}
+		return nil, fmt.Errorf("error listing deployments, enter them in the provider form instead: %w", err)
+	}
+
+	for _, d := range deployments {
+		if !slices.Contains(models, d) {
+			models = append(models, d)
+		}
+	}
+
+	return models, nil
+}
+
+func (a azureOpenAIProvider) listDeployments() ([]string, error) {
+	req, err := http.NewRequestWithContext(context.Background(), "GET",
+		strings.TrimRight(a.Endpoint, "/")+"/openai/deployments?api-version="+azureDeploymentsAPIVersion, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %w", err)
+	}
+	req.Header.Set("api-key", a.APIKey)
+
+	resp, err := newProxyHTTPClient(a.Proxy).Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error sending request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("unexpected status code: %d, body: %s", resp.StatusCode, string(body))
+	}
+
+	var deployments azureDeploymentsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&deployments); err != nil {
+		return nil, fmt.Errorf("error decoding response: %w", err)
+	}
+
+	res := make([]string, len(deployments.Data))
+	for i, d := range deployments.Data {
+		res[i] = d.ID
+	}
+
+	return res, nil
+}
+
+func (a azureOpenAIProvider) configuredDeployments() []string {
+	var deployments []string
+	for _, d := range strings.Split(a.Deployments, ",") {
+		d = strings.TrimSpace(d)
+		if d == "" || slices.Contains(deployments, d) {
+			continue
+		}
+		deployments = append(deployments, d)
+	}
+	return deployments
+}
+
+func (a azureOpenAIProvider) isConfigured() bool {
+	return a.Endpoint != "" && a.APIKey != ""
+}
+
+func (a azureOpenAIProvider) testConnection() error {
+	_, err := a.listDeployments()
+	return err
+}
+
+func (a azureOpenAIProvider) form(width, height int, keymap *huh.KeyMap) *huh.Form {
+	endpoint := a.Endpoint
+	if endpoint == "" {
+		endpoint = os.Getenv("AZURE_OPENAI_ENDPOINT")
+	}
+	apiKey := a.APIKey
+	if apiKey == "" {
+		apiKey = os.Getenv("AZURE_OPENAI_API_KEY")
+	}
+	apiVersion := a.APIVersion
+	if apiVersion == "" {
+		apiVersion = os.Getenv("OPENAI_API_VERSION")
+	}
+	if apiVersion == "" {
+		apiVersion = defaultAzureOpenAIAPIVersion
+	}
+	deployments := a.Deployments
+	proxy := a.Proxy
+	rateLimit := a.rateLimitSettings
+	return huh.NewForm(
+		huh.NewGroup(
+			huh.NewInput().
+				Key("azureOpenAIEndpoint").
+				Title("Endpoint").
+				Description("Enter the resource endpoint, e.g. https://my-resource.openai.azure.com.").
+				Placeholder("Endpoint").
+				Value(&endpoint),
+			huh.NewInput().
+				Key("azureOpenAIAPIKey").
+				Title("API Key").
+				Description("Enter the API key for Azure OpenAI.").
+				Placeholder("API Key").
+				Value(&apiKey),
+			huh.NewInput().
+				Key("azureOpenAIAPIVersion").
+				Title("API Version").
+				Description("Enter the api-version to use.").
+				Placeholder(defaultAzureOpenAIAPIVersion).
+				Value(&apiVersion),
+			huh.NewInput().
+				Key("azureOpenAIDeployments").
+				Title("Deployments").
+				Description("Comma-separated deployment names, used when the resource can't list them.").
+				Placeholder("gpt-4o, text-embedding-3-small").
+				Value(&deployments),
+			proxyField("azureOpenAIProxy", "Azure OpenAI", &proxy),
+			requestsPerMinuteField("azureOpenAI", &rateLimit.RequestsPerMinute),
+			tokensPerMinuteField("azureOpenAI", &rateLimit.TokensPerMinute),
+			testConnectionField("azureOpenAITest", func() error {
+				return azureOpenAIProvider{Endpoint: endpoint, APIKey: apiKey, Proxy: proxy}.testConnection()
+			}),
+			huh.NewConfirm().
+				Key("azureOpenAIConfirm").
+				Title("Confirm").
+				Description("Save this Azure OpenAI settings?").
+				Affirmative("Yes").
+				Negative("Back"),
+		),
+	).
+		WithWidth(width).
+		WithHeight(height).
+		WithTheme(huh.ThemeCatppuccin()).
+		WithKeyMap(keymap).
+		WithShowErrors(true).
+		WithShowHelp(true)
+}
+
+func (a azureOpenAIProvider) saveForm(form *huh.Form) (llmProvider, bool) {
+	if !form.GetBool("azureOpenAIConfirm") {
+		return a, false
+	}
+
+	endpoint := form.GetString("azureOpenAIEndpoint")
+	apiKey := form.GetString("azureOpenAIAPIKey")
+
+	if endpoint == "" || apiKey == "" {
+		return a, false
+	}
+
+	a.Endpoint = endpoint
+	a.APIKey = apiKey
+	a.APIVersion = form.GetString("azureOpenAIAPIVersion")
+	a.Deployments = form.GetString("azureOpenAIDeployments")
+	a.Proxy = form.GetString("azureOpenAIProxy")
+	a.rateLimitSettings = rateLimitSettingsFromForm(form, "azureOpenAI")
+
+	return a, true
+}
+
+func (a azureOpenAIProvider) apiVersion() string {
+	if a.APIVersion == "" {
+		return defaultAzureOpenAIAPIVersion
+	}
+	return a.APIVersion
+}
+
+func (a azureOpenAIProvider) client() *goopenai.Client {
+	cfg := goopenai.DefaultAzureConfig(a.APIKey, a.Endpoint)
+	cfg.APIVersion = a.apiVersion()
+	// The model in llmSetting is already the deployment name, so it must be used
+	// verbatim instead of the default mapper that strips dots and colons.
+	cfg.AzureModelMapperFunc = func(model string) string {
+		return model
+	}
+	cfg.HTTPClient = newProxyHTTPClient(a.Proxy)
+	return goopenai.NewClientWithConfig(cfg)
+}
+
+func (a azureOpenAIProvider) new(setting llmSetting) llm {
+	return azureOpenAI{
+		openai: openai{
+			apiKey:           a.APIKey,
+			model:            setting.Model,
+			temperature:      setting.Temperature,
+			topP:             setting.TopP,
+			frequencyPenalty: setting.FrequencyPenalty,
+			presencePenalty:  setting.PresencePenalty,
+			stop:             setting.StopSequences,
+			streamUsage:      true,
+			client:           a.client(),
+		},
+		endpoint:   a.Endpoint,
+		apiVersion: a.apiVersion(),
+	}
+}
+
+func (a azureOpenAIProvider) supportEmbedding() bool {
+	return true
+}
+
+func (a azureOpenAIProvider) newEmbedder(setting llmSetting) embedder {
+	return azureOpenAI{
+		openai: openai{
+			apiKey: a.APIKey,
+			model:  setting.Model,
+			client: a.client(),
+		},
+		endpoint:   a.Endpoint,
+		apiVersion: a.apiVersion(),
+	}
+}
+
+// tokenizer returns the tiktoken tokenizer of the embedding model. The model is
+// the deployment name, which falls back to the encoding of the current OpenAI
+// embedding models when it isn't a model name.
+func (a azureOpenAIProvider) tokenizer(model string) tokenizer {
+	return newTiktokenTokenizer(model)
+}
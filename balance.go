@@ -0,0 +1,103 @@
+package main
+
+import (
+	"slices"
+
+	"github.com/philippgille/chromem-go"
+)
+
+const (
+	// retrievalStrategyGlobal takes the chunks most similar to the question
+	// from all the documents, retrievalStrategyBalanced first takes an equal
+	// share of them from each document, and retrievalStrategyMMR first takes
+	// the chunks by their maximal marginal relevance.
+	retrievalStrategyGlobal   = "global"
+	retrievalStrategyBalanced = "balanced"
+	retrievalStrategyMMR      = "mmr"
+)
+
+// selection is the results given to the LLM for a question, with all the
+// results of the merge of the chunks they were taken from and the number of
+// duplicates left out.
+type selection struct {
+	results    []chromem.Result
+	merged     []chromem.Result
+	duplicates int
+}
+
+// selectResults returns the needed results from the chunks retrieved from each
+// document, sorted from the most similar. The chunks are merged and
+// deduplicated by windows of twice the needed results, the next window is
+// taken when the duplicates leave too few. The balanced strategy starts with
+// a window of at most a share of the needed results from each document, and
+// the MMR one with a window of the needed results diversified with lambda,
+// then they fall back to the global ranking.
+func selectResults(docResults [][]chromem.Result, strategy string, needed int, lambda float32) selection {
+	var all []chromem.Result
+	for _, rs := range docResults {
+		all = append(all, rs...)
+	}
+	sortResults(all)
+
+	var windows [][]chromem.Result
+	rest := all
+	switch strategy {
+	case retrievalStrategyBalanced:
+		var first []chromem.Result
+		first, rest = balancedWindow(docResults, needed)
+		windows = append(windows, first)
+	case retrievalStrategyMMR:
+		var first []chromem.Result
+		first, rest = mmrWindow(all, lambda, needed)
+		windows = append(windows, first)
+	}
+	initialCount := needed * 2
+	for start := 0; start < len(rest); start += initialCount {
+		windows = append(windows, rest[start:min(start+initialCount, len(rest))])
+	}
+
+	var sel selection
+	for _, w := range windows {
+		if len(sel.results) >= needed {
+			break
+		}
+		// Merge overlapping chunks
+		merged := mergeChunks(w)
+		sortResults(merged)
+		sel.merged = append(sel.merged, merged...)
+
+		var dropped int
+		sel.results, dropped = appendDistinct(sel.results, merged, needed)
+		sel.duplicates += dropped
+	}
+
+	sortResults(sel.results)
+	return sel
+}
+
+// balancedWindow returns the most similar chunks of each document, at most
+// the needed results divided by the documents with chunks, rounded up.
+func balancedWindow(docResults [][]chromem.Result, needed int) ([]chromem.Result, []chromem.Result) {
+	active := 0
+	for _, rs := range docResults {
+		if len(rs) > 0 {
+			active++
+		}
+	}
+	if active == 0 {
+		return nil, nil
+	}
+	quota := (needed + active - 1) / active
+
+	var window, rest []chromem.Result
+	for _, rs := range docResults {
+		rs = slices.Clone(rs)
+		sortResults(rs)
+		n := min(quota, len(rs))
+		window = append(window, rs[:n]...)
+		rest = append(rest, rs[n:]...)
+	}
+	sortResults(window)
+	sortResults(rest)
+	return window, rest
+}
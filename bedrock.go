@@ -0,0 +1,508 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime/types"
+	"github.com/charmbracelet/huh"
+	"github.com/philippgille/chromem-go"
+)
+
+type bedrockProvider struct {
+	Region          string `json:"region"`
+	Profile         string `json:"profile"`
+	AccessKeyID     string `json:"accessKeyID"`
+	SecretAccessKey string `json:"secretAccessKey"`
+	Proxy           string `json:"proxy"`
+
+	rateLimitSettings
+}
+
+type bedrock struct {
+	model       string
+	temperature float64
+
+	client *bedrockruntime.Client
+	// clientErr holds the error from loading the AWS configuration, as the llm
+	// constructors can't return one.
+	clientErr error
+}
+
+type bedrockAnthropicRequest struct {
+	AnthropicVersion string             `json:"anthropic_version"`
+	Messages         []anthropicMessage `json:"messages"`
+	System           string             `json:"system,omitempty"`
+	MaxTokens        int                `json:"max_tokens"`
+	Temperature      float64            `json:"temperature"`
+}
+
+type bedrockTitanEmbeddingRequest struct {
+	InputText string `json:"inputText"`
+}
+
+type bedrockTitanEmbeddingResponse struct {
+	Embedding []float32 `json:"embedding"`
+}
+
+const (
+	bedrockAnthropicVersion = "bedrock-2023-05-31"
+	defaultBedrockRegion    = "us-east-1"
+)
+
+var (
+	bedrockAnthropicModels = []string{
+		"anthropic.claude-3-5-sonnet-20241022-v2:0",
+		"anthropic.claude-3-5-haiku-20241022-v1:0",
+		"anthropic.claude-3-5-sonnet-20240620-v1:0",
+		"anthropic.claude-3-opus-20240229-v1:0",
+		"anthropic.claude-3-sonnet-20240229-v1:0",
+		"anthropic.claude-3-haiku-20240307-v1:0",
+	}
+
+	bedrockTitanEmbeddingModels = []string{
+		"amazon.titan-embed-text-v2:0",
+		"amazon.titan-embed-text-v1",
+	}
+)
+
+func (b bedrock) chat(ctx context.Context, chats []chat) llmResponse {
+	if hasImages(chats) {
+		return llmResponse{err: errImagesUnsupported}
+	}
+	if b.clientErr != nil {
+		return llmResponse{
+			err: fmt.Errorf("error loading aws config: %w", b.clientErr),
+		}
+	}
+
+	body, err := b.requestBody(chats)
+	if err != nil {
+		return llmResponse{
+			err: fmt.Errorf("error marshaling request: %w", err),
+		}
+	}
+
+	resp, err := b.client.InvokeModel(ctx, &bedrockruntime.InvokeModelInput{
+		ModelId:     aws.String(b.model),
+		ContentType: aws.String("application/json"),
+		Accept:      aws.String("application/json"),
+		Body:        body,
+	})
+	if err != nil {
+		return llmResponse{
+			err: fmt.Errorf("error sending request: %w", err),
+		}
+	}
+
+	var response anthropicChatResponse
+	if err := json.Unmarshal(resp.Body, &response); err != nil {
+		return llmResponse{
+			err: fmt.Errorf("error decoding response: %w", err),
+		}
+	}
+
+	if len(response.Content) == 0 {
+		return llmResponse{
+			err: fmt.Errorf("empty response content"),
+		}
+	}
+
+	return llmResponse{
+		content:          response.Content[0].Text,
+		promptTokens:     response.Usage.promptTokens(),
+		completionTokens: response.Usage.OutputTokens,
+	}
+}
+
+func (b bedrock) chatStream(ctx context.Context, chats []chat) <-chan llmResponse {
+	responseChan := make(chan llmResponse)
+
+	go func() {
+		defer close(responseChan)
+
+		if b.clientErr != nil {
+			responseChan <- llmResponse{
+				err: fmt.Errorf("error loading aws config: %w", b.clientErr),
+			}
+			return
+		}
+
+		body, err := b.requestBody(chats)
+		if err != nil {
+			responseChan <- llmResponse{
+				err: fmt.Errorf("error marshaling request: %w", err),
+			}
+			return
+		}
+
+		resp, err := b.client.InvokeModelWithResponseStream(ctx, &bedrockruntime.InvokeModelWithResponseStreamInput{
+			ModelId:     aws.String(b.model),
+			ContentType: aws.String("application/json"),
+			Accept:      aws.String("application/json"),
+			Body:        body,
+		})
+		if err != nil {
+			if errors.Is(err, context.Canceled) {
+				return
+			}
+			responseChan <- llmResponse{
+				err: fmt.Errorf("error sending request: %w", err),
+			}
+			return
+		}
+
+		stream := resp.GetStream()
+		defer stream.Close()
+
+		// Bedrock wraps the same events Anthropic sends over SSE in its own
+		// event stream, so the payloads can be decoded the same way.
+		var promptTokens int
+		for event := range stream.Events() {
+			chunk, ok := event.(*types.ResponseStreamMemberChunk)
+			if !ok {
+				continue
+			}
+
+			var streamResp anthropicStreamResponse
+			if err := json.Unmarshal(chunk.Value.Bytes, &streamResp); err != nil {
+				responseChan <- llmResponse{
+					err: fmt.Errorf("error decoding response: %w", err),
+				}
+				return
+			}
+
+			if streamResp.Type == "message_start" {
+				promptTokens = streamResp.Message.Usage.promptTokens()
+			}
+
+			if streamResp.Type == "content_block_delta" && streamResp.Delta.Text != "" {
+				responseChan <- llmResponse{
+					content: streamResp.Delta.Text,
+				}
+			}
+
+			if streamResp.Type == "message_delta" {
+				responseChan <- llmResponse{
+					promptTokens:     promptTokens,
+					completionTokens: streamResp.Usage.OutputTokens,
+				}
+			}
+
+			if streamResp.Type == "message_stop" {
+				return
+			}
+		}
+
+		if err := stream.Err(); err != nil {
+			if !errors.Is(err, context.Canceled) {
+				responseChan <- llmResponse{
+					err: fmt.Errorf("error reading response: %w", err),
+				}
+			}
+		}
+	}()
+
+	return responseChan
+}
+
+func (b bedrock) requestBody(chats []chat) ([]byte, error) {
+	systemChat, cs := extractSystemChat(chats)
+
+	msgs := make([]anthropicMessage, len(cs))
+	for i, chat := range cs {
+		msgs[i] = anthropicMessage{
+			Role:    chat.Role,
+			Content: chat.Content,
+		}
+	}
+
+	return json.Marshal(bedrockAnthropicRequest{
+		AnthropicVersion: bedrockAnthropicVersion,
+		Messages:         msgs,
+		System:           systemChat,
+		MaxTokens:        claudeMaxTokens(b.claudeModel()),
+		Temperature:      b.temperature,
+	})
+}
+
+// claudeModel returns the model ID without the bedrock vendor and cross-region
+// inference prefixes, e.g. "us.anthropic.claude-3-5-haiku-20241022-v1:0" becomes
+// "claude-3-5-haiku-20241022-v1:0".
+func (b bedrock) claudeModel() string {
+	_, model, found := strings.Cut(b.model, "anthropic.")
+	if !found {
+		return b.model
+	}
+	return model
+}
+
+func (b bedrock) embeddingFunc() chromem.EmbeddingFunc {
+	var checkedNormalized bool
+	checkNormalized := sync.Once{}
+
+	return func(ctx context.Context, text string) ([]float32, error) {
+		if b.clientErr != nil {
+			return nil, fmt.Errorf("error loading aws config: %w", b.clientErr)
+		}
+
+		body, err := json.Marshal(bedrockTitanEmbeddingRequest{
+			InputText: text,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("couldn't marshal request body: %w", err)
+		}
+
+		resp, err := b.client.InvokeModel(ctx, &bedrockruntime.InvokeModelInput{
+			ModelId:     aws.String(b.model),
+			ContentType: aws.String("application/json"),
+			Accept:      aws.String("application/json"),
+			Body:        body,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("couldn't send request: %w", err)
+		}
+
+		var embeddingResp bedrockTitanEmbeddingResponse
+		if err := json.Unmarshal(resp.Body, &embeddingResp); err != nil {
+			return nil, fmt.Errorf("couldn't unmarshal response body: %w", err)
+		}
+
+		if len(embeddingResp.Embedding) == 0 {
+			return nil, errors.New("no embeddings found in the response")
+		}
+
+		v := embeddingResp.Embedding
+		checkNormalized.Do(func() {
+			checkedNormalized = isNormalized(v)
+		})
+		if !checkedNormalized {
+			v = normalizeVector(v)
+		}
+
+		return v, nil
+	}
+}
+
+func (b bedrockProvider) Title() string {
+	if b.isConfigured() {
+		return fmt.Sprintf("%s (configured)", providerBedrock)
+	}
+	return fmt.Sprintf("%s (not configured)", providerBedrock)
+}
+
+func (b bedrockProvider) Description() string {
+	return "Configure AWS Bedrock connection"
+}
+
+func (b bedrockProvider) FilterValue() string {
+	return providerBedrock
+}
+
+func (b bedrockProvider) name() string {
+	return providerBedrock
+}
+
+// availableModels returns a curated list of the Bedrock models doconvo knows
+// how to talk to. The cross-region inference profiles are only offered for
+// the geography of the configured region.
+func (b bedrockProvider) availableModels() ([]string, error) {
+	models := make([]string, 0, len(bedrockAnthropicModels)*2+len(bedrockTitanEmbeddingModels))
+	models = append(models, bedrockAnthropicModels...)
+
+	var geo string
+	switch {
+	case strings.HasPrefix(b.Region, "us-"):
+		geo = "us."
+	case strings.HasPrefix(b.Region, "eu-"):
+		geo = "eu."
+	case strings.HasPrefix(b.Region, "ap-"):
+		geo = "apac."
+	}
+	if geo != "" {
+		for _, m := range bedrockAnthropicModels {
+			models = append(models, geo+m)
+		}
+	}
+
+	return append(models, bedrockTitanEmbeddingModels...), nil
+}
+
+func (b bedrockProvider) isConfigured() bool {
+	return b.Region != ""
+}
+
+func (b bedrockProvider) testConnection() error {
+	// Bedrock has no cheap model listing in the runtime API, so the test only
+	// checks that the credentials can be resolved for the region.
+	cfg, err := b.config()
+	if err != nil {
+		return err
+	}
+	if _, err := cfg.Credentials.Retrieve(context.Background()); err != nil {
+		return fmt.Errorf("error retrieving credentials: %w", err)
+	}
+	return nil
+}
+
+func (b bedrockProvider) form(width, height int, keymap *huh.KeyMap) *huh.Form {
+	region := b.Region
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if region == "" {
+		region = defaultBedrockRegion
+	}
+	profile := b.Profile
+	if profile == "" {
+		profile = os.Getenv("AWS_PROFILE")
+	}
+	accessKeyID := b.AccessKeyID
+	secretAccessKey := b.SecretAccessKey
+	proxy := b.Proxy
+	rateLimit := b.rateLimitSettings
+	return huh.NewForm(
+		huh.NewGroup(
+			huh.NewInput().
+				Key("bedrockRegion").
+				Title("Region").
+				Description("Enter the AWS region for Bedrock.").
+				Placeholder(defaultBedrockRegion).
+				Value(&region),
+			huh.NewInput().
+				Key("bedrockProfile").
+				Title("Profile").
+				Description("Enter the shared config profile, or leave empty to use the default credential chain.").
+				Placeholder("Profile").
+				Value(&profile),
+			huh.NewInput().
+				Key("bedrockAccessKeyID").
+				Title("Access Key ID").
+				Description("Enter the access key ID, takes precedence over the profile.").
+				Placeholder("Access Key ID").
+				Value(&accessKeyID),
+			huh.NewInput().
+				Key("bedrockSecretAccessKey").
+				Title("Secret Access Key").
+				Description("Enter the secret access key.").
+				Placeholder("Secret Access Key").
+				EchoMode(huh.EchoModePassword).
+				Value(&secretAccessKey),
+			proxyField("bedrockProxy", "AWS Bedrock", &proxy),
+			requestsPerMinuteField("bedrock", &rateLimit.RequestsPerMinute),
+			tokensPerMinuteField("bedrock", &rateLimit.TokensPerMinute),
+			testConnectionField("bedrockTest", func() error {
+				return bedrockProvider{
+					Region:          region,
+					Profile:         profile,
+					AccessKeyID:     accessKeyID,
+					SecretAccessKey: secretAccessKey,
+					Proxy:           proxy,
+				}.testConnection()
+			}),
+			huh.NewConfirm().
+				Key("bedrockConfirm").
+				Title("Confirm").
+				Description("Save this AWS Bedrock settings?").
+				Affirmative("Yes").
+				Negative("Back"),
+		),
+	).
+		WithWidth(width).
+		WithHeight(height).
+		WithTheme(huh.ThemeCatppuccin()).
+		WithKeyMap(keymap).
+		WithShowErrors(true).
+		WithShowHelp(true)
+}
+
+func (b bedrockProvider) saveForm(form *huh.Form) (llmProvider, bool) {
+	if !form.GetBool("bedrockConfirm") {
+		return b, false
+	}
+
+	region := form.GetString("bedrockRegion")
+	if region == "" {
+		return b, false
+	}
+
+	b.Region = region
+	b.Profile = form.GetString("bedrockProfile")
+	b.AccessKeyID = form.GetString("bedrockAccessKeyID")
+	b.SecretAccessKey = form.GetString("bedrockSecretAccessKey")
+	b.Proxy = form.GetString("bedrockProxy")
+	b.rateLimitSettings = rateLimitSettingsFromForm(form, "bedrock")
+
+	return b, true
+}
+
+func (b bedrockProvider) client() (*bedrockruntime.Client, error) {
+	cfg, err := b.config()
+	if err != nil {
+		return nil, err
+	}
+
+	return bedrockruntime.NewFromConfig(cfg), nil
+}
+
+// config loads the AWS config for the region and credentials of the provider.
+func (b bedrockProvider) config() (aws.Config, error) {
+	opts := []func(*config.LoadOptions) error{
+		config.WithRegion(b.Region),
+	}
+	switch {
+	case b.AccessKeyID != "":
+		opts = append(opts, config.WithCredentialsProvider(
+			credentials.NewStaticCredentialsProvider(b.AccessKeyID, b.SecretAccessKey, "")))
+	case b.Profile != "":
+		opts = append(opts, config.WithSharedConfigProfile(b.Profile))
+	}
+	client := awshttp.NewBuildableClient()
+	if b.Proxy != "" {
+		// Without a proxy the SDK client already uses the proxy environment
+		// variables.
+		client = client.WithTransportOptions(func(t *http.Transport) {
+			t.Proxy = proxyFunc(b.Proxy)
+		})
+	}
+	opts = append(opts, config.WithHTTPClient(debugHTTPClient{client: client}))
+
+	return config.LoadDefaultConfig(context.Background(), opts...)
+}
+
+func (b bedrockProvider) new(setting llmSetting) llm {
+	client, err := b.client()
+	return bedrock{
+		model:       setting.Model,
+		temperature: setting.Temperature,
+		client:      client,
+		clientErr:   err,
+	}
+}
+
+func (b bedrockProvider) supportEmbedding() bool {
+	return true
+}
+
+func (b bedrockProvider) newEmbedder(setting llmSetting) embedder {
+	client, err := b.client()
+	return bedrock{
+		model:     setting.Model,
+		client:    client,
+		clientErr: err,
+	}
+}
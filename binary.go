@@ -0,0 +1,24 @@
+package main
+
+import (
+	"bytes"
+	"unicode/utf8"
+)
+
+// binarySniffLen is the start of a file checked by isBinary.
+const binarySniffLen = 8192
+
+// isBinary reports whether the data isn't text, from a null byte or invalid
+// UTF-8 in its start. The data of the formats with an extractor, like the
+// archives and the images, are binary too.
+func isBinary(data []byte) bool {
+	head := data
+	if len(head) > binarySniffLen {
+		head = head[:binarySniffLen]
+		// The last rune may be cut by the end of the start.
+		for i := 1; i < utf8.UTFMax && !utf8.Valid(head); i++ {
+			head = head[:len(head)-1]
+		}
+	}
+	return bytes.IndexByte(head, 0) >= 0 || !utf8.Valid(head)
+}
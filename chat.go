@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"strconv"
 	"strings"
 	"time"
 
@@ -23,6 +24,29 @@ type chat struct {
 	Content   string    `json:"content"`
 	Timestamp time.Time `json:"timestamp"`
 	Failed    bool      `json:"failed"`
+	// Thinking is the reasoning of a thinking model, only kept after the answer
+	// is done when the convo LLM is set to keep it.
+	Thinking string `json:"thinking,omitempty"`
+	// Incomplete is set when the answer was interrupted by an error, the content
+	// is what was received before it.
+	Incomplete bool `json:"incomplete,omitempty"`
+
+	PromptTokens     int `json:"promptTokens,omitempty"`
+	CompletionTokens int `json:"completionTokens,omitempty"`
+
+	// Sources are the chunks of the documents given to the LLM for the answer.
+	Sources []chatSource `json:"sources,omitempty"`
+	// Searched and Skipped are the names of the documents searched for the
+	// answer and of the ones skipped as their summary is not about the question.
+	Searched []string `json:"searched,omitempty"`
+	Skipped  []string `json:"skipped,omitempty"`
+	// Retrieval is how the sources were found when no chunk was similar enough
+	// to the question, by their keywords or not at all.
+	Retrieval string `json:"retrieval,omitempty"`
+
+	// images are sent with the content to the vision models, they are not
+	// saved with the sessions.
+	images []chatImage
 }
 
 const (
@@ -76,16 +100,49 @@ func (m mainModel) updateChatSize() mainModel {
 
 	m.chatTextArea.SetWidth(m.width - chatTextareaStyle.GetHorizontalFrameSize())
 
+	// The copied path is marked in the sources of the last answer, the one
+	// it's copied from.
+	lastAnswer := -1
+	for i, c := range selectedSession.Chats {
+		if c.Role == roleAssistant {
+			lastAnswer = i
+		}
+	}
+
 	var sb strings.Builder
-	for _, c := range selectedSession.Chats {
+	for i, c := range selectedSession.Chats {
 		rc, _ := m.chatMDRenderer.Render(wordwrap.String(c.Content, m.width-10))
 
 		sb.WriteString(chatEntityStyle.Render(fmt.Sprintf("%s: ", c.displayName())))
+		if c.Thinking != "" {
+			sb.WriteString("\n")
+			sb.WriteString(m.thinkingView(c.Thinking))
+		}
 		sb.WriteString(chatContentStyle.Render(rc))
+		if len(c.Sources) > 0 || c.searchedSeveralDocuments() || c.Retrieval != "" {
+			copiedPath := ""
+			if i == lastAnswer {
+				copiedPath = m.chatCopiedPath
+			}
+			sb.WriteString(m.sourcesFooter(c, copiedPath))
+			sb.WriteString("\n")
+		}
+		if c.Incomplete {
+			sb.WriteString(chatUsageStyle.Render("(incomplete, the answer was interrupted)"))
+			sb.WriteString("\n")
+		}
+		if c.PromptTokens > 0 || c.CompletionTokens > 0 {
+			sb.WriteString(chatUsageStyle.Render(formatTokenUsage(c.PromptTokens, c.CompletionTokens)))
+			sb.WriteString("\n")
+		}
 		sb.WriteString("\n")
 	}
 	if m.chatIsThinking {
 		sb.WriteString(spinnerStyle.Render(m.chatSpinner.View()))
+		if m.chatStage != "" {
+			sb.WriteString(" ")
+			sb.WriteString(chatUsageStyle.Render(m.chatStage))
+		}
 	}
 
 	m.chatViewport.SetContent(sb.String())
@@ -120,6 +177,17 @@ func (m mainModel) handleChatEvents(msg tea.Msg) (mainModel, tea.Cmd) {
 			return m.setViewState(viewStateSessions).updateSessionsSize(), nil
 		case key.Matches(msg, m.keymap.submit):
 			return m.sendChat()
+		case key.Matches(msg, m.keymap.toggleThinking):
+			m.chatShowThinking = !m.chatShowThinking
+			return m.updateChatSize(), nil
+		case key.Matches(msg, m.keymap.togglePlain):
+			return m.togglePlainChat(), nil
+		case key.Matches(msg, m.keymap.copySource):
+			return m.copySourcePath(), nil
+		case key.Matches(msg, m.keymap.toggleRAGDebug):
+			return m.toggleRAGDebug(), nil
+		case key.Matches(msg, m.keymap.showContext):
+			return m.setViewState(viewStateChatContext).updateChatContextSize(), nil
 		case key.Matches(msg, m.keymap.openHelp):
 			m.keymap.openHelp.SetEnabled(false)
 			m.keymap.closeHelp.SetEnabled(true)
@@ -157,6 +225,13 @@ func (m mainModel) handleChatEvents(msg tea.Msg) (mainModel, tea.Cmd) {
 }
 
 func (m mainModel) handleChatsResponse(msg llmResponseMsg) (mainModel, tea.Cmd) {
+	// The answer is added with its first content, the stages only tell what
+	// the spinner waits for.
+	if msg.stage != "" {
+		m.chatStage = msg.stage
+		return m.updateChatSize(), nil
+	}
+
 	selectedSession := m.sessions[m.selectedSessionIndex]
 
 	if msg.chatIndex == len(selectedSession.Chats) {
@@ -167,11 +242,23 @@ func (m mainModel) handleChatsResponse(msg llmResponseMsg) (mainModel, tea.Cmd)
 	}
 
 	if msg.err != nil {
+		last := &selectedSession.Chats[len(selectedSession.Chats)-1]
 		if !errors.Is(msg.err, context.Canceled) {
-			selectedSession.Chats[len(selectedSession.Chats)-1].
-				Content = "Sorry, I'm having trouble connecting to the LLM. Please try again later."
-			selectedSession.Chats[len(selectedSession.Chats)-1].Failed = true
+			var mismatch embedderMismatchError
+			switch {
+			case strings.TrimSpace(last.Content) != "":
+				last.Incomplete = true
+			case errors.As(msg.err, &mismatch):
+				reason := mismatch.Error()
+				last.Content = fmt.Sprintf("Sorry, I can't search the documents. %s%s. "+
+					"Rescan it from the documents list.", strings.ToUpper(reason[:1]), reason[1:])
+				last.Failed = true
+			default:
+				last.Content = "Sorry, I'm having trouble connecting to the LLM. Please try again later."
+				last.Failed = true
+			}
 		}
+		m.chatCancelFunc = nil
 		m.sessions[m.selectedSessionIndex] = selectedSession
 
 		m.chatIsThinking = false
@@ -186,6 +273,11 @@ func (m mainModel) handleChatsResponse(msg llmResponseMsg) (mainModel, tea.Cmd)
 
 	m.chatIsThinking = msg.isThinking
 	selectedSession.Chats[len(selectedSession.Chats)-1].Content += msg.content
+	selectedSession.Chats[len(selectedSession.Chats)-1].Thinking += msg.thinking
+	if msg.promptTokens > 0 || msg.completionTokens > 0 {
+		selectedSession.Chats[len(selectedSession.Chats)-1].PromptTokens = msg.promptTokens
+		selectedSession.Chats[len(selectedSession.Chats)-1].CompletionTokens = msg.completionTokens
+	}
 
 	var cmds []tea.Cmd
 	var cmd tea.Cmd
@@ -193,6 +285,15 @@ func (m mainModel) handleChatsResponse(msg llmResponseMsg) (mainModel, tea.Cmd)
 	if msg.done {
 		m.chatIsThinking = false
 		m.chatCancelFunc = nil
+		if !m.convoLLMSetting.KeepThinking {
+			selectedSession.Chats[len(selectedSession.Chats)-1].Thinking = ""
+		}
+		selectedSession.Chats[len(selectedSession.Chats)-1].Sources = msg.sources
+		selectedSession.Chats[len(selectedSession.Chats)-1].Searched = msg.searched
+		selectedSession.Chats[len(selectedSession.Chats)-1].Skipped = msg.skipped
+		selectedSession.Chats[len(selectedSession.Chats)-1].Retrieval = msg.retrievalPath
+		selectedSession.Summary = msg.summary
+		selectedSession.SummarizedCount = msg.summarizedCount
 		if selectedSession.Name == "" {
 			sessionIndex := m.selectedSessionIndex
 			cmd = func() tea.Msg {
@@ -246,9 +347,19 @@ func (m mainModel) handleChatsResponseTitle(msg llmResponseTitleMsg) mainModel {
 
 func (m mainModel) chatView() string {
 	selectedSession := m.sessions[m.selectedSessionIndex]
+	title := selectedSession.Title()
+	switch filter := selectedSession.RetrievalFilter.String(); {
+	case selectedSession.PlainChat:
+		title += " (no documents)"
+	case filter != "":
+		title += " (" + filter + ")"
+	}
+	if m.ragDebugEnabled && !selectedSession.PlainChat {
+		title += " (retrieval debug)"
+	}
 
 	return lipgloss.JoinVertical(lipgloss.Left,
-		titleStyle.Render(selectedSession.Title()),
+		titleStyle.Render(title),
 		m.chatViewport.View(),
 		chatTextareaStyle.Render(m.chatTextArea.View()),
 		m.helpModel.View(m.keymap),
@@ -261,22 +372,34 @@ func (m mainModel) sendChat() (mainModel, tea.Cmd) {
 	}
 
 	msg := m.chatTextArea.Value()
+	if isFilterCommand(msg) {
+		return m.handleFilterCommand(msg)
+	}
 	selectedSession := m.sessions[m.selectedSessionIndex]
 
 	m.err = nil
+	m.chatCopiedPath = ""
 	selectedSession.Chats = append(selectedSession.Chats, chat{
 		Role:      roleUser,
 		Content:   msg,
 		Timestamp: time.Now(),
 	})
 	m.chatIsThinking = true
+	m.chatStage = chatStageGenerating
+	if !selectedSession.PlainChat {
+		m.chatStage = chatStageRetrieving
+	}
 	m.chatTextArea.Reset()
 	m.chatTextArea.Blur()
 
 	ctx, cancel := context.WithCancel(context.Background())
 	m.chatCancelFunc = cancel
 
-	go m.rag.chat(ctx, msg, len(selectedSession.Chats), m.documents, m.llmResponses)
+	var debug chan<- ragDebugMsg
+	if m.ragDebugEnabled {
+		debug = m.ragDebugs
+	}
+	go m.rag.chat(ctx, msg, len(selectedSession.Chats), m.documents, selectedSession, m.llmResponses, debug)
 
 	m.sessions[m.selectedSessionIndex] = selectedSession
 
@@ -285,6 +408,50 @@ func (m mainModel) sendChat() (mainModel, tea.Cmd) {
 	}
 }
 
+// togglePlainChat switches the selected session between searching the
+// documents and the plain chat with the model.
+func (m mainModel) togglePlainChat() mainModel {
+	selectedSession := m.sessions[m.selectedSessionIndex]
+	selectedSession.PlainChat = !selectedSession.PlainChat
+	if err := saveSession(m.db, &selectedSession); err != nil {
+		m.err = fmt.Errorf("error saving session: %w", err)
+		slog.Error(m.err.Error())
+		return m.updateChatSize()
+	}
+	m.sessions[m.selectedSessionIndex] = selectedSession
+	m.sessionList.SetItem(m.selectedSessionIndex, selectedSession)
+
+	return m.updateChatSize()
+}
+
+// thinkingView renders the reasoning of a chat dimmed, collapsed to a single
+// line unless the user expanded it.
+func (m mainModel) thinkingView(thinking string) string {
+	toggle := m.keymap.toggleThinking.Help().Key
+	if !m.chatShowThinking {
+		return chatThinkingStyle.Render(fmt.Sprintf("▸ Reasoning (%s to show)", toggle))
+	}
+
+	return chatThinkingStyle.Render(fmt.Sprintf("▾ Reasoning (%s to hide)\n%s",
+		toggle, wordwrap.String(strings.TrimSpace(thinking), m.width-10)))
+}
+
+// formatTokenUsage formats the token counts like "(1.2k in / 350 out)".
+func formatTokenUsage(promptTokens, completionTokens int) string {
+	return fmt.Sprintf("(%s in / %s out)", formatTokenCount(promptTokens), formatTokenCount(completionTokens))
+}
+
+func formatTokenCount(tokens int) string {
+	switch {
+	case tokens >= 1_000_000:
+		return strconv.FormatFloat(float64(tokens)/1_000_000, 'f', 1, 64) + "M"
+	case tokens >= 1_000:
+		return strconv.FormatFloat(float64(tokens)/1_000, 'f', 1, 64) + "k"
+	default:
+		return strconv.Itoa(tokens)
+	}
+}
+
 func (c chat) displayName() string {
 	if c.Role == roleUser {
 		return "You"
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/charmbracelet/bubbles/key"
+	"github.com/charmbracelet/bubbles/viewport"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+	"github.com/muesli/reflow/wordwrap"
+	"github.com/philippgille/chromem-go"
+)
+
+// chatSource is a chunk of the documents given to the LLM for an answer, kept
+// with the answer to tell a bad retrieval from a bad answer.
+type chatSource struct {
+	ID       string `json:"id"`
+	Filename string `json:"filename"`
+	// Path is the full path of the file, Section the heading path or the
+	// symbols of the chunk.
+	Path       string  `json:"path,omitempty"`
+	Section    string  `json:"section,omitempty"`
+	ChunkIndex int     `json:"chunkIndex,omitempty"`
+	Similarity float32 `json:"similarity"`
+	Excerpt    string  `json:"excerpt"`
+}
+
+const (
+	// chatSourceExcerptRunes is the length of the start of the chunks kept
+	// with the answers.
+	chatSourceExcerptRunes = 200
+)
+
+func newChatSources(docs []chromem.Result) []chatSource {
+	sources := make([]chatSource, len(docs))
+	for i, doc := range docs {
+		// The files that fit in a chunk are not chunked, their ID is their
+		// path.
+		path := doc.Metadata["originalID"]
+		if path == "" {
+			path = doc.ID
+		}
+		section := doc.Metadata["headingPath"]
+		if section == "" {
+			section = doc.Metadata["symbol"]
+		}
+		chunkIndex, _ := strconv.Atoi(doc.Metadata["chunkIndex"])
+		// The file and the section are shown apart from the excerpt.
+		content, _ := splitChunkHeader(doc.Content, doc.Metadata)
+
+		sources[i] = chatSource{
+			ID:         doc.ID,
+			Filename:   sourceName(doc.Metadata),
+			Path:       path,
+			Section:    section,
+			ChunkIndex: chunkIndex,
+			Similarity: doc.Similarity,
+			Excerpt:    excerpt(content, chatSourceExcerptRunes),
+		}
+	}
+	return sources
+}
+
+// excerpt returns the start of the content on a single line, at most n
+// runes long.
+func excerpt(content string, n int) string {
+	content = strings.Join(strings.Fields(content), " ")
+	runes := 0
+	for i := range content {
+		if runes == n {
+			return content[:i] + "…"
+		}
+		runes++
+	}
+	return content
+}
+
+func (m mainModel) initChatContext() mainModel {
+	m.chatContextViewport = viewport.New(0, 0)
+	m.chatContextViewport.KeyMap = m.keymap.viewportKeymap
+
+	return m
+}
+
+func (m mainModel) updateChatContextSize() mainModel {
+	titleHeight := lipgloss.Height(titleStyle.Render(""))
+	helpHeight := lipgloss.Height(m.helpModel.View(m.keymap))
+	height := m.height - titleHeight - helpHeight
+
+	if m.err != nil {
+		height -= errHeight(m.width, m.err)
+	}
+
+	m.chatContextViewport.Width = m.width
+	m.chatContextViewport.Height = height
+
+	m.chatContextViewport.SetContent(m.chatContextContent())
+
+	return m
+}
+
+// chatContextContent lists the sources of the last answer of the selected
+// session.
+func (m mainModel) chatContextContent() string {
+	selectedSession := m.sessions[m.selectedSessionIndex]
+
+	var last *chat
+	for i := len(selectedSession.Chats) - 1; i >= 0; i-- {
+		if selectedSession.Chats[i].Role == roleAssistant {
+			last = &selectedSession.Chats[i]
+			break
+		}
+	}
+	if last == nil {
+		return chatUsageStyle.Render("No answer yet.")
+	}
+	if len(last.Sources) == 0 {
+		return chatUsageStyle.Render("No documents were given to the LLM for the last answer.")
+	}
+
+	var sb strings.Builder
+	for i, s := range last.Sources {
+		sb.WriteString(chatEntityStyle.Render(fmt.Sprintf("%d. [%s] %.3f", i+1, s.Filename, s.Similarity)))
+		sb.WriteString("\n")
+		sb.WriteString(chatUsageStyle.Render(s.ID))
+		sb.WriteString("\n")
+		sb.WriteString(chatContentStyle.Render(wordwrap.String(s.Excerpt, m.width-10)))
+		sb.WriteString("\n\n")
+	}
+	return sb.String()
+}
+
+func (m mainModel) handleChatContextEvents(msg tea.Msg) (mainModel, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.WindowSizeMsg:
+		m = m.updateChatContextSize()
+	case tea.KeyMsg:
+		switch {
+		case key.Matches(msg, m.keymap.escape):
+			return m.setViewState(viewStateChat).updateChatSize(), nil
+		case key.Matches(msg, m.keymap.openHelp):
+			m.keymap.openHelp.SetEnabled(false)
+			m.keymap.closeHelp.SetEnabled(true)
+			m.helpModel.ShowAll = true
+			return m.updateChatContextSize(), nil
+		case key.Matches(msg, m.keymap.closeHelp):
+			m.keymap.closeHelp.SetEnabled(false)
+			m.keymap.openHelp.SetEnabled(true)
+			m.helpModel.ShowAll = false
+			return m.updateChatContextSize(), nil
+		}
+	case llmResponseMsg:
+		// The answer may still be streamed while its context is shown.
+		m, cmd := m.handleChatsResponse(msg)
+		return m.updateChatContextSize(), cmd
+	}
+
+	var cmd tea.Cmd
+	m.chatContextViewport, cmd = m.chatContextViewport.Update(msg)
+	return m, cmd
+}
+
+func (m mainModel) chatContextView() string {
+	return lipgloss.JoinVertical(lipgloss.Left,
+		titleStyle.Render("Context of the last answer"),
+		m.chatContextViewport.View(),
+		m.helpModel.View(m.keymap),
+	)
+}
@@ -0,0 +1,613 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/philippgille/chromem-go"
+)
+
+// textChunk is a part of a text, overlap is the bytes at its start that repeat
+// the end of the previous part.
+type textChunk struct {
+	content string
+	overlap int
+}
+
+// markdownSection is the text under a heading of a markdown document, with the
+// path of the headings it's nested in.
+type markdownSection struct {
+	headingPath string
+	content     string
+}
+
+// codeSegment is a top-level declaration of a source file, with its comments,
+// or the code between the declarations.
+type codeSegment struct {
+	symbol  string
+	content string
+}
+
+// codeLanguage finds the top-level declarations of a programming language.
+type codeLanguage struct {
+	// declarations match the first line of a declaration, their first group
+	// is the symbol declared.
+	declarations []*regexp.Regexp
+	// commentPrefixes start the lines of the comments, and the annotations,
+	// kept with the declaration that follows them.
+	commentPrefixes []string
+}
+
+// boundary is the kind of place between two tokens of a text, the chunks of
+// prose are cut at the strongest one.
+type boundary int
+
+const (
+	boundaryNone boundary = iota
+	boundaryWhitespace
+	boundarySentence
+	boundaryParagraph
+)
+
+const (
+	headingPathSeparator = " > "
+	symbolSeparator      = ", "
+
+	chunkHeaderKey = "header"
+
+	// sentenceEnds end the sentences. The ideographic ones end a sentence
+	// without a following space.
+	sentenceEnds    = ".!?…"
+	ideographicEnds = "。！？"
+	sentenceClosers = `"')]}’”」』»`
+)
+
+var (
+	jsDeclarations = []*regexp.Regexp{
+		regexp.MustCompile(`^(?:export\s+)?(?:default\s+)?(?:async\s+)?function\*?\s+([\w$]+)`),
+		regexp.MustCompile(`^(?:export\s+)?(?:default\s+)?(?:abstract\s+)?class\s+([\w$]+)`),
+		regexp.MustCompile(`^(?:export\s+)?(?:const|let|var)\s+([\w$]+)`),
+	}
+	tsDeclarations = append([]*regexp.Regexp{
+		regexp.MustCompile(`^(?:export\s+)?(?:declare\s+)?(?:interface|type|enum|namespace)\s+([\w$]+)`),
+	}, jsDeclarations...)
+
+	javaModifiers = `(?:(?:public|private|protected|static|final|abstract|sealed|synchronized|native|default)\s+)*`
+
+	// codeLanguages are the languages chunked on their declarations, by file
+	// extension.
+	codeLanguages = map[string]codeLanguage{
+		".go": {
+			declarations: []*regexp.Regexp{
+				regexp.MustCompile(`^func\s+(?:\([^)]*\)\s*)?(\w+)`),
+				regexp.MustCompile(`^(?:type|var|const)\s+(\w+)`),
+				regexp.MustCompile(`^(?:type|var|const)\s+\(()`),
+			},
+			commentPrefixes: []string{"//", "/*", "*"},
+		},
+		".py": {
+			declarations: []*regexp.Regexp{
+				regexp.MustCompile(`^(?:async\s+)?def\s+(\w+)`),
+				regexp.MustCompile(`^class\s+(\w+)`),
+			},
+			commentPrefixes: []string{"#", "@"},
+		},
+		".js":  {declarations: jsDeclarations, commentPrefixes: []string{"//", "/*", "*", "@"}},
+		".jsx": {declarations: jsDeclarations, commentPrefixes: []string{"//", "/*", "*", "@"}},
+		".mjs": {declarations: jsDeclarations, commentPrefixes: []string{"//", "/*", "*", "@"}},
+		".ts":  {declarations: tsDeclarations, commentPrefixes: []string{"//", "/*", "*", "@"}},
+		".tsx": {declarations: tsDeclarations, commentPrefixes: []string{"//", "/*", "*", "@"}},
+		".java": {
+			// The members of the top-level class are indented once, they are
+			// split too as a class is usually the whole file.
+			declarations: []*regexp.Regexp{
+				regexp.MustCompile(`^(?: {0,4}|\t)` + javaModifiers + `(?:class|interface|enum|record|@interface)\s+(\w+)`),
+				regexp.MustCompile(`^(?: {1,4}|\t)` + javaModifiers + `\w[\w<>\[\],.? ]*\s+(\w+)\s*\(`),
+			},
+			commentPrefixes: []string{"//", "/*", "*", "@"},
+		},
+	}
+)
+
+// chunkDocument splits the document into chunks of chunkSize tokens, the
+// chunks repeat the last chunkOverlap tokens of the previous one. The overlap
+// metadata is the bytes of the repeated text after the header of the chunk, for
+// mergeChunks. The markdown documents, and the documents extracted as markdown,
+// are split on their headings first. A last chunk of fewer than minChunkChars
+// characters is merged into the previous one.
+func chunkDocument(doc chromem.Document, tok tokenizer, chunkSize, chunkOverlap, minChunkChars int) []chromem.Document {
+	ends := tok.tokenize(doc.Content)
+	if len(ends) <= chunkSize {
+		doc.Metadata = maps.Clone(doc.Metadata)
+		return []chromem.Document{withChunkHeader(doc)}
+	}
+
+	ext := strings.ToLower(filepath.Ext(doc.Metadata["filename"]))
+	if doc.Metadata[formatKey] == formatMarkdown {
+		ext = ".md"
+	}
+	switch ext {
+	case ".md", ".mdx":
+		return mergeTinyTail(chunkMarkdown(doc, tok, chunkSize, chunkOverlap), minChunkChars)
+	}
+	if lang, ok := codeLanguages[ext]; ok {
+		return mergeTinyTail(chunkCode(doc, tok, lang, chunkSize, chunkOverlap), minChunkChars)
+	}
+
+	var chunks []chromem.Document
+	for _, c := range splitProse(doc.Content, ends, chunkSize, chunkOverlap) {
+		chunks = append(chunks, newChunk(doc, len(chunks), c, nil))
+	}
+	return mergeTinyTail(chunks, minChunkChars)
+}
+
+// mergeTinyTail merges the last chunk into the previous one when it has fewer
+// than minChars characters, as the end of a file just over the chunk size
+// embeds as noise. The last chunk of another section or symbols is kept.
+func mergeTinyTail(chunks []chromem.Document, minChars int) []chromem.Document {
+	if len(chunks) < 2 {
+		return chunks
+	}
+	last, prev := chunks[len(chunks)-1], chunks[len(chunks)-2]
+	if last.Metadata["headingPath"] != prev.Metadata["headingPath"] || last.Metadata["symbol"] != prev.Metadata["symbol"] {
+		return chunks
+	}
+
+	content, _ := splitChunkHeader(last.Content, last.Metadata)
+	if utf8.RuneCountInString(strings.TrimSpace(content)) >= minChars {
+		return chunks
+	}
+	// Only the text after the overlap is new.
+	overlap, _ := strconv.Atoi(last.Metadata["overlap"])
+	chunks[len(chunks)-2].Content += content[seamOverlap(prev.Content, content, overlap):]
+	return chunks[:len(chunks)-1]
+}
+
+// isTinyFile reports whether the content of a file has fewer than minChars
+// characters, besides its spaces.
+func isTinyFile(content string, minChars int) bool {
+	return utf8.RuneCountInString(strings.TrimSpace(content)) < minChars
+}
+
+// chunkMarkdown makes a chunk of each section of the markdown document, with
+// the path of its headings. Only the sections over the chunk size are split.
+func chunkMarkdown(doc chromem.Document, tok tokenizer, chunkSize, chunkOverlap int) []chromem.Document {
+	var chunks []chromem.Document
+	for _, section := range markdownSections(doc.Content) {
+		var metadata map[string]string
+		if section.headingPath != "" {
+			metadata = map[string]string{"headingPath": section.headingPath}
+		}
+
+		ends := tok.tokenize(section.content)
+		if len(ends) == 0 {
+			continue
+		}
+		for _, c := range splitProse(section.content, ends, chunkSize, chunkOverlap) {
+			chunks = append(chunks, newChunk(doc, len(chunks), c, metadata))
+		}
+	}
+	return chunks
+}
+
+// chunkCode splits the source file on its top-level declarations. The small
+// declarations that follow each other share a chunk, and only the declarations
+// over the chunk size are split.
+func chunkCode(doc chromem.Document, tok tokenizer, lang codeLanguage, chunkSize, chunkOverlap int) []chromem.Document {
+	var chunks []chromem.Document
+
+	var pending codeSegment
+	pendingTokens := 0
+	var symbols []string
+
+	flush := func() {
+		if pending.content == "" {
+			return
+		}
+		var metadata map[string]string
+		if len(symbols) > 0 {
+			metadata = map[string]string{"symbol": strings.Join(symbols, symbolSeparator)}
+		}
+		chunks = append(chunks, newChunk(doc, len(chunks), textChunk{content: pending.content}, metadata))
+		pending = codeSegment{}
+		pendingTokens = 0
+		symbols = nil
+	}
+
+	for _, segment := range codeSegments(doc.Content, lang) {
+		ends := tok.tokenize(segment.content)
+		if len(ends) == 0 {
+			continue
+		}
+
+		if len(ends) > chunkSize {
+			flush()
+			var metadata map[string]string
+			if segment.symbol != "" {
+				metadata = map[string]string{"symbol": segment.symbol}
+			}
+			for _, c := range splitTokens(segment.content, ends, chunkSize, chunkOverlap) {
+				chunks = append(chunks, newChunk(doc, len(chunks), c, metadata))
+			}
+			continue
+		}
+
+		if pendingTokens+len(ends) > chunkSize {
+			flush()
+		}
+		pending.content += segment.content
+		pendingTokens += len(ends)
+		if segment.symbol != "" {
+			symbols = append(symbols, segment.symbol)
+		}
+	}
+	flush()
+
+	return chunks
+}
+
+// codeSegments splits the source code before the lines that start a top-level
+// declaration, or the comments above it. The segments add up to the content.
+func codeSegments(content string, lang codeLanguage) []codeSegment {
+	lines := strings.SplitAfter(content, "\n")
+
+	type start struct {
+		line   int
+		symbol string
+	}
+	var starts []start
+	for i, line := range lines {
+		symbol, ok := lang.declaration(line)
+		if !ok {
+			continue
+		}
+
+		// The comments and annotations right above the declaration belong
+		// to it.
+		first := i
+		for first > 0 && lang.isComment(lines[first-1]) {
+			if len(starts) > 0 && first-1 <= starts[len(starts)-1].line {
+				break
+			}
+			first--
+		}
+		starts = append(starts, start{line: first, symbol: symbol})
+	}
+
+	var segments []codeSegment
+	if len(starts) == 0 || starts[0].line > 0 {
+		end := len(lines)
+		if len(starts) > 0 {
+			end = starts[0].line
+		}
+		segments = append(segments, codeSegment{content: strings.Join(lines[:end], "")})
+	}
+	for i, s := range starts {
+		end := len(lines)
+		if i+1 < len(starts) {
+			end = starts[i+1].line
+		}
+		segments = append(segments, codeSegment{
+			symbol:  s.symbol,
+			content: strings.Join(lines[s.line:end], ""),
+		})
+	}
+
+	return segments
+}
+
+// declaration returns the symbol of the declaration started by the line, empty
+// for the declarations of several symbols.
+func (l codeLanguage) declaration(line string) (string, bool) {
+	for _, re := range l.declarations {
+		if m := re.FindStringSubmatch(line); m != nil {
+			return m[1], true
+		}
+	}
+	return "", false
+}
+
+func (l codeLanguage) isComment(line string) bool {
+	trimmed := strings.TrimSpace(line)
+	for _, p := range l.commentPrefixes {
+		if strings.HasPrefix(trimmed, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitTokens splits the content, whose tokens end at the given offsets, into
+// parts of chunkSize tokens that repeat chunkOverlap tokens of the previous
+// part.
+func splitTokens(content string, ends []int, chunkSize, chunkOverlap int) []textChunk {
+	var res []textChunk
+
+	prevEnd := 0
+	for i := 0; i < len(ends); i += chunkSize - chunkOverlap {
+		end := min(i+chunkSize, len(ends))
+
+		start := 0
+		if i > 0 {
+			start = ends[i-1]
+		}
+
+		res = append(res, textChunk{
+			content: content[start:ends[end-1]],
+			overlap: max(prevEnd-start, 0),
+		})
+		prevEnd = ends[end-1]
+
+		if end == len(ends) {
+			break
+		}
+	}
+
+	return res
+}
+
+// splitProse splits the content, whose tokens end at the given offsets, into
+// parts of at most chunkSize tokens. A part ends at its last paragraph break
+// past its middle, or else at its last sentence end, or else at its last
+// space, and only a sentence longer than the chunk size is cut anywhere. The
+// parts repeat up to chunkOverlap tokens of the previous part, starting after
+// a space.
+func splitProse(content string, ends []int, chunkSize, chunkOverlap int) []textChunk {
+	var res []textChunk
+
+	// offset returns the offset before the token i.
+	offset := func(i int) int {
+		if i == 0 {
+			return 0
+		}
+		return ends[i-1]
+	}
+
+	start := 0
+	prevEnd := 0
+	for start < len(ends) {
+		cut := min(start+chunkSize, len(ends))
+		if cut < len(ends) {
+			cut = proseCut(content, ends, start, cut, chunkSize, chunkOverlap)
+		}
+
+		res = append(res, textChunk{
+			content: content[offset(start):ends[cut-1]],
+			overlap: max(prevEnd-offset(start), 0),
+		})
+		prevEnd = ends[cut-1]
+
+		if cut == len(ends) {
+			break
+		}
+
+		// The next part starts at the first space of the overlap, so it
+		// doesn't start in the middle of a word.
+		next := cut
+		for i := max(cut-chunkOverlap, start+1); i < cut; i++ {
+			if proseBoundary(content, offset(i)) >= boundaryWhitespace {
+				next = i
+				break
+			}
+		}
+		start = next
+	}
+
+	return res
+}
+
+// proseCut returns the token before which the part starting at the token
+// start is cut, at most limit.
+func proseCut(content string, ends []int, start, limit, chunkSize, chunkOverlap int) int {
+	// The part must go past the overlap, so the next one makes progress.
+	first := start + chunkOverlap + 1
+
+	best, bestCut := boundaryNone, limit
+	for i := limit; i >= first; i-- {
+		b := proseBoundary(content, ends[i-1])
+		if b == boundaryParagraph && i-start > chunkSize/2 {
+			return i
+		}
+		if b > best {
+			best, bestCut = b, i
+		}
+	}
+	return bestCut
+}
+
+// proseBoundary returns the kind of boundary at the offset of the content.
+func proseBoundary(content string, offset int) boundary {
+	if offset <= 0 || offset >= len(content) {
+		return boundaryParagraph
+	}
+
+	before := strings.TrimRightFunc(content[:offset], unicode.IsSpace)
+	after := strings.TrimLeftFunc(content[offset:], unicode.IsSpace)
+	gap := content[len(before) : len(content)-len(after)]
+
+	if strings.Count(gap, "\n") >= 2 {
+		return boundaryParagraph
+	}
+
+	// The end of a sentence may be followed by its closing quotes and brackets.
+	last, _ := utf8.DecodeLastRuneInString(strings.TrimRight(before, sentenceClosers))
+	switch {
+	case strings.ContainsRune(ideographicEnds, last):
+		return boundarySentence
+	case gap != "" && strings.ContainsRune(sentenceEnds, last):
+		return boundarySentence
+	case gap != "":
+		return boundaryWhitespace
+	}
+	return boundaryNone
+}
+
+func newChunk(doc chromem.Document, index int, c textChunk, metadata map[string]string) chromem.Document {
+	// The chunks keep the metadata of their file.
+	md := maps.Clone(doc.Metadata)
+	if md == nil {
+		md = make(map[string]string)
+	}
+	md["originalID"] = doc.ID
+	md["chunkIndex"] = fmt.Sprintf("%d", index)
+	md["overlap"] = strconv.Itoa(c.overlap)
+	maps.Copy(md, metadata)
+
+	return withChunkHeader(chromem.Document{
+		ID:       fmt.Sprintf("%s-chunk-%d", doc.ID, index),
+		Content:  c.content,
+		Metadata: md,
+	})
+}
+
+// withChunkHeader prepends the header of the chunk to its content, so a chunk
+// that doesn't name its file or section is embedded and given to the LLM with
+// them, like "File: server.md | Section: Configuration". The header is kept in
+// the metadata for mergeChunks.
+func withChunkHeader(chunk chromem.Document) chromem.Document {
+	filename := chunk.Metadata["filename"]
+	if filename == "" {
+		return chunk
+	}
+
+	header := "File: " + filename
+	if title := chunk.Metadata[titleKey]; title != "" {
+		header += " | Title: " + title
+	}
+	if chapter := chunk.Metadata[chapterKey]; chapter != "" {
+		header += " | Chapter: " + chapter
+	}
+	if sheet := chunk.Metadata[sheetKey]; sheet != "" {
+		header += " | Sheet: " + sheet
+	}
+	if rows := chunk.Metadata[rowsKey]; rows != "" {
+		header += " | Rows: " + rows
+	}
+	if cells := chunk.Metadata[cellsKey]; cells != "" {
+		header += " | Cells: " + cells
+	}
+	if timestamp := chunk.Metadata[timestampKey]; timestamp != "" {
+		header += " | Time: " + timestamp
+	}
+	if section := chunk.Metadata["headingPath"]; section != "" {
+		header += " | Section: " + section
+	} else if symbols := chunk.Metadata["symbol"]; symbols != "" {
+		header += " | Symbols: " + symbols
+	}
+
+	chunk.Metadata[chunkHeaderKey] = header
+	chunk.Content = header + "\n" + chunk.Content
+	return chunk
+}
+
+// splitChunkHeader returns the content of a chunk without its header, and the
+// header. The chunks scanned before the headers and the parts of a split chunk
+// after the first one have none.
+func splitChunkHeader(content string, metadata map[string]string) (string, string) {
+	header := metadata[chunkHeaderKey]
+	if header == "" || !strings.HasPrefix(content, header+"\n") {
+		return content, ""
+	}
+	return content[len(header)+1:], header
+}
+
+// markdownSections splits the markdown content on its ATX headings, the
+// headings in fenced code blocks are ignored. The text before the first
+// heading is a section without heading path. The sections keep their heading
+// line, so they add up to the content.
+func markdownSections(content string) []markdownSection {
+	var sections []markdownSection
+
+	var headings []string // the heading of each level, empty when not set
+	var current strings.Builder
+	currentPath := ""
+	fence := ""
+
+	flush := func() {
+		if current.Len() > 0 {
+			sections = append(sections, markdownSection{
+				headingPath: currentPath,
+				content:     current.String(),
+			})
+			current.Reset()
+		}
+	}
+
+	for _, line := range strings.SplitAfter(content, "\n") {
+		trimmed := strings.TrimSpace(line)
+
+		if fence != "" {
+			if strings.HasPrefix(trimmed, fence) {
+				fence = ""
+			}
+			current.WriteString(line)
+			continue
+		}
+		if strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~") {
+			fence = trimmed[:3]
+			current.WriteString(line)
+			continue
+		}
+
+		if level, title, ok := markdownHeading(line); ok {
+			flush()
+
+			if len(headings) < level {
+				headings = append(headings, make([]string, level-len(headings))...)
+			}
+			headings = headings[:level]
+			headings[level-1] = title
+
+			var path []string
+			for _, h := range headings {
+				if h != "" {
+					path = append(path, h)
+				}
+			}
+			currentPath = strings.Join(path, headingPathSeparator)
+		}
+		current.WriteString(line)
+	}
+	flush()
+
+	return sections
+}
+
+// markdownHeading returns the level and the title of an ATX heading line.
+func markdownHeading(line string) (int, string, bool) {
+	// Up to 3 spaces of indentation, more is a code block.
+	trimmed := strings.TrimLeft(line, " ")
+	if len(line)-len(trimmed) > 3 {
+		return 0, "", false
+	}
+
+	level := 0
+	for level < len(trimmed) && trimmed[level] == '#' {
+		level++
+	}
+	if level == 0 || level > 6 {
+		return 0, "", false
+	}
+
+	rest := strings.TrimRight(trimmed[level:], "\r\n")
+	if rest != "" && rest[0] != ' ' && rest[0] != '\t' {
+		return 0, "", false
+	}
+
+	// The closing sequence of #s is not part of the title.
+	title := strings.TrimSpace(rest)
+	if t := strings.TrimRight(title, "#"); t == "" || strings.HasSuffix(t, " ") {
+		title = strings.TrimSpace(t)
+	}
+	if title == "" {
+		return 0, "", false
+	}
+
+	return level, title, true
+}
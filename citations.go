@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/atotto/clipboard"
+	"github.com/muesli/reflow/wordwrap"
+)
+
+// citation is a section of a file cited in the sources of an answer, with the
+// indexes of its chunks given to the LLM.
+type citation struct {
+	path       string
+	section    string
+	chunkIdxes []int
+}
+
+// citations returns the sections of the files of the sources, in the order of
+// the sources, which are sorted by similarity.
+func citations(sources []chatSource) []citation {
+	var res []citation
+	for _, s := range sources {
+		path := s.Path
+		if path == "" {
+			path = s.Filename
+		}
+
+		i := slices.IndexFunc(res, func(c citation) bool {
+			return c.path == path && c.section == s.Section
+		})
+		if i < 0 {
+			res = append(res, citation{path: path, section: s.Section})
+			i = len(res) - 1
+		}
+		res[i].chunkIdxes = append(res[i].chunkIdxes, s.ChunkIndex)
+	}
+	return res
+}
+
+// citedPaths returns the paths of the files cited in the sources, without
+// duplicates.
+func citedPaths(sources []chatSource) []string {
+	var paths []string
+	for _, c := range citations(sources) {
+		if !slices.Contains(paths, c.path) {
+			paths = append(paths, c.path)
+		}
+	}
+	return paths
+}
+
+// sourcesFooter renders the sources of an answer, the ones of the file at the
+// copied path are marked. The documents searched are listed when there were
+// several.
+func (m mainModel) sourcesFooter(answer chat, copiedPath string) string {
+	var sb strings.Builder
+	switch answer.Retrieval {
+	case retrievalKeyword:
+		sb.WriteString("Sources (keyword match, no chunk was similar enough):")
+	case retrievalNothing:
+		sb.WriteString("Sources: none, nothing in the documents matches the question")
+	default:
+		sb.WriteString("Sources:")
+		if len(answer.Sources) == 0 {
+			sb.WriteString(" none")
+		}
+	}
+	for i, c := range citations(answer.Sources) {
+		line := fmt.Sprintf("[%d] %s", i+1, c.path)
+		if c.section != "" {
+			line += " › " + c.section
+		}
+
+		chunks := make([]string, len(c.chunkIdxes))
+		for j, idx := range c.chunkIdxes {
+			chunks[j] = strconv.Itoa(idx)
+		}
+		if len(chunks) == 1 {
+			line += " (chunk " + chunks[0] + ")"
+		} else {
+			line += " (chunks " + strings.Join(chunks, ", ") + ")"
+		}
+
+		if c.path == copiedPath {
+			line += " (copied)"
+		}
+		sb.WriteString("\n")
+		sb.WriteString(line)
+	}
+	if answer.searchedSeveralDocuments() {
+		fmt.Fprintf(&sb, "\nSearched: %s", strings.Join(answer.Searched, ", "))
+		if len(answer.Skipped) > 0 {
+			fmt.Fprintf(&sb, " (skipped: %s)", strings.Join(answer.Skipped, ", "))
+		}
+	}
+
+	return chatSourcesStyle.Render(wordwrap.String(sb.String(), m.width-10))
+}
+
+// searchedSeveralDocuments reports whether the question of the answer could
+// be searched in several documents.
+func (c chat) searchedSeveralDocuments() bool {
+	return len(c.Searched)+len(c.Skipped) > 1
+}
+
+// copySourcePath copies the path of a file cited by the last answer to the
+// clipboard, each copy takes the next file.
+func (m mainModel) copySourcePath() mainModel {
+	selectedSession := m.sessions[m.selectedSessionIndex]
+
+	var paths []string
+	for i := len(selectedSession.Chats) - 1; i >= 0; i-- {
+		if c := selectedSession.Chats[i]; c.Role == roleAssistant {
+			paths = citedPaths(c.Sources)
+			break
+		}
+	}
+	if len(paths) == 0 {
+		return m
+	}
+
+	next := 0
+	if i := slices.Index(paths, m.chatCopiedPath); i >= 0 {
+		next = (i + 1) % len(paths)
+	}
+	if err := clipboard.WriteAll(paths[next]); err != nil {
+		m.err = fmt.Errorf("error copying the path to the clipboard: %w", err)
+		return m.updateChatSize()
+	}
+	m.chatCopiedPath = paths[next]
+
+	return m.updateChatSize()
+}
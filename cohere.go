@@ -0,0 +1,448 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/charmbracelet/huh"
+	"github.com/philippgille/chromem-go"
+)
+
+type cohereProvider struct {
+	APIKey string `json:"apiKey"`
+	Proxy  string `json:"proxy"`
+
+	rateLimitSettings
+}
+
+type cohere struct {
+	apiKey      string
+	model       string
+	temperature float64
+
+	client *http.Client
+}
+
+type cohereChatRequest struct {
+	Model       string          `json:"model"`
+	Messages    []cohereMessage `json:"messages"`
+	Temperature float64         `json:"temperature"`
+	Stream      bool            `json:"stream"`
+}
+
+type cohereMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type cohereChatResponse struct {
+	Message struct {
+		Content []struct {
+			Text string `json:"text"`
+		} `json:"content"`
+	} `json:"message"`
+	Usage cohereUsage `json:"usage"`
+}
+
+type cohereUsage struct {
+	Tokens struct {
+		InputTokens  float64 `json:"input_tokens"`
+		OutputTokens float64 `json:"output_tokens"`
+	} `json:"tokens"`
+}
+
+type cohereStreamResponse struct {
+	Type  string `json:"type"`
+	Delta struct {
+		Message struct {
+			Content struct {
+				Text string `json:"text"`
+			} `json:"content"`
+		} `json:"message"`
+		// Usage is sent with the message-end event.
+		Usage cohereUsage `json:"usage"`
+	} `json:"delta"`
+}
+
+type cohereEmbedRequest struct {
+	Model     string   `json:"model"`
+	Texts     []string `json:"texts"`
+	InputType string   `json:"input_type"`
+}
+
+type cohereEmbedResponse struct {
+	Embeddings [][]float32 `json:"embeddings"`
+}
+
+type cohereModelsResponse struct {
+	Models []struct {
+		Name string `json:"name"`
+	} `json:"models"`
+}
+
+const (
+	cohereAPIEndpoint = "https://api.cohere.com"
+)
+
+// cohereInputTypes maps the chromem-go Cohere prefixes to their input type.
+var cohereInputTypes = map[string]string{
+	chromem.InputTypeCohereSearchDocumentPrefix: "search_document",
+	chromem.InputTypeCohereSearchQueryPrefix:    "search_query",
+	chromem.InputTypeCohereClassificationPrefix: "classification",
+	chromem.InputTypeCohereClusteringPrefix:     "clustering",
+}
+
+func (c cohere) chat(ctx context.Context, chats []chat) llmResponse {
+	if hasImages(chats) {
+		return llmResponse{err: errImagesUnsupported}
+	}
+	resp, err := c.sendChatRequest(ctx, chats, false)
+	if err != nil {
+		return llmResponse{
+			err: err,
+		}
+	}
+	defer resp.Body.Close()
+
+	var response cohereChatResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return llmResponse{
+			err: fmt.Errorf("error decoding response: %w", err),
+		}
+	}
+
+	if len(response.Message.Content) == 0 {
+		return llmResponse{
+			err: fmt.Errorf("empty response content"),
+		}
+	}
+
+	return llmResponse{
+		content:          response.Message.Content[0].Text,
+		promptTokens:     int(response.Usage.Tokens.InputTokens),
+		completionTokens: int(response.Usage.Tokens.OutputTokens),
+	}
+}
+
+func (c cohere) chatStream(ctx context.Context, chats []chat) <-chan llmResponse {
+	responseChan := make(chan llmResponse)
+
+	go func() {
+		defer close(responseChan)
+
+		resp, err := c.sendChatRequest(ctx, chats, true)
+		if err != nil {
+			if errors.Is(err, context.Canceled) {
+				return
+			}
+			responseChan <- llmResponse{
+				err: err,
+			}
+			return
+		}
+		defer resp.Body.Close()
+
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if !strings.HasPrefix(line, "data: ") {
+				continue
+			}
+
+			var streamResp cohereStreamResponse
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &streamResp); err != nil {
+				responseChan <- llmResponse{
+					err: fmt.Errorf("error decoding response: %w", err),
+				}
+				return
+			}
+
+			if streamResp.Type == "content-delta" && streamResp.Delta.Message.Content.Text != "" {
+				responseChan <- llmResponse{
+					content: streamResp.Delta.Message.Content.Text,
+				}
+			}
+
+			if streamResp.Type == "message-end" {
+				responseChan <- llmResponse{
+					promptTokens:     int(streamResp.Delta.Usage.Tokens.InputTokens),
+					completionTokens: int(streamResp.Delta.Usage.Tokens.OutputTokens),
+				}
+				return
+			}
+		}
+
+		if err := scanner.Err(); err != nil {
+			if !errors.Is(err, context.Canceled) {
+				responseChan <- llmResponse{
+					err: fmt.Errorf("error reading response: %w", err),
+				}
+			}
+		}
+	}()
+
+	return responseChan
+}
+
+func (c cohere) sendChatRequest(ctx context.Context, chats []chat, stream bool) (*http.Response, error) {
+	// Cohere accepts the system prompt as a regular message with the system role,
+	// so the chats can be sent as is.
+	msgs := make([]cohereMessage, len(chats))
+	for i, chat := range chats {
+		msgs[i] = cohereMessage{
+			Role:    chat.Role,
+			Content: chat.Content,
+		}
+	}
+
+	jsonBody, err := json.Marshal(cohereChatRequest{
+		Model:       c.model,
+		Messages:    msgs,
+		Temperature: c.temperature,
+		Stream:      stream,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", cohereAPIEndpoint+"/v2/chat", bytes.NewBuffer(jsonBody))
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+c.apiKey)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error sending request: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, newHTTPStatusError(resp)
+	}
+
+	return resp, nil
+}
+
+// embeddingFunc returns an EmbeddingFunc that uses the Cohere embed API.
+//
+// The input type is taken from the chromem-go Cohere prefix of the text, which
+// the collections don't add, so texts without a prefix are embedded as search
+// documents.
+func (c cohere) embeddingFunc() chromem.EmbeddingFunc {
+	var checkedNormalized bool
+	checkNormalized := sync.Once{}
+
+	return func(ctx context.Context, text string) ([]float32, error) {
+		inputType := "search_document"
+		for prefix, t := range cohereInputTypes {
+			if strings.HasPrefix(text, prefix) {
+				inputType = t
+				text = strings.TrimPrefix(text, prefix)
+				break
+			}
+		}
+
+		jsonBody, err := json.Marshal(cohereEmbedRequest{
+			Model:     c.model,
+			Texts:     []string{text},
+			InputType: inputType,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error marshaling request: %w", err)
+		}
+
+		req, err := http.NewRequestWithContext(ctx, "POST", cohereAPIEndpoint+"/v1/embed", bytes.NewBuffer(jsonBody))
+		if err != nil {
+			return nil, fmt.Errorf("error creating request: %w", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+c.apiKey)
+
+		resp, err := c.client.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("error sending request: %w", err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return nil, newHTTPStatusError(resp)
+		}
+
+		var embedResp cohereEmbedResponse
+		if err := json.NewDecoder(resp.Body).Decode(&embedResp); err != nil {
+			return nil, fmt.Errorf("error decoding response: %w", err)
+		}
+
+		if len(embedResp.Embeddings) == 0 || len(embedResp.Embeddings[0]) == 0 {
+			return nil, errors.New("no embeddings found in the response")
+		}
+
+		v := embedResp.Embeddings[0]
+		checkNormalized.Do(func() {
+			checkedNormalized = isNormalized(v)
+		})
+		if !checkedNormalized {
+			v = normalizeVector(v)
+		}
+
+		return v, nil
+	}
+}
+
+func (c cohereProvider) Title() string {
+	if c.isConfigured() {
+		return fmt.Sprintf("%s (configured)", providerCohere)
+	}
+	return fmt.Sprintf("%s (not configured)", providerCohere)
+}
+
+func (c cohereProvider) Description() string {
+	return "Configure Cohere connection"
+}
+
+func (c cohereProvider) FilterValue() string {
+	return providerCohere
+}
+
+func (c cohereProvider) name() string {
+	return providerCohere
+}
+
+func (c cohereProvider) availableModels() ([]string, error) {
+	return c.listModels("chat")
+}
+
+func (c cohereProvider) availableEmbeddingModels() ([]string, error) {
+	return c.listModels("embed")
+}
+
+// listModels returns the names of the models that are compatible with the given
+// Cohere endpoint.
+func (c cohereProvider) listModels(endpoint string) ([]string, error) {
+	req, err := http.NewRequestWithContext(context.Background(), "GET",
+		cohereAPIEndpoint+"/v1/models?page_size=1000&endpoint="+endpoint, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+c.APIKey)
+
+	resp, err := newProxyHTTPClient(c.Proxy).Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error sending request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("unexpected status code: %d, body: %s", resp.StatusCode, string(body))
+	}
+
+	var models cohereModelsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&models); err != nil {
+		return nil, fmt.Errorf("error decoding response: %w", err)
+	}
+
+	res := make([]string, len(models.Models))
+	for i, m := range models.Models {
+		res[i] = m.Name
+	}
+
+	return res, nil
+}
+
+func (c cohereProvider) isConfigured() bool {
+	return c.APIKey != ""
+}
+
+func (c cohereProvider) testConnection() error {
+	_, err := c.listModels("chat")
+	return err
+}
+
+func (c cohereProvider) form(width, height int, keymap *huh.KeyMap) *huh.Form {
+	proxy := c.Proxy
+	apiKey := c.APIKey
+	if apiKey == "" {
+		apiKey = os.Getenv("COHERE_API_KEY")
+	}
+	rateLimit := c.rateLimitSettings
+	return huh.NewForm(
+		huh.NewGroup(
+			huh.NewInput().
+				Key("cohereAPIKey").
+				Title("API Key").
+				Description("Enter the API key for Cohere.").
+				Placeholder("API Key").
+				Value(&apiKey),
+			proxyField("cohereProxy", "Cohere", &proxy),
+			requestsPerMinuteField("cohere", &rateLimit.RequestsPerMinute),
+			tokensPerMinuteField("cohere", &rateLimit.TokensPerMinute),
+			testConnectionField("cohereTest", func() error {
+				return cohereProvider{APIKey: apiKey, Proxy: proxy}.testConnection()
+			}),
+			huh.NewConfirm().
+				Key("cohereConfirm").
+				Title("Confirm").
+				Description("Save this Cohere settings?").
+				Affirmative("Yes").
+				Negative("Back"),
+		),
+	).
+		WithWidth(width).
+		WithHeight(height).
+		WithTheme(huh.ThemeCatppuccin()).
+		WithKeyMap(keymap).
+		WithShowErrors(true).
+		WithShowHelp(true)
+}
+
+func (c cohereProvider) saveForm(form *huh.Form) (llmProvider, bool) {
+	if !form.GetBool("cohereConfirm") {
+		return c, false
+	}
+
+	apiKey := form.GetString("cohereAPIKey")
+
+	if apiKey == "" {
+		return c, false
+	}
+
+	c.APIKey = apiKey
+	c.Proxy = form.GetString("cohereProxy")
+	c.rateLimitSettings = rateLimitSettingsFromForm(form, "cohere")
+
+	return c, true
+}
+
+func (c cohereProvider) new(setting llmSetting) llm {
+	return cohere{
+		apiKey:      c.APIKey,
+		model:       setting.Model,
+		temperature: setting.Temperature,
+		client:      newProxyHTTPClient(c.Proxy),
+	}
+}
+
+func (c cohereProvider) supportEmbedding() bool {
+	return true
+}
+
+func (c cohereProvider) newEmbedder(setting llmSetting) embedder {
+	return cohere{
+		apiKey: c.APIKey,
+		model:  setting.Model,
+		client: newProxyHTTPClient(c.Proxy),
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"strings"
+)
+
+// contextWindowProvider is implemented by the providers that can report the
+// context window of their models.
+type contextWindowProvider interface {
+	modelContextWindow(ctx context.Context, model string) (int, error)
+}
+
+const (
+	// defaultContextWindow is the context window assumed for the unknown
+	// models, small enough for most of the models served today.
+	defaultContextWindow = 8192
+
+	// contextAnswerReserve is the part of the context window kept for the
+	// answer, at most a quarter of the window.
+	contextAnswerReserve = 4096
+
+	// omittedHistoryMarker starts the conversation sent to the LLM when the
+	// oldest chats were left out, so the model knows the context was cut.
+	omittedHistoryMarker = "[earlier conversation omitted]"
+)
+
+// modelContextWindows holds the context windows of the known model families, in
+// tokens. The names are matched at the start of any part of the model ID, so
+// the IDs of the gateways and of Bedrock match too, and the more specific names
+// come first.
+var modelContextWindows = []struct {
+	name          string
+	contextWindow int
+}{
+	{"claude", 200000},
+	{"gpt-4.1", 1047576},
+	{"gpt-4o", 128000},
+	{"gpt-4-turbo", 128000},
+	{"gpt-4", 8192},
+	{"gpt-3.5-turbo", 16385},
+	{"o4-mini", 200000},
+	{"o3", 200000},
+	{"o1", 200000},
+	{"gemini-1.5-pro", 2097152},
+	{"gemini", 1048576},
+	{"deepseek", 65536},
+	{"grok", 131072},
+	{"mistral-large", 131072},
+	{"mistral-small", 32768},
+	{"codestral", 262144},
+	{"mistral-nemo", 131072},
+	{"command-a", 256000},
+	{"command-r", 128000},
+	{"llama-3", 131072},
+	{"llama3", 131072},
+	{"mixtral-8x7b", 32768},
+	{"gemma2", 8192},
+}
+
+// contextWindow returns the context window of the model of the setting, from
+// its provider when it reports it, or else from the known model families,
+// falling back to defaultContextWindow.
+func (l llmSetting) contextWindow(ctx context.Context, providers []llmProvider) int {
+	for _, p := range providers {
+		if p.name() != l.Provider {
+			continue
+		}
+		c, ok := p.(contextWindowProvider)
+		if !ok {
+			break
+		}
+		n, err := c.modelContextWindow(ctx, l.Model)
+		if err != nil {
+			slog.Warn("Failed to get the context window of the model", "model", l.Model, "error", err)
+			break
+		}
+		if n > 0 {
+			return n
+		}
+		break
+	}
+
+	if n, ok := knownContextWindow(l.Model); ok {
+		return n
+	}
+
+	slog.Warn("Unknown context window of the model, using the default", "model", l.Model, "contextWindow", defaultContextWindow)
+	return defaultContextWindow
+}
+
+// knownContextWindow returns the context window of the model families that
+// were released when this was written.
+func knownContextWindow(model string) (int, bool) {
+	model = strings.ToLower(model)
+	for _, m := range modelContextWindows {
+		if containsModelName(model, m.name) {
+			return m.contextWindow, true
+		}
+	}
+	return 0, false
+}
+
+// containsModelName reports whether the name is in the model ID at its start
+// or after a separator, so o1 doesn't match in the middle of another name.
+func containsModelName(model, name string) bool {
+	for i := 0; i < len(model); {
+		j := strings.Index(model[i:], name)
+		if j < 0 {
+			return false
+		}
+		j += i
+		if j == 0 || strings.ContainsRune("/.:-_", rune(model[j-1])) {
+			return true
+		}
+		i = j + 1
+	}
+	return false
+}
+
+// historyBudget returns the tokens left for the past chats in the context
+// window, once the answer, the system prompt, the current message and the
+// omitted history marker are accounted for.
+func historyBudget(contextWindow int, systemPrompt, msg string) int {
+	reserve := min(contextAnswerReserve, contextWindow/4)
+	return contextWindow - reserve - estimateTokens(systemPrompt, msg, omittedHistoryMarker)
+}
+
+// markOmittedHistory prefixes the first chat of the conversation, a user chat,
+// with the omittedHistoryMarker. The chats are copied, so the session keeps
+// them unchanged.
+func markOmittedHistory(conversation []chat) []chat {
+	if len(conversation) == 0 {
+		return conversation
+	}
+	conversation = slices.Clone(conversation)
+	conversation[0].Content = omittedHistoryMarker + "\n\n" + conversation[0].Content
+	return conversation
+}
+
+// trimHistory drops the oldest chats until the rest fit in the budget, and
+// returns the chats kept and how many were dropped. The kept chats start with
+// a user chat, as some providers reject a conversation starting with an
+// answer.
+func trimHistory(chats []chat, budget int) ([]chat, int) {
+	total := 0
+	for _, c := range chats {
+		total += estimateTokens(c.Content)
+	}
+
+	start := 0
+	for start < len(chats) && total > budget {
+		total -= estimateTokens(chats[start].Content)
+		start++
+	}
+	for start < len(chats) && chats[start].Role != roleUser {
+		start++
+	}
+
+	return chats[start:], start
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/philippgille/chromem-go"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+const (
+	documentSourceFolder = "folder"
+	documentSourceURL    = "url"
+
+	// urlKey is the metadata of the URL of a crawled page.
+	urlKey = "url"
+
+	defaultCrawlDepth = 2
+	maxCrawlDepth     = 10
+	defaultCrawlPages = 100
+	maxCrawlPages     = 10000
+
+	// crawlTimeout is the time a page can go without sending anything.
+	crawlTimeout = 30 * time.Second
+)
+
+// crawledPage is a page to fetch, at the number of links from the start URL.
+type crawledPage struct {
+	url   *url.URL
+	depth int
+}
+
+func (d document) isURL() bool {
+	return d.Source == documentSourceURL
+}
+
+func (d document) crawlDepth() int {
+	if d.CrawlDepth == nil {
+		return defaultCrawlDepth
+	}
+	return *d.CrawlDepth
+}
+
+func (d document) maxPages() int {
+	if d.MaxPages == 0 {
+		return defaultCrawlPages
+	}
+	return d.MaxPages
+}
+
+func parseDocumentURL(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("invalid URL %q, use an http or https URL", s)
+	}
+	return s, nil
+}
+
+func parseCrawlDepth(s string) (int, error) {
+	n, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || n < 0 || n > maxCrawlDepth {
+		return 0, fmt.Errorf("invalid crawl depth %q, use a number from 0 to %d", s, maxCrawlDepth)
+	}
+	return n, nil
+}
+
+func parseCrawlPages(s string) (int, error) {
+	n, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || n < 1 || n > maxCrawlPages {
+		return 0, fmt.Errorf("invalid page limit %q, use a number from 1 to %d", s, maxCrawlPages)
+	}
+	return n, nil
+}
+
+// crawlPages fetches the pages of the document from its URL, following the
+// links to the same origin up to its crawl depth and its page limit, one page
+// at a time. The pages are scanned as the HTML files, with their URL as their
+// ID.
+func (r *rag) crawlPages(
+	ctx context.Context,
+	doc document,
+	exclusions *scanExclusions,
+	files chan<- scannedFile,
+	progress chan<- documentScanLogMsg,
+) {
+	start, err := url.Parse(doc.Path)
+	if err != nil {
+		progress <- documentScanLogMsg{
+			content: fmt.Sprintf("Error scanning %s: %s", doc.Path, err),
+			err:     err,
+		}
+		return
+	}
+	start.Fragment = ""
+	depth, maxPages := doc.crawlDepth(), doc.maxPages()
+	progress <- documentScanLogMsg{
+		content: fmt.Sprintf("Crawling %s, up to %d links deep and %d pages", start, depth, maxPages),
+	}
+
+	client := newTimeoutHTTPClient(crawlTimeout, "")
+	opts := extractOptions{ctx: ctx}
+	maxPageBytes := int64(r.settings.maxFileMB()) << 20
+
+	queue := []crawledPage{{url: start}}
+	seen := map[string]bool{start.String(): true}
+	pages := 0
+	for len(queue) > 0 && pages < maxPages {
+		if ctx.Err() != nil {
+			break
+		}
+		page := queue[0]
+		queue = queue[1:]
+		pageURL := page.url.String()
+
+		data, contentType, modTime, err := fetchPage(ctx, client, pageURL, maxPageBytes)
+		if errors.Is(err, errPageTooLarge) {
+			exclusions.oversizedFiles++
+		}
+		if err != nil {
+			// The start page is the document, the scan fails without it.
+			if page.depth == 0 {
+				progress <- documentScanLogMsg{
+					content: fmt.Sprintf("Error scanning %s: %s", pageURL, err),
+					err:     err,
+				}
+				return
+			}
+			if !errors.Is(err, errPageTooLarge) {
+				exclusions.failures.add(pageURL, err)
+			}
+			progress <- documentScanLogMsg{
+				content: fmt.Sprintf("Warning: skipped %s: %s", pageURL, err),
+			}
+			continue
+		}
+
+		metadata := map[string]string{
+			"filename": pageName(page.url),
+			"ext":      "html",
+			"path":     strings.TrimPrefix(page.url.EscapedPath(), "/"),
+			urlKey:     pageURL,
+		}
+		if !modTime.IsZero() {
+			metadata[modTimeKey] = modTime.UTC().Format(time.RFC3339)
+		}
+		var extracted chromem.Document
+		var text extractedText
+		switch contentType {
+		case "text/html", "application/xhtml+xml":
+			extracted, text, err = extractWith(chromem.Document{ID: pageURL, Metadata: metadata},
+				extractors[".html"], data, opts)
+			if err == nil && page.depth < depth {
+				for _, link := range htmlLinks(data, page.url) {
+					if link.Scheme == start.Scheme && link.Host == start.Host && !seen[link.String()] {
+						seen[link.String()] = true
+						queue = append(queue, crawledPage{url: link, depth: page.depth + 1})
+					}
+				}
+			}
+		case "text/plain", "text/markdown":
+			metadata["ext"] = strings.TrimPrefix(path.Ext(page.url.Path), ".")
+			extracted = chromem.Document{ID: pageURL, Content: string(data), Metadata: metadata}
+		default:
+			err = fmt.Errorf("the content type %s is not a page", contentType)
+		}
+		if err != nil {
+			progress <- documentScanLogMsg{
+				content: fmt.Sprintf("Warning: skipped %s: %s", pageURL, err),
+			}
+			continue
+		}
+		pages++
+		progress <- documentScanLogMsg{filesRead: pages}
+		if strings.TrimSpace(extracted.Content) == "" {
+			continue
+		}
+
+		files <- scannedFile{
+			doc:      extracted,
+			sections: text.sections,
+			state: fileState{
+				Hash:    contentHash(string(data)),
+				ModTime: modTime,
+				Size:    int64(len(data)),
+			},
+		}
+	}
+
+	progress <- documentScanLogMsg{
+		content: fmt.Sprintf("Crawled %d pages", pages),
+	}
+	if len(queue) > 0 && ctx.Err() == nil {
+		progress <- documentScanLogMsg{
+			content: fmt.Sprintf("Warning: the page limit of %d was reached, %d linked pages were not crawled", maxPages, len(queue)),
+		}
+	}
+
+	close(files)
+}
+
+var errPageTooLarge = errors.New("the page is over the file size limit")
+
+// fetchPage returns the body of the page, its media type and its modification
+// time.
+func fetchPage(ctx context.Context, client *http.Client, pageURL string, maxBytes int64) ([]byte, string, time.Time, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, pageURL, nil)
+	if err != nil {
+		return nil, "", time.Time{}, fmt.Errorf("error creating request: %w", err)
+	}
+	req.Header.Set("Accept", "text/html, text/plain;q=0.9, */*;q=0.1")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, "", time.Time{}, fmt.Errorf("error fetching the page: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", time.Time{}, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	if resp.ContentLength > maxBytes {
+		return nil, "", time.Time{}, errPageTooLarge
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxBytes+1))
+	if err != nil {
+		return nil, "", time.Time{}, fmt.Errorf("error reading the page: %w", err)
+	}
+	if int64(len(data)) > maxBytes {
+		return nil, "", time.Time{}, errPageTooLarge
+	}
+
+	contentType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		contentType = http.DetectContentType(data)
+		contentType, _, _ = strings.Cut(contentType, ";")
+	}
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return data, contentType, modTime, nil
+}
+
+// htmlLinks returns the http and https links of the page, resolved from its
+// URL and without their fragment.
+func htmlLinks(data []byte, base *url.URL) []*url.URL {
+	root, err := html.Parse(bytes.NewReader(data))
+	if err != nil {
+		return nil
+	}
+
+	var links []*url.URL
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode && n.DataAtom == atom.A {
+			for _, a := range n.Attr {
+				if a.Key != "href" {
+					continue
+				}
+				link, err := base.Parse(strings.TrimSpace(a.Val))
+				if err != nil || (link.Scheme != "http" && link.Scheme != "https") {
+					continue
+				}
+				link.Fragment, link.RawFragment = "", ""
+				links = append(links, link)
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(root)
+	return links
+}
+
+// pageName names the page in the chunk headers and the sources, by the last
+// segment of its path or its host.
+func pageName(u *url.URL) string {
+	name := path.Base(strings.TrimSuffix(u.Path, "/"))
+	if name == "." || name == "/" || name == "" {
+		return u.Host
+	}
+	return name
+}
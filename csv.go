@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// rowsKey is the metadata of the rows of a table in a chunk, like "2-21" with
+// the header as the first row, named in the chunk headers and the sources.
+const rowsKey = "rows"
+
+func extractCSV(data []byte, opts extractOptions) (extractedText, error) {
+	return extractDelimited(data, ',', opts)
+}
+
+func extractTSV(data []byte, opts extractOptions) (extractedText, error) {
+	return extractDelimited(data, '\t', opts)
+}
+
+// extractDelimited splits a table into sections of tableRowsPerChunk complete
+// rows, each one a chunk that starts with the header row so its values keep
+// their column names. The rows with another number of fields than the header,
+// or that can't be parsed, are skipped with a warning.
+func extractDelimited(data []byte, comma rune, opts extractOptions) (extractedText, error) {
+	r := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(data, []byte("\ufeff"))))
+	r.Comma = comma
+	// The quotes of the tab separated values are usually literal.
+	r.LazyQuotes = comma == '\t'
+
+	header, err := r.Read()
+	if err != nil {
+		return extractedText{}, fmt.Errorf("error reading the header row: %w", err)
+	}
+
+	var text extractedText
+	var rows [][]string
+	// The header is the first row.
+	row, first, last := 1, 0, 0
+	skipped := 0
+	var firstErr error
+
+	flush := func() {
+		if len(rows) == 0 {
+			return
+		}
+		section := extractedSection{
+			content:  formatDelimited(header, rows, comma),
+			metadata: map[string]string{rowsKey: strconv.Itoa(first) + "-" + strconv.Itoa(last)},
+			whole:    true,
+		}
+		text.sections = append(text.sections, section)
+		rows = nil
+	}
+
+	rowsPerChunk := max(opts.tableRowsPerChunk, 1)
+	for {
+		record, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		row++
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			skipped++
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if err != nil {
+			return extractedText{}, fmt.Errorf("error reading the rows: %w", err)
+		}
+
+		if len(rows) == 0 {
+			first = row
+		}
+		last = row
+		rows = append(rows, record)
+		if len(rows) == rowsPerChunk {
+			flush()
+		}
+	}
+	flush()
+
+	if skipped > 0 {
+		text.warnings = append(text.warnings, fmt.Sprintf("skipped %d malformed rows, the first one: %s", skipped, firstErr))
+	}
+	return text, nil
+}
+
+// formatDelimited writes the header and the rows back as delimited values,
+// quoted where they need to be.
+func formatDelimited(header []string, rows [][]string, comma rune) string {
+	var sb strings.Builder
+	w := csv.NewWriter(&sb)
+	w.Comma = comma
+	_ = w.Write(header)
+	_ = w.WriteAll(rows)
+	return strings.TrimSuffix(sb.String(), "\n")
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// debugTransport logs the requests sent to the providers and their responses at
+// the debug level, while the provider traffic debugging is enabled.
+type debugTransport struct {
+	base http.RoundTripper
+}
+
+// debugHTTPClient logs the traffic of a client that can't be given a
+// transport, like the AWS SDK client.
+type debugHTTPClient struct {
+	client interface {
+		Do(*http.Request) (*http.Response, error)
+	}
+}
+
+// debugBody logs the start of the response body once it's read to the end or
+// closed, so a stream is logged as a single truncated transcript instead of
+// every event.
+type debugBody struct {
+	io.ReadCloser
+
+	url        string
+	statusCode int
+	transcript bytes.Buffer
+	size       int
+	logOnce    sync.Once
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+const (
+	// debugBodyLimit is the most bytes of a request or response body logged.
+	debugBodyLimit = 8 << 10
+)
+
+var (
+	// debugTraffic enables the logging of the provider traffic.
+	debugTraffic atomic.Bool
+
+	// logLevel is the level of the logger, lowered to debug while the provider
+	// traffic is logged.
+	logLevel     slog.LevelVar
+	baseLogLevel = slog.LevelError
+
+	// secretFieldRegexp matches the JSON fields that may hold a credential.
+	secretFieldRegexp = regexp.MustCompile(`(?i)("[a-z_]*(?:api_?key|token|secret|password)[a-z_]*"\s*:\s*)"[^"]*"`)
+)
+
+// secretHeaders are the request headers that carry the API keys of the
+// providers, their values are never logged.
+var secretHeaders = []string{"Authorization", "X-Api-Key", "Api-Key", "X-Goog-Api-Key", "X-Amz-Security-Token"}
+
+// secretQueryParams are the query parameters that carry the API keys of the
+// providers.
+var secretQueryParams = []string{"key", "api_key", "api-key"}
+
+// setDebugTraffic enables or disables the logging of the provider traffic.
+func setDebugTraffic(enabled bool) {
+	debugTraffic.Store(enabled)
+	if enabled {
+		logLevel.Set(min(baseLogLevel, slog.LevelDebug))
+		return
+	}
+	logLevel.Set(baseLogLevel)
+}
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func (c debugHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	return debugTransport{base: roundTripperFunc(c.client.Do)}.RoundTrip(req)
+}
+
+func (t debugTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !debugTraffic.Load() {
+		return t.base.RoundTrip(req)
+	}
+
+	u := redactURL(req.URL)
+	slog.Debug("provider request",
+		"method", req.Method,
+		"url", u,
+		"headers", redactHeaders(req.Header),
+		"body", requestBody(req))
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		slog.Debug("provider request failed", "url", u, "error", err)
+		return nil, err
+	}
+
+	resp.Body = &debugBody{
+		ReadCloser: resp.Body,
+		url:        u,
+		statusCode: resp.StatusCode,
+	}
+	return resp, nil
+}
+
+func (b *debugBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.size += n
+		if room := debugBodyLimit - b.transcript.Len(); room > 0 {
+			b.transcript.Write(p[:min(n, room)])
+		}
+	}
+	if err == io.EOF {
+		b.log()
+	}
+	return n, err
+}
+
+func (b *debugBody) Close() error {
+	b.log()
+	return b.ReadCloser.Close()
+}
+
+func (b *debugBody) log() {
+	b.logOnce.Do(func() {
+		slog.Debug("provider response",
+			"url", b.url,
+			"status", b.statusCode,
+			"bytes", b.size,
+			"truncated", b.size > debugBodyLimit,
+			"body", redactBody(b.transcript.String()))
+	})
+}
+
+// requestBody returns the start of the request body, read from a copy so the
+// request is sent unchanged.
+func requestBody(req *http.Request) string {
+	if req.Body == nil || req.Body == http.NoBody {
+		return ""
+	}
+	if req.GetBody == nil {
+		return "(body not logged)"
+	}
+
+	body, err := req.GetBody()
+	if err != nil {
+		return "(body not logged)"
+	}
+	defer body.Close()
+
+	data, _ := io.ReadAll(io.LimitReader(body, debugBodyLimit))
+	return redactBody(string(data))
+}
+
+func redactBody(body string) string {
+	return secretFieldRegexp.ReplaceAllString(body, `$1"REDACTED"`)
+}
+
+func redactHeaders(header http.Header) http.Header {
+	res := header.Clone()
+	for _, h := range secretHeaders {
+		if res.Get(h) != "" {
+			res.Set(h, "REDACTED")
+		}
+	}
+	return res
+}
+
+func redactURL(u *url.URL) string {
+	redacted := *u
+	redacted.User = nil
+
+	query := u.Query()
+	changed := false
+	for k := range query {
+		for _, p := range secretQueryParams {
+			if strings.EqualFold(k, p) {
+				query.Set(k, "REDACTED")
+				changed = true
+			}
+		}
+	}
+	if changed {
+		redacted.RawQuery = query.Encode()
+	}
+	return redacted.String()
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/philippgille/chromem-go"
+)
+
+const (
+	// duplicateShingleWords is the number of words of the shingles compared to
+	// find the near-duplicate chunks.
+	duplicateShingleWords = 3
+	// duplicateJaccard is the share of the shingles two chunks have in common
+	// from which they are duplicates, like a license header in many files.
+	duplicateJaccard = 0.8
+)
+
+// appendDistinct appends the candidates to the selected results until there
+// are n, leaving out the ones that duplicate a selected result. It returns the
+// number of duplicates left out.
+func appendDistinct(selected, candidates []chromem.Result, n int) ([]chromem.Result, int) {
+	shingles := make([]map[string]struct{}, len(selected))
+	for i, s := range selected {
+		shingles[i] = contentShingles(s.Content)
+	}
+
+	dropped := 0
+	for _, c := range candidates {
+		if len(selected) >= n {
+			break
+		}
+
+		cs := contentShingles(c.Content)
+		duplicate := false
+		for _, s := range shingles {
+			if jaccard(cs, s) >= duplicateJaccard {
+				duplicate = true
+				break
+			}
+		}
+		if duplicate {
+			dropped++
+			continue
+		}
+
+		selected = append(selected, c)
+		shingles = append(shingles, cs)
+	}
+
+	return selected, dropped
+}
+
+// contentShingles returns the sequences of duplicateShingleWords words of the
+// content, ignoring the case and the spacing. A shorter content is a single
+// shingle.
+func contentShingles(content string) map[string]struct{} {
+	words := strings.Fields(strings.ToLower(content))
+	res := make(map[string]struct{})
+	if len(words) < duplicateShingleWords {
+		res[strings.Join(words, " ")] = struct{}{}
+		return res
+	}
+	for i := 0; i+duplicateShingleWords <= len(words); i++ {
+		res[strings.Join(words[i:i+duplicateShingleWords], " ")] = struct{}{}
+	}
+	return res
+}
+
+func jaccard(a, b map[string]struct{}) float64 {
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+	common := 0
+	for s := range a {
+		if _, ok := b[s]; ok {
+			common++
+		}
+	}
+	return float64(common) / float64(len(a)+len(b)-common)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/charmbracelet/huh"
+)
+
+type deepSeekProvider struct {
+	APIKey string `json:"apiKey"`
+	Proxy  string `json:"proxy"`
+
+	rateLimitSettings
+}
+
+const (
+	deepSeekAPIEndpoint = "https://api.deepseek.com"
+)
+
+func (d deepSeekProvider) Title() string {
+	if d.isConfigured() {
+		return fmt.Sprintf("%s (configured)", providerDeepSeek)
+	}
+	return fmt.Sprintf("%s (not configured)", providerDeepSeek)
+}
+
+func (d deepSeekProvider) Description() string {
+	return "Configure DeepSeek connection"
+}
+
+func (d deepSeekProvider) FilterValue() string {
+	return providerDeepSeek
+}
+
+func (d deepSeekProvider) name() string {
+	return providerDeepSeek
+}
+
+func (d deepSeekProvider) availableModels() ([]string, error) {
+	return listOpenAIModels(newOpenAICompatClient(d.APIKey, deepSeekAPIEndpoint, d.Proxy))
+}
+
+func (d deepSeekProvider) isConfigured() bool {
+	return d.APIKey != ""
+}
+
+func (d deepSeekProvider) testConnection() error {
+	_, err := d.availableModels()
+	return err
+}
+
+func (d deepSeekProvider) form(width, height int, keymap *huh.KeyMap) *huh.Form {
+	proxy := d.Proxy
+	apiKey := d.APIKey
+	if apiKey == "" {
+		apiKey = os.Getenv("DEEPSEEK_API_KEY")
+	}
+	rateLimit := d.rateLimitSettings
+	return huh.NewForm(
+		huh.NewGroup(
+			huh.NewInput().
+				Key("deepSeekAPIKey").
+				Title("API Key").
+				Description("Enter the API key for DeepSeek.").
+				Placeholder("API Key").
+				Value(&apiKey),
+			proxyField("deepSeekProxy", "DeepSeek", &proxy),
+			requestsPerMinuteField("deepSeek", &rateLimit.RequestsPerMinute),
+			tokensPerMinuteField("deepSeek", &rateLimit.TokensPerMinute),
+			testConnectionField("deepSeekTest", func() error {
+				return deepSeekProvider{APIKey: apiKey, Proxy: proxy}.testConnection()
+			}),
+			huh.NewConfirm().
+				Key("deepSeekConfirm").
+				Title("Confirm").
+				Description("Save this DeepSeek settings?").
+				Affirmative("Yes").
+				Negative("Back"),
+		),
+	).
+		WithWidth(width).
+		WithHeight(height).
+		WithTheme(huh.ThemeCatppuccin()).
+		WithKeyMap(keymap).
+		WithShowErrors(true).
+		WithShowHelp(true)
+}
+
+func (d deepSeekProvider) saveForm(form *huh.Form) (llmProvider, bool) {
+	if !form.GetBool("deepSeekConfirm") {
+		return d, false
+	}
+
+	apiKey := form.GetString("deepSeekAPIKey")
+
+	if apiKey == "" {
+		return d, false
+	}
+
+	d.APIKey = apiKey
+	d.Proxy = form.GetString("deepSeekProxy")
+	d.rateLimitSettings = rateLimitSettingsFromForm(form, "deepSeek")
+
+	return d, true
+}
+
+func (d deepSeekProvider) new(setting llmSetting) llm {
+	return openai{
+		apiKey:           d.APIKey,
+		model:            setting.Model,
+		temperature:      setting.Temperature,
+		topP:             setting.TopP,
+		frequencyPenalty: setting.FrequencyPenalty,
+		presencePenalty:  setting.PresencePenalty,
+		stop:             setting.StopSequences,
+		streamUsage:      true,
+		client:           newOpenAICompatClient(d.APIKey, deepSeekAPIEndpoint, d.Proxy),
+	}
+}
+
+func (d deepSeekProvider) supportEmbedding() bool {
+	return false
+}
+
+func (d deepSeekProvider) newEmbedder(setting llmSetting) embedder {
+	return nil
+}
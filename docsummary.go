@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"math"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/philippgille/chromem-go"
+)
+
+const (
+	// docSummaryListedFiles and docSummarySampledFiles are the number of files
+	// listed and excerpted to summarize a document.
+	docSummaryListedFiles  = 200
+	docSummarySampledFiles = 30
+	docSummaryExcerptRunes = 300
+
+	// routingMargin is how much less similar to the question than the best
+	// summary the summary of a document can be for it to be searched.
+	routingMargin = 0.1
+)
+
+// summarizeDocument returns a paragraph about the files of the document, to
+// tell the questions it answers from the ones it doesn't.
+func summarizeDocument(ctx context.Context, llm llm, name string, paths, excerpts []string) (string, error) {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Document: %s\n\nFiles:\n", name)
+	for _, p := range paths {
+		sb.WriteString(p)
+		sb.WriteString("\n")
+	}
+	sb.WriteString("\nExcerpts:\n")
+	for _, e := range excerpts {
+		sb.WriteString(e)
+		sb.WriteString("\n\n")
+	}
+
+	cs := []chat{
+		{
+			Role: roleSystem,
+			Content: `
+Summarize what the document, a collection of files, is about, to choose the documents to search for a question.
+
+Rules for the summary:
+1. One paragraph of plain sentences, at most 120 words
+2. Name the subjects, the products, the projects and the kinds of files
+3. NO introduction, reply with the summary only
+      `,
+		},
+		{
+			Role:    roleUser,
+			Content: sb.String(),
+		},
+	}
+
+	slog.Info("Document Summary Prompt", "chats", cs)
+
+	res := llm.chat(ctx, cs)
+	if res.err != nil {
+		return "", res.err
+	}
+	if strings.TrimSpace(res.content) == "" {
+		return "", errors.New("empty summary generated")
+	}
+
+	return strings.TrimSpace(res.content), nil
+}
+
+// summarizeScannedDocument summarizes the document from its scanned files, with
+// the start of the first chunk of some of them, and embeds the summary for the
+// routing of the questions.
+func (r *rag) summarizeScannedDocument(
+	ctx context.Context,
+	doc document,
+	coll *chromem.Collection,
+	states map[string]fileState,
+) (string, []float32, error) {
+	files := slices.Sorted(maps.Keys(states))
+
+	var paths, excerpts []string
+	for i, f := range files {
+		// The crawled pages are listed by their URL.
+		rel, err := filepath.Rel(doc.Path, f)
+		if err != nil || doc.isURL() {
+			rel = f
+		}
+		rel = filepath.ToSlash(rel)
+		if i < docSummaryListedFiles {
+			paths = append(paths, rel)
+		}
+
+		// The files spread over the document are excerpted.
+		if len(files) > docSummarySampledFiles && i%(len(files)/docSummarySampledFiles) != 0 {
+			continue
+		}
+		if len(excerpts) == docSummarySampledFiles {
+			continue
+		}
+		// The files that fit in a chunk are not chunked, their ID is their
+		// path.
+		chunk, err := coll.GetByID(ctx, f)
+		if err != nil {
+			chunk, err = coll.GetByID(ctx, f+"-chunk-0")
+		}
+		if err != nil {
+			continue
+		}
+		content, _ := splitChunkHeader(chunk.Content, chunk.Metadata)
+		excerpts = append(excerpts, rel+": "+excerpt(content, docSummaryExcerptRunes))
+	}
+
+	summary, err := summarizeDocument(ctx, r.genTitleLLM, doc.Name, paths, excerpts)
+	if err != nil {
+		return "", nil, fmt.Errorf("error summarizing the document: %w", err)
+	}
+	embedding, err := r.embedder.embeddingFunc()(ctx, summary)
+	if err != nil {
+		return "", nil, fmt.Errorf("error embedding the summary: %w", err)
+	}
+
+	return summary, embedding, nil
+}
+
+// routeDocuments returns the documents to search for the question, the ones
+// whose summary is about as similar to the question as the best one. The
+// documents without a summary embedded like the question are always searched.
+func routeDocuments(queryEmbedding []float32, documents []document) ([]document, []document) {
+	similarities := make(map[int]float64)
+	best := math.Inf(-1)
+	for _, d := range documents {
+		if len(d.SummaryEmbedding) == 0 || len(d.SummaryEmbedding) != len(queryEmbedding) {
+			continue
+		}
+		s := cosineSimilarity(queryEmbedding, d.SummaryEmbedding)
+		similarities[d.ID] = s
+		best = max(best, s)
+	}
+	if len(similarities) < 2 {
+		return documents, nil
+	}
+
+	var searched, skipped []document
+	for _, d := range documents {
+		if s, ok := similarities[d.ID]; ok && s < best-routingMargin {
+			skipped = append(skipped, d)
+			continue
+		}
+		searched = append(searched, d)
+	}
+	return searched, skipped
+}
+
+func cosineSimilarity(a, b []float32) float64 {
+	if len(a) != len(b) {
+		return 0
+	}
+	var dot, normA, normB float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		normA += float64(a[i]) * float64(a[i])
+		normB += float64(b[i]) * float64(b[i])
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(normA) * math.Sqrt(normB))
+}
+
+// documentNames returns the names of the documents.
+func documentNames(documents []document) []string {
+	names := make([]string, len(documents))
+	for i, d := range documents {
+		names[i] = d.Name
+	}
+	return names
+}
@@ -2,10 +2,12 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"os"
 	"slices"
+	"strconv"
 	"strings"
 	"time"
 
@@ -19,20 +21,147 @@ import (
 )
 
 type document struct {
-	ID               int       `json:"id"`
-	Name             string    `json:"name"`
-	Path             string    `json:"path"`
-	ScannedFileCount int       `json:"scannedFileCount"`
-	LastScanTime     time.Time `json:"lastScanTime"`
+	ID               int    `json:"id"`
+	Name             string `json:"name"`
+	Path             string `json:"path"`
+	ScannedFileCount int    `json:"scannedFileCount"`
+	// Source is documentSourceURL for a website, whose start URL is the path,
+	// or a folder or a file otherwise. A website is crawled up to the
+	// CrawlDepth links from its URL and MaxPages pages.
+	Source       string    `json:"source,omitempty"`
+	CrawlDepth   *int      `json:"crawlDepth,omitempty"`
+	MaxPages     int       `json:"maxPages,omitempty"`
+	LastScanTime time.Time `json:"lastScanTime"`
+	// NewestFileTime is the modification time of the newest file of the last
+	// scan.
+	NewestFileTime time.Time `json:"newestFileTime,omitempty"`
+	// RescanInterval is rescanHourly, rescanDaily or rescanWeekly when the
+	// document is rescanned automatically that long after its last scan.
+	RescanInterval string `json:"rescanInterval,omitempty"`
+	// The embedder of the last scan, the questions must be embedded by the same
+	// model for the retrieval to work.
+	EmbedderProvider    string `json:"embedderProvider,omitempty"`
+	EmbedderModel       string `json:"embedderModel,omitempty"`
+	EmbeddingDimensions int    `json:"embeddingDimensions,omitempty"`
+	// ChunkSize, ChunkOverlap, MinChunkChars and TableRowsPerChunk are the
+	// chunk settings of the last scan.
+	ChunkSize         int `json:"chunkSize,omitempty"`
+	ChunkOverlap      int `json:"chunkOverlap,omitempty"`
+	MinChunkChars     int `json:"minChunkChars,omitempty"`
+	TableRowsPerChunk int `json:"tableRowsPerChunk,omitempty"`
+	// FailedFiles are the files the last scan failed to read, with their
+	// error.
+	FailedFiles []string `json:"failedFiles,omitempty"`
+	// SimilarityThreshold and ResultsCount override the RAG settings for this
+	// document when they are set.
+	SimilarityThreshold *float32 `json:"similarityThreshold,omitempty"`
+	ResultsCount        int      `json:"resultsCount,omitempty"`
+	// OCR reads the text of the images of the document with the OCR backend of
+	// the RAG settings, they are skipped otherwise.
+	OCR bool `json:"ocr,omitempty"`
+	// Transcribe transcribes the recordings of the document with the
+	// transcription API of the RAG settings, they are skipped otherwise.
+	Transcribe bool `json:"transcribe,omitempty"`
+	// Watch syncs the changes of the files of the document while the app is
+	// running, a folder or a file.
+	Watch bool `json:"watch,omitempty"`
+	// IncludeIgnored scans the files matched by the .gitignore files of the
+	// document, they are skipped otherwise.
+	IncludeIgnored bool `json:"includeIgnored,omitempty"`
+	// IncludeHidden scans the hidden files and the skipped directories of the
+	// RAG settings, they are skipped otherwise.
+	IncludeHidden bool `json:"includeHidden,omitempty"`
+	// FollowSymlinks walks the directories linked from the document, the
+	// links to them are skipped otherwise.
+	FollowSymlinks bool `json:"followSymlinks,omitempty"`
+	// ScanArchives scans the files inside the zip and the gzipped tar archives
+	// of the document, the archives are skipped as binary files otherwise.
+	ScanArchives bool `json:"scanArchives,omitempty"`
+	// IncludePatterns and ExcludePatterns are the glob patterns of the paths
+	// of the files scanned, relative to the document.
+	IncludePatterns []string `json:"includePatterns,omitempty"`
+	ExcludePatterns []string `json:"excludePatterns,omitempty"`
+	// Summary is about the files of the last scan, the questions are routed to
+	// the documents whose SummaryEmbedding is similar to them.
+	Summary          string    `json:"summary,omitempty"`
+	SummaryEmbedding []float32 `json:"summaryEmbedding,omitempty"`
+
+	// rescanStatus is the state of the automatic rescan of the document for
+	// the documents list, rescanFailedTime delays the next one after a failure.
+	rescanStatus     string
+	rescanFailedTime time.Time
+	// changed is set when the files of the watched document changed since its
+	// last scan.
+	changed bool
+	// stale is set when the documents list found files modified after the
+	// last scan.
+	stale bool
 }
 
+// embedderMismatchError is returned when a document was embedded by another
+// embedder than the one used for the questions.
+type embedderMismatchError struct {
+	document   string
+	model      string
+	current    string
+	dimensions int
+	// queryDimensions is set when the models match but the dimensions don't,
+	// e.g. when the model was replaced on the server.
+	queryDimensions int
+}
+
+const (
+	scanModeIncremental = "incremental"
+	scanModeFull        = "full"
+	scanModeBack        = "back"
+)
+
+const (
+	// embedderProviderKey and embedderModelKey record the embedder of the
+	// chunks in their metadata and in the metadata of their collection, which
+	// chromem-go doesn't give back.
+	embedderProviderKey = "embedderProvider"
+	embedderModelKey    = "embedderModel"
+)
+
 type documentScanLogMsg struct {
+	// content is a line of the scan log, it's empty for the progress updates.
 	content string
 	err     error
 
+	// filesRead of filesTotal files are read, then chunksEmbedded of
+	// chunksTotal chunks are embedded, for the progress bar.
+	filesRead      int
+	filesTotal     int
+	chunksEmbedded int
+	chunksTotal    int
+
 	done             bool
 	scannedFileCount int
 	lastScanTime     time.Time
+	newestFileTime   time.Time
+
+	embedderProvider    string
+	embedderModel       string
+	embeddingDimensions int
+	chunkSize           int
+	chunkOverlap        int
+	minChunkChars       int
+	tableRowsPerChunk   int
+
+	// fileStates are the states of the scanned files by their path,
+	// clearFileStates is set when the ones of the previous scan are no longer
+	// valid.
+	fileStates      map[string]fileState
+	clearFileStates bool
+	// failedFiles are the files the scan failed to read, with their error.
+	failedFiles []string
+	// discarded is set when the collection written by a cancelled scan was
+	// deleted, the document is not scanned anymore.
+	discarded bool
+
+	summary          string
+	summaryEmbedding []float32
 }
 
 func (m mainModel) initDocuments() (mainModel, error) {
@@ -56,6 +185,8 @@ func (m mainModel) initDocuments() (mainModel, error) {
 		return []key.Binding{
 			m.keymap.new,
 			m.keymap.delete,
+			m.keymap.rescan,
+			m.keymap.rescanAffected,
 			m.keymap.pick,
 			m.keymap.escape,
 		}
@@ -90,6 +221,10 @@ func (m mainModel) handleDocumentsEvents(msg tea.Msg) (mainModel, tea.Cmd) {
 			return m.selectDocument(m.documentsList.Index())
 		case key.Matches(msg, m.keymap.delete):
 			return m.deleteDocument(m.documentsList.Index()), nil
+		case key.Matches(msg, m.keymap.rescan):
+			return m.rescanDocument(m.documentsList.Index())
+		case key.Matches(msg, m.keymap.rescanAffected):
+			return m.rescanAffectedDocuments()
 		}
 	}
 
@@ -144,6 +279,8 @@ func (m mainModel) selectDocument(index int) (mainModel, tea.Cmd) {
 func (m mainModel) deleteDocument(index int) mainModel {
 	document := m.documents[index]
 
+	m = m.cancelAutoScan(document.ID)
+	m.unwatchDocument(document.ID)
 	if err := deleteDocument(m.db, document.ID); err != nil {
 		m.err = fmt.Errorf("error deleting document: %w", err)
 		slog.Error(m.err.Error())
@@ -156,6 +293,25 @@ func (m mainModel) deleteDocument(index int) mainModel {
 	return m
 }
 
+// rescanDocument scans the document again with its saved path, without going
+// through its form.
+func (m mainModel) rescanDocument(index int) (mainModel, tea.Cmd) {
+	if index < 0 || index >= len(m.documents) {
+		return m, nil
+	}
+	if m.documents[index].Path == "" {
+		m.err = fmt.Errorf("document %s has no path, select it to set one", m.documents[index].Name)
+		return m.updateDocumentsSize(), nil
+	}
+	if m.rag == nil {
+		m.err = errors.New("the LLMs are not configured, set them up in the options before scanning")
+		return m.updateDocumentsSize(), nil
+	}
+
+	m.selectedDocumentIndex = index
+	return m.setViewState(viewStateDocumentScan).scanDocument(false), nil
+}
+
 func (m mainModel) newDocumentForm() (mainModel, tea.Cmd) {
 	homeDir, err := os.UserHomeDir()
 	if err != nil {
@@ -165,11 +321,53 @@ func (m mainModel) newDocumentForm() (mainModel, tea.Cmd) {
 	}
 
 	selectedDocument := m.documents[m.selectedDocumentIndex]
-	if selectedDocument.Path == "" {
-		selectedDocument.Path = homeDir
-	}
 	name := selectedDocument.Name
-	path := selectedDocument.Path
+	source := documentSourceFolder
+	path, pageURL := selectedDocument.Path, ""
+	if selectedDocument.isURL() {
+		source = documentSourceURL
+		path, pageURL = "", selectedDocument.Path
+	}
+	if path == "" {
+		path = homeDir
+	}
+	rescanInterval := selectedDocument.RescanInterval
+	crawlDepth := strconv.Itoa(selectedDocument.crawlDepth())
+	maxPages := strconv.Itoa(selectedDocument.maxPages())
+	threshold := ""
+	if selectedDocument.SimilarityThreshold != nil {
+		threshold = strconv.FormatFloat(float64(*selectedDocument.SimilarityThreshold), 'g', -1, 32)
+	}
+	resultsCount := ""
+	if selectedDocument.ResultsCount > 0 {
+		resultsCount = strconv.Itoa(selectedDocument.ResultsCount)
+	}
+	ocr := selectedDocument.OCR
+	transcribe := selectedDocument.Transcribe
+	watch := selectedDocument.Watch
+	includeIgnored := selectedDocument.IncludeIgnored
+	skipHidden := !selectedDocument.IncludeHidden
+	followSymlinks := selectedDocument.FollowSymlinks
+	scanArchives := selectedDocument.ScanArchives
+	includePatterns := strings.Join(selectedDocument.IncludePatterns, ", ")
+	excludePatterns := strings.Join(selectedDocument.ExcludePatterns, ", ")
+
+	// A rescan only embeds the changed files by default, the first scan embeds
+	// them all anyway.
+	scanMode := scanModeIncremental
+	scanDescription := "Only the new and changed files are embedded by an incremental rescan."
+	scanOptions := []huh.Option[string]{
+		huh.NewOption("Incremental rescan", scanModeIncremental),
+		huh.NewOption("Full rescan", scanModeFull),
+		huh.NewOption("Back", scanModeBack),
+	}
+	if selectedDocument.ScannedFileCount == 0 {
+		scanDescription = "Are you sure you want to scan this document?"
+		scanOptions = []huh.Option[string]{
+			huh.NewOption("Scan", scanModeIncremental),
+			huh.NewOption("Back", scanModeBack),
+		}
+	}
 
 	m.documentForm = huh.NewForm(
 		huh.NewGroup(
@@ -179,21 +377,179 @@ func (m mainModel) newDocumentForm() (mainModel, tea.Cmd) {
 				Description("Enter the name of the document.").
 				Placeholder("Document Name").
 				Value(&name),
+			huh.NewSelect[string]().
+				Key("documentSource").
+				Title("Source").
+				Description("Scan a folder or a file, or crawl a website.").
+				Options(
+					huh.NewOption("Folder", documentSourceFolder),
+					huh.NewOption("URL", documentSourceURL),
+				).
+				Value(&source),
+		),
+		huh.NewGroup(
+			huh.NewInput().
+				Key("documentURL").
+				Title("Document URL").
+				Description("The page the website is crawled from, only the links to the same site are followed.").
+				Placeholder("https://example.com/docs/").
+				Validate(func(s string) error {
+					_, err := parseDocumentURL(s)
+					return err
+				}).
+				Value(&pageURL),
+			huh.NewInput().
+				Key("documentCrawlDepth").
+				Title("Crawl Depth").
+				Description("The links followed from the URL, 0 only scans its page.").
+				Validate(func(s string) error {
+					_, err := parseCrawlDepth(s)
+					return err
+				}).
+				Value(&crawlDepth),
+			huh.NewInput().
+				Key("documentMaxPages").
+				Title("Page Limit").
+				Description("The pages over this number are not crawled.").
+				Validate(func(s string) error {
+					_, err := parseCrawlPages(s)
+					return err
+				}).
+				Value(&maxPages),
+		).WithHideFunc(func() bool { return source != documentSourceURL }),
+		huh.NewGroup(
 			newFormFilePicker(huh.NewFilePicker().
 				Key("documentPath").
 				Title("Document Path").
-				Description("Select the path of the document.").
-				FileAllowed(false).
+				Description("Select the directory of the document, or a single file.").
+				FileAllowed(true).
 				DirAllowed(true).
-				CurrentDirectory(selectedDocument.Path).
+				CurrentDirectory(path).
 				Value(&path),
 				m.keymap.formKeymap.FilePicker),
 			huh.NewConfirm().
+				Key("documentOCR").
+				Title("OCR Images").
+				Description(fmt.Sprintf("Read the text of the .png, .jpg and .tiff images of this document with %s. "+
+					"It's slow, the images are skipped when it's off.", ocrBackendName(m.ragSettings.ocrBackend()))).
+				Affirmative("Yes").
+				Negative("No").
+				Value(&ocr),
+			huh.NewConfirm().
+				Key("documentTranscribe").
+				Title("Transcribe Audio").
+				Description(fmt.Sprintf("Transcribe the .mp3, .wav and .m4a recordings of this document up to %d MB "+
+					"with the transcription API of the RAG settings. The recordings are skipped when it's off.",
+					m.ragSettings.maxAudioMB())).
+				Affirmative("Yes").
+				Negative("No").
+				Value(&transcribe),
+			huh.NewConfirm().
+				Key("documentWatch").
+				Title("Watch Changes").
+				Description("Sync the new, changed and deleted files of this document while the app is running, "+
+					"only the changed files are embedded again.").
+				Affirmative("Yes").
+				Negative("No").
+				Value(&watch),
+			huh.NewConfirm().
+				Key("documentIncludeIgnored").
+				Title("Include Ignored Files").
+				Description("Scan the files matched by the .gitignore files of this document, like the build outputs. "+
+					"They are skipped when it's off.").
+				Affirmative("Yes").
+				Negative("No").
+				Value(&includeIgnored),
+			huh.NewConfirm().
+				Key("documentSkipHidden").
+				Title("Skip Hidden Files").
+				Description(fmt.Sprintf("Skip the hidden files and the %s directories of this document. "+
+					"The directories are listed in the RAG settings.", strings.Join(m.ragSettings.skippedDirs(), ", "))).
+				Affirmative("Yes").
+				Negative("No").
+				Value(&skipHidden),
+			huh.NewConfirm().
+				Key("documentFollowSymlinks").
+				Title("Follow Symlinks").
+				Description("Scan the directories linked from this document, each one once. "+
+					"The links to the directories are skipped when it's off, the links to the files are always read.").
+				Affirmative("Yes").
+				Negative("No").
+				Value(&followSymlinks),
+			huh.NewConfirm().
+				Key("documentScanArchives").
+				Title("Index Archives").
+				Description("Scan the files inside the .zip, .tar.gz and .tgz archives of this document, "+
+					"without the archives inside them. The archive size limit is in the RAG settings.").
+				Affirmative("Yes").
+				Negative("No").
+				Value(&scanArchives),
+			huh.NewInput().
+				Key("documentIncludePatterns").
+				Title("Include Patterns").
+				Description("Only scan the files matching one of these comma-separated globs, like docs/**/*.md. "+
+					"A glob without a slash matches the file names. Leave it empty to scan all the files.").
+				Validate(func(s string) error {
+					_, err := parseGlobPatterns(s)
+					return err
+				}).
+				Value(&includePatterns),
+			huh.NewInput().
+				Key("documentExcludePatterns").
+				Title("Exclude Patterns").
+				Description("Skip the files matching one of these comma-separated globs, like **/testdata/**.").
+				Validate(func(s string) error {
+					_, err := parseGlobPatterns(s)
+					return err
+				}).
+				Value(&excludePatterns),
+		).WithHideFunc(func() bool { return source == documentSourceURL }),
+		huh.NewGroup(
+			huh.NewInput().
+				Key("documentSimilarityThreshold").
+				Title("Similarity Threshold").
+				Description("Chunks of this document less similar to the question than this, from 0 to 1, are left out. "+
+					"Leave it empty to use the RAG settings.").
+				Placeholder(strconv.FormatFloat(float64(m.ragSettings.SimilarityThreshold), 'g', -1, 32)).
+				Validate(func(s string) error {
+					if strings.TrimSpace(s) == "" {
+						return nil
+					}
+					_, err := parseSimilarityThreshold(s)
+					return err
+				}).
+				Value(&threshold),
+			huh.NewInput().
+				Key("documentResultsCount").
+				Title("Results Count").
+				Description("Chunks retrieved from this document for a question. Leave it empty to use the RAG settings.").
+				Placeholder(strconv.Itoa(m.ragSettings.ResultsCount)).
+				Validate(func(s string) error {
+					if strings.TrimSpace(s) == "" {
+						return nil
+					}
+					_, err := parseRAGResultsCount(s)
+					return err
+				}).
+				Value(&resultsCount),
+			huh.NewSelect[string]().
+				Key("documentRescanInterval").
+				Title("Automatic Rescan").
+				Description("Rescan this document in the background that long after its last scan, "+
+					"while the app is running.").
+				Options(
+					huh.NewOption("Off", ""),
+					huh.NewOption("Hourly", rescanHourly),
+					huh.NewOption("Daily", rescanDaily),
+					huh.NewOption("Weekly", rescanWeekly),
+				).
+				Value(&rescanInterval),
+			huh.NewSelect[string]().
 				Key("documentConfirm").
 				Title("Scan").
-				Description("Are you sure you want to scan this document?").
-				Affirmative("Yes").
-				Negative("Back"),
+				Description(scanDescription).
+				Options(scanOptions...).
+				Value(&scanMode),
 		),
 	).
 		WithWidth(m.formWidth).
@@ -225,13 +581,37 @@ func (m mainModel) handleDocumentFormEvents(msg tea.Msg) (mainModel, tea.Cmd) {
 		return m, cmd
 	}
 
-	if !m.documentForm.GetBool("documentConfirm") {
+	scanMode := m.documentForm.GetString("documentConfirm")
+	if scanMode == scanModeBack {
 		return m.setViewState(viewStateDocuments), nil
 	}
 
 	selectedDocument := m.documents[m.selectedDocumentIndex]
 	selectedDocument.Name = m.documentForm.GetString("documentName")
+	selectedDocument.Source = m.documentForm.GetString("documentSource")
 	selectedDocument.Path = m.documentForm.GetString("documentPath")
+	if selectedDocument.isURL() {
+		selectedDocument.Path, _ = parseDocumentURL(m.documentForm.GetString("documentURL"))
+		depth, _ := parseCrawlDepth(m.documentForm.GetString("documentCrawlDepth"))
+		selectedDocument.CrawlDepth = &depth
+		selectedDocument.MaxPages, _ = parseCrawlPages(m.documentForm.GetString("documentMaxPages"))
+	}
+	// The values are validated by the form, an empty one is not set.
+	selectedDocument.SimilarityThreshold = nil
+	if threshold, err := parseSimilarityThreshold(m.documentForm.GetString("documentSimilarityThreshold")); err == nil {
+		selectedDocument.SimilarityThreshold = &threshold
+	}
+	selectedDocument.ResultsCount, _ = parseRAGResultsCount(m.documentForm.GetString("documentResultsCount"))
+	selectedDocument.RescanInterval = m.documentForm.GetString("documentRescanInterval")
+	selectedDocument.OCR = m.documentForm.GetBool("documentOCR")
+	selectedDocument.Transcribe = m.documentForm.GetBool("documentTranscribe")
+	selectedDocument.Watch = m.documentForm.GetBool("documentWatch") && !selectedDocument.isURL()
+	selectedDocument.IncludeIgnored = m.documentForm.GetBool("documentIncludeIgnored")
+	selectedDocument.IncludeHidden = !m.documentForm.GetBool("documentSkipHidden")
+	selectedDocument.FollowSymlinks = m.documentForm.GetBool("documentFollowSymlinks")
+	selectedDocument.ScanArchives = m.documentForm.GetBool("documentScanArchives")
+	selectedDocument.IncludePatterns, _ = parseGlobPatterns(m.documentForm.GetString("documentIncludePatterns"))
+	selectedDocument.ExcludePatterns, _ = parseGlobPatterns(m.documentForm.GetString("documentExcludePatterns"))
 
 	if err := saveDocument(m.db, &selectedDocument); err != nil {
 		m.err = fmt.Errorf("error creating new document: %w", err)
@@ -241,8 +621,9 @@ func (m mainModel) handleDocumentFormEvents(msg tea.Msg) (mainModel, tea.Cmd) {
 
 	m.documents[m.selectedDocumentIndex] = selectedDocument
 	m.documentsList.SetItem(m.selectedDocumentIndex, selectedDocument)
+	m = m.updateWatcher(m.selectedDocumentIndex)
 
-	return m.setViewState(viewStateDocumentScan).scanDocument(), nil
+	return m.setViewState(viewStateDocumentScan).scanDocument(scanMode == scanModeFull), nil
 }
 
 func (m mainModel) documentFormView() string {
@@ -264,6 +645,9 @@ func (m mainModel) initDocumentScan() mainModel {
 	m.documentScanViewport.KeyMap = m.keymap.viewportKeymap
 
 	m.documentScanProgress = make(chan documentScanLogMsg)
+	m.autoScanProgress = make(chan documentScanLogMsg)
+	m.watchChanges = make(chan int)
+	m.watchers = make(map[int]*documentWatcher)
 
 	return m
 }
@@ -271,7 +655,8 @@ func (m mainModel) initDocumentScan() mainModel {
 func (m mainModel) updateDocumentScanSize() mainModel {
 	titleHeight := lipgloss.Height(titleStyle.Render(""))
 	helpHeight := lipgloss.Height(m.helpModel.View(m.keymap))
-	height := m.height - logoHeight() - titleHeight - helpHeight
+	progressHeight := lipgloss.Height(m.documentScanStatus.View())
+	height := m.height - logoHeight() - titleHeight - progressHeight - helpHeight
 
 	if m.err != nil {
 		height -= errHeight(m.width, m.err)
@@ -322,22 +707,40 @@ func (m mainModel) handleDocumentScanEvents(msg tea.Msg) (mainModel, tea.Cmd) {
 }
 
 func (m mainModel) documentScanView() string {
-	selectedDocument := m.documents[m.selectedDocumentIndex]
 	return lipgloss.JoinVertical(lipgloss.Left,
 		logoView(),
-		titleStyle.Render(fmt.Sprintf("Scanning %s", selectedDocument.Path)),
+		titleStyle.Render(m.documentScanTitle()),
+		m.documentScanStatus.View(),
 		m.documentScanViewport.View(),
 		m.helpModel.View(m.keymap),
 	)
 }
 
 func (m mainModel) handleScanLogMsg(msg documentScanLogMsg) mainModel {
+	m.documentScanStatus = m.documentScanStatus.update(msg)
+	if msg.content == "" && msg.err == nil && !msg.done {
+		return m
+	}
 	m.documentScanLogs = append(m.documentScanLogs, msg.content)
 
+	if msg.err != nil || msg.done {
+		m.documentScanDocumentID = 0
+	}
+	if msg.discarded {
+		m = m.discardDocumentScan(m.selectedDocumentIndex)
+	}
+	if msg.clearFileStates {
+		if err := saveFileStates(m.db, m.documents[m.selectedDocumentIndex].ID, nil); err != nil {
+			m.err = fmt.Errorf("error deleting file states: %w", err)
+			slog.Error(m.err.Error())
+		}
+	}
+
 	if msg.err != nil {
 		m.err = msg.err
 		slog.Error(m.err.Error())
 		m.documentScanCancelFunc = nil
+		m = m.stopScanQueue()
 
 		m.documentScanViewport.SetContent(strings.Join(m.documentScanLogs, "\n"))
 		m.documentScanViewport.GotoBottom()
@@ -346,19 +749,24 @@ func (m mainModel) handleScanLogMsg(msg documentScanLogMsg) mainModel {
 	}
 
 	if msg.done {
-		m.documents[m.selectedDocumentIndex].ScannedFileCount = msg.scannedFileCount
-		m.documents[m.selectedDocumentIndex].LastScanTime = msg.lastScanTime
+		m.documents[m.selectedDocumentIndex] = m.documents[m.selectedDocumentIndex].withScan(msg)
 		doc := m.documents[m.selectedDocumentIndex]
 		if err := saveDocument(m.db, &doc); err != nil {
 			m.err = fmt.Errorf("error saving knowledge: %w", err)
 			slog.Error(m.err.Error())
-			return m
+			return m.stopScanQueue()
+		}
+		if err := saveFileStates(m.db, doc.ID, msg.fileStates); err != nil {
+			m.err = fmt.Errorf("error saving file states: %w", err)
+			slog.Error(m.err.Error())
+			return m.stopScanQueue()
 		}
 
 		m.documentScanLogs = append(m.documentScanLogs,
 			fmt.Sprintf("Scan complete in %s", time.Since(m.documentScanStartTime)))
 		m.documentsList.SetItem(m.selectedDocumentIndex, doc)
 		m.documentScanCancelFunc = nil
+		m = m.scanNextQueued()
 	}
 
 	m.documentScanViewport.SetContent(strings.Join(m.documentScanLogs, "\n"))
@@ -367,15 +775,89 @@ func (m mainModel) handleScanLogMsg(msg documentScanLogMsg) mainModel {
 	return m
 }
 
-func (m mainModel) scanDocument() mainModel {
+// withScan returns the document with the results of its completed scan.
+func (d document) withScan(msg documentScanLogMsg) document {
+	d.ScannedFileCount = msg.scannedFileCount
+	d.LastScanTime = msg.lastScanTime
+	d.NewestFileTime = msg.newestFileTime
+	d.EmbedderProvider = msg.embedderProvider
+	d.EmbedderModel = msg.embedderModel
+	d.EmbeddingDimensions = msg.embeddingDimensions
+	d.ChunkSize = msg.chunkSize
+	d.ChunkOverlap = msg.chunkOverlap
+	d.MinChunkChars = msg.minChunkChars
+	d.TableRowsPerChunk = msg.tableRowsPerChunk
+	d.FailedFiles = msg.failedFiles
+	d.Summary = msg.summary
+	d.SummaryEmbedding = msg.summaryEmbedding
+	d.rescanStatus, d.rescanFailedTime = "", time.Time{}
+	d.stale = false
+	return d
+}
+
+// discardDocumentScan resets the document once the partial collection of its
+// cancelled scan was deleted, so it's not listed as scanned.
+func (m mainModel) discardDocumentScan(index int) mainModel {
+	doc := &m.documents[index]
+	doc.ScannedFileCount = 0
+	doc.LastScanTime, doc.NewestFileTime = time.Time{}, time.Time{}
+	doc.EmbedderProvider, doc.EmbedderModel, doc.EmbeddingDimensions = "", "", 0
+	doc.Summary, doc.SummaryEmbedding = "", nil
+	doc.FailedFiles = nil
+	if err := saveDocument(m.db, doc); err != nil {
+		m.err = fmt.Errorf("error saving the document: %w", err)
+		slog.Error(m.err.Error())
+	}
+	if err := saveFileStates(m.db, doc.ID, nil); err != nil {
+		m.err = fmt.Errorf("error deleting file states: %w", err)
+		slog.Error(m.err.Error())
+	}
+	m.documentsList.SetItem(index, *doc)
+	return m
+}
+
+// scanDocument scans the selected document, a full scan embeds all its files
+// again instead of only the new and changed ones.
+func (m mainModel) scanDocument(full bool) mainModel {
 	m.err = nil
 	m.documentScanStartTime = time.Now()
 	m.documentScanLogs = make([]string, 0)
+	m.documentScanStatus = scanProgress{filesStart: m.documentScanStartTime}
+
+	doc := m.documents[m.selectedDocumentIndex]
+	// A document is only scanned by one scan at a time, the cancelled scans
+	// stop once they discarded their partial index.
+	if doc.ID == m.autoScanDocumentID || doc.ID == m.documentScanDocumentID {
+		m.err = fmt.Errorf("%s is being scanned, scan it again once it's done", doc.Name)
+		if doc.ID == m.autoScanDocumentID {
+			m.err = fmt.Errorf("%s is being rescanned automatically, scan it again once it's done", doc.Name)
+		}
+		m.documentScanLogs = append(m.documentScanLogs, m.err.Error())
+		return m.stopScanQueue().updateDocumentScanSize()
+	}
+	var fileStates map[string]fileState
+	if full {
+		// The collection is replaced, so are the states of its files.
+		if err := saveFileStates(m.db, doc.ID, nil); err != nil {
+			m.err = fmt.Errorf("error deleting file states: %w", err)
+			slog.Error(m.err.Error())
+			return m.updateDocumentScanSize()
+		}
+	} else {
+		var err error
+		fileStates, err = loadFileStates(m.db, doc.ID)
+		if err != nil {
+			// The files are all embedded again.
+			slog.Warn("Failed to load the file states", "error", err)
+			fileStates = nil
+		}
+	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	m.documentScanCancelFunc = cancel
+	m.documentScanDocumentID = doc.ID
 
-	go m.rag.scanDocument(ctx, m.documents[m.selectedDocumentIndex], m.documentScanProgress)
+	go m.rag.scanDocument(ctx, doc, fileStates, m.documentScanProgress)
 
 	return m.updateDocumentScanSize()
 }
@@ -391,9 +873,64 @@ func (d document) Title() string {
 func (d document) Description() string {
 	lst := "Not scanned yet"
 	if !d.LastScanTime.IsZero() {
-		lst = fmt.Sprintf("Last scan time: %s", d.LastScanTime.Format(time.RFC1123))
+		lst = fmt.Sprintf("Last scan: %s", d.LastScanTime.Format(time.RFC1123))
+		if d.Watch {
+			lst = fmt.Sprintf("Watching, last synced: %s", d.LastScanTime.Format(time.RFC1123))
+		}
+		if !d.NewestFileTime.IsZero() {
+			lst += fmt.Sprintf("; newest file: %s", d.NewestFileTime.Format(time.RFC1123))
+		}
+		if d.stale {
+			lst += "; files changed since, rescan it"
+		}
+	} else if d.Watch {
+		lst = "Watching, not scanned yet"
+	}
+	files := formatFileCount(d.ScannedFileCount)
+	if len(d.FailedFiles) > 0 {
+		files = fmt.Sprintf("%s indexed, %s failed", formatCount(d.ScannedFileCount), formatCount(len(d.FailedFiles)))
+	}
+	desc := fmt.Sprintf("%s; %s", files, lst)
+	if d.rescanStatus != "" {
+		desc += "; " + d.rescanStatus
+	}
+	if d.RescanInterval != "" {
+		desc += "; Rescanned " + d.RescanInterval
+	}
+	if d.SimilarityThreshold != nil {
+		desc += fmt.Sprintf("; Threshold: %g", *d.SimilarityThreshold)
+	}
+	if d.ResultsCount > 0 {
+		desc += fmt.Sprintf("; Results: %d", d.ResultsCount)
+	}
+	if d.isURL() {
+		desc += fmt.Sprintf("; Crawl depth: %d; Page limit: %d", d.crawlDepth(), d.maxPages())
+	}
+	if d.OCR {
+		desc += "; OCR"
+	}
+	if d.Transcribe {
+		desc += "; Transcribed"
+	}
+	if d.IncludeIgnored {
+		desc += "; Ignored files included"
+	}
+	if d.IncludeHidden {
+		desc += "; Hidden files included"
+	}
+	if d.FollowSymlinks {
+		desc += "; Symlinks followed"
+	}
+	if d.ScanArchives {
+		desc += "; Archives indexed"
 	}
-	return fmt.Sprintf("File count: %d; %s", d.ScannedFileCount, lst)
+	if len(d.IncludePatterns) > 0 {
+		desc += "; Include: " + strings.Join(d.IncludePatterns, ", ")
+	}
+	if len(d.ExcludePatterns) > 0 {
+		desc += "; Exclude: " + strings.Join(d.ExcludePatterns, ", ")
+	}
+	return desc
 }
 
 func (d document) FilterValue() string {
@@ -404,23 +941,135 @@ func (d document) vectorDBCollectionName() string {
 	return fmt.Sprintf("doc-%d", d.ID)
 }
 
-func (d document) retrieve(ctx context.Context, vectordb *chromem.DB, key string, embedFunc chromem.EmbeddingFunc) ([]chromem.Result, error) {
-	var res []chromem.Result
+// checkEmbedder returns an embedderMismatchError when the document was embedded
+// by another embedder than the given one, whose embeddings have the given
+// dimensions. The documents scanned before the embedder was recorded are not
+// checked.
+func (d document) checkEmbedder(setting llmSetting, dimensions int) error {
+	if d.EmbedderProvider == "" && d.EmbedderModel == "" {
+		return nil
+	}
+
+	mismatch := embedderMismatchError{
+		document:   d.Name,
+		model:      embedderName(d.EmbedderProvider, d.EmbedderModel),
+		current:    embedderName(setting.Provider, setting.Model),
+		dimensions: d.EmbeddingDimensions,
+	}
+	if d.EmbedderProvider != setting.Provider || d.EmbedderModel != setting.Model {
+		return mismatch
+	}
+	if d.EmbeddingDimensions > 0 && d.EmbeddingDimensions != dimensions {
+		mismatch.queryDimensions = dimensions
+		return mismatch
+	}
+	return nil
+}
+
+// checkStoredEmbedder returns an embedderMismatchError when the chunk of the
+// document was embedded by another embedder than the given one. The document
+// may be out of date with its collection, e.g. after a restored backup, the
+// chunks tell which embedder they were stored with. The chunks stored before
+// the embedder was recorded with them are checked by checkEmbedder.
+func (d document) checkStoredEmbedder(chunkMetadata map[string]string, setting llmSetting) error {
+	provider, model := chunkMetadata[embedderProviderKey], chunkMetadata[embedderModelKey]
+	if provider == "" && model == "" {
+		return nil
+	}
+	if provider != setting.Provider || model != setting.Model {
+		return embedderMismatchError{
+			document: d.Name,
+			model:    embedderName(provider, model),
+			current:  embedderName(setting.Provider, setting.Model),
+		}
+	}
+	return nil
+}
+
+// retrievalSettings returns the settings with the retrieval settings of the
+// document in place of the ones it sets.
+func (d document) retrievalSettings(settings ragSettings) ragSettings {
+	if d.SimilarityThreshold != nil {
+		settings.SimilarityThreshold = *d.SimilarityThreshold
+	}
+	if d.ResultsCount > 0 {
+		settings.ResultsCount = d.ResultsCount
+	}
+	return settings
+}
+
+// retrieve returns the chunks of the document most similar to the question,
+// and the ones among them below the similarity threshold.
+func (d document) retrieve(
+	ctx context.Context,
+	vectordb *chromem.DB,
+	queryEmbedding []float32,
+	embedderSetting llmSetting,
+	embedFunc chromem.EmbeddingFunc,
+	settings ragSettings,
+	filter retrievalFilter,
+) ([]chromem.Result, []chromem.Result, error) {
+	var res, rejected []chromem.Result
+
+	settings = d.retrievalSettings(settings)
+	if err := d.checkEmbedder(embedderSetting, len(queryEmbedding)); err != nil {
+		return nil, nil, err
+	}
 
 	collName := d.vectorDBCollectionName()
 	coll := vectordb.GetCollection(collName, embedFunc)
 	if coll == nil {
-		return nil, fmt.Errorf("failed to get vectordb collection %s", collName)
+		return nil, nil, fmt.Errorf("failed to get vectordb collection %s", collName)
 	}
-	docRes, err := coll.Query(ctx, key, ragResultsCount, nil, nil)
+	// chromem-go rejects more results than the chunks of the collection.
+	count := min(settings.ResultsCount, coll.Count())
+	if count == 0 {
+		return nil, nil, nil
+	}
+	// The path and the exclusions are filtered after the query, so all the
+	// chunks are ranked.
+	queryCount := count
+	if filter.afterQuery() {
+		queryCount = coll.Count()
+	}
+	docRes, err := coll.QueryEmbedding(ctx, queryEmbedding, queryCount, filter.where(), nil)
 	if err != nil {
-		return nil, fmt.Errorf("failed to query vectordb collection %s: %w", collName, err)
+		return nil, nil, fmt.Errorf("failed to query vectordb collection %s: %w", collName, err)
+	}
+	// The similarities are meaningless when the chunks were embedded by
+	// another model, all of them are stored by the same scan.
+	if len(docRes) > 0 {
+		if err := d.checkStoredEmbedder(docRes[0].Metadata, embedderSetting); err != nil {
+			return nil, nil, err
+		}
 	}
 	for _, r := range docRes {
-		if r.Similarity >= ragSimiliarityThreshold {
+		if !filter.matchesPath(r.Metadata) {
+			continue
+		}
+		if r.Similarity >= settings.SimilarityThreshold {
 			res = append(res, r)
+		} else {
+			rejected = append(rejected, r)
+		}
+		if len(res)+len(rejected) == count {
+			break
 		}
 	}
 
-	return res, nil
+	return res, rejected, nil
+}
+
+func (e embedderMismatchError) Error() string {
+	if e.queryDimensions > 0 {
+		return fmt.Sprintf("document '%s' needs rescanning (embedded with %d dimensions, %s now returns %d)",
+			e.document, e.dimensions, e.model, e.queryDimensions)
+	}
+	return fmt.Sprintf("document '%s' needs rescanning (embedded with %s, current embedder is %s)",
+		e.document, e.model, e.current)
+}
+
+// embedderName returns the display name of an embedding model.
+func embedderName(provider, model string) string {
+	return fmt.Sprintf("%s/%s", provider, model)
 }
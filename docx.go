@@ -0,0 +1,165 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// oleMagic starts the compound files, the password-protected documents are
+// encrypted in one as the old .doc documents.
+var oleMagic = []byte{0xD0, 0xCF, 0x11, 0xE0, 0xA1, 0xB1, 0x1A, 0xE1}
+
+// extractDOCX extracts the paragraphs of word/document.xml, a paragraph by
+// line. The paragraphs with a heading style or an outline level are markdown
+// headings, the list items are markdown list items and a table row is a line
+// with its cells separated by "|".
+func extractDOCX(data []byte) (extractedText, error) {
+	if bytes.HasPrefix(data, oleMagic) {
+		return extractedText{}, errors.New("the document is password-protected or not a .docx document")
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return extractedText{}, fmt.Errorf("error opening the document: %w", err)
+	}
+	f, err := zr.Open("word/document.xml")
+	if err != nil {
+		return extractedText{}, fmt.Errorf("error opening the document body: %w", err)
+	}
+	defer f.Close()
+
+	content, err := docxText(f)
+	if err != nil {
+		return extractedText{}, fmt.Errorf("error reading the document body: %w", err)
+	}
+
+	return extractedText{content: content, markdown: true}, nil
+}
+
+func docxText(r io.Reader) (string, error) {
+	var out, para, cell strings.Builder
+	var row []string
+	headingLevel, tableDepth := 0, 0
+	listItem, inText := false, false
+
+	d := xml.NewDecoder(r)
+	for {
+		tok, err := d.Token()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "p":
+				para.Reset()
+				headingLevel, listItem = 0, false
+			case "pStyle":
+				if level := docxHeadingLevel(docxVal(t)); level > 0 {
+					headingLevel = level
+				}
+			case "outlineLvl":
+				if n, err := strconv.Atoi(docxVal(t)); err == nil && n < 9 && headingLevel == 0 {
+					headingLevel = n + 1
+				}
+			case "numPr":
+				listItem = true
+			case "t":
+				inText = true
+			case "tab":
+				para.WriteString("\t")
+			case "br", "cr":
+				para.WriteString("\n")
+			case "tbl":
+				tableDepth++
+			case "tr":
+				if tableDepth == 1 {
+					row = row[:0]
+				}
+			case "tc":
+				if tableDepth == 1 {
+					cell.Reset()
+				}
+			}
+		case xml.CharData:
+			if inText {
+				para.Write(t)
+			}
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "t":
+				inText = false
+			case "p":
+				text := strings.TrimSpace(para.String())
+				if text == "" {
+					continue
+				}
+				if tableDepth > 0 {
+					if cell.Len() > 0 {
+						cell.WriteString(" ")
+					}
+					cell.WriteString(strings.Join(strings.Fields(text), " "))
+					continue
+				}
+
+				switch {
+				case headingLevel > 0:
+					out.WriteString(strings.Repeat("#", min(headingLevel, 6)) + " " + strings.Join(strings.Fields(text), " "))
+				case listItem:
+					out.WriteString("- " + text)
+				default:
+					out.WriteString(text)
+				}
+				out.WriteString("\n\n")
+			case "tc":
+				if tableDepth == 1 {
+					row = append(row, cell.String())
+				}
+			case "tr":
+				if tableDepth == 1 && strings.Join(row, "") != "" {
+					out.WriteString("| " + strings.Join(row, " | ") + " |\n")
+				}
+			case "tbl":
+				tableDepth--
+				if tableDepth == 0 {
+					out.WriteString("\n")
+				}
+			}
+		}
+	}
+
+	return strings.TrimSpace(out.String()), nil
+}
+
+// docxHeadingLevel returns the level of the built-in heading styles, "Title"
+// and "Heading1" to "Heading9", or 0.
+func docxHeadingLevel(style string) int {
+	style = strings.ToLower(strings.ReplaceAll(style, " ", ""))
+	if style == "title" {
+		return 1
+	}
+	n, err := strconv.Atoi(strings.TrimPrefix(style, "heading"))
+	if err != nil || !strings.HasPrefix(style, "heading") || n < 1 {
+		return 0
+	}
+	return n
+}
+
+func docxVal(t xml.StartElement) string {
+	for _, a := range t.Attr {
+		if a.Name.Local == "val" {
+			return a.Value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/charmbracelet/bubbles/key"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/huh"
+	"github.com/charmbracelet/lipgloss"
+)
+
+// embeddedWithOther returns the indexes of the documents last scanned with
+// another embedder than the given one. The documents scanned before the
+// embedder was recorded are not known to be.
+func embeddedWithOther(documents []document, embedder llmSetting) []int {
+	var res []int
+	for i, d := range documents {
+		if d.EmbedderProvider == "" && d.EmbedderModel == "" {
+			continue
+		}
+		if d.EmbedderProvider != embedder.Provider || d.EmbedderModel != embedder.Model {
+			res = append(res, i)
+		}
+	}
+	return res
+}
+
+// embedderChangeSummary lists the documents with the embedder they were
+// scanned with.
+func (m mainModel) embedderChangeSummary(indexes []int) string {
+	var sb strings.Builder
+	for _, i := range indexes {
+		d := m.documents[i]
+		fmt.Fprintf(&sb, "- %s (%s)\n", d.Name, embedderName(d.EmbedderProvider, d.EmbedderModel))
+	}
+	return strings.TrimSuffix(sb.String(), "\n")
+}
+
+// newEmbedderChangeForm offers to rescan the documents embedded with another
+// model than the new embedder, their chunks can't be compared with the
+// questions until then.
+func (m mainModel) newEmbedderChangeForm(indexes []int) (mainModel, tea.Cmd) {
+	m.embedderChangeForm = huh.NewForm(
+		huh.NewGroup(
+			huh.NewConfirm().
+				Key("embedderChangeRescan").
+				Title("Rescan the documents?").
+				Description(fmt.Sprintf("These documents were embedded with another model than %s, they can't be "+
+					"searched until they are rescanned:\n%s",
+					embedderName(m.embedderLLMSetting.Provider, m.embedderLLMSetting.Model),
+					m.embedderChangeSummary(indexes))).
+				Affirmative("Rescan all").
+				Negative("Later"),
+		),
+	).
+		WithWidth(m.formWidth).
+		WithHeight(m.formHeight).
+		WithTheme(huh.ThemeCatppuccin()).
+		WithKeyMap(m.keymap.formKeymap).
+		WithShowErrors(true).
+		WithShowHelp(true)
+
+	return m.setViewState(viewStateEmbedderChange), m.embedderChangeForm.PrevField()
+}
+
+func (m mainModel) handleEmbedderChangeEvents(msg tea.Msg) (mainModel, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.WindowSizeMsg:
+		m = m.updateFormSize()
+	case tea.KeyMsg:
+		if key.Matches(msg, m.keymap.escape) {
+			return m.rescanLater(), nil
+		}
+	}
+
+	form, cmd := m.embedderChangeForm.Update(msg)
+	if f, ok := form.(*huh.Form); ok {
+		m.embedderChangeForm = f
+	}
+
+	if m.embedderChangeForm.State != huh.StateCompleted {
+		return m, cmd
+	}
+
+	if !m.embedderChangeForm.GetBool("embedderChangeRescan") {
+		return m.rescanLater(), nil
+	}
+	return m.rescanAffectedDocuments()
+}
+
+// rescanLater goes back to the options, warning about the documents left to
+// rescan.
+func (m mainModel) rescanLater() mainModel {
+	m.err = fmt.Errorf("the documents embedded with another model can't be searched, rescan them with %s "+
+		"in the documents list:\n%s",
+		m.keymap.rescanAffected.Help().Key, m.embedderChangeSummary(embeddedWithOther(m.documents, m.embedderLLMSetting)))
+	return m.updateOptionsSize().setViewState(viewStateOptions)
+}
+
+// rescanAffectedDocuments scans the documents embedded with another model than
+// the embedder one after the other, in the scan view.
+func (m mainModel) rescanAffectedDocuments() (mainModel, tea.Cmd) {
+	if m.rag == nil {
+		m.err = errors.New("the LLMs are not configured, set them up in the options before scanning")
+		return m.updateDocumentsSize().setViewState(viewStateDocuments), nil
+	}
+
+	var queue []int
+	for _, i := range embeddedWithOther(m.documents, m.embedderLLMSetting) {
+		if m.documents[i].Path != "" {
+			queue = append(queue, i)
+		}
+	}
+	if len(queue) == 0 {
+		m.err = nil
+		return m.updateDocumentsSize().setViewState(viewStateDocuments), nil
+	}
+
+	m.documentScanQueue = queue[1:]
+	m.documentScanQueueTotal = len(queue)
+	m.selectedDocumentIndex = queue[0]
+	return m.setViewState(viewStateDocumentScan).scanDocument(true), nil
+}
+
+// scanNextQueued starts the scan of the next queued document once the last one
+// is done, keeping the logs of the previous ones.
+func (m mainModel) scanNextQueued() mainModel {
+	if len(m.documentScanQueue) == 0 {
+		m.documentScanQueueTotal = 0
+		return m
+	}
+
+	logs := m.documentScanLogs
+	m.selectedDocumentIndex = m.documentScanQueue[0]
+	m.documentScanQueue = m.documentScanQueue[1:]
+	m = m.scanDocument(true)
+	m.documentScanLogs = append(append(logs, "", fmt.Sprintf("Rescanning %s", m.documents[m.selectedDocumentIndex].Name)),
+		m.documentScanLogs...)
+	return m.updateDocumentScanSize()
+}
+
+// stopScanQueue leaves the queued documents unscanned after a failed scan.
+func (m mainModel) stopScanQueue() mainModel {
+	if len(m.documentScanQueue) > 0 {
+		slog.Warn("Stopped the queued scans", "remaining", len(m.documentScanQueue))
+		m.documentScanLogs = append(m.documentScanLogs,
+			fmt.Sprintf("The %d remaining documents were not rescanned", len(m.documentScanQueue)))
+	}
+	m.documentScanQueue = nil
+	m.documentScanQueueTotal = 0
+	return m
+}
+
+// documentScanTitle is the title of the scan view, with the position of the
+// document in the queued scans.
+func (m mainModel) documentScanTitle() string {
+	title := fmt.Sprintf("Scanning %s", m.documents[m.selectedDocumentIndex].Path)
+	if m.documentScanQueueTotal > 1 {
+		title += fmt.Sprintf(" (%d/%d)", m.documentScanQueueTotal-len(m.documentScanQueue), m.documentScanQueueTotal)
+	}
+	return title
+}
+
+func (m mainModel) embedderChangeFormView() string {
+	return lipgloss.JoinVertical(lipgloss.Left,
+		logoView(),
+		titleStyle.Render("Embedder Changed"),
+		m.embedderChangeForm.View(),
+	)
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// chapterKey is the metadata of the chapter title of the chunks of a book,
+// named in the chunk headers and the sources.
+const chapterKey = "chapter"
+
+type epubContainer struct {
+	Rootfiles []struct {
+		FullPath string `xml:"full-path,attr"`
+	} `xml:"rootfiles>rootfile"`
+}
+
+type epubPackage struct {
+	Manifest []struct {
+		ID         string `xml:"id,attr"`
+		Href       string `xml:"href,attr"`
+		MediaType  string `xml:"media-type,attr"`
+		Properties string `xml:"properties,attr"`
+	} `xml:"manifest>item"`
+	Spine struct {
+		Toc      string `xml:"toc,attr"`
+		Itemrefs []struct {
+			IDRef string `xml:"idref,attr"`
+		} `xml:"itemref"`
+	} `xml:"spine"`
+}
+
+type epubNCXPoint struct {
+	Label   string `xml:"navLabel>text"`
+	Content struct {
+		Src string `xml:"src,attr"`
+	} `xml:"content"`
+	Points []epubNCXPoint `xml:"navPoint"`
+}
+
+type epubEncryption struct {
+	References []struct {
+		URI string `xml:"URI,attr"`
+	} `xml:"EncryptedData>CipherData>CipherReference"`
+}
+
+// extractEPUB extracts the chapters of the spine of a book in reading order,
+// each one a section with the text of its XHTML as extractHTML does. The
+// chapter titles are taken from the table of contents, else from the first
+// heading of the chapter.
+func extractEPUB(data []byte) (extractedText, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return extractedText{}, fmt.Errorf("error opening the book: %w", err)
+	}
+	files := make(map[string]*zip.File, len(zr.File))
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+
+	if err := epubCheckEncryption(files); err != nil {
+		return extractedText{}, err
+	}
+
+	var container epubContainer
+	if err := zipDecode(files, "META-INF/container.xml", &container); err != nil {
+		return extractedText{}, err
+	}
+	if len(container.Rootfiles) == 0 {
+		return extractedText{}, errors.New("the book has no package document")
+	}
+	opfPath := container.Rootfiles[0].FullPath
+	var pkg epubPackage
+	if err := zipDecode(files, opfPath, &pkg); err != nil {
+		return extractedText{}, err
+	}
+	base := path.Dir(opfPath)
+
+	hrefs := make(map[string]string)
+	titles := make(map[string]string)
+	for _, item := range pkg.Manifest {
+		href := epubResolve(base, item.Href)
+		hrefs[item.ID] = href
+		switch {
+		case strings.Contains(" "+item.Properties+" ", " nav "):
+			epubNavTitles(files, href, titles)
+		case item.ID == pkg.Spine.Toc || item.MediaType == "application/x-dtbncx+xml":
+			epubNCXTitles(files, href, titles)
+		}
+	}
+
+	var sections []extractedSection
+	for _, ref := range pkg.Spine.Itemrefs {
+		href, ok := hrefs[ref.IDRef]
+		if !ok {
+			continue
+		}
+		chapter, err := zipRead(files, href)
+		if err != nil {
+			return extractedText{}, err
+		}
+		text, err := extractHTML(chapter)
+		if err != nil {
+			return extractedText{}, fmt.Errorf("error reading %s: %w", href, err)
+		}
+		// The cover and the other pages without text are left out.
+		if text.content == "" {
+			continue
+		}
+
+		title := titles[href]
+		if title == "" {
+			title = firstMarkdownHeading(text.content)
+		}
+		var metadata map[string]string
+		if title != "" {
+			metadata = map[string]string{chapterKey: title}
+		}
+		sections = append(sections, extractedSection{content: text.content, metadata: metadata})
+	}
+	if len(sections) == 0 {
+		return extractedText{}, errors.New("the book has no chapter with text")
+	}
+
+	return extractedText{markdown: true, sections: sections}, nil
+}
+
+// epubCheckEncryption returns an error when the chapters are encrypted, the
+// books with DRM. The obfuscated fonts don't prevent reading them.
+func epubCheckEncryption(files map[string]*zip.File) error {
+	if _, ok := files["META-INF/encryption.xml"]; !ok {
+		return nil
+	}
+	var enc epubEncryption
+	if err := zipDecode(files, "META-INF/encryption.xml", &enc); err != nil {
+		return err
+	}
+	for _, d := range enc.References {
+		switch strings.ToLower(path.Ext(d.URI)) {
+		case ".xhtml", ".html", ".htm", ".xml":
+			return errors.New("the book is DRM-protected")
+		}
+	}
+	return nil
+}
+
+// epubNCXTitles records the titles of the table of contents of EPUB 2 books by
+// their file, the first entry of a file names it.
+func epubNCXTitles(files map[string]*zip.File, ncxPath string, titles map[string]string) {
+	var ncx struct {
+		Points []epubNCXPoint `xml:"navMap>navPoint"`
+	}
+	if err := zipDecode(files, ncxPath, &ncx); err != nil {
+		return
+	}
+
+	var walk func([]epubNCXPoint)
+	walk = func(points []epubNCXPoint) {
+		for _, p := range points {
+			href := epubResolve(path.Dir(ncxPath), p.Content.Src)
+			if label := strings.Join(strings.Fields(p.Label), " "); label != "" && titles[href] == "" {
+				titles[href] = label
+			}
+			walk(p.Points)
+		}
+	}
+	walk(ncx.Points)
+}
+
+// epubNavTitles records the titles of the navigation document of EPUB 3 books
+// by their file, the first link to a file names it.
+func epubNavTitles(files map[string]*zip.File, navPath string, titles map[string]string) {
+	data, err := zipRead(files, navPath)
+	if err != nil {
+		return
+	}
+	root, err := html.Parse(bytes.NewReader(data))
+	if err != nil {
+		return
+	}
+
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode && n.DataAtom == atom.A {
+			for _, a := range n.Attr {
+				if a.Key != "href" {
+					continue
+				}
+				href := epubResolve(path.Dir(navPath), a.Val)
+				if label := strings.Join(strings.Fields(htmlNodeText(n)), " "); label != "" && titles[href] == "" {
+					titles[href] = label
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(root)
+}
+
+// epubResolve returns the path in the archive of a reference relative to dir,
+// without its fragment.
+func epubResolve(dir, ref string) string {
+	ref, _, _ = strings.Cut(ref, "#")
+	if unescaped, err := url.PathUnescape(ref); err == nil {
+		ref = unescaped
+	}
+	return path.Clean(path.Join(dir, ref))
+}
+
+// zipRead reads the file of an archive, zipDecode parses its XML.
+func zipRead(files map[string]*zip.File, name string) ([]byte, error) {
+	f, ok := files[name]
+	if !ok {
+		return nil, fmt.Errorf("the archive has no %s", name)
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return nil, fmt.Errorf("error opening %s: %w", name, err)
+	}
+	defer rc.Close()
+
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", name, err)
+	}
+	return data, nil
+}
+
+func zipDecode(files map[string]*zip.File, name string, v any) error {
+	data, err := zipRead(files, name)
+	if err != nil {
+		return err
+	}
+	if err := xml.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("error parsing %s: %w", name, err)
+	}
+	return nil
+}
+
+// firstMarkdownHeading returns the title of the first heading of the markdown
+// content.
+func firstMarkdownHeading(content string) string {
+	for _, line := range strings.Split(content, "\n") {
+		if _, title, ok := markdownHeading(line); ok {
+			return title
+		}
+	}
+	return ""
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/philippgille/chromem-go"
+)
+
+// formatKey is the metadata of the documents extracted as markdown, they are
+// chunked on their headings as the markdown files.
+const (
+	formatKey      = "format"
+	formatMarkdown = "markdown"
+)
+
+// extractedText is the readable text of a file that is not plain text.
+type extractedText struct {
+	content string
+	// markdown is set when the headings of the content are markdown headings.
+	markdown bool
+	// metadata is added to the metadata of every chunk of the file.
+	metadata map[string]string
+	// sections are chunked apart, e.g. the chapters of a book, the content is
+	// their text joined when it's not set.
+	sections []extractedSection
+	// warnings are the parts of the file that were skipped, e.g. the malformed
+	// rows, for the scan log.
+	warnings []string
+}
+
+// extractedSection is a part of a file chunked on its own, its metadata is
+// added to the metadata of its chunks.
+type extractedSection struct {
+	content  string
+	metadata map[string]string
+	// whole is set when the section is one chunk whatever its size, e.g. the
+	// rows of a table.
+	whole bool
+}
+
+// extractOptions are the settings of the extraction of a file.
+type extractOptions struct {
+	// ctx is the context of the scan, for the extractions that send requests.
+	ctx context.Context
+
+	tableRowsPerChunk   int
+	maxSpreadsheetCells int
+	// imageReader reads the text of the images and transcriber transcribes the
+	// recordings, they are skipped when they are not set.
+	imageReader *imageReader
+	transcriber *audioTranscriber
+}
+
+// extractors extract the text of the files by their lower case extension, the
+// other files are indexed as they are.
+var extractors = map[string]func(data []byte, opts extractOptions) (extractedText, error){
+	".docx":  func(data []byte, _ extractOptions) (extractedText, error) { return extractDOCX(data) },
+	".html":  func(data []byte, _ extractOptions) (extractedText, error) { return extractHTML(data) },
+	".htm":   func(data []byte, _ extractOptions) (extractedText, error) { return extractHTML(data) },
+	".epub":  func(data []byte, _ extractOptions) (extractedText, error) { return extractEPUB(data) },
+	".csv":   extractCSV,
+	".tsv":   extractTSV,
+	".xlsx":  extractXLSX,
+	".ipynb": func(data []byte, _ extractOptions) (extractedText, error) { return extractIPYNB(data) },
+	".png":   imageExtractor(imageMIMETypes[".png"]),
+	".jpg":   imageExtractor(imageMIMETypes[".jpg"]),
+	".jpeg":  imageExtractor(imageMIMETypes[".jpeg"]),
+	".tif":   imageExtractor(imageMIMETypes[".tif"]),
+	".tiff":  imageExtractor(imageMIMETypes[".tiff"]),
+	".mp3":   audioExtractor(".mp3"),
+	".wav":   audioExtractor(".wav"),
+	".m4a":   audioExtractor(".m4a"),
+}
+
+// extractDocument replaces the content of the document with the text extracted
+// from the file data, when its format has an extractor, and returns the text
+// for its sections to chunk apart and its warnings. The error is the file that can't be
+// read, corrupt or password-protected, it should be skipped.
+func extractDocument(doc chromem.Document, data []byte, opts extractOptions) (chromem.Document, extractedText, error) {
+	extract, ok := extractors[strings.ToLower(filepath.Ext(doc.ID))]
+	if !ok {
+		doc.Content = string(data)
+		return doc, extractedText{}, nil
+	}
+	return extractWith(doc, extract, data, opts)
+}
+
+// extractWith replaces the content of the document with the text extracted
+// from the data by the extractor, as extractDocument, for the data without a
+// file extension like the crawled pages.
+func extractWith(
+	doc chromem.Document,
+	extract func(data []byte, opts extractOptions) (extractedText, error),
+	data []byte,
+	opts extractOptions,
+) (chromem.Document, extractedText, error) {
+	text, err := extract(data, opts)
+	if err != nil {
+		return doc, extractedText{}, err
+	}
+
+	doc.Content = text.content
+	if doc.Content == "" {
+		var contents []string
+		for _, s := range text.sections {
+			contents = append(contents, s.content)
+		}
+		doc.Content = strings.Join(contents, "\n\n")
+	}
+	doc.Metadata = maps.Clone(doc.Metadata)
+	if doc.Metadata == nil {
+		doc.Metadata = map[string]string{}
+	}
+	maps.Copy(doc.Metadata, text.metadata)
+	if text.markdown {
+		doc.Metadata[formatKey] = formatMarkdown
+	}
+	return doc, text, nil
+}
+
+// chunkSections chunks each section of the document on its own, as a document
+// with the metadata of the document and of the section. The chunks are numbered
+// across the sections, as the chunks of the document.
+func chunkSections(
+	doc chromem.Document,
+	sections []extractedSection,
+	tok tokenizer,
+	chunkSize, chunkOverlap, minChunkChars int,
+) []chromem.Document {
+	var chunks []chromem.Document
+	for _, s := range sections {
+		section := chromem.Document{ID: doc.ID, Content: s.content, Metadata: maps.Clone(doc.Metadata)}
+		if section.Metadata == nil {
+			section.Metadata = map[string]string{}
+		}
+		maps.Copy(section.Metadata, s.metadata)
+
+		if s.whole {
+			chunks = append(chunks, newChunk(section, len(chunks), textChunk{content: s.content}, nil))
+			continue
+		}
+		for _, c := range chunkDocument(section, tok, chunkSize, chunkOverlap, minChunkChars) {
+			index := len(chunks)
+			c.ID = fmt.Sprintf("%s-chunk-%d", doc.ID, index)
+			c.Metadata["originalID"] = doc.ID
+			c.Metadata["chunkIndex"] = strconv.Itoa(index)
+			// A section that fits in a chunk repeats nothing.
+			if c.Metadata["overlap"] == "" {
+				c.Metadata["overlap"] = "0"
+			}
+			chunks = append(chunks, c)
+		}
+	}
+	return chunks
+}
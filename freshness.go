@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// modTimeKey is the metadata of the modification time of the file of a chunk,
+// in RFC 3339.
+const modTimeKey = "modTime"
+
+// documentFreshnessMsg is the result of the check of a document for the files
+// changed since its last scan.
+type documentFreshnessMsg struct {
+	id    int
+	stale bool
+}
+
+// checkDocumentsFreshness looks for the files changed since the last scan of
+// the scanned folders in the background, their results are sent as
+// documentFreshnessMsg.
+func (m mainModel) checkDocumentsFreshness() (mainModel, tea.Cmd) {
+	var cmds []tea.Cmd
+	for _, doc := range m.documents {
+		if doc.isURL() || doc.Path == "" || doc.LastScanTime.IsZero() || doc.ScannedFileCount == 0 {
+			continue
+		}
+		cmds = append(cmds, func() tea.Msg {
+			stale, err := changedSince(doc, m.ragSettings, doc.LastScanTime)
+			if err != nil {
+				slog.Warn("Failed to check the freshness of the document", "document", doc.Name, "error", err)
+			}
+			return documentFreshnessMsg{id: doc.ID, stale: stale}
+		})
+	}
+
+	return m, tea.Batch(cmds...)
+}
+
+func (m mainModel) handleDocumentFreshnessMsg(msg documentFreshnessMsg) mainModel {
+	// The document may have been deleted while it was checked.
+	idx := slices.IndexFunc(m.documents, func(d document) bool { return d.ID == msg.id })
+	if idx == -1 || m.documents[idx].stale == msg.stale {
+		return m
+	}
+	m.documents[idx].stale = msg.stale
+	m.documentsList.SetItem(idx, m.documents[idx])
+	return m
+}
+
+// errNewerFile stops the walk of changedSince at the first changed file.
+var errNewerFile = errors.New("a file is newer than the last scan")
+
+// changedSince reports whether a file of the document scanned by its scans was
+// modified after the time, without reading the files.
+func changedSince(doc document, settings ragSettings, since time.Time) (bool, error) {
+	root := doc.Path
+	hidden := newHiddenSkipper(doc, settings)
+	var ignores *ignoreMatcher
+	if !doc.IncludeIgnored {
+		ignores = &ignoreMatcher{}
+	}
+	var filter *pathFilter
+	if len(doc.IncludePatterns) > 0 || len(doc.ExcludePatterns) > 0 {
+		filter = newPathFilter(doc.IncludePatterns, doc.ExcludePatterns)
+	}
+
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == root {
+				return err
+			}
+			return nil
+		}
+		if d.IsDir() && d.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if hidden != nil && path != root && hidden.skipped(d.Name(), d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel == "." && !d.IsDir() {
+			rel = filepath.Base(path)
+		}
+		if ignores != nil {
+			if rel != "." && ignores.ignored(rel, d.IsDir()) {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if d.IsDir() {
+				ignores.loadGitignore(root, rel)
+			}
+		}
+		if d.IsDir() || (filter != nil && !filter.keep(rel)) {
+			return nil
+		}
+
+		// The links are read through by the scans.
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil
+		}
+		if info.ModTime().After(since) {
+			return errNewerFile
+		}
+		return nil
+	})
+	if errors.Is(err, errNewerFile) {
+		return true, nil
+	}
+	return false, err
+}
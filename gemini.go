@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/charmbracelet/huh"
+	"github.com/philippgille/chromem-go"
+)
+
+type geminiProvider struct {
+	APIKey string `json:"apiKey"`
+	Proxy  string `json:"proxy"`
+
+	rateLimitSettings
+}
+
+// gemini chats through the OpenAI compatible endpoint of the Gemini API.
+type gemini struct {
+	openai
+}
+
+// geminiEmbedder embeds with the native Gemini API, the OpenAI compatible
+// endpoint doesn't serve all the embedding models.
+type geminiEmbedder struct {
+	apiKey string
+	model  string
+
+	client *http.Client
+}
+
+type geminiModel struct {
+	Name                       string   `json:"name"`
+	InputTokenLimit            int      `json:"inputTokenLimit"`
+	SupportedGenerationMethods []string `json:"supportedGenerationMethods"`
+}
+
+type geminiModelsResponse struct {
+	Models        []geminiModel `json:"models"`
+	NextPageToken string        `json:"nextPageToken"`
+}
+
+type geminiContent struct {
+	Parts []geminiPart `json:"parts"`
+}
+
+type geminiPart struct {
+	Text string `json:"text"`
+}
+
+type geminiEmbedRequest struct {
+	Model   string        `json:"model"`
+	Content geminiContent `json:"content"`
+}
+
+type geminiBatchEmbedRequest struct {
+	Requests []geminiEmbedRequest `json:"requests"`
+}
+
+type geminiEmbedding struct {
+	Values []float32 `json:"values"`
+}
+
+type geminiBatchEmbedResponse struct {
+	Embeddings []geminiEmbedding `json:"embeddings"`
+}
+
+const (
+	geminiAPIEndpoint    = "https://generativelanguage.googleapis.com/v1beta"
+	geminiOpenAIEndpoint = geminiAPIEndpoint + "/openai"
+
+	geminiChatMethod      = "generateContent"
+	geminiEmbeddingMethod = "embedContent"
+)
+
+// embeddingFunc returns an EmbeddingFunc that uses the Gemini embeddings API.
+func (g geminiEmbedder) embeddingFunc() chromem.EmbeddingFunc {
+	var checkedNormalized bool
+	checkNormalized := sync.Once{}
+
+	return func(ctx context.Context, text string) ([]float32, error) {
+		vs, err := g.embedBatch(ctx, []string{text})
+		if err != nil {
+			return nil, err
+		}
+
+		// text-embedding-004 is normalized, but the embeddings of the newer
+		// models with a reduced dimensionality are not.
+		v := vs[0]
+		checkNormalized.Do(func() {
+			checkedNormalized = isNormalized(v)
+		})
+		if !checkedNormalized {
+			v = normalizeVector(v)
+		}
+
+		return v, nil
+	}
+}
+
+// embedBatch embeds the texts in a single batchEmbedContents request. The
+// embeddings are not normalized, chromem-go does it when they are added to a
+// collection.
+func (g geminiEmbedder) embedBatch(ctx context.Context, texts []string) ([][]float32, error) {
+	model := geminiModelName(g.model)
+
+	body := geminiBatchEmbedRequest{
+		Requests: make([]geminiEmbedRequest, len(texts)),
+	}
+	for i, text := range texts {
+		body.Requests[i] = geminiEmbedRequest{
+			Model: model,
+			Content: geminiContent{
+				Parts: []geminiPart{{Text: text}},
+			},
+		}
+	}
+
+	jsonBody, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST",
+		geminiAPIEndpoint+"/"+model+":batchEmbedContents", bytes.NewBuffer(jsonBody))
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Goog-Api-Key", g.apiKey)
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error sending request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, newHTTPStatusError(resp)
+	}
+
+	var response geminiBatchEmbedResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, fmt.Errorf("error decoding response: %w", err)
+	}
+
+	if len(response.Embeddings) != len(texts) {
+		return nil, fmt.Errorf("got %d embeddings for %d texts", len(response.Embeddings), len(texts))
+	}
+
+	vs := make([][]float32, len(texts))
+	for i, e := range response.Embeddings {
+		if len(e.Values) == 0 {
+			return nil, errors.New("no embeddings found in the response")
+		}
+		vs[i] = e.Values
+	}
+
+	return vs, nil
+}
+
+// embeddingContextLength returns the input token limit of the model.
+func (g geminiEmbedder) embeddingContextLength(ctx context.Context) (int, error) {
+	models, err := listGeminiModels(ctx, g.apiKey, g.client)
+	if err != nil {
+		return 0, err
+	}
+
+	model := geminiModelName(g.model)
+	for _, m := range models {
+		if m.Name == model {
+			return m.InputTokenLimit, nil
+		}
+	}
+	return 0, fmt.Errorf("model %s not found", g.model)
+}
+
+// modelContextWindow returns the input token limit of the model.
+func (g geminiProvider) modelContextWindow(ctx context.Context, model string) (int, error) {
+	return geminiEmbedder{
+		apiKey: g.APIKey,
+		model:  model,
+		client: newProxyHTTPClient(g.Proxy),
+	}.embeddingContextLength(ctx)
+}
+
+// geminiModelName returns the resource name of the model, the API expects the
+// models/ prefix that the model list of the forms leaves out.
+func geminiModelName(model string) string {
+	if strings.HasPrefix(model, "models/") {
+		return model
+	}
+	return "models/" + model
+}
+
+// listGeminiModels returns all the models available to the API key.
+func listGeminiModels(ctx context.Context, apiKey string, client *http.Client) ([]geminiModel, error) {
+	var res []geminiModel
+
+	pageToken := ""
+	for {
+		query := url.Values{"pageSize": {"1000"}}
+		if pageToken != "" {
+			query.Set("pageToken", pageToken)
+		}
+
+		req, err := http.NewRequestWithContext(ctx, "GET", geminiAPIEndpoint+"/models?"+query.Encode(), nil)
+		if err != nil {
+			return nil, fmt.Errorf("error creating request: %w", err)
+		}
+		req.Header.Set("X-Goog-Api-Key", apiKey)
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("error sending request: %w", err)
+		}
+
+		var models geminiModelsResponse
+		if resp.StatusCode != http.StatusOK {
+			err = newHTTPStatusError(resp)
+		} else if decodeErr := json.NewDecoder(resp.Body).Decode(&models); decodeErr != nil {
+			err = fmt.Errorf("error decoding response: %w", decodeErr)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		res = append(res, models.Models...)
+		if models.NextPageToken == "" {
+			return res, nil
+		}
+		pageToken = models.NextPageToken
+	}
+}
+
+func (g geminiProvider) Title() string {
+	if g.isConfigured() {
+		return fmt.Sprintf("%s (configured)", providerGemini)
+	}
+	return fmt.Sprintf("%s (not configured)", providerGemini)
+}
+
+func (g geminiProvider) Description() string {
+	return "Configure Google Gemini connection"
+}
+
+func (g geminiProvider) FilterValue() string {
+	return providerGemini
+}
+
+func (g geminiProvider) name() string {
+	return providerGemini
+}
+
+func (g geminiProvider) availableModels() ([]string, error) {
+	return g.listModels(geminiChatMethod)
+}
+
+func (g geminiProvider) availableEmbeddingModels() ([]string, error) {
+	return g.listModels(geminiEmbeddingMethod)
+}
+
+// listModels returns the names of the models that support the given generation
+// method, without their models/ prefix.
+func (g geminiProvider) listModels(method string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), providerStatusTimeout)
+	defer cancel()
+
+	models, err := listGeminiModels(ctx, g.APIKey, newProxyHTTPClient(g.Proxy))
+	if err != nil {
+		return nil, fmt.Errorf("error listing models: %w", err)
+	}
+
+	var res []string
+	for _, m := range models {
+		if slices.Contains(m.SupportedGenerationMethods, method) {
+			res = append(res, strings.TrimPrefix(m.Name, "models/"))
+		}
+	}
+	return res, nil
+}
+
+func (g geminiProvider) isConfigured() bool {
+	return g.APIKey != ""
+}
+
+func (g geminiProvider) testConnection() error {
+	_, err := g.availableModels()
+	return err
+}
+
+func (g geminiProvider) form(width, height int, keymap *huh.KeyMap) *huh.Form {
+	proxy := g.Proxy
+	apiKey := g.APIKey
+	if apiKey == "" {
+		apiKey = os.Getenv("GEMINI_API_KEY")
+	}
+	if apiKey == "" {
+		apiKey = os.Getenv("GOOGLE_API_KEY")
+	}
+	rateLimit := g.rateLimitSettings
+	return huh.NewForm(
+		huh.NewGroup(
+			huh.NewInput().
+				Key("geminiAPIKey").
+				Title("API Key").
+				Description("Enter the Google AI Studio API key for Gemini.").
+				Placeholder("API Key").
+				Value(&apiKey),
+			proxyField("geminiProxy", "Gemini", &proxy),
+			requestsPerMinuteField("gemini", &rateLimit.RequestsPerMinute),
+			tokensPerMinuteField("gemini", &rateLimit.TokensPerMinute),
+			testConnectionField("geminiTest", func() error {
+				return geminiProvider{APIKey: apiKey, Proxy: proxy}.testConnection()
+			}),
+			huh.NewConfirm().
+				Key("geminiConfirm").
+				Title("Confirm").
+				Description("Save this Gemini settings?").
+				Affirmative("Yes").
+				Negative("Back"),
+		),
+	).
+		WithWidth(width).
+		WithHeight(height).
+		WithTheme(huh.ThemeCatppuccin()).
+		WithKeyMap(keymap).
+		WithShowErrors(true).
+		WithShowHelp(true)
+}
+
+func (g geminiProvider) saveForm(form *huh.Form) (llmProvider, bool) {
+	if !form.GetBool("geminiConfirm") {
+		return g, false
+	}
+
+	apiKey := form.GetString("geminiAPIKey")
+
+	if apiKey == "" {
+		return g, false
+	}
+
+	g.APIKey = apiKey
+	g.Proxy = form.GetString("geminiProxy")
+	g.rateLimitSettings = rateLimitSettingsFromForm(form, "gemini")
+
+	return g, true
+}
+
+func (g geminiProvider) new(setting llmSetting) llm {
+	return gemini{
+		openai: openai{
+			apiKey:           g.APIKey,
+			model:            setting.Model,
+			temperature:      setting.Temperature,
+			topP:             setting.TopP,
+			frequencyPenalty: setting.FrequencyPenalty,
+			presencePenalty:  setting.PresencePenalty,
+			stop:             setting.StopSequences,
+			client:           newOpenAICompatClient(g.APIKey, geminiOpenAIEndpoint, g.Proxy),
+		},
+	}
+}
+
+func (g geminiProvider) supportEmbedding() bool {
+	return true
+}
+
+func (g geminiProvider) newEmbedder(setting llmSetting) embedder {
+	return geminiEmbedder{
+		apiKey: g.APIKey,
+		model:  setting.Model,
+		client: newProxyHTTPClient(g.Proxy),
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ignoreRule is a pattern of a .gitignore file, it applies to the paths under
+// the directory of the file.
+type ignoreRule struct {
+	// base is the directory of the .gitignore file relative to the document,
+	// empty for its root.
+	base     string
+	segments []string
+	negate   bool
+	dirOnly  bool
+}
+
+// ignoreMatcher matches the paths of a document with the rules of its
+// .gitignore files, the rules of a nested file are loaded when the scan enters
+// its directory and override the ones above it.
+type ignoreMatcher struct {
+	rules []ignoreRule
+}
+
+// loadGitignore adds the rules of the .gitignore file of the directory rel of
+// the document root, "." for the root, if it has one. The root also reads
+// .git/info/exclude.
+func (m *ignoreMatcher) loadGitignore(root, rel string) {
+	if rel == "." {
+		rel = ""
+		m.loadRules(filepath.Join(root, ".git", "info", "exclude"), "")
+	}
+	m.loadRules(filepath.Join(root, filepath.FromSlash(rel), ".gitignore"), rel)
+}
+
+func (m *ignoreMatcher) loadRules(file, base string) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return
+	}
+	m.rules = append(m.rules, parseGitignore(data, base)...)
+}
+
+// parseGitignore parses the rules of a .gitignore file of the directory base.
+func parseGitignore(data []byte, base string) []ignoreRule {
+	var rules []ignoreRule
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		// The trailing spaces are ignored unless they are escaped.
+		for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, `\ `) {
+			line = line[:len(line)-1]
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		rule := ignoreRule{base: base}
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+
+		// A pattern without a slash before its end matches at any depth.
+		if !strings.Contains(line, "/") {
+			line = "**/" + line
+		}
+		rule.segments = strings.Split(strings.TrimPrefix(line, "/"), "/")
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// ignored reports whether the path relative to the document is ignored, by the
+// last rule that matches it.
+func (m *ignoreMatcher) ignored(rel string, isDir bool) bool {
+	ignored := false
+	for _, rule := range m.rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		p := rel
+		if rule.base != "" {
+			if !strings.HasPrefix(rel, rule.base+"/") {
+				continue
+			}
+			p = strings.TrimPrefix(rel, rule.base+"/")
+		}
+		if matchSegments(rule.segments, strings.Split(p, "/")) {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
+
+// matchSegments matches the path segments with the pattern segments, "**"
+// matches any number of segments.
+func matchSegments(pattern, segments []string) bool {
+	if len(pattern) == 0 {
+		return len(segments) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(segments); i++ {
+			if matchSegments(pattern[1:], segments[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(segments) == 0 {
+		return false
+	}
+	if ok, err := path.Match(pattern[0], segments[0]); err != nil || !ok {
+		return false
+	}
+	return matchSegments(pattern[1:], segments[1:])
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// parseGlobPatterns parses the comma-separated glob patterns of the paths of a
+// document, empty has no pattern.
+func parseGlobPatterns(s string) ([]string, error) {
+	var patterns []string
+	for _, p := range strings.Split(s, ",") {
+		p = strings.Trim(strings.TrimSpace(p), "/")
+		if p == "" {
+			continue
+		}
+		for _, segment := range strings.Split(p, "/") {
+			if _, err := path.Match(segment, ""); err != nil {
+				return nil, fmt.Errorf("invalid pattern %q: %w", p, err)
+			}
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns, nil
+}
+
+// matchGlob reports whether the path relative to the document matches the glob
+// pattern, "**" matches any number of directories. A pattern without a slash,
+// like "*.md", matches the file name at any depth.
+func matchGlob(pattern, rel string) bool {
+	if !strings.Contains(pattern, "/") {
+		pattern = "**/" + pattern
+	}
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(rel, "/"))
+}
+
+// pathFilter keeps the files of a document matched by one of its include
+// patterns, all of them without one, and not matched by its exclude patterns.
+// It counts the files each pattern left out.
+type pathFilter struct {
+	include     []string
+	exclude     []string
+	notIncluded int
+	excluded    []int
+}
+
+func newPathFilter(include, exclude []string) *pathFilter {
+	return &pathFilter{include: include, exclude: exclude, excluded: make([]int, len(exclude))}
+}
+
+// keep reports whether the file of the path relative to the document is
+// scanned.
+func (f *pathFilter) keep(rel string) bool {
+	if len(f.include) > 0 && !matchAnyGlob(f.include, rel) {
+		f.notIncluded++
+		return false
+	}
+	for i, p := range f.exclude {
+		if matchGlob(p, rel) {
+			f.excluded[i]++
+			return false
+		}
+	}
+	return true
+}
+
+// patterns describes the effective patterns for the scan log.
+func (f *pathFilter) patterns() string {
+	var parts []string
+	if len(f.include) > 0 {
+		parts = append(parts, "including "+strings.Join(f.include, ", "))
+	}
+	if len(f.exclude) > 0 {
+		parts = append(parts, "excluding "+strings.Join(f.exclude, ", "))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// counts describes the files left out by each pattern for the scan log.
+func (f *pathFilter) counts() string {
+	var parts []string
+	if len(f.include) > 0 {
+		parts = append(parts, fmt.Sprintf("%s files not matching %s",
+			formatCount(f.notIncluded), strings.Join(f.include, ", ")))
+	}
+	for i, p := range f.exclude {
+		parts = append(parts, fmt.Sprintf("%s files excluded by %s", formatCount(f.excluded[i]), p))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func matchAnyGlob(patterns []string, rel string) bool {
+	for _, p := range patterns {
+		if matchGlob(p, rel) {
+			return true
+		}
+	}
+	return false
+}
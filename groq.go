@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/charmbracelet/huh"
+)
+
+type groqProvider struct {
+	APIKey string `json:"apiKey"`
+	Proxy  string `json:"proxy"`
+
+	rateLimitSettings
+}
+
+const (
+	groqAPIEndpoint = "https://api.groq.com/openai/v1"
+)
+
+// groqModels is used when the live model listing is unavailable.
+var groqModels = []string{
+	"llama-3.3-70b-versatile",
+	"llama-3.1-8b-instant",
+	"llama3-70b-8192",
+	"llama3-8b-8192",
+	"mixtral-8x7b-32768",
+	"gemma2-9b-it",
+}
+
+func (g groqProvider) Title() string {
+	if g.isConfigured() {
+		return fmt.Sprintf("%s (configured)", providerGroq)
+	}
+	return fmt.Sprintf("%s (not configured)", providerGroq)
+}
+
+func (g groqProvider) Description() string {
+	return "Configure Groq connection"
+}
+
+func (g groqProvider) FilterValue() string {
+	return providerGroq
+}
+
+func (g groqProvider) name() string {
+	return providerGroq
+}
+
+func (g groqProvider) availableModels() ([]string, error) {
+	listed, err := listOpenAIModels(newOpenAICompatClient(g.APIKey, groqAPIEndpoint, g.Proxy))
+	if err != nil {
+		return groqModels, nil
+	}
+
+	var models []string
+	for _, m := range listed {
+		// Groq also hosts speech-to-text models, which can't be used for chat.
+		if strings.HasPrefix(m, "whisper") {
+			continue
+		}
+		models = append(models, m)
+	}
+
+	if len(models) == 0 {
+		return groqModels, nil
+	}
+
+	return models, nil
+}
+
+func (g groqProvider) isConfigured() bool {
+	return g.APIKey != ""
+}
+
+func (g groqProvider) testConnection() error {
+	_, err := listOpenAIModels(newOpenAICompatClient(g.APIKey, groqAPIEndpoint, g.Proxy))
+	return err
+}
+
+func (g groqProvider) form(width, height int, keymap *huh.KeyMap) *huh.Form {
+	proxy := g.Proxy
+	apiKey := g.APIKey
+	if apiKey == "" {
+		apiKey = os.Getenv("GROQ_API_KEY")
+	}
+	rateLimit := g.rateLimitSettings
+	return huh.NewForm(
+		huh.NewGroup(
+			huh.NewInput().
+				Key("groqAPIKey").
+				Title("API Key").
+				Description("Enter the API key for Groq.").
+				Placeholder("API Key").
+				Value(&apiKey),
+			proxyField("groqProxy", "Groq", &proxy),
+			requestsPerMinuteField("groq", &rateLimit.RequestsPerMinute),
+			tokensPerMinuteField("groq", &rateLimit.TokensPerMinute),
+			testConnectionField("groqTest", func() error {
+				return groqProvider{APIKey: apiKey, Proxy: proxy}.testConnection()
+			}),
+			huh.NewConfirm().
+				Key("groqConfirm").
+				Title("Confirm").
+				Description("Save this Groq settings?").
+				Affirmative("Yes").
+				Negative("Back"),
+		),
+	).
+		WithWidth(width).
+		WithHeight(height).
+		WithTheme(huh.ThemeCatppuccin()).
+		WithKeyMap(keymap).
+		WithShowErrors(true).
+		WithShowHelp(true)
+}
+
+func (g groqProvider) saveForm(form *huh.Form) (llmProvider, bool) {
+	if !form.GetBool("groqConfirm") {
+		return g, false
+	}
+
+	apiKey := form.GetString("groqAPIKey")
+
+	if apiKey == "" {
+		return g, false
+	}
+
+	g.APIKey = apiKey
+	g.Proxy = form.GetString("groqProxy")
+	g.rateLimitSettings = rateLimitSettingsFromForm(form, "groq")
+
+	return g, true
+}
+
+func (g groqProvider) new(setting llmSetting) llm {
+	return openai{
+		apiKey:           g.APIKey,
+		model:            setting.Model,
+		temperature:      setting.Temperature,
+		topP:             setting.TopP,
+		frequencyPenalty: setting.FrequencyPenalty,
+		presencePenalty:  setting.PresencePenalty,
+		stop:             setting.StopSequences,
+		client:           newOpenAICompatClient(g.APIKey, groqAPIEndpoint, g.Proxy),
+	}
+}
+
+func (g groqProvider) supportEmbedding() bool {
+	return false
+}
+
+func (g groqProvider) newEmbedder(setting llmSetting) embedder {
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// defaultSkippedDirs are the directories skipped by the scans of the documents
+// that skip the hidden files, the dot-directories and the common dependency and
+// build directories.
+var defaultSkippedDirs = []string{".*", "node_modules", "vendor", "target", "__pycache__", "dist", "build"}
+
+// parseSkippedDirs parses the comma-separated globs of the names of the
+// skipped directories, empty skips none.
+func parseSkippedDirs(s string) ([]string, error) {
+	dirs := []string{}
+	for _, d := range strings.Split(s, ",") {
+		d = strings.TrimSpace(d)
+		if d == "" {
+			continue
+		}
+		if strings.ContainsAny(d, `/\`) {
+			return nil, fmt.Errorf("invalid directory %q, use a name without a slash", d)
+		}
+		if _, err := path.Match(d, ""); err != nil {
+			return nil, fmt.Errorf("invalid directory %q: %w", d, err)
+		}
+		dirs = append(dirs, d)
+	}
+	return dirs, nil
+}
+
+func (s ragSettings) skippedDirs() []string {
+	if s.SkippedDirs == nil {
+		return defaultSkippedDirs
+	}
+	return s.SkippedDirs
+}
+
+// hiddenSkipper skips the hidden files and the directories matching its
+// names, the document root is never skipped.
+type hiddenSkipper struct {
+	dirs []string
+}
+
+// newHiddenSkipper returns the skipper of the document, nil when it scans the
+// hidden files.
+func newHiddenSkipper(doc document, settings ragSettings) *hiddenSkipper {
+	if doc.IncludeHidden {
+		return nil
+	}
+	return &hiddenSkipper{dirs: settings.skippedDirs()}
+}
+
+func (s *hiddenSkipper) skipped(name string, isDir bool) bool {
+	if !isDir {
+		return strings.HasPrefix(name, ".")
+	}
+	for _, d := range s.dirs {
+		if ok, _ := path.Match(d, name); ok {
+			return true
+		}
+	}
+	return false
+}
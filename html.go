@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// titleKey is the metadata of the title of an HTML page, named in the chunk
+// headers and the sources.
+const titleKey = "title"
+
+// htmlSkipped are the elements without readable text.
+var htmlSkipped = map[atom.Atom]bool{
+	atom.Script: true, atom.Style: true, atom.Noscript: true, atom.Template: true,
+	atom.Svg: true, atom.Canvas: true, atom.Iframe: true, atom.Object: true,
+}
+
+// htmlBlocks are the elements that end the paragraph before them and start a
+// new one after them.
+var htmlBlocks = map[atom.Atom]bool{
+	atom.P: true, atom.Div: true, atom.Section: true, atom.Article: true,
+	atom.Header: true, atom.Footer: true, atom.Nav: true, atom.Main: true,
+	atom.Aside: true, atom.Blockquote: true, atom.Table: true, atom.Ul: true,
+	atom.Ol: true, atom.Dl: true, atom.Dt: true, atom.Dd: true, atom.Form: true,
+	atom.Figure: true, atom.Figcaption: true, atom.Hr: true, atom.Address: true,
+	atom.Br: true, atom.Body: true,
+}
+
+var htmlHeadings = map[atom.Atom]int{
+	atom.H1: 1, atom.H2: 2, atom.H3: 3, atom.H4: 4, atom.H5: 5, atom.H6: 6,
+}
+
+// extractHTML extracts the readable text of an HTML page, without its scripts
+// and styles. The headings are markdown headings, the list items markdown list
+// items, the links keep their text and a table row is a line with its cells
+// separated by "|". The page title is recorded in the metadata.
+func extractHTML(data []byte) (extractedText, error) {
+	root, err := html.Parse(bytes.NewReader(data))
+	if err != nil {
+		return extractedText{}, fmt.Errorf("error parsing the page: %w", err)
+	}
+
+	var w htmlTextWriter
+	w.walk(root)
+	w.endBlock()
+
+	text := extractedText{content: strings.TrimSpace(w.out.String()), markdown: true}
+	if w.title != "" {
+		text.metadata = map[string]string{titleKey: w.title}
+	}
+	return text, nil
+}
+
+// htmlTextWriter writes the text of an HTML tree, a paragraph at a time.
+type htmlTextWriter struct {
+	out    strings.Builder
+	block  strings.Builder
+	prefix string
+	title  string
+}
+
+// endBlock writes the pending paragraph with its whitespace collapsed.
+func (w *htmlTextWriter) endBlock() {
+	text := strings.Join(strings.Fields(w.block.String()), " ")
+	w.block.Reset()
+	if text == "" {
+		return
+	}
+	w.out.WriteString(w.prefix + text + "\n\n")
+}
+
+func (w *htmlTextWriter) walk(n *html.Node) {
+	switch n.Type {
+	case html.TextNode:
+		w.block.WriteString(n.Data)
+		return
+	case html.ElementNode:
+	default:
+		w.walkChildren(n)
+		return
+	}
+
+	switch {
+	case htmlSkipped[n.DataAtom]:
+	case n.DataAtom == atom.Title:
+		if w.title == "" {
+			w.title = strings.Join(strings.Fields(htmlNodeText(n)), " ")
+		}
+	case htmlHeadings[n.DataAtom] > 0:
+		w.endBlock()
+		w.prefix = strings.Repeat("#", htmlHeadings[n.DataAtom]) + " "
+		w.walkChildren(n)
+		w.endBlock()
+		w.prefix = ""
+	case n.DataAtom == atom.Li:
+		w.endBlock()
+		w.prefix = "- "
+		w.walkChildren(n)
+		w.endBlock()
+		w.prefix = ""
+	case n.DataAtom == atom.Pre:
+		w.endBlock()
+		if code := strings.Trim(htmlNodeText(n), "\n"); code != "" {
+			w.out.WriteString("```\n" + code + "\n```\n\n")
+		}
+	case n.DataAtom == atom.Tr:
+		w.endBlock()
+		w.walkChildren(n)
+		w.endBlock()
+	case n.DataAtom == atom.Td || n.DataAtom == atom.Th:
+		if strings.TrimSpace(w.block.String()) != "" {
+			w.block.WriteString(" | ")
+		}
+		w.walkChildren(n)
+	case n.DataAtom == atom.Img:
+		for _, a := range n.Attr {
+			if a.Key == "alt" {
+				w.block.WriteString(" " + a.Val + " ")
+			}
+		}
+	case htmlBlocks[n.DataAtom]:
+		w.endBlock()
+		w.walkChildren(n)
+		w.endBlock()
+	default:
+		w.walkChildren(n)
+	}
+}
+
+func (w *htmlTextWriter) walkChildren(n *html.Node) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		w.walk(c)
+	}
+}
+
+// htmlNodeText returns the text of the node as it is.
+func htmlNodeText(n *html.Node) string {
+	var sb strings.Builder
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.TextNode {
+			sb.WriteString(n.Data)
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(n)
+	return sb.String()
+}
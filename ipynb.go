@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// cellsKey is the metadata of the cells of a notebook in a chunk, like "3-7"
+	// from 1, named in the chunk headers and the sources.
+	cellsKey = "cells"
+
+	// maxNotebookOutputChars is the characters over which the text output of
+	// a code cell is left out.
+	maxNotebookOutputChars = 500
+)
+
+type notebook struct {
+	Cells    []notebookCell `json:"cells"`
+	Metadata struct {
+		Kernelspec struct {
+			Language string `json:"language"`
+		} `json:"kernelspec"`
+		LanguageInfo struct {
+			Name string `json:"name"`
+		} `json:"language_info"`
+	} `json:"metadata"`
+}
+
+type notebookCell struct {
+	CellType string           `json:"cell_type"`
+	Source   notebookText     `json:"source"`
+	Outputs  []notebookOutput `json:"outputs"`
+}
+
+type notebookOutput struct {
+	OutputType string                  `json:"output_type"`
+	Text       notebookText            `json:"text"`
+	Data       map[string]notebookText `json:"data"`
+}
+
+// notebookText is the text of a notebook, a string or a list of lines.
+type notebookText string
+
+func (t *notebookText) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*t = notebookText(s)
+		return nil
+	}
+	var lines []string
+	if err := json.Unmarshal(data, &lines); err != nil {
+		// The other data of the outputs, like the JSON ones, are not text.
+		return nil
+	}
+	*t = notebookText(strings.Join(lines, ""))
+	return nil
+}
+
+// extractIPYNB converts the cells of a notebook to markdown, the markdown cells
+// as they are and the code cells as code blocks of the language of the
+// notebook, followed by their short text outputs. The other outputs, like the
+// images, are left out. The cells are grouped in sections that start at the
+// markdown cells with a heading, which record their cells.
+func extractIPYNB(data []byte) (extractedText, error) {
+	var nb notebook
+	if err := json.Unmarshal(data, &nb); err != nil {
+		return extractedText{}, fmt.Errorf("error parsing the notebook: %w", err)
+	}
+	if nb.Cells == nil {
+		return extractedText{}, errors.New("the notebook has no cells, it may be an old version")
+	}
+	language := nb.Metadata.Kernelspec.Language
+	if language == "" {
+		language = nb.Metadata.LanguageInfo.Name
+	}
+
+	var text extractedText
+	var section []string
+	first, last := 0, 0
+	flush := func() {
+		if len(section) == 0 {
+			return
+		}
+		text.sections = append(text.sections, extractedSection{
+			content:  strings.Join(section, "\n\n"),
+			metadata: map[string]string{cellsKey: strconv.Itoa(first) + "-" + strconv.Itoa(last)},
+		})
+		section = nil
+	}
+
+	for i, cell := range nb.Cells {
+		source := strings.TrimSpace(string(cell.Source))
+		if source == "" {
+			continue
+		}
+
+		var content string
+		switch cell.CellType {
+		case "markdown":
+			firstLine, _, _ := strings.Cut(source, "\n")
+			if _, _, ok := markdownHeading(firstLine); ok {
+				flush()
+			}
+			content = source
+		case "code":
+			content = "```" + language + "\n" + source + "\n```"
+			if output := notebookCellOutput(cell.Outputs); output != "" {
+				content += "\n\nOutput:\n\n```\n" + output + "\n```"
+			}
+		default:
+			content = source
+		}
+
+		if len(section) == 0 {
+			first = i + 1
+		}
+		last = i + 1
+		section = append(section, content)
+	}
+	flush()
+
+	text.markdown = true
+	return text, nil
+}
+
+// notebookCellOutput returns the text outputs of a code cell, when they are
+// short enough.
+func notebookCellOutput(outputs []notebookOutput) string {
+	var texts []string
+	for _, o := range outputs {
+		switch o.OutputType {
+		case "stream":
+			texts = append(texts, string(o.Text))
+		case "execute_result", "display_data":
+			// The text of the images is only their description.
+			if !notebookHasImage(o.Data) {
+				texts = append(texts, string(o.Data["text/plain"]))
+			}
+		}
+	}
+	output := strings.TrimSpace(strings.Join(texts, "\n"))
+	if len(output) > maxNotebookOutputChars {
+		return ""
+	}
+	return output
+}
+
+func notebookHasImage(data map[string]notebookText) bool {
+	for mime := range data {
+		if strings.HasPrefix(mime, "image/") {
+			return true
+		}
+	}
+	return false
+}
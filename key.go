@@ -14,12 +14,17 @@ type keymap struct {
 	viewportKeymap viewport.KeyMap
 	formKeymap     *huh.KeyMap
 
-	submit    key.Binding
-	openHelp  key.Binding
-	closeHelp key.Binding
-	quit      key.Binding
-	escape    key.Binding
-	option    key.Binding
+	submit         key.Binding
+	toggleThinking key.Binding
+	togglePlain    key.Binding
+	showContext    key.Binding
+	copySource     key.Binding
+	toggleRAGDebug key.Binding
+	openHelp       key.Binding
+	closeHelp      key.Binding
+	quit           key.Binding
+	escape         key.Binding
+	option         key.Binding
 
 	viewState viewState
 }
@@ -27,7 +32,11 @@ type keymap struct {
 type listKeymap struct {
 	new    key.Binding
 	delete key.Binding
-	pick   key.Binding // Can't use select because it's a reserved word
+	reset  key.Binding
+	rescan key.Binding
+	// rescanAffected rescans the documents embedded with another model.
+	rescanAffected key.Binding
+	pick           key.Binding // Can't use select because it's a reserved word
 }
 
 func newKeymap() keymap {
@@ -40,6 +49,26 @@ func newKeymap() keymap {
 			key.WithKeys("ctrl+s"),
 			key.WithHelp("ctrl+s", "submit"),
 		),
+		toggleThinking: key.NewBinding(
+			key.WithKeys("ctrl+r"),
+			key.WithHelp("ctrl+r", "toggle reasoning"),
+		),
+		togglePlain: key.NewBinding(
+			key.WithKeys("ctrl+p"),
+			key.WithHelp("ctrl+p", "toggle documents"),
+		),
+		showContext: key.NewBinding(
+			key.WithKeys("ctrl+g"),
+			key.WithHelp("ctrl+g", "show context"),
+		),
+		copySource: key.NewBinding(
+			key.WithKeys("ctrl+y"),
+			key.WithHelp("ctrl+y", "copy source path"),
+		),
+		toggleRAGDebug: key.NewBinding(
+			key.WithKeys("ctrl+l"),
+			key.WithHelp("ctrl+l", "toggle retrieval debug"),
+		),
 		openHelp: key.NewBinding(
 			key.WithKeys("ctrl+h"),
 			key.WithHelp("ctrl+h", "more"),
@@ -74,6 +103,18 @@ func newListKeymap() listKeymap {
 			key.WithKeys("ctrl+d"),
 			key.WithHelp("ctrl+d", "delete"),
 		),
+		reset: key.NewBinding(
+			key.WithKeys("ctrl+x"),
+			key.WithHelp("ctrl+x", "reset"),
+		),
+		rescan: key.NewBinding(
+			key.WithKeys("r"),
+			key.WithHelp("r", "rescan"),
+		),
+		rescanAffected: key.NewBinding(
+			key.WithKeys("R"),
+			key.WithHelp("R", "rescan other embedder"),
+		),
 		pick: key.NewBinding(
 			key.WithKeys("enter"),
 			key.WithHelp("enter", "select"),
@@ -124,7 +165,7 @@ func newFormKeymap() *huh.KeyMap {
 }
 
 func (k keymap) FullHelp() [][]key.Binding {
-	if k.viewState == viewStateDocumentScan {
+	if k.viewState == viewStateDocumentScan || k.viewState == viewStateChatContext || k.viewState == viewStateRAGDebug {
 		return [][]key.Binding{
 			{k.viewportKeymap.Up, k.viewportKeymap.Down, k.viewportKeymap.PageUp, k.viewportKeymap.PageDown, k.escape},
 			{k.quit, k.closeHelp},
@@ -132,12 +173,12 @@ func (k keymap) FullHelp() [][]key.Binding {
 	}
 	return [][]key.Binding{
 		{k.viewportKeymap.Up, k.viewportKeymap.Down, k.viewportKeymap.PageUp, k.viewportKeymap.PageDown, k.escape},
-		{k.textAreaKeymap.InsertNewline, k.submit, k.quit, k.closeHelp},
+		{k.textAreaKeymap.InsertNewline, k.submit, k.toggleThinking, k.togglePlain, k.showContext, k.copySource, k.toggleRAGDebug, k.quit, k.closeHelp},
 	}
 }
 
 func (k keymap) ShortHelp() []key.Binding {
-	if k.viewState == viewStateDocumentScan {
+	if k.viewState == viewStateDocumentScan || k.viewState == viewStateChatContext || k.viewState == viewStateRAGDebug {
 		return []key.Binding{k.escape, k.viewportKeymap.Up, k.viewportKeymap.Down, k.openHelp}
 	}
 	return []key.Binding{k.textAreaKeymap.InsertNewline, k.submit, k.quit, k.openHelp}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/philippgille/chromem-go"
+)
+
+const (
+	// retrievalKeyword and retrievalNothing are how the chunks of an answer
+	// were found, when no chunk was similar enough to the question.
+	retrievalKeyword = "keyword"
+	retrievalNothing = "nothing"
+
+	// keywordMatchKey marks the chunks found by their keywords.
+	keywordMatchKey = "keywordMatch"
+
+	minKeywordRunes = 3
+	maxKeywords     = 10
+
+	nothingFoundSystemPrompt = `
+The documents were searched for the question of the user, and nothing in them is about it.
+
+GUIDELINES:
+1. Start by telling the user that nothing about the question was found in the documents
+2. If you answer anyway, make clear that the answer doesn't come from the documents
+3. Be conversational and engaging`
+)
+
+// keywordStopwords are the words too common to find the chunks about a
+// question.
+var keywordStopwords = map[string]bool{
+	"the": true, "and": true, "for": true, "are": true, "but": true, "not": true, "you": true, "all": true,
+	"any": true, "can": true, "had": true, "her": true, "was": true, "one": true, "our": true, "out": true,
+	"has": true, "have": true, "how": true, "its": true, "may": true, "who": true, "why": true, "what": true,
+	"when": true, "where": true, "which": true, "with": true, "this": true, "that": true, "these": true,
+	"those": true, "from": true, "does": true, "did": true, "about": true, "into": true, "there": true,
+	"their": true, "them": true, "they": true, "then": true, "than": true, "some": true, "would": true,
+	"could": true, "should": true, "will": true, "your": true, "tell": true, "please": true, "explain": true,
+	"get": true, "use": true, "using": true, "used": true, "much": true, "many": true, "also": true,
+}
+
+// keywordHit is a chunk found by the keywords of a question, with the number
+// of keywords it contains.
+type keywordHit struct {
+	result  chromem.Result
+	matches int
+}
+
+// questionKeywords returns the words of the question to search for in the
+// chunks, in lower case and without the common words.
+func questionKeywords(question string) []string {
+	var keywords []string
+	words := strings.FieldsFunc(strings.ToLower(question), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' && r != '-' && r != '.'
+	})
+	for _, w := range words {
+		w = strings.Trim(w, "-.")
+		if utf8.RuneCountInString(w) < minKeywordRunes || keywordStopwords[w] || slices.Contains(keywords, w) {
+			continue
+		}
+		keywords = append(keywords, w)
+		if len(keywords) == maxKeywords {
+			break
+		}
+	}
+	return keywords
+}
+
+// keywordSearch returns the chunks of the document that contain keywords of
+// the question, ignoring the case, from the ones with the most keywords.
+func (d document) keywordSearch(
+	ctx context.Context,
+	vectordb *chromem.DB,
+	queryEmbedding []float32,
+	embedFunc chromem.EmbeddingFunc,
+	keywords []string,
+	settings ragSettings,
+	filter retrievalFilter,
+) ([]keywordHit, error) {
+	settings = d.retrievalSettings(settings)
+
+	collName := d.vectorDBCollectionName()
+	coll := vectordb.GetCollection(collName, embedFunc)
+	if coll == nil {
+		return nil, fmt.Errorf("failed to get vectordb collection %s", collName)
+	}
+	if coll.Count() == 0 {
+		return nil, nil
+	}
+
+	// chromem-go only matches the content with its case, all the chunks are
+	// ranked to match them here.
+	docRes, err := coll.QueryEmbedding(ctx, queryEmbedding, coll.Count(), filter.where(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query vectordb collection %s: %w", collName, err)
+	}
+
+	var hits []keywordHit
+	for _, r := range docRes {
+		if !filter.matchesPath(r.Metadata) {
+			continue
+		}
+		content := strings.ToLower(r.Content)
+		matches := 0
+		for _, k := range keywords {
+			if strings.Contains(content, k) {
+				matches++
+			}
+		}
+		if matches == 0 {
+			continue
+		}
+
+		r.Metadata = maps.Clone(r.Metadata)
+		r.Metadata[keywordMatchKey] = "true"
+		hits = append(hits, keywordHit{result: r, matches: matches})
+	}
+
+	sortKeywordHits(hits)
+	if len(hits) > settings.ResultsCount {
+		hits = hits[:settings.ResultsCount]
+	}
+	return hits, nil
+}
+
+// sortKeywordHits sorts the hits from the ones with the most keywords, then
+// like sortResults.
+func sortKeywordHits(hits []keywordHit) {
+	slices.SortFunc(hits, func(a, b keywordHit) int {
+		if c := cmp.Compare(b.matches, a.matches); c != 0 {
+			return c
+		}
+		if c := cmp.Compare(b.result.Similarity, a.result.Similarity); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.result.ID, b.result.ID)
+	})
+}
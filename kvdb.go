@@ -3,6 +3,8 @@ package main
 import (
 	"encoding/binary"
 	"encoding/json"
+	"errors"
+	"slices"
 
 	bolt "go.etcd.io/bbolt"
 )
@@ -12,6 +14,14 @@ const (
 	documentsBucket           = "documents"
 	llmProviderSettingsBucket = "llmProviderSettings"
 	llmSettingsBucket         = "llmSettings"
+	appSettingsBucket         = "appSettings"
+	// fileHashesBucket has a bucket for each document, with the state of its
+	// files by their path.
+	fileHashesBucket = "fileHashes"
+
+	providerInstancesKey = "instances"
+	debugTrafficKey      = "debugTraffic"
+	ragSettingsKey       = "ragSettings"
 )
 
 func initKVDB(db *bolt.DB) error {
@@ -32,6 +42,14 @@ func initKVDB(db *bolt.DB) error {
 		if err != nil {
 			return err
 		}
+		_, err = tx.CreateBucketIfNotExists([]byte(appSettingsBucket))
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists([]byte(fileHashesBucket))
+		if err != nil {
+			return err
+		}
 
 		return nil
 	})
@@ -121,57 +139,142 @@ func saveDocument(db *bolt.DB, doc *document) error {
 func deleteDocument(db *bolt.DB, id int) error {
 	return db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(documentsBucket))
-		return b.Delete(itob(id))
+		if err := b.Delete(itob(id)); err != nil {
+			return err
+		}
+
+		return deleteFileStatesBucket(tx, id)
 	})
 }
 
-func loadOllamaSettings(db *bolt.DB) (ollamaProvider, error) {
-	var ollama ollamaProvider
+// loadFileStates returns the state of the files of the last scan of the
+// document by their path.
+func loadFileStates(db *bolt.DB, docID int) (map[string]fileState, error) {
+	states := make(map[string]fileState)
 
 	err := db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(llmProviderSettingsBucket))
+		b := tx.Bucket([]byte(fileHashesBucket)).Bucket(itob(docID))
+		if b == nil {
+			return nil
+		}
 
-		data := b.Get([]byte("ollama"))
-		if data == nil {
+		return b.ForEach(func(k, v []byte) error {
+			var state fileState
+			if err := json.Unmarshal(v, &state); err != nil {
+				// Only the content hash was stored before the modification
+				// times.
+				state = fileState{Hash: string(v)}
+			}
+			states[string(k)] = state
+			return nil
+		})
+	})
+
+	return states, err
+}
+
+// saveFileStates replaces the state of the files of the document, no states
+// delete them.
+func saveFileStates(db *bolt.DB, docID int, states map[string]fileState) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		if err := deleteFileStatesBucket(tx, docID); err != nil {
+			return err
+		}
+		if len(states) == 0 {
 			return nil
 		}
 
-		err := json.Unmarshal(data, &ollama)
+		b, err := tx.Bucket([]byte(fileHashesBucket)).CreateBucket(itob(docID))
 		if err != nil {
 			return err
 		}
+		for path, state := range states {
+			data, err := json.Marshal(state)
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(path), data); err != nil {
+				return err
+			}
+		}
 
 		return nil
 	})
+}
+
+func deleteFileStatesBucket(tx *bolt.Tx, docID int) error {
+	err := tx.Bucket([]byte(fileHashesBucket)).DeleteBucket(itob(docID))
+	if err != nil && !errors.Is(err, bolt.ErrBucketNotFound) {
+		return err
+	}
+	return nil
+}
+
+// loadProviderInstances returns the stored provider instances, found is false
+// when they were never stored, i.e. before the providers were stored as a list.
+func loadProviderInstances(db *bolt.DB) ([]providerInstance, bool, error) {
+	var instances []providerInstance
+	found := false
+
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(llmProviderSettingsBucket))
+
+		data := b.Get([]byte(providerInstancesKey))
+		if data == nil {
+			return nil
+		}
+		found = true
+
+		return json.Unmarshal(data, &instances)
+	})
 
-	return ollama, err
+	return instances, found, err
 }
 
-func saveOllamaSettings(db *bolt.DB, ollama ollamaProvider) error {
+func saveProviderInstances(db *bolt.DB, instances []providerInstance) error {
 	return db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(llmProviderSettingsBucket))
 
-		data, err := json.Marshal(ollama)
+		data, err := json.Marshal(instances)
 		if err != nil {
 			return err
 		}
 
-		return b.Put([]byte("ollama"), data)
+		return b.Put([]byte(providerInstancesKey), data)
 	})
 }
 
-func loadAnthropicSettings(db *bolt.DB) (anthropicProvider, error) {
-	var anthro anthropicProvider
+// loadLegacyProviderSettings returns the settings stored for the single
+// instance of a provider type, nil when there are none.
+func loadLegacyProviderSettings(db *bolt.DB, key string) ([]byte, error) {
+	var settings []byte
 
 	err := db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(llmProviderSettingsBucket))
 
-		data := b.Get([]byte("anthropic"))
+		if data := b.Get([]byte(key)); data != nil {
+			// The data is only valid during the transaction.
+			settings = slices.Clone(data)
+		}
+
+		return nil
+	})
+
+	return settings, err
+}
+
+func loadLLMSettings(db *bolt.DB, roles string) (llmSetting, error) {
+	var llm llmSetting
+
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(llmSettingsBucket))
+
+		data := b.Get([]byte(roles))
 		if data == nil {
 			return nil
 		}
 
-		err := json.Unmarshal(data, &anthro)
+		err := json.Unmarshal(data, &llm)
 		if err != nil {
 			return err
 		}
@@ -179,89 +282,82 @@ func loadAnthropicSettings(db *bolt.DB) (anthropicProvider, error) {
 		return nil
 	})
 
-	return anthro, err
+	return llm, err
 }
 
-func saveAnthropicSettings(db *bolt.DB, anthro anthropicProvider) error {
+func saveLLMSettings(db *bolt.DB, roles string, llm llmSetting) error {
 	return db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(llmProviderSettingsBucket))
+		b := tx.Bucket([]byte(llmSettingsBucket))
 
-		data, err := json.Marshal(anthro)
+		data, err := json.Marshal(llm)
 		if err != nil {
 			return err
 		}
 
-		return b.Put([]byte("anthropic"), data)
+		return b.Put([]byte(roles), data)
 	})
 }
 
-func loadOpenAISettings(db *bolt.DB) (openaiProvider, error) {
-	var openai openaiProvider
+// loadDebugTraffic returns whether the provider traffic is logged.
+func loadDebugTraffic(db *bolt.DB) (bool, error) {
+	var enabled bool
 
 	err := db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(llmProviderSettingsBucket))
+		b := tx.Bucket([]byte(appSettingsBucket))
 
-		data := b.Get([]byte("openai"))
+		data := b.Get([]byte(debugTrafficKey))
 		if data == nil {
 			return nil
 		}
 
-		err := json.Unmarshal(data, &openai)
-		if err != nil {
-			return err
-		}
-
-		return nil
+		return json.Unmarshal(data, &enabled)
 	})
 
-	return openai, err
+	return enabled, err
 }
 
-func saveOpenAISettings(db *bolt.DB, openai openaiProvider) error {
+func saveDebugTraffic(db *bolt.DB, enabled bool) error {
 	return db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(llmProviderSettingsBucket))
+		b := tx.Bucket([]byte(appSettingsBucket))
 
-		data, err := json.Marshal(openai)
+		data, err := json.Marshal(enabled)
 		if err != nil {
 			return err
 		}
 
-		return b.Put([]byte("openai"), data)
+		return b.Put([]byte(debugTrafficKey), data)
 	})
 }
 
-func loadLLMSettings(db *bolt.DB, roles string) (llmSetting, error) {
-	var llm llmSetting
+// loadRAGSettings returns the saved RAG settings, the settings that were never
+// saved keep their defaults.
+func loadRAGSettings(db *bolt.DB) (ragSettings, error) {
+	settings := defaultRAGSettings()
 
 	err := db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(llmSettingsBucket))
+		b := tx.Bucket([]byte(appSettingsBucket))
 
-		data := b.Get([]byte(roles))
+		data := b.Get([]byte(ragSettingsKey))
 		if data == nil {
 			return nil
 		}
 
-		err := json.Unmarshal(data, &llm)
-		if err != nil {
-			return err
-		}
-
-		return nil
+		return json.Unmarshal(data, &settings)
 	})
 
-	return llm, err
+	return settings, err
 }
 
-func saveLLMSettings(db *bolt.DB, roles string, llm llmSetting) error {
+func saveRAGSettings(db *bolt.DB, settings ragSettings) error {
 	return db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(llmSettingsBucket))
+		b := tx.Bucket([]byte(appSettingsBucket))
 
-		data, err := json.Marshal(llm)
+		data, err := json.Marshal(settings)
 		if err != nil {
 			return err
 		}
 
-		return b.Put([]byte(roles), data)
+		return b.Put([]byte(ragSettingsKey), data)
 	})
 }
 
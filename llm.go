@@ -2,10 +2,12 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"slices"
 	"strconv"
+	"strings"
 
 	"github.com/charmbracelet/bubbles/key"
 	tea "github.com/charmbracelet/bubbletea"
@@ -17,14 +19,52 @@ import (
 type llmResponse struct {
 	content string
 	err     error
+
+	// thinking is the reasoning streamed by a thinking model before its answer,
+	// it's not part of the content.
+	thinking string
+
+	// The token usage is only set on the response that carries it, usually the
+	// last one of a stream.
+	promptTokens     int
+	completionTokens int
 }
 
+const (
+	chatStageRetrieving = "searching documents…"
+	chatStageGenerating = "thinking…"
+)
+
 type llmResponseMsg struct {
 	chatIndex  int
 	content    string
 	isThinking bool
-	err        error
-	done       bool
+	// thinking is the reasoning text, sent with isThinking while the model is
+	// still reasoning.
+	thinking string
+	err      error
+	done     bool
+	// stage is sent on its own when the answer moves on to the next stage,
+	// searching the documents or generating.
+	stage string
+
+	promptTokens     int
+	completionTokens int
+
+	// sources are sent with the done message, they are the chunks given to the
+	// LLM for the answer.
+	sources []chatSource
+	// searched and skipped are sent with the done message, they are the names
+	// of the documents searched for the answer and of the ones skipped.
+	searched []string
+	skipped  []string
+	// retrievalPath is sent with the done message, it's set when no chunk was
+	// similar enough to the question.
+	retrievalPath string
+	// summary and summarizedCount are sent with the done message, they are the
+	// summary of the oldest chats of the session and how many it covers.
+	summary         string
+	summarizedCount int
 }
 
 type llmResponseTitleMsg struct {
@@ -37,6 +77,20 @@ type llmSetting struct {
 	Provider    string  `json:"provider"`
 	Model       string  `json:"model"`
 	Temperature float64 `json:"temperature"`
+	// The sampling parameters are optional, unset ones are not sent so the
+	// provider defaults apply.
+	TopP             *float64 `json:"topP,omitempty"`
+	FrequencyPenalty *float64 `json:"frequencyPenalty,omitempty"`
+	PresencePenalty  *float64 `json:"presencePenalty,omitempty"`
+	// KeepThinking saves the reasoning of thinking models with the answers of
+	// the sessions, only used by the convo LLM.
+	KeepThinking bool `json:"keepThinking,omitempty"`
+	// StopSequences end the answer when the model generates one of them, only
+	// used by the convo LLM.
+	StopSequences []string `json:"stopSequences,omitempty"`
+	// StallTimeout cancels a stream that sends nothing for this long, empty uses
+	// defaultStallTimeout.
+	StallTimeout string `json:"stallTimeout,omitempty"`
 }
 
 type llm interface {
@@ -48,6 +102,22 @@ type embedder interface {
 	embeddingFunc() chromem.EmbeddingFunc
 }
 
+// contextLimitedEmbedder is implemented by the embedders that know the context
+// length of their model, in tokens. The longer inputs are split before they are
+// embedded, instead of being truncated or rejected.
+type contextLimitedEmbedder interface {
+	// embeddingContextLength returns 0 when the context length is unknown.
+	embeddingContextLength(ctx context.Context) (int, error)
+}
+
+// batchEmbedder is implemented by the embedders that can embed many texts in a
+// single request. The document scans use it instead of a request per chunk.
+type batchEmbedder interface {
+	embedder
+	// embedBatch returns the embeddings of the texts, in the same order.
+	embedBatch(ctx context.Context, texts []string) ([][]float32, error)
+}
+
 const (
 	roleConvo    = "convo"
 	roleTitleGen = "title-gen"
@@ -55,6 +125,13 @@ const (
 
 	convoDefaultTemperature    = 0.8
 	genTitleDefaultTemperature = 0.2
+
+	maxTemperature = 2.0
+	maxTopP        = 1
+	maxPenalty     = 2
+
+	// maxStopSequences is the most stop sequences OpenAI accepts.
+	maxStopSequences = 4
 )
 
 func extractSystemChat(chats []chat) (string, []chat) {
@@ -71,8 +148,18 @@ func extractSystemChat(chats []chat) (string, []chat) {
 
 func llmFromSetting(setting llmSetting, providers []llmProvider) (llm, error) {
 	for _, p := range providers {
+		if !supportChat(p) {
+			continue
+		}
 		if p.name() == setting.Provider {
-			return p.new(setting), nil
+			l := llm(stallingLLM{llm: p.new(setting), timeout: stallTimeout(setting.StallTimeout)})
+			if len(setting.StopSequences) > 0 {
+				l = stoppingLLM{llm: l, stop: setting.StopSequences}
+			}
+			if limiter := providerRateLimiter(p); limiter != nil {
+				l = rateLimitedLLM{llm: l, limiter: limiter}
+			}
+			return retryingLLM{llm: l}, nil
 		}
 	}
 
@@ -85,7 +172,14 @@ func embedderFromSetting(setting llmSetting, providers []llmProvider) (embedder,
 			continue
 		}
 		if p.name() == setting.Provider {
-			return p.newEmbedder(setting), nil
+			e := p.newEmbedder(setting)
+			if limiter := providerRateLimiter(p); limiter != nil {
+				e = newRateLimitedEmbedder(e, limiter)
+			}
+			if b, ok := e.(batchEmbedder); ok {
+				return retryingBatchEmbedder{retryingEmbedder: retryingEmbedder{embedder: e}, batch: b}, nil
+			}
+			return retryingEmbedder{embedder: e}, nil
 		}
 	}
 
@@ -117,7 +211,7 @@ func (m mainModel) initLLMSettings() (mainModel, error) {
 	return m, nil
 }
 
-func (m mainModel) newLLMForm(setting llmSetting, isEmbedding bool, defaultTemperature float64) *huh.Form {
+func (m mainModel) newLLMForm(setting llmSetting, isEmbedding, isConvo bool, defaultTemperature float64) *huh.Form {
 	pIdx := slices.IndexFunc(m.providers, func(p llmProvider) bool {
 		return p.name() == setting.Provider
 	})
@@ -131,6 +225,15 @@ func (m mainModel) newLLMForm(setting llmSetting, isEmbedding bool, defaultTempe
 		tmp = setting.Temperature
 	}
 	tmpStr := fmt.Sprintf("%.2f", tmp)
+	keepThinking := setting.KeepThinking
+	stopSequences := strings.Join(setting.StopSequences, ", ")
+	stallTimeoutStr := setting.StallTimeout
+	topPStr := formatSamplingParam(setting.TopP)
+	frequencyPenaltyStr := formatSamplingParam(setting.FrequencyPenalty)
+	presencePenaltyStr := formatSamplingParam(setting.PresencePenalty)
+	// models holds the last models listed for the selected provider, to validate
+	// the selected model against.
+	var models []string
 
 	var options []huh.Option[llmProvider]
 	for _, p := range m.providers {
@@ -141,6 +244,8 @@ func (m mainModel) newLLMForm(setting llmSetting, isEmbedding bool, defaultTempe
 			if !p.supportEmbedding() {
 				continue
 			}
+		} else if !supportChat(p) {
+			continue
 		}
 		options = append(options, huh.NewOption(p.name(), p))
 	}
@@ -156,11 +261,36 @@ func (m mainModel) newLLMForm(setting llmSetting, isEmbedding bool, defaultTempe
 		huh.NewSelect[string]().
 			Key("llmModel").
 			OptionsFunc(func() []huh.Option[string] {
-				models := p.availableModels()
+				if p == nil {
+					return nil
+				}
+				listModels := p.availableModels
+				if lister, ok := p.(embeddingModelsLister); ok && isEmbedding {
+					listModels = lister.availableEmbeddingModels
+				}
+				var err error
+				models, err = listModels()
+				if err != nil {
+					slog.Error("error listing models", "provider", p.name(), "error", err)
+					// The empty value is rejected by the validation below, so the
+					// error is shown without letting the user save it as a model.
+					return []huh.Option[string]{huh.NewOption(fmt.Sprintf("Error: %s", err), "")}
+				}
 				return huh.NewOptions(models...)
 			}, &p).
 			Title("Model").
 			Description("Select the LLM model").
+			Validate(func(s string) error {
+				if s == "" {
+					return errors.New("no model selected")
+				}
+				// The saved model may not be listed for this role, e.g. a chat
+				// model saved as the embedder.
+				if !slices.Contains(models, s) {
+					return fmt.Errorf("model %s can't be used for this role", s)
+				}
+				return nil
+			}).
 			Value(&mdl).
 			Height(10),
 	}
@@ -169,9 +299,64 @@ func (m mainModel) newLLMForm(setting llmSetting, isEmbedding bool, defaultTempe
 		fields = append(fields, huh.NewInput().
 			Key("llmTemperature").
 			Title("Temperature").
-			Description("Enter the temperature").
+			Description("Enter the temperature between 0 and 2, Anthropic accepts up to 1").
 			Placeholder("Temperature").
-			Value(&tmpStr))
+			Validate(func(s string) error {
+				_, err := parseTemperature(s)
+				return err
+			}).
+			Value(&tmpStr),
+			huh.NewInput().
+				Key("llmTopP").
+				Title("Top P").
+				Description("Optional nucleus sampling between 0 and 1, leave empty to use the model default").
+				Placeholder("Default").
+				Validate(samplingParamValidator(maxTopP)).
+				Value(&topPStr),
+			huh.NewInput().
+				Key("llmFrequencyPenalty").
+				Title("Frequency Penalty").
+				Description("Optional penalty between 0 and 2 for repeating the same tokens, ignored by Anthropic").
+				Placeholder("Default").
+				Validate(samplingParamValidator(maxPenalty)).
+				Value(&frequencyPenaltyStr),
+			huh.NewInput().
+				Key("llmPresencePenalty").
+				Title("Presence Penalty").
+				Description("Optional penalty between 0 and 2 for tokens already used, ignored by Anthropic").
+				Placeholder("Default").
+				Validate(samplingParamValidator(maxPenalty)).
+				Value(&presencePenaltyStr))
+	}
+
+	if isConvo {
+		fields = append(fields, huh.NewConfirm().
+			Key("llmKeepThinking").
+			Title("Keep Reasoning").
+			Description("Save the reasoning of thinking models with the answers? Otherwise it's only shown while they are generated.").
+			Affirmative("Yes").
+			Negative("No").
+			Value(&keepThinking),
+			huh.NewInput().
+				Key("llmStopSequences").
+				Title("Stop Sequences").
+				Description(fmt.Sprintf("Optional comma-separated sequences that end the answer, e.g. <|im_end|>, at most %d", maxStopSequences)).
+				Placeholder("None").
+				Validate(func(s string) error {
+					_, err := parseStopSequences(s)
+					return err
+				}).
+				Value(&stopSequences),
+			huh.NewInput().
+				Key("llmStallTimeout").
+				Title("Stall Timeout").
+				Description("Cancel the answer when the LLM sends nothing for this long, e.g. 60s or 5m. Raise it for slow local or reasoning models").
+				Placeholder(defaultStallTimeout.String()).
+				Validate(func(s string) error {
+					_, err := parseStallTimeout(s)
+					return err
+				}).
+				Value(&stallTimeoutStr))
 	}
 
 	fields = append(fields,
@@ -196,6 +381,90 @@ func (m mainModel) newLLMForm(setting llmSetting, isEmbedding bool, defaultTempe
 		WithShowHelp(true)
 }
 
+// parseTemperature parses a temperature between 0 and maxTemperature.
+func parseTemperature(s string) (float64, error) {
+	v, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || v < 0 || v > maxTemperature {
+		return 0, fmt.Errorf("invalid temperature %q, use a number between 0 and %g", s, maxTemperature)
+	}
+	return v, nil
+}
+
+// parseSamplingParam parses an optional sampling parameter between 0 and maximum,
+// an empty value returns nil.
+func parseSamplingParam(s string, maximum float64) (*float64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || v < 0 || v > maximum {
+		return nil, fmt.Errorf("invalid value %q, use a number between 0 and %g", s, maximum)
+	}
+	return &v, nil
+}
+
+// parseStopSequences parses the comma-separated stop sequences, the empty ones
+// are skipped.
+func parseStopSequences(s string) ([]string, error) {
+	var res []string
+	for _, seq := range strings.Split(s, ",") {
+		seq = strings.TrimSpace(seq)
+		if seq == "" {
+			continue
+		}
+		res = append(res, seq)
+	}
+	if len(res) > maxStopSequences {
+		return nil, fmt.Errorf("too many stop sequences, use at most %d", maxStopSequences)
+	}
+	return res, nil
+}
+
+func samplingParamValidator(maximum float64) func(string) error {
+	return func(s string) error {
+		_, err := parseSamplingParam(s, maximum)
+		return err
+	}
+}
+
+func formatSamplingParam(v *float64) string {
+	if v == nil {
+		return ""
+	}
+	return strconv.FormatFloat(*v, 'f', -1, 64)
+}
+
+// clearUnavailableRoles clears the roles whose provider was deleted or is not
+// configured anymore, so they are picked again instead of failing to load. The
+// cleared roles are not saved until they are picked.
+func (m mainModel) clearUnavailableRoles() mainModel {
+	for _, r := range []struct {
+		title   string
+		setting *llmSetting
+	}{
+		{optionConvoLLMTitle, &m.convoLLMSetting},
+		{optionGenTitleLLMTitle, &m.genTitleLLMSetting},
+		{optionEmbedderTitle, &m.embedderLLMSetting},
+	} {
+		if r.setting.Provider == "" {
+			continue
+		}
+		if slices.ContainsFunc(m.providers, func(p llmProvider) bool {
+			return p.name() == r.setting.Provider && p.isConfigured()
+		}) {
+			continue
+		}
+
+		slog.Warn("clearing the llm role of an unavailable provider", "role", r.title, "provider", r.setting.Provider)
+		m.err = fmt.Errorf("the provider %s of the %s is not available, pick it again", r.setting.Provider, r.title)
+		r.setting.Provider = ""
+		r.setting.Model = ""
+	}
+	return m
+}
+
 func (m mainModel) llmIsConfigured() bool {
 	if !m.convoLLMSetting.isConfigured() {
 		return false
@@ -211,7 +480,7 @@ func (m mainModel) llmIsConfigured() bool {
 }
 
 func (m mainModel) newConvoLLMForm() (mainModel, tea.Cmd) {
-	m.convoLLMForm = m.newLLMForm(m.convoLLMSetting, false, convoDefaultTemperature)
+	m.convoLLMForm = m.newLLMForm(m.convoLLMSetting, false, true, convoDefaultTemperature)
 
 	return m, m.convoLLMForm.PrevField()
 }
@@ -242,11 +511,18 @@ func (m mainModel) handleConvoLLMFormEvents(msg tea.Msg) (mainModel, tea.Cmd) {
 	p, _ := m.convoLLMForm.Get("llmProvider").(llmProvider)
 	m.convoLLMSetting.Provider = p.name()
 	m.convoLLMSetting.Model = m.convoLLMForm.GetString("llmModel")
-	tmp, err := strconv.ParseFloat(m.convoLLMForm.GetString("llmTemperature"), 64)
-	if err != nil {
-		tmp = 0
-	}
-	m.convoLLMSetting.Temperature = tmp
+	// The form rejects an invalid temperature, the previous one is kept if it
+	// gets through anyway.
+	tmp, err := parseTemperature(m.convoLLMForm.GetString("llmTemperature"))
+	if err == nil {
+		m.convoLLMSetting.Temperature = tmp
+	}
+	m.convoLLMSetting.TopP, _ = parseSamplingParam(m.convoLLMForm.GetString("llmTopP"), maxTopP)
+	m.convoLLMSetting.FrequencyPenalty, _ = parseSamplingParam(m.convoLLMForm.GetString("llmFrequencyPenalty"), maxPenalty)
+	m.convoLLMSetting.PresencePenalty, _ = parseSamplingParam(m.convoLLMForm.GetString("llmPresencePenalty"), maxPenalty)
+	m.convoLLMSetting.KeepThinking = m.convoLLMForm.GetBool("llmKeepThinking")
+	m.convoLLMSetting.StopSequences, _ = parseStopSequences(m.convoLLMForm.GetString("llmStopSequences"))
+	m.convoLLMSetting.StallTimeout = m.convoLLMForm.GetString("llmStallTimeout")
 
 	if err := saveLLMSettings(m.db, roleConvo, m.convoLLMSetting); err != nil {
 		m.err = fmt.Errorf("error saving convo llm settings: %w", err)
@@ -273,7 +549,7 @@ func (m mainModel) convoLLMFormView() string {
 }
 
 func (m mainModel) newGenTitleLLMForm() (mainModel, tea.Cmd) {
-	m.genTitleLLMForm = m.newLLMForm(m.genTitleLLMSetting, false, genTitleDefaultTemperature)
+	m.genTitleLLMForm = m.newLLMForm(m.genTitleLLMSetting, false, false, genTitleDefaultTemperature)
 
 	return m, m.genTitleLLMForm.PrevField()
 }
@@ -304,11 +580,13 @@ func (m mainModel) handleGenTitleLLMFormEvents(msg tea.Msg) (mainModel, tea.Cmd)
 	p, _ := m.genTitleLLMForm.Get("llmProvider").(llmProvider)
 	m.genTitleLLMSetting.Provider = p.name()
 	m.genTitleLLMSetting.Model = m.genTitleLLMForm.GetString("llmModel")
-	tmp, err := strconv.ParseFloat(m.genTitleLLMForm.GetString("llmTemperature"), 64)
-	if err != nil {
-		tmp = 0
+	tmp, err := parseTemperature(m.genTitleLLMForm.GetString("llmTemperature"))
+	if err == nil {
+		m.genTitleLLMSetting.Temperature = tmp
 	}
-	m.genTitleLLMSetting.Temperature = tmp
+	m.genTitleLLMSetting.TopP, _ = parseSamplingParam(m.genTitleLLMForm.GetString("llmTopP"), maxTopP)
+	m.genTitleLLMSetting.FrequencyPenalty, _ = parseSamplingParam(m.genTitleLLMForm.GetString("llmFrequencyPenalty"), maxPenalty)
+	m.genTitleLLMSetting.PresencePenalty, _ = parseSamplingParam(m.genTitleLLMForm.GetString("llmPresencePenalty"), maxPenalty)
 
 	if err := saveLLMSettings(m.db, roleTitleGen, m.genTitleLLMSetting); err != nil {
 		m.err = fmt.Errorf("error saving gen title llm settings: %w", err)
@@ -335,7 +613,7 @@ func (m mainModel) genTitleLLMFormView() string {
 }
 
 func (m mainModel) newEmbedderLLMForm() (mainModel, tea.Cmd) {
-	m.embedderLLMForm = m.newLLMForm(m.embedderLLMSetting, true, 0)
+	m.embedderLLMForm = m.newLLMForm(m.embedderLLMSetting, true, false, 0)
 
 	return m, m.embedderLLMForm.PrevField()
 }
@@ -364,6 +642,7 @@ func (m mainModel) handleEmbedderLLMFormEvents(msg tea.Msg) (mainModel, tea.Cmd)
 	}
 
 	p, _ := m.embedderLLMForm.Get("llmProvider").(llmProvider)
+	previous := m.embedderLLMSetting
 	m.embedderLLMSetting.Provider = p.name()
 	m.embedderLLMSetting.Model = m.embedderLLMForm.GetString("llmModel")
 
@@ -381,7 +660,13 @@ func (m mainModel) handleEmbedderLLMFormEvents(msg tea.Msg) (mainModel, tea.Cmd)
 		return m.updateFormSize(), nil
 	}
 
-	return m.initOptions().updateOptionsSize().setViewState(viewStateOptions), nil
+	m = m.initOptions()
+	changed := previous.Provider != m.embedderLLMSetting.Provider || previous.Model != m.embedderLLMSetting.Model
+	if affected := embeddedWithOther(m.documents, m.embedderLLMSetting); changed && len(affected) > 0 {
+		return m.updateFormSize().newEmbedderChangeForm(affected)
+	}
+
+	return m.updateOptionsSize().setViewState(viewStateOptions), nil
 }
 
 func (m mainModel) embedderLLMFormView() string {
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/charmbracelet/huh"
+)
+
+type lmStudioProvider struct {
+	Host string `json:"host"`
+
+	rateLimitSettings
+}
+
+const (
+	defaultLMStudioHost = "http://localhost:1234"
+
+	// lmStudioAPIKey is sent as the bearer token, LM Studio ignores it but the
+	// OpenAI client requires one.
+	lmStudioAPIKey = "lm-studio"
+)
+
+func (l lmStudioProvider) Title() string {
+	if l.isConfigured() {
+		return fmt.Sprintf("%s (configured)", providerLMStudio)
+	}
+	return fmt.Sprintf("%s (not configured)", providerLMStudio)
+}
+
+func (l lmStudioProvider) Description() string {
+	return "Configure LM Studio local server connection"
+}
+
+func (l lmStudioProvider) FilterValue() string {
+	return providerLMStudio
+}
+
+func (l lmStudioProvider) name() string {
+	return providerLMStudio
+}
+
+func (l lmStudioProvider) availableModels() ([]string, error) {
+	models, err := listOpenAIModels(newOpenAICompatClient(lmStudioAPIKey, l.baseURL(), ""))
+	if err != nil {
+		return nil, fmt.Errorf("is the LM Studio server running at %s? %w", l.Host, err)
+	}
+	return models, nil
+}
+
+func (l lmStudioProvider) baseURL() string {
+	return strings.TrimRight(l.Host, "/") + "/v1"
+}
+
+func (l lmStudioProvider) isConfigured() bool {
+	return l.Host != ""
+}
+
+func (l lmStudioProvider) testConnection() error {
+	_, err := l.availableModels()
+	return err
+}
+
+func (l lmStudioProvider) form(width, height int, keymap *huh.KeyMap) *huh.Form {
+	host := l.Host
+	if host == "" {
+		host = defaultLMStudioHost
+	}
+	rateLimit := l.rateLimitSettings
+	return huh.NewForm(
+		huh.NewGroup(
+			huh.NewInput().
+				Key("lmStudioHost").
+				Title("Host").
+				Description("Enter the host and port of the LM Studio server.").
+				Placeholder(defaultLMStudioHost).
+				Value(&host),
+			requestsPerMinuteField("lmStudio", &rateLimit.RequestsPerMinute),
+			tokensPerMinuteField("lmStudio", &rateLimit.TokensPerMinute),
+			testConnectionField("lmStudioTest", func() error {
+				return lmStudioProvider{Host: host}.testConnection()
+			}),
+			huh.NewConfirm().
+				Key("lmStudioConfirm").
+				Title("Confirm").
+				Description("Save this LM Studio settings?").
+				Affirmative("Yes").
+				Negative("Back"),
+		),
+	).
+		WithWidth(width).
+		WithHeight(height).
+		WithTheme(huh.ThemeCatppuccin()).
+		WithKeyMap(keymap).
+		WithShowErrors(true).
+		WithShowHelp(true)
+}
+
+func (l lmStudioProvider) saveForm(form *huh.Form) (llmProvider, bool) {
+	if !form.GetBool("lmStudioConfirm") {
+		return l, false
+	}
+
+	host := form.GetString("lmStudioHost")
+	if host == "" {
+		return l, false
+	}
+
+	l.Host = host
+	l.rateLimitSettings = rateLimitSettingsFromForm(form, "lmStudio")
+
+	return l, true
+}
+
+func (l lmStudioProvider) new(setting llmSetting) llm {
+	return openai{
+		apiKey:           lmStudioAPIKey,
+		model:            setting.Model,
+		temperature:      setting.Temperature,
+		topP:             setting.TopP,
+		frequencyPenalty: setting.FrequencyPenalty,
+		presencePenalty:  setting.PresencePenalty,
+		stop:             setting.StopSequences,
+		client:           newOpenAICompatClient(lmStudioAPIKey, l.baseURL(), ""),
+	}
+}
+
+func (l lmStudioProvider) supportEmbedding() bool {
+	return true
+}
+
+func (l lmStudioProvider) newEmbedder(setting llmSetting) embedder {
+	// The embeddings are sent with the same client as the chats, LM Studio
+	// serves the OpenAI embeddings API.
+	return openai{
+		apiKey: lmStudioAPIKey,
+		model:  setting.Model,
+		client: newOpenAICompatClient(lmStudioAPIKey, l.baseURL(), ""),
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"strings"
+	"unicode"
+
+	"github.com/charmbracelet/huh"
+	"github.com/philippgille/chromem-go"
+)
+
+// localProvider is the built-in embedder that runs without any external
+// service. It has nothing to configure, so it is always configured.
+type localProvider struct{}
+
+// local embeds the texts with feature hashing: the words, the pairs of adjacent
+// words and the character trigrams of the words are hashed into a fixed number
+// of dimensions. It only matches the texts that share their words, so the
+// retrieval is of lower quality than the embedding models.
+type local struct {
+	dimensions int
+}
+
+const (
+	localEmbeddingModel = "feature-hashing"
+
+	localEmbeddingDimensions = 1024
+
+	localBigramWeight  = 0.5
+	localTrigramWeight = 0.25
+)
+
+func (l local) embeddingFunc() chromem.EmbeddingFunc {
+	return func(_ context.Context, text string) ([]float32, error) {
+		return l.embed(text)
+	}
+}
+
+func (l local) embed(text string) ([]float32, error) {
+	features := make(map[string]float64)
+
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for i, word := range words {
+		features["w:"+word]++
+		if i > 0 {
+			features["b:"+words[i-1]+" "+word] += localBigramWeight
+		}
+
+		runes := []rune("^" + word + "$")
+		for j := 0; j+3 <= len(runes); j++ {
+			features["t:"+string(runes[j:j+3])] += localTrigramWeight
+		}
+	}
+	if len(features) == 0 {
+		return nil, errors.New("no words to embed in the text")
+	}
+
+	v := make([]float32, l.dimensions)
+	for feature, weight := range features {
+		h := fnv.New64a()
+		h.Write([]byte(feature))
+		sum := h.Sum64()
+
+		// The sign bit halves the bias of the hash collisions, as the colliding
+		// features cancel out instead of adding up.
+		sign := float32(1)
+		if sum>>63 == 1 {
+			sign = -1
+		}
+		// The repeated features are dampened, so a word that appears many times
+		// doesn't outweigh the rest of the text.
+		v[sum%uint64(l.dimensions)] += sign * float32(1+math.Log(weight+1))
+	}
+
+	if isZeroVector(v) {
+		return nil, errors.New("no words to embed in the text")
+	}
+
+	return normalizeVector(v), nil
+}
+
+func isZeroVector(v []float32) bool {
+	for _, val := range v {
+		if val != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (l localProvider) Title() string {
+	return fmt.Sprintf("%s (configured)", providerLocal)
+}
+
+func (l localProvider) Description() string {
+	return "Built-in embeddings without any service (embeddings only, lower quality)"
+}
+
+func (l localProvider) FilterValue() string {
+	return providerLocal
+}
+
+func (l localProvider) name() string {
+	return providerLocal
+}
+
+func (l localProvider) availableModels() ([]string, error) {
+	return []string{localEmbeddingModel}, nil
+}
+
+func (l localProvider) isConfigured() bool {
+	return true
+}
+
+func (l localProvider) testConnection() error {
+	return nil
+}
+
+func (l localProvider) form(width, height int, keymap *huh.KeyMap) *huh.Form {
+	return huh.NewForm(
+		huh.NewGroup(
+			huh.NewNote().
+				Title("Local").
+				Description("The Local embedder runs inside doconvo and needs no service or API key. "+
+					"It only matches the documents that share words with the question, so the answers "+
+					"are of lower quality than with an embedding model."),
+			huh.NewConfirm().
+				Key("localConfirm").
+				Title("Confirm").
+				Description("Save this Local settings?").
+				Affirmative("Yes").
+				Negative("Back"),
+		),
+	).
+		WithWidth(width).
+		WithHeight(height).
+		WithTheme(huh.ThemeCatppuccin()).
+		WithKeyMap(keymap).
+		WithShowErrors(true).
+		WithShowHelp(true)
+}
+
+func (l localProvider) saveForm(form *huh.Form) (llmProvider, bool) {
+	return l, form.GetBool("localConfirm")
+}
+
+// new returns nil, the Local provider has no chat model. The provider is never
+// offered for the chat roles, see embeddingOnly.
+func (l localProvider) new(setting llmSetting) llm {
+	return nil
+}
+
+func (l localProvider) supportEmbedding() bool {
+	return true
+}
+
+func (l localProvider) embeddingOnly() bool {
+	return true
+}
+
+func (l localProvider) newEmbedder(setting llmSetting) embedder {
+	return local{
+		dimensions: localEmbeddingDimensions,
+	}
+}
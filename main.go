@@ -33,6 +33,13 @@ type mainModel struct {
 	chatCancelFunc         context.CancelFunc
 	documentScanProgress   chan documentScanLogMsg
 	documentScanCancelFunc context.CancelFunc
+	autoScanProgress       chan documentScanLogMsg
+	autoScanCancelFunc     context.CancelFunc
+	watchChanges           chan int
+	// watchers are the watchers of the documents by their ID, shared by the
+	// copies of the model.
+	watchers  map[int]*documentWatcher
+	ragDebugs chan ragDebugMsg
 
 	sessionList list.Model
 
@@ -41,34 +48,63 @@ type mainModel struct {
 	chatSpinner    spinner.Model
 	chatTextArea   textarea.Model
 
+	chatContextViewport viewport.Model
+	ragDebugViewport    viewport.Model
+
 	optionsList list.Model
 
 	documentsList        list.Model
 	documentForm         *huh.Form
 	documentScanViewport viewport.Model
 
-	providersList list.Model
-	providerForm  *huh.Form
+	providersList        list.Model
+	providerForm         *huh.Form
+	providerInstanceForm *huh.Form
 
 	convoLLMForm    *huh.Form
 	genTitleLLMForm *huh.Form
 	embedderLLMForm *huh.Form
+	ragSettingsForm *huh.Form
+
+	promptTemplateForm *huh.Form
+
+	embedderChangeForm *huh.Form
 
 	helpModel help.Model
 
 	sessions              []session
 	selectedSessionIndex  int
 	chatIsThinking        bool
+	chatStage             string
+	chatShowThinking      bool
+	chatCopiedPath        string
+	ragDebugEnabled       bool
+	ragDebug              ragDebugMsg
 	options               []optionItem
 	documents             []document
 	selectedDocumentIndex int
 	documentScanLogs      []string
 	documentScanStartTime time.Time
-	providers             []llmProvider
-	selectedProviderIndex int
-	convoLLMSetting       llmSetting
-	genTitleLLMSetting    llmSetting
-	embedderLLMSetting    llmSetting
+	documentScanStatus    scanProgress
+	// documentScanDocumentID and autoScanDocumentID are the IDs of the
+	// documents being scanned from the scan view and rescanned automatically,
+	// 0 when there is none.
+	documentScanDocumentID int
+	autoScanDocumentID     int
+	autoScanStatus         scanProgress
+	// autoScanSync is set when the automatic rescan syncs the changes of a
+	// watched document.
+	autoScanSync bool
+	// documentScanQueue are the indexes of the documents scanned after the
+	// selected one, out of documentScanQueueTotal.
+	documentScanQueue      []int
+	documentScanQueueTotal int
+	providers              []llmProvider
+	selectedProviderIndex  int
+	convoLLMSetting        llmSetting
+	genTitleLLMSetting     llmSetting
+	embedderLLMSetting     llmSetting
+	ragSettings            ragSettings
 
 	keymap     keymap
 	width      int
@@ -91,9 +127,15 @@ const (
 	viewStateDocumentScan
 	viewStateProviders
 	viewStateProviderForm
+	viewStateProviderInstanceForm
 	viewStateConvoLLMForm
 	viewStateGenTitleLLMForm
 	viewStateEmbedderLLMForm
+	viewStateRAGSettingsForm
+	viewStateChatContext
+	viewStateRAGDebug
+	viewStateEmbedderChange
+	viewStatePromptTemplateForm
 )
 
 func initLogger(cfgPath string, debug bool) error {
@@ -103,13 +145,13 @@ func initLogger(cfgPath string, debug bool) error {
 		return fmt.Errorf("error creating log file: %w", err)
 	}
 
-	logLevel := slog.LevelError
 	if debug {
-		logLevel = slog.LevelDebug
+		baseLogLevel = slog.LevelDebug
 	}
+	logLevel.Set(baseLogLevel)
 
 	opts := &slog.HandlerOptions{
-		Level:     logLevel,
+		Level:     &logLevel,
 		AddSource: true,
 	}
 
@@ -176,7 +218,27 @@ func main() {
 		}
 	}()
 
-	if _, err := p.Run(); err != nil {
+	go func() {
+		for msg := range m.autoScanProgress {
+			p.Send(autoScanMsg(msg))
+		}
+	}()
+
+	go func() {
+		for id := range m.watchChanges {
+			p.Send(documentChangedMsg(id))
+		}
+	}()
+
+	go func() {
+		for msg := range m.ragDebugs {
+			p.Send(msg)
+		}
+	}()
+
+	_, err = p.Run()
+	m.stopWatchers()
+	if err != nil {
 		fmt.Println("Error running program:", err)
 		os.Exit(1)
 	}
@@ -200,16 +262,29 @@ func newMainModel(db *bolt.DB, vectordb *chromem.DB) (mainModel, error) {
 		return mainModel{}, fmt.Errorf("failed to load llm settings: %w", err)
 	}
 
-	m.viewState = viewStateSessions
-	if !m.providersIsConfigured() || !m.llmIsConfigured() {
-		m.viewState = viewStateOptions
+	debug, err := loadDebugTraffic(db)
+	if err != nil {
+		return mainModel{}, fmt.Errorf("failed to load debug traffic setting: %w", err)
+	}
+	setDebugTraffic(debug)
+
+	m.ragSettings, err = loadRAGSettings(db)
+	if err != nil {
+		return mainModel{}, fmt.Errorf("failed to load rag settings: %w", err)
 	}
 
+	// The rag is refreshed first, as it clears the roles of the providers that
+	// are not available anymore.
 	m, err = m.refreshRAG()
 	if err != nil {
 		return m, fmt.Errorf("failed to refresh rag: %w", err)
 	}
 
+	m.viewState = viewStateSessions
+	if !m.providersIsConfigured() || !m.llmIsConfigured() {
+		m.viewState = viewStateOptions
+	}
+
 	m.keymap = newKeymap()
 
 	m, err = m.initSessions()
@@ -217,6 +292,8 @@ func newMainModel(db *bolt.DB, vectordb *chromem.DB) (mainModel, error) {
 		return m, fmt.Errorf("error initializing sessions: %w", err)
 	}
 	m = m.initChat()
+	m = m.initChatContext()
+	m = m.initRAGDebug()
 	m = m.initOptions()
 
 	m, err = m.initDocuments()
@@ -224,6 +301,9 @@ func newMainModel(db *bolt.DB, vectordb *chromem.DB) (mainModel, error) {
 		return m, fmt.Errorf("error initializing documents: %w", err)
 	}
 	m = m.initDocumentScan()
+	for i := range m.documents {
+		m = m.updateWatcher(i)
+	}
 
 	m.helpModel = help.New()
 
@@ -231,7 +311,7 @@ func newMainModel(db *bolt.DB, vectordb *chromem.DB) (mainModel, error) {
 }
 
 func (mainModel) Init() tea.Cmd {
-	return tea.EnterAltScreen
+	return tea.Batch(tea.EnterAltScreen, autoScanTick())
 }
 
 func (m mainModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
@@ -247,6 +327,27 @@ func (m mainModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		// We put this handler here because this title generation message might
 		// be received when viewState is not viewStateChat.
 		return m.handleChatsResponseTitle(msg), nil
+	case providerStatusMsg:
+		// The checks may finish after the user left the providers list.
+		return m.handleProviderStatusMsg(msg), nil
+	case ragDebugMsg:
+		return m.handleRAGDebugMsg(msg), nil
+	case autoScanTickMsg:
+		return m.startDueAutoScan(time.Time(msg)), autoScanTick()
+	case autoScanMsg:
+		return m.handleAutoScanMsg(msg), nil
+	case documentChangedMsg:
+		return m.handleDocumentChangedMsg(msg), nil
+	case documentFreshnessMsg:
+		// The checks may finish after the user left the documents list.
+		return m.handleDocumentFreshnessMsg(msg), nil
+	case documentScanLogMsg:
+		// The last message of a cancelled scan may come after the user left
+		// the scan view.
+		if m.viewState != viewStateDocumentScan && (msg.err != nil || msg.done) {
+			m.documentScanDocumentID = 0
+			return m, nil
+		}
 	}
 
 	var cmd tea.Cmd
@@ -268,12 +369,24 @@ func (m mainModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		m, cmd = m.handleProvidersEvents(msg)
 	case viewStateProviderForm:
 		m, cmd = m.handleProviderFormEvents(msg)
+	case viewStateProviderInstanceForm:
+		m, cmd = m.handleProviderInstanceFormEvents(msg)
 	case viewStateConvoLLMForm:
 		m, cmd = m.handleConvoLLMFormEvents(msg)
 	case viewStateGenTitleLLMForm:
 		m, cmd = m.handleGenTitleLLMFormEvents(msg)
 	case viewStateEmbedderLLMForm:
 		m, cmd = m.handleEmbedderLLMFormEvents(msg)
+	case viewStateRAGSettingsForm:
+		m, cmd = m.handleRAGSettingsFormEvents(msg)
+	case viewStateChatContext:
+		m, cmd = m.handleChatContextEvents(msg)
+	case viewStateRAGDebug:
+		m, cmd = m.handleRAGDebugEvents(msg)
+	case viewStateEmbedderChange:
+		m, cmd = m.handleEmbedderChangeEvents(msg)
+	case viewStatePromptTemplateForm:
+		m, cmd = m.handlePromptTemplateFormEvents(msg)
 	}
 
 	return m, cmd
@@ -299,12 +412,24 @@ func (m mainModel) View() string {
 		vs = append(vs, m.providersView())
 	case viewStateProviderForm:
 		vs = append(vs, m.providerFormView())
+	case viewStateProviderInstanceForm:
+		vs = append(vs, m.providerInstanceFormView())
 	case viewStateConvoLLMForm:
 		vs = append(vs, m.convoLLMFormView())
 	case viewStateGenTitleLLMForm:
 		vs = append(vs, m.genTitleLLMFormView())
 	case viewStateEmbedderLLMForm:
 		vs = append(vs, m.embedderLLMFormView())
+	case viewStateRAGSettingsForm:
+		vs = append(vs, m.ragSettingsFormView())
+	case viewStateChatContext:
+		vs = append(vs, m.chatContextView())
+	case viewStateRAGDebug:
+		vs = append(vs, m.ragDebugView())
+	case viewStateEmbedderChange:
+		vs = append(vs, m.embedderChangeFormView())
+	case viewStatePromptTemplateForm:
+		vs = append(vs, m.promptTemplateFormView())
 	default:
 		m.err = fmt.Errorf("unknown view state %d", m.viewState)
 	}
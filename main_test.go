@@ -1,10 +1,28 @@
 package main
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+	"unicode/utf8"
 
+	"github.com/charmbracelet/bubbles/list"
 	"github.com/philippgille/chromem-go"
 	bolt "go.etcd.io/bbolt"
 )
@@ -159,3 +177,2450 @@ func TestInitLogger(t *testing.T) {
 		})
 	}
 }
+
+func TestLoadLLMProvidersMigration(t *testing.T) {
+	db, tempDir := setupTestDB(t)
+	defer os.RemoveAll(tempDir)
+	defer db.Close()
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(llmProviderSettingsBucket))
+		return b.Put([]byte("ollama"), []byte(`{"host":"http://gpu-box:11434"}`))
+	})
+	if err != nil {
+		t.Fatalf("Failed to store legacy settings: %v", err)
+	}
+
+	providers, err := loadLLMProviders(db)
+	if err != nil {
+		t.Fatalf("loadLLMProviders() error = %v, want nil", err)
+	}
+	if len(providers) != len(providerTypes) {
+		t.Fatalf("loadLLMProviders() returned %d providers, want %d", len(providers), len(providerTypes))
+	}
+	if providers[0].name() != providerOllama {
+		t.Errorf("providers[0].name() = %q, want %q", providers[0].name(), providerOllama)
+	}
+	if !providers[0].isConfigured() {
+		t.Errorf("migrated %s is not configured", providerOllama)
+	}
+
+	// Add a second Ollama instance and check it survives a reload.
+	second := namedProvider{llmProvider: ollamaProvider{Host: "http://localhost:11434"}, instanceName: "Ollama (local)"}
+	if err := saveLLMProviders(db, append(providers, second)); err != nil {
+		t.Fatalf("saveLLMProviders() error = %v, want nil", err)
+	}
+
+	providers, err = loadLLMProviders(db)
+	if err != nil {
+		t.Fatalf("loadLLMProviders() error = %v, want nil", err)
+	}
+	last := providers[len(providers)-1].(namedProvider)
+	if last.name() != "Ollama (local)" || last.typeName() != providerOllama {
+		t.Errorf("last provider = %q of type %q, want %q of type %q",
+			last.name(), last.typeName(), "Ollama (local)", providerOllama)
+	}
+}
+
+// chunkBody returns the content of the chunk without its header.
+func chunkBody(c chromem.Document) string {
+	body, _ := splitChunkHeader(c.Content, c.Metadata)
+	return body
+}
+
+// withoutChunkHeaders removes the headers of the chunks from their merged
+// content.
+func withoutChunkHeaders(content string, chunks []chromem.Document) string {
+	for _, c := range chunks {
+		if header := c.Metadata[chunkHeaderKey]; header != "" {
+			content = strings.ReplaceAll(content, header+"\n", "")
+		}
+	}
+	return content
+}
+
+// chunkResults returns the chunks as the results of a query, for mergeChunks.
+func chunkResults(chunks []chromem.Document) []chromem.Result {
+	res := make([]chromem.Result, len(chunks))
+	for i, c := range chunks {
+		res[i] = chromem.Result{ID: c.ID, Content: c.Content, Metadata: c.Metadata}
+	}
+	return res
+}
+
+func TestChunkDocumentProseBoundaries(t *testing.T) {
+	paragraphs := []string{
+		"The café opened at dawn. Élodie served crème brûlée to the first guests! Was it too sweet? Nobody complained.",
+		"東京の朝は早い。電車はもう満員だ。駅の前で友達を待っている。",
+		"Emoji work too 🎉🚀. The party lasted until midnight, and everyone went home happy.",
+		"Ça marche très bien, n'est-ce pas? Oui, c'est évident.",
+	}
+	var sb strings.Builder
+	for i := 0; i < 6; i++ {
+		for _, p := range paragraphs {
+			sb.WriteString(p)
+			sb.WriteString("\n\n")
+		}
+	}
+	content := sb.String()
+
+	doc := chromem.Document{ID: "doc", Content: content, Metadata: map[string]string{"filename": "notes.txt"}}
+	chunks := chunkDocument(doc, heuristicTokenizer{}, 48, 8, 0)
+	if len(chunks) < 2 {
+		t.Fatalf("chunkDocument() returned %d chunks, want several", len(chunks))
+	}
+
+	for i, c := range chunks {
+		body := chunkBody(c)
+		if !utf8.ValidString(body) {
+			t.Errorf("chunk %d is not valid UTF-8: %q", i, body)
+		}
+		if i == len(chunks)-1 {
+			continue
+		}
+		trimmed := strings.TrimSpace(body)
+		last, _ := utf8.DecodeLastRuneInString(trimmed)
+		if !strings.ContainsRune(".!?。", last) {
+			t.Errorf("chunk %d doesn't end at a sentence end: %q", i, body)
+		}
+	}
+
+	merged := mergeChunks(chunkResults(chunks))
+	if len(merged) != 1 {
+		t.Fatalf("mergeChunks() returned %d documents, want 1", len(merged))
+	}
+	// The header of the chunks is only kept once.
+	if want := "File: notes.txt\n" + content; merged[0].Content != want {
+		t.Errorf("mergeChunks() content = %q, want %q", merged[0].Content, want)
+	}
+}
+
+func TestChunkDocumentLongSentence(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		wantWord bool
+	}{
+		{"words without sentence end", strings.Repeat("naïve résumé ", 200), true},
+		{"ideographs without sentence end", strings.Repeat("日本語のテキスト", 100), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc := chromem.Document{ID: "doc", Content: tt.content, Metadata: map[string]string{"filename": "long.txt"}}
+			chunks := chunkDocument(doc, heuristicTokenizer{}, 32, 4, 0)
+			if len(chunks) < 2 {
+				t.Fatalf("chunkDocument() returned %d chunks, want several", len(chunks))
+			}
+
+			for i, c := range chunks {
+				body := chunkBody(c)
+				if !utf8.ValidString(body) {
+					t.Errorf("chunk %d is not valid UTF-8: %q", i, body)
+				}
+				if n := len(heuristicTokenizer{}.tokenize(body)); n > 32 {
+					t.Errorf("chunk %d has %d tokens, want at most the chunk size", i, n)
+				}
+				// A sentence of words is cut between the words.
+				if tt.wantWord && !strings.HasSuffix(body, "naïve") && !strings.HasSuffix(body, "résumé") &&
+					i < len(chunks)-1 {
+					t.Errorf("chunk %d is cut in a word: %q", i, body)
+				}
+			}
+
+			merged := mergeChunks(chunkResults(chunks))
+			if len(merged) != 1 || withoutChunkHeaders(merged[0].Content, chunks) != tt.content {
+				t.Errorf("mergeChunks() doesn't reassemble the content")
+			}
+		})
+	}
+}
+
+func TestChunkDocumentTinyTail(t *testing.T) {
+	content := strings.Repeat("The quick brown fox jumps over the lazy dog. ", 12) + "The end."
+	doc := chromem.Document{ID: "doc", Content: content, Metadata: map[string]string{"filename": "fox.txt"}}
+
+	chunks := chunkDocument(doc, heuristicTokenizer{}, 32, 4, 0)
+	if len(chunks) < 3 {
+		t.Fatalf("chunkDocument() returned %d chunks, want several", len(chunks))
+	}
+	tail := utf8.RuneCountInString(strings.TrimSpace(chunkBody(chunks[len(chunks)-1])))
+
+	tests := []struct {
+		name     string
+		minChars int
+		want     int
+	}{
+		{"at the minimum", tail, len(chunks)},
+		{"under the minimum", tail + 1, len(chunks) - 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := chunkDocument(doc, heuristicTokenizer{}, 32, 4, tt.minChars)
+			if len(got) != tt.want {
+				t.Fatalf("chunkDocument() returned %d chunks, want %d", len(got), tt.want)
+			}
+
+			merged := mergeChunks(chunkResults(got))
+			if len(merged) != 1 || withoutChunkHeaders(merged[0].Content, got) != content {
+				t.Errorf("mergeChunks() doesn't reassemble the content")
+			}
+		})
+	}
+
+	t.Run("another section", func(t *testing.T) {
+		md := "# Guide\n\n" + content + "\n\n# License\n\nMIT.\n"
+		doc := chromem.Document{ID: "guide", Content: md, Metadata: map[string]string{"filename": "guide.md"}}
+
+		got := chunkDocument(doc, heuristicTokenizer{}, 32, 4, 100)
+		if section := got[len(got)-1].Metadata["headingPath"]; section != "License" {
+			t.Errorf("last chunk section = %q, want the License section kept", section)
+		}
+	})
+}
+
+func TestIsTinyFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		minChars int
+		want     bool
+	}{
+		{"under the minimum", strings.Repeat("é", 99), 100, true},
+		{"at the minimum", strings.Repeat("é", 100), 100, false},
+		{"spaces don't count", "\n  " + strings.Repeat("a", 99) + "  \n", 100, true},
+		{"no minimum", "", 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isTinyFile(tt.content, tt.minChars); got != tt.want {
+				t.Errorf("isTinyFile() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChunkDocumentMultiByte(t *testing.T) {
+	japanese := strings.Repeat("# 日本語の見出し\n\n吾輩は猫である。名前はまだ無い。どこで生れたかとんと見当がつかぬ。"+
+		"何でも薄暗いじめじめした所でニャーニャー泣いていた事だけは記憶している。\n\n", 8)
+	emoji := strings.Repeat("Family 👨‍👩‍👧‍👦 trip to 🇯🇵 and 🇫🇷 👍🏽👍🏽👍🏽 "+
+		"with cafe\u0301 and nai\u0308ve friends ❤️‍🔥❤️‍🔥🎉🎉🎉🎉 ", 12)
+
+	tests := []struct {
+		name     string
+		filename string
+		content  string
+		tok      tokenizer
+	}{
+		{"japanese markdown", "neko.md", japanese, heuristicTokenizer{}},
+		{"japanese markdown with tiktoken", "neko.md", japanese, newTiktokenTokenizer("text-embedding-3-small")},
+		{"emoji text", "trip.txt", emoji, heuristicTokenizer{}},
+		{"emoji text with tiktoken", "trip.txt", emoji, newTiktokenTokenizer("text-embedding-3-small")},
+		{"emoji code", "trip.go", "package trip\n\n// Emoji are fun.\nvar s = \"" + emoji + "\"\n", heuristicTokenizer{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			boundaries := map[int]bool{0: true}
+			for _, end := range graphemeEnds(tt.content) {
+				boundaries[end] = true
+			}
+
+			doc := chromem.Document{ID: "doc", Content: tt.content, Metadata: map[string]string{"filename": tt.filename}}
+			chunks := chunkDocument(doc, tt.tok, 16, 4, 0)
+			if len(chunks) < 2 {
+				t.Fatalf("chunkDocument() returned %d chunks, want several", len(chunks))
+			}
+
+			// A chunk starts where the previous one ended, less its overlap.
+			end := 0
+			for i, c := range chunks {
+				body := chunkBody(c)
+				if !utf8.ValidString(body) {
+					t.Errorf("chunk %d is not valid UTF-8: %q", i, body)
+				}
+				overlap, _ := strconv.Atoi(c.Metadata["overlap"])
+				start := end - overlap
+				end = start + len(body)
+				if !boundaries[start] || !boundaries[end] {
+					t.Errorf("chunk %d is cut inside a character: %q", i, body)
+				}
+			}
+
+			merged := mergeChunks(chunkResults(chunks))
+			if len(merged) != 1 {
+				t.Fatalf("mergeChunks() returned %d documents, want 1", len(merged))
+			}
+			if got := withoutChunkHeaders(merged[0].Content, chunks); got != tt.content {
+				t.Errorf("mergeChunks() content = %q, want %q", got, tt.content)
+			}
+		})
+	}
+}
+
+func TestSplitOversizedChunksMultiByte(t *testing.T) {
+	content := strings.Repeat("👨‍👩‍👧‍👦日本🇯🇵e\u0301", 50)
+	chunks := []chromem.Document{{ID: "doc-chunk-0", Content: content}}
+
+	parts, split := splitOversizedChunks(chunks, 4)
+	if split != 1 || len(parts) < 2 {
+		t.Fatalf("splitOversizedChunks() split %d chunks into %d parts, want 1 into several", split, len(parts))
+	}
+
+	boundaries := map[int]bool{0: true}
+	for _, end := range graphemeEnds(content) {
+		boundaries[end] = true
+	}
+
+	var sb strings.Builder
+	for i, p := range parts {
+		if !utf8.ValidString(p.Content) {
+			t.Errorf("part %d is not valid UTF-8: %q", i, p.Content)
+		}
+		sb.WriteString(p.Content)
+		if !boundaries[sb.Len()] {
+			t.Errorf("part %d is cut inside a character: %q", i, p.Content)
+		}
+	}
+	if sb.String() != content {
+		t.Errorf("the parts join as %q, want %q", sb.String(), content)
+	}
+}
+
+func TestMergeChunks(t *testing.T) {
+	chunk := func(file string, index, overlap int, content string, similarity float32, extra ...string) chromem.Result {
+		md := map[string]string{
+			"filename":   file,
+			"originalID": file,
+			"chunkIndex": strconv.Itoa(index),
+			"overlap":    strconv.Itoa(overlap),
+		}
+		for i := 0; i+1 < len(extra); i += 2 {
+			md[extra[i]] = extra[i+1]
+		}
+		id := fmt.Sprintf("%s-chunk-%d", file, index)
+		if part, ok := md["part"]; ok {
+			id += "-part-" + part
+		}
+		return chromem.Result{ID: id, Content: content, Metadata: md, Similarity: similarity}
+	}
+
+	tests := []struct {
+		name        string
+		docs        []chromem.Result
+		wantContent []string
+		wantSim     []float32
+	}{
+		{
+			name: "merged chunks rank by their best similarity",
+			docs: []chromem.Result{
+				chunk("a.md", 1, 7, "world. Bye now.", 0.7),
+				chunk("a.md", 0, 0, "Hello world. ", 0.6),
+				chunk("b.md", 0, 0, "The single best chunk.", 0.8),
+			},
+			wantContent: []string{"The single best chunk.", "Hello world. Bye now."},
+			wantSim:     []float32{0.8, 0.7},
+		},
+		{
+			name: "merged chunk ranks above a weaker single chunk",
+			docs: []chromem.Result{
+				chunk("b.md", 0, 0, "A weak chunk.", 0.55),
+				chunk("a.md", 0, 0, "Hello world. ", 0.9),
+				chunk("a.md", 1, 7, "world. Bye now.", 0.6),
+			},
+			wantContent: []string{"Hello world. Bye now.", "A weak chunk."},
+			wantSim:     []float32{0.9, 0.55},
+		},
+		{
+			name: "non-contiguous chunks stay separate",
+			docs: []chromem.Result{
+				chunk("a.md", 0, 0, "First. ", 0.7),
+				chunk("a.md", 1, 3, "t. Second. ", 0.6),
+				chunk("a.md", 3, 4, "rd. Fourth.", 0.8),
+			},
+			wantContent: []string{"rd. Fourth.", "First. Second. "},
+			wantSim:     []float32{0.8, 0.7},
+		},
+		{
+			name: "parts of a split chunk are merged in order",
+			docs: []chromem.Result{
+				chunk("a.md", 0, 0, "One ", 0.5),
+				chunk("a.md", 1, 0, "wo ", 0.7, "part", "1", "parts", "2"),
+				chunk("a.md", 1, 2, "e t", 0.6, "part", "0", "parts", "2"),
+				chunk("a.md", 2, 3, "wo three", 0.5),
+			},
+			wantContent: []string{"One two three"},
+			wantSim:     []float32{0.7},
+		},
+		{
+			name: "next chunk after a missing part stays separate",
+			docs: []chromem.Result{
+				chunk("a.md", 1, 0, "One ", 0.7, "part", "0", "parts", "2"),
+				chunk("a.md", 2, 0, "three", 0.6),
+			},
+			wantContent: []string{"One ", "three"},
+			wantSim:     []float32{0.7, 0.6},
+		},
+		{
+			name: "repeated headers are stripped",
+			docs: []chromem.Result{
+				chunk("a.md", 0, 0, "File: a.md | Section: A\nOne ", 0.5, "header", "File: a.md | Section: A"),
+				chunk("a.md", 1, 0, "File: a.md | Section: A\ntwo", 0.6, "header", "File: a.md | Section: A"),
+				chunk("a.md", 2, 0, "File: a.md | Section: B\nthree", 0.4, "header", "File: a.md | Section: B"),
+			},
+			wantContent: []string{"File: a.md | Section: A\nOne two\nFile: a.md | Section: B\nthree"},
+			wantSim:     []float32{0.6},
+		},
+		{
+			name: "last chunk shorter than the recorded overlap",
+			docs: []chromem.Result{
+				chunk("a.md", 0, 0, "Hello world. ", 0.5),
+				chunk("a.md", 1, 7, "d. Bye", 0.6),
+			},
+			wantContent: []string{"Hello world. Bye"},
+			wantSim:     []float32{0.6},
+		},
+		{
+			name: "last chunk repeating only the end of the previous one",
+			docs: []chromem.Result{
+				chunk("a.md", 0, 0, "Hello world. ", 0.5),
+				chunk("a.md", 1, 7, "world. ", 0.6),
+			},
+			wantContent: []string{"Hello world. "},
+			wantSim:     []float32{0.6},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			merged := mergeChunks(tt.docs)
+			sortResults(merged)
+
+			if len(merged) != len(tt.wantContent) {
+				t.Fatalf("mergeChunks() returned %d results, want %d: %v", len(merged), len(tt.wantContent), merged)
+			}
+			for i, m := range merged {
+				if m.Content != tt.wantContent[i] {
+					t.Errorf("result %d content = %q, want %q", i, m.Content, tt.wantContent[i])
+				}
+				if m.Similarity != tt.wantSim[i] {
+					t.Errorf("result %d similarity = %v, want %v", i, m.Similarity, tt.wantSim[i])
+				}
+			}
+		})
+	}
+}
+
+func TestMergeChunksSeams(t *testing.T) {
+	text := strings.Repeat("The café opened at dawn, Élodie served crème brûlée to the first guests. ", 20)
+
+	// The lengths are not multiples of the stride of the chunks, so the last
+	// chunk is shorter than the others, down to less than the overlap.
+	for _, length := range []int{301, 517, 733, 1009, 1212} {
+		content := text[:length]
+		for !utf8.ValidString(content) {
+			content = content[:len(content)-1]
+		}
+
+		t.Run(fmt.Sprintf("tokens/%d", length), func(t *testing.T) {
+			for _, minChunkChars := range []int{0, defaultMinChunkChars} {
+				doc := chromem.Document{ID: "doc", Content: content, Metadata: map[string]string{"filename": "cafe.txt"}}
+				chunks := chunkDocument(doc, heuristicTokenizer{}, 24, 6, minChunkChars)
+				merged := mergeChunks(chunkResults(chunks))
+				if len(merged) != 1 || withoutChunkHeaders(merged[0].Content, chunks) != content {
+					t.Errorf("mergeChunks() with a minimum of %d characters = %q, want %q",
+						minChunkChars, merged[0].Content, content)
+				}
+			}
+		})
+
+		// The legacy chunks were cut every 300 bytes, with a constant overlap
+		// of legacyChunkOverlap bytes, in the middle of the characters.
+		t.Run(fmt.Sprintf("legacy/%d", length), func(t *testing.T) {
+			const legacyChunkSize = 300
+			content := strings.Repeat("東京の朝は早い。電車はもう満員だ。", 30)[:length/3*3]
+			var chunks []chromem.Result
+			for i := 0; i < len(content); i += legacyChunkSize - legacyChunkOverlap {
+				end := min(i+legacyChunkSize, len(content))
+				chunks = append(chunks, chromem.Result{
+					ID:      fmt.Sprintf("doc-chunk-%d", len(chunks)),
+					Content: content[i:end],
+					Metadata: map[string]string{
+						"filename":   "cafe.txt",
+						"originalID": "doc",
+						"chunkIndex": strconv.Itoa(len(chunks)),
+					},
+				})
+				if end == len(content) {
+					break
+				}
+			}
+
+			merged := mergeChunks(chunks)
+			if len(merged) != 1 || merged[0].Content != content {
+				t.Errorf("mergeChunks() = %q, want %q", merged[0].Content, content)
+			}
+		})
+	}
+}
+
+func TestSelectResults(t *testing.T) {
+	// The chunks of a document are of files of their own, so they're not
+	// merged.
+	results := func(doc string, similarities ...float32) []chromem.Result {
+		rs := make([]chromem.Result, len(similarities))
+		for i, s := range similarities {
+			id := fmt.Sprintf("%s-%d.md", doc, i)
+			rs[i] = chromem.Result{
+				ID:         id,
+				Metadata:   map[string]string{"filename": id},
+				Content:    fmt.Sprintf("the content of the file %s about its own subject", id),
+				Similarity: s,
+			}
+		}
+		return rs
+	}
+	big := results("big", 0.95, 0.9, 0.85, 0.8, 0.75, 0.7, 0.65, 0.6)
+	small := results("small", 0.55)
+	medium := results("medium", 0.58, 0.57)
+
+	tests := []struct {
+		name       string
+		docResults [][]chromem.Result
+		strategy   string
+		needed     int
+		want       []string
+	}{
+		{
+			name:       "global ranks all the chunks together",
+			docResults: [][]chromem.Result{big, small},
+			strategy:   retrievalStrategyGlobal,
+			needed:     3,
+			want:       []string{"big-0.md", "big-1.md", "big-2.md"},
+		},
+		{
+			name:       "balanced takes a share of each document",
+			docResults: [][]chromem.Result{big, small},
+			strategy:   retrievalStrategyBalanced,
+			needed:     4,
+			want:       []string{"big-0.md", "big-1.md", "big-2.md", "small-0.md"},
+		},
+		{
+			name:       "shares over the needed results leave out the least similar",
+			docResults: [][]chromem.Result{big, medium, small},
+			strategy:   retrievalStrategyBalanced,
+			needed:     4,
+			want:       []string{"big-0.md", "big-1.md", "medium-0.md", "medium-1.md"},
+		},
+		{
+			name:       "balanced falls back to the global ranking",
+			docResults: [][]chromem.Result{big, small},
+			strategy:   retrievalStrategyBalanced,
+			needed:     6,
+			want:       []string{"big-0.md", "big-1.md", "big-2.md", "big-3.md", "big-4.md", "small-0.md"},
+		},
+		{
+			name:       "balanced with a document without chunks",
+			docResults: [][]chromem.Result{big, nil},
+			strategy:   retrievalStrategyBalanced,
+			needed:     2,
+			want:       []string{"big-0.md", "big-1.md"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sel := selectResults(tt.docResults, tt.strategy, tt.needed, defaultMMRLambda)
+
+			var got []string
+			for _, r := range sel.results {
+				got = append(got, r.ID)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("selectResults() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMMRWindow(t *testing.T) {
+	result := func(id string, similarity float32, embedding ...float32) chromem.Result {
+		return chromem.Result{ID: id, Similarity: similarity, Embedding: embedding}
+	}
+	// The first two chunks are of the same section, almost the same.
+	results := []chromem.Result{
+		result("section-0", 0.9, 1, 0),
+		result("section-1", 0.89, 0.99, 0.01),
+		result("section-2", 0.88, 0.98, 0.02),
+		result("other", 0.7, 0, 1),
+		result("another", 0.65, 0.7, 0.7),
+	}
+
+	tests := []struct {
+		name     string
+		lambda   float32
+		needed   int
+		want     []string
+		wantRest []string
+	}{
+		{
+			name:     "lambda of 1 keeps the similarity ranking",
+			lambda:   1,
+			needed:   3,
+			want:     []string{"section-0", "section-1", "section-2"},
+			wantRest: []string{"other", "another"},
+		},
+		{
+			name:     "lower lambda takes the chunks unlike the ones taken",
+			lambda:   0.5,
+			needed:   3,
+			want:     []string{"section-0", "other", "another"},
+			wantRest: []string{"section-1", "section-2"},
+		},
+		{
+			name:   "more needed than the results",
+			lambda: 0.5,
+			needed: 10,
+			want:   []string{"section-0", "other", "another", "section-1", "section-2"},
+		},
+	}
+
+	ids := func(rs []chromem.Result) []string {
+		var res []string
+		for _, r := range rs {
+			res = append(res, r.ID)
+		}
+		return res
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			window, rest := mmrWindow(results, tt.lambda, tt.needed)
+			if got := ids(window); !slices.Equal(got, tt.want) {
+				t.Errorf("mmrWindow() window = %v, want %v", got, tt.want)
+			}
+			if got := ids(rest); !slices.Equal(got, tt.wantRest) {
+				t.Errorf("mmrWindow() rest = %v, want %v", got, tt.wantRest)
+			}
+		})
+	}
+}
+
+func TestSessionSwitchKeepsHistoriesApart(t *testing.T) {
+	db, tempDir := setupTestDB(t)
+	defer os.RemoveAll(tempDir)
+	defer db.Close()
+
+	model, err := newMainModel(db, setupTestVectorDB(t, tempDir))
+	if err != nil {
+		t.Fatalf("newMainModel() error = %v", err)
+	}
+	model.width, model.height = 100, 30
+	convo := recordingLLM{answer: "An answer.", prompts: make(chan []chat, 1)}
+	model.rag = newRAG(model.vectordb, convo, convo, testEmbedder{}, llmSetting{}, llmSetting{}, nil, defaultRAGSettings())
+
+	user := func(content string) chat { return chat{Role: roleUser, Content: content} }
+	assistant := func(content string) chat { return chat{Role: roleAssistant, Content: content} }
+	model.sessions = []session{
+		{ID: 1, Chats: []chat{user("What is session A about?"), assistant("Session A is about apples.")}},
+		{ID: 2, Chats: []chat{user("What is session B about?"), assistant("Session B is about bananas.")}},
+	}
+
+	send := func(index int, msg string) []chat {
+		t.Helper()
+		model = model.selectSession(index)
+		model.chatTextArea.SetValue(msg)
+		model, _ = model.sendChat()
+		// The responses are drained first, the stages are sent before the
+		// prompt.
+		for res := range model.llmResponses {
+			if res.err != nil {
+				t.Fatalf("chat error = %v", res.err)
+			}
+			if res.done {
+				break
+			}
+		}
+		return <-convo.prompts
+	}
+
+	send(0, "Tell me more about apples.")
+	// The conversation of the opened session is loaded before any message.
+	model = model.selectSession(1)
+	if got := model.rag.chats; len(got) != 2 || got[1].Content != "Session B is about bananas." {
+		t.Fatalf("rag chats after opening session B = %v, want its history", got)
+	}
+
+	// Only the plain chat prompt is compared, without the documents.
+	prompt := send(1, "Tell me more about bananas.")
+	var contents []string
+	for _, c := range prompt {
+		if c.Role != roleSystem {
+			contents = append(contents, c.Content)
+		}
+	}
+	want := []string{"What is session B about?", "Session B is about bananas.", "Tell me more about bananas."}
+	if !slices.Equal(contents, want) {
+		t.Errorf("prompt of session B = %q, want %q", contents, want)
+	}
+}
+
+func TestRAGSystemPromptTemplate(t *testing.T) {
+	docs := []chromem.Result{
+		{Content: "Apples are red.", Metadata: map[string]string{"filename": "apples.md"}},
+		{Content: "Bananas are yellow.", Metadata: map[string]string{"filename": "bananas.md"}},
+		{Content: "Green apples too.", Metadata: map[string]string{"filename": "apples.md"}},
+	}
+
+	got := ragSystemPrompt(docs, "Only answer from {{filenames}}:{{knowledge}}")
+	want := "Only answer from apples.md, bananas.md:" +
+		"\n---\n[apples.md]\nApples are red.\n" +
+		"\n---\n[bananas.md]\nBananas are yellow.\n" +
+		"\n---\n[apples.md]\nGreen apples too.\n"
+	if got != want {
+		t.Errorf("ragSystemPrompt() = %q, want %q", got, want)
+	}
+
+	if got := ragSystemPrompt(docs, ""); got != ragSystemPrompt(docs, defaultPromptTemplate) {
+		t.Errorf("ragSystemPrompt() with an empty template = %q, want the built-in one", got)
+	}
+
+	tests := []struct {
+		template string
+		wantErr  bool
+	}{
+		{"", false},
+		{"Answer strictly from {{knowledge}}, citing {{filenames}}.", false},
+		{"Answer strictly from {{filenames}}.", true},
+		{"{{knowledge}} in {{language}}", true},
+	}
+	for _, tt := range tests {
+		if err := validatePromptTemplate(tt.template); (err != nil) != tt.wantErr {
+			t.Errorf("validatePromptTemplate(%q) error = %v, want error %t", tt.template, err, tt.wantErr)
+		}
+	}
+}
+
+func TestGetContextString(t *testing.T) {
+	user := func(content string) chat { return chat{Role: roleUser, Content: content} }
+	assistant := func(content string) chat { return chat{Role: roleAssistant, Content: content} }
+	failed := chat{Role: roleAssistant, Content: "Sorry", Failed: true}
+
+	tests := []struct {
+		name  string
+		chats []chat
+		want  string
+	}{
+		{
+			name:  "empty",
+			chats: nil,
+			want:  "",
+		},
+		{
+			name:  "last pairs in order",
+			chats: []chat{user("q1"), assistant("a1"), user("q2"), assistant("a2"), user("q3"), assistant("a3")},
+			want:  "User: q2\nAssistant: a2\nUser: q3\nAssistant: a3\n",
+		},
+		{
+			name:  "trailing user chat",
+			chats: []chat{user("q1"), assistant("a1"), user("q2")},
+			want:  "User: q1\nAssistant: a1\n",
+		},
+		{
+			name:  "consecutive user chats",
+			chats: []chat{user("q1"), user("q2"), assistant("a2"), user("q3"), user("q4"), assistant("a4")},
+			want:  "User: q2\nAssistant: a2\nUser: q4\nAssistant: a4\n",
+		},
+		{
+			name:  "failed answer",
+			chats: []chat{user("q1"), assistant("a1"), user("q2"), failed, user("q3"), assistant("a3")},
+			want:  "User: q1\nAssistant: a1\nUser: q3\nAssistant: a3\n",
+		},
+		{
+			name: "starts with an assistant and a system chat",
+			chats: []chat{
+				assistant("hello"), {Role: roleSystem, Content: "system"}, user("q1"), assistant("a1"),
+			},
+			want: "User: q1\nAssistant: a1\n",
+		},
+		{
+			name:  "consecutive answers",
+			chats: []chat{user("q1"), assistant("a1"), assistant("a1 again"), user("q2"), assistant("a2")},
+			want:  "User: q1\nAssistant: a1\nUser: q2\nAssistant: a2\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := getContextString(tt.chats); got != tt.want {
+				t.Errorf("getContextString() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// recordingLLM answers every chat with the same content, and records the
+// prompts it was sent.
+type recordingLLM struct {
+	answer  string
+	prompts chan []chat
+}
+
+func (l recordingLLM) chat(_ context.Context, _ []chat) llmResponse {
+	return llmResponse{content: l.answer}
+}
+
+func (l recordingLLM) chatStream(_ context.Context, cs []chat) <-chan llmResponse {
+	l.prompts <- slices.Clone(cs)
+	res := make(chan llmResponse, 1)
+	res <- llmResponse{content: l.answer}
+	close(res)
+	return res
+}
+
+// testEmbedder embeds the texts by their length, which is enough to store and
+// list the chunks.
+type testEmbedder struct{}
+
+func (testEmbedder) embeddingFunc() chromem.EmbeddingFunc {
+	return func(_ context.Context, text string) ([]float32, error) {
+		return []float32{1, float32(len(text)%10) + 1}, nil
+	}
+}
+
+// testFileContent is a file long enough not to be skipped as too small by the
+// scans.
+const testFileContent = "The file has enough words to answer a question. " +
+	"The file has enough words to answer a question. " +
+	"The file has enough words to answer a question. "
+
+// scanTestDocument scans the document like the documents view, applying the
+// finished scan to the document. The messages of the scan are
+// returned for its logs.
+func scanTestDocument(
+	t *testing.T,
+	r *rag,
+	doc *document,
+	states map[string]fileState,
+) (map[string]fileState, []documentScanLogMsg) {
+	t.Helper()
+
+	progress := make(chan documentScanLogMsg)
+	go r.scanDocument(context.Background(), *doc, states, progress)
+	var logs []documentScanLogMsg
+	for msg := range progress {
+		if msg.err != nil {
+			t.Fatalf("scan failed: %v", msg.err)
+		}
+		logs = append(logs, msg)
+		if msg.done {
+			*doc = doc.withScan(msg)
+			return msg.fileStates, logs
+		}
+	}
+	return nil, logs
+}
+
+// scanSummary returns the summary of the scan from its logs.
+func scanSummary(logs []documentScanLogMsg) string {
+	for _, msg := range logs {
+		if strings.HasPrefix(msg.content, "Scanned ") {
+			return msg.content
+		}
+	}
+	return ""
+}
+
+// scanLogContents returns the lines of the logs of the scan.
+func scanLogContents(logs []documentScanLogMsg) []string {
+	var contents []string
+	for _, msg := range logs {
+		contents = append(contents, msg.content)
+	}
+	return contents
+}
+
+// collectionPaths returns the sorted paths of the files of the chunks of the
+// document.
+func collectionPaths(t *testing.T, vectordb *chromem.DB, doc document) []string {
+	t.Helper()
+
+	coll := vectordb.GetCollection(doc.vectorDBCollectionName(), testEmbedder{}.embeddingFunc())
+	if coll == nil {
+		return nil
+	}
+	results, err := coll.QueryEmbedding(context.Background(), []float32{1, 1}, coll.Count(), nil, nil)
+	if err != nil {
+		t.Fatalf("QueryEmbedding() error = %v", err)
+	}
+	var paths []string
+	for _, res := range results {
+		paths = append(paths, res.Metadata["path"])
+	}
+	slices.Sort(paths)
+	return slices.Compact(paths)
+}
+
+func TestRescanReplacesStaleChunks(t *testing.T) {
+	for _, full := range []bool{false, true} {
+		t.Run(fmt.Sprintf("full=%t", full), func(t *testing.T) {
+			tempDir := t.TempDir()
+			docDir := filepath.Join(tempDir, "docs")
+			if err := os.Mkdir(docDir, 0o755); err != nil {
+				t.Fatal(err)
+			}
+			writeFile := func(name, content string) {
+				if err := os.WriteFile(filepath.Join(docDir, name), []byte(content), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			writeFile("kept.md", "The kept file stays the same.")
+			writeFile("edited.md", "The first version of the edited file.")
+			writeFile("deleted.md", "The deleted file is removed before the rescan.")
+
+			// The files are short, none is skipped as too small.
+			settings := defaultRAGSettings()
+			settings.MinChunkChars = 0
+			embedderSetting := llmSetting{Provider: "test", Model: "test"}
+			r := newRAG(setupTestVectorDB(t, tempDir), nil, nil, testEmbedder{},
+				llmSetting{}, embedderSetting, nil, settings)
+			doc := document{ID: 1, Name: "docs", Path: docDir}
+			states, _ := scanTestDocument(t, r, &doc, nil)
+
+			writeFile("edited.md", "The second version, with more words than the first one.")
+			if err := os.Remove(filepath.Join(docDir, "deleted.md")); err != nil {
+				t.Fatal(err)
+			}
+			if full {
+				states = nil
+			}
+			scanTestDocument(t, r, &doc, states)
+
+			// The chunks stored on disk are the ones loaded on the next start.
+			vectordb := setupTestVectorDB(t, tempDir)
+			coll := vectordb.GetCollection(doc.vectorDBCollectionName(), testEmbedder{}.embeddingFunc())
+			if coll == nil {
+				t.Fatal("collection not found after the rescan")
+			}
+			results, err := coll.QueryEmbedding(context.Background(), []float32{1, 1}, coll.Count(), nil, nil)
+			if err != nil {
+				t.Fatalf("QueryEmbedding() error = %v", err)
+			}
+
+			var contents []string
+			for _, res := range results {
+				contents = append(contents, res.Content)
+			}
+			slices.Sort(contents)
+			want := []string{
+				"File: edited.md\nThe second version, with more words than the first one.",
+				"File: kept.md\nThe kept file stays the same.",
+			}
+			if !slices.Equal(contents, want) {
+				t.Errorf("chunks after the rescan = %q, want %q", contents, want)
+			}
+		})
+	}
+}
+
+func TestScanSkipsTinyFiles(t *testing.T) {
+	long := strings.Repeat("The long file has enough words to answer a question. ", 3)
+	tests := []struct {
+		name  string
+		files map[string]string
+		want  []string
+	}{
+		{
+			name:  "tiny files along with others",
+			files: map[string]string{"long.md": long, "tiny.md": "Too short."},
+			want:  []string{"File: long.md\n" + long},
+		},
+		{
+			name:  "only tiny files",
+			files: map[string]string{"a.md": "Too short.", "b.md": "Short too."},
+			want:  []string{"File: a.md\nToo short.", "File: b.md\nShort too."},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tempDir := t.TempDir()
+			docDir := filepath.Join(tempDir, "docs")
+			if err := os.Mkdir(docDir, 0o755); err != nil {
+				t.Fatal(err)
+			}
+			for name, content := range tt.files {
+				if err := os.WriteFile(filepath.Join(docDir, name), []byte(content), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			vectordb := setupTestVectorDB(t, tempDir)
+			r := newRAG(vectordb, nil, nil, testEmbedder{},
+				llmSetting{}, llmSetting{Provider: "test", Model: "test"}, nil, defaultRAGSettings())
+			doc := document{ID: 1, Name: "docs", Path: docDir}
+			scanTestDocument(t, r, &doc, nil)
+
+			coll := vectordb.GetCollection(doc.vectorDBCollectionName(), testEmbedder{}.embeddingFunc())
+			results, err := coll.QueryEmbedding(context.Background(), []float32{1, 1}, coll.Count(), nil, nil)
+			if err != nil {
+				t.Fatalf("QueryEmbedding() error = %v", err)
+			}
+			var contents []string
+			for _, res := range results {
+				contents = append(contents, res.Content)
+			}
+			slices.Sort(contents)
+			if !slices.Equal(contents, tt.want) {
+				t.Errorf("chunks = %q, want %q", contents, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetrieveChecksStoredEmbedder(t *testing.T) {
+	tempDir := t.TempDir()
+	docDir := filepath.Join(tempDir, "docs")
+	if err := os.Mkdir(docDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(docDir, "file.md"), []byte(testFileContent), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	vectordb := setupTestVectorDB(t, tempDir)
+	scanned := llmSetting{Provider: "test", Model: "scanned"}
+	r := newRAG(vectordb, nil, nil, testEmbedder{}, llmSetting{}, scanned, nil, defaultRAGSettings())
+	doc := document{ID: 1, Name: "docs", Path: docDir}
+	scanTestDocument(t, r, &doc, nil)
+
+	// The legacy collection was stored before the embedder was recorded with
+	// the chunks.
+	legacy := document{ID: 2, Name: "legacy"}
+	coll, err := vectordb.CreateCollection(legacy.vectorDBCollectionName(), nil, testEmbedder{}.embeddingFunc())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := coll.AddDocument(context.Background(), chromem.Document{
+		ID:        "file.md-chunk-0",
+		Content:   testFileContent,
+		Embedding: []float32{1, 1},
+		Metadata:  map[string]string{"filename": "file.md"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The record of the document doesn't tell the embedder, only its chunks
+	// do.
+	unrecorded := doc
+	unrecorded.EmbedderProvider, unrecorded.EmbedderModel, unrecorded.EmbeddingDimensions = "", "", 0
+
+	tests := []struct {
+		name     string
+		doc      document
+		embedder llmSetting
+		wantErr  string
+	}{
+		{name: "same embedder", doc: doc, embedder: scanned},
+		{name: "same unrecorded embedder", doc: unrecorded, embedder: scanned},
+		{
+			name:     "other embedder",
+			doc:      unrecorded,
+			embedder: llmSetting{Provider: "test", Model: "current"},
+			wantErr:  "document 'docs' needs rescanning (embedded with test/scanned, current embedder is test/current)",
+		},
+		{name: "legacy collection", doc: legacy, embedder: llmSetting{Provider: "test", Model: "current"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			passed, rejected, err := tt.doc.retrieve(context.Background(), vectordb, []float32{1, 1}, tt.embedder,
+				testEmbedder{}.embeddingFunc(), defaultRAGSettings(), retrievalFilter{})
+			if tt.wantErr != "" {
+				var mismatch embedderMismatchError
+				if !errors.As(err, &mismatch) {
+					t.Fatalf("retrieve() error = %v, want an embedderMismatchError", err)
+				}
+				if err.Error() != tt.wantErr {
+					t.Errorf("retrieve() error = %q, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("retrieve() error = %v", err)
+			}
+			if len(passed)+len(rejected) == 0 {
+				t.Error("retrieve() returned no chunks")
+			}
+		})
+	}
+}
+
+func testZip(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestExtractDOCX(t *testing.T) {
+	body := `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main"><w:body>
+<w:p><w:pPr><w:pStyle w:val="Heading1"/></w:pPr><w:r><w:t>Install</w:t></w:r></w:p>
+<w:p><w:r><w:t xml:space="preserve">Run the </w:t></w:r><w:r><w:t>installer.</w:t></w:r></w:p>
+<w:p><w:pPr><w:numPr><w:ilvl w:val="0"/></w:numPr></w:pPr><w:r><w:t>Linux</w:t></w:r></w:p>
+<w:p><w:pPr><w:pStyle w:val="Heading2"/></w:pPr><w:r><w:t>Options</w:t></w:r></w:p>
+<w:tbl><w:tr><w:tc><w:p><w:r><w:t>Name</w:t></w:r></w:p></w:tc><w:tc><w:p><w:r><w:t>Default</w:t></w:r></w:p></w:tc></w:tr></w:tbl>
+<w:p><w:r><w:t>Line one</w:t><w:br/><w:t>line two</w:t></w:r></w:p>
+</w:body></w:document>`
+
+	tests := []struct {
+		name    string
+		data    []byte
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "paragraphs headings lists and tables",
+			data: testZip(t, map[string]string{"word/document.xml": body}),
+			want: "# Install\n\nRun the installer.\n\n- Linux\n\n## Options\n\n| Name | Default |\n\nLine one\nline two",
+		},
+		{
+			name:    "corrupt",
+			data:    []byte("PK\x03\x04 not really a zip"),
+			wantErr: true,
+		},
+		{
+			name:    "password-protected",
+			data:    append(slices.Clone(oleMagic), "encrypted"...),
+			wantErr: true,
+		},
+		{
+			name:    "no document body",
+			data:    testZip(t, map[string]string{"docProps/core.xml": "<coreProperties/>"}),
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc, _, err := extractDocument(chromem.Document{
+				ID:       "/docs/guide.docx",
+				Metadata: map[string]string{"filename": "guide.docx"},
+			}, tt.data, extractOptions{})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("extractDocument() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if doc.Content != tt.want {
+				t.Errorf("content = %q, want %q", doc.Content, tt.want)
+			}
+			if doc.Metadata[formatKey] != formatMarkdown {
+				t.Errorf("format = %q, want %q", doc.Metadata[formatKey], formatMarkdown)
+			}
+		})
+	}
+}
+
+func TestExtractHTML(t *testing.T) {
+	page := `<!DOCTYPE html>
+<html><head><title> Getting  Started </title>
+<style>body { color: red; }</style><script>var tracking = true;</script></head>
+<body><nav><a href="/">Home</a></nav>
+<h1>Install</h1>
+<div class="content"><p>Run the <a href="/installer">installer</a>
+  and <b>restart</b>.</p>
+<ul><li>Linux</li><li>macOS</li></ul>
+<h2>Config</h2><pre>key = value
+other = 1</pre>
+<table><tr><th>Name</th><th>Default</th></tr><tr><td>port</td><td>8080</td></tr></table>
+<noscript>Enable JavaScript</noscript></div></body></html>`
+
+	doc, _, err := extractDocument(chromem.Document{
+		ID:       "/docs/start.html",
+		Metadata: map[string]string{"filename": "start.html"},
+	}, []byte(page), extractOptions{})
+	if err != nil {
+		t.Fatalf("extractDocument() error = %v", err)
+	}
+
+	want := "Home\n\n# Install\n\nRun the installer and restart.\n\n- Linux\n\n- macOS\n\n## Config\n\n" +
+		"```\nkey = value\nother = 1\n```\n\nName | Default\n\nport | 8080"
+	if doc.Content != want {
+		t.Errorf("content = %q, want %q", doc.Content, want)
+	}
+	if got := doc.Metadata[titleKey]; got != "Getting Started" {
+		t.Errorf("title = %q, want %q", got, "Getting Started")
+	}
+	if got := sourceName(doc.Metadata); got != "start.html – Getting Started" {
+		t.Errorf("sourceName() = %q, want %q", got, "start.html – Getting Started")
+	}
+}
+
+func TestExtractEPUB(t *testing.T) {
+	chapter := func(title, body string) string {
+		return `<?xml version="1.0" encoding="UTF-8"?><html xmlns="http://www.w3.org/1999/xhtml">` +
+			`<head><title>The Book</title></head><body>` + title + body + `</body></html>`
+	}
+	long := strings.Repeat("The harbour was quiet before the storm came in. ", 12)
+	files := map[string]string{
+		"mimetype":               "application/epub+zip",
+		"META-INF/container.xml": `<container><rootfiles><rootfile full-path="OEBPS/content.opf"/></rootfiles></container>`,
+		"OEBPS/content.opf": `<package xmlns="http://www.idpf.org/2007/opf"><manifest>
+<item id="cover" href="cover.xhtml" media-type="application/xhtml+xml"/>
+<item id="ch1" href="text/chapter%201.xhtml" media-type="application/xhtml+xml"/>
+<item id="ch2" href="text/ch2.xhtml" media-type="application/xhtml+xml"/>
+<item id="ncx" href="toc.ncx" media-type="application/x-dtbncx+xml"/>
+</manifest><spine toc="ncx"><itemref idref="cover"/><itemref idref="ch2"/><itemref idref="ch1"/></spine></package>`,
+		"OEBPS/toc.ncx": `<ncx><navMap><navPoint><navLabel><text>Chapter 1: Departure</text></navLabel>` +
+			`<content src="text/chapter%201.xhtml#start"/></navPoint></navMap></ncx>`,
+		"OEBPS/cover.xhtml":          chapter("", `<img src="cover.jpg"/>`),
+		"OEBPS/text/chapter 1.xhtml": chapter("<h1>Departure</h1>", "<p>"+long+"</p>"),
+		"OEBPS/text/ch2.xhtml":       chapter("<h1>The Storm</h1>", "<p>Short chapter.</p>"),
+	}
+
+	doc, text, err := extractDocument(chromem.Document{
+		ID:       "/docs/book.epub",
+		Metadata: map[string]string{"filename": "book.epub"},
+	}, testZip(t, files), extractOptions{})
+	if err != nil {
+		t.Fatalf("extractDocument() error = %v", err)
+	}
+	if len(text.sections) != 2 {
+		t.Fatalf("extractDocument() returned %d sections, want 2", len(text.sections))
+	}
+	if !strings.HasPrefix(doc.Content, "# The Storm\n\nShort chapter.\n\n# Departure") {
+		t.Errorf("content = %q, want the chapters in the spine order", doc.Content)
+	}
+
+	chunks := chunkSections(doc, text.sections, heuristicTokenizer{}, 48, 8, 0)
+	if len(chunks) < 3 {
+		t.Fatalf("chunkSections() returned %d chunks, want the long chapter split", len(chunks))
+	}
+	for i, c := range chunks {
+		if c.ID != fmt.Sprintf("/docs/book.epub-chunk-%d", i) || c.Metadata["chunkIndex"] != strconv.Itoa(i) ||
+			c.Metadata["originalID"] != "/docs/book.epub" {
+			t.Errorf("chunk %d is %q, chunkIndex %q, originalID %q", i, c.ID, c.Metadata["chunkIndex"], c.Metadata["originalID"])
+		}
+	}
+	if got := sourceName(chunks[0].Metadata); got != "book.epub – The Storm" {
+		t.Errorf("sourceName() of the first chunk = %q", got)
+	}
+	if got := chunks[len(chunks)-1].Metadata[chapterKey]; got != "Chapter 1: Departure" {
+		t.Errorf("chapter of the last chunk = %q, want the title of the table of contents", got)
+	}
+
+	files["META-INF/encryption.xml"] = `<encryption><EncryptedData><CipherData>` +
+		`<CipherReference URI="OEBPS/text/ch2.xhtml"/></CipherData></EncryptedData></encryption>`
+	if _, _, err := extractDocument(chromem.Document{ID: "/docs/book.epub"}, testZip(t, files), extractOptions{}); err == nil {
+		t.Error("extractDocument() of a DRM-protected book error = nil, want an error")
+	}
+}
+
+func TestExtractCSV(t *testing.T) {
+	tests := []struct {
+		name         string
+		id           string
+		data         string
+		wantContents []string
+		wantRows     []string
+		wantWarnings int
+	}{
+		{
+			name: "rows grouped with the header",
+			id:   "/docs/people.csv",
+			data: "\ufeffname,city\nAda,London\n\"Lovelace, A\",\"New\nYork\"\nAlan,Wilmslow\n",
+			wantContents: []string{
+				"name,city\nAda,London\n\"Lovelace, A\",\"New\nYork\"",
+				"name,city\nAlan,Wilmslow",
+			},
+			wantRows: []string{"2-3", "4-4"},
+		},
+		{
+			name:         "malformed rows skipped",
+			id:           "/docs/people.csv",
+			data:         "name,city\nAda,London\nbroken\nAlan,Wilmslow\nGrace\n",
+			wantContents: []string{"name,city\nAda,London\nAlan,Wilmslow"},
+			wantRows:     []string{"2-4"},
+			wantWarnings: 1,
+		},
+		{
+			name:         "tab separated",
+			id:           "/docs/people.tsv",
+			data:         "name\tnote\nAda\tsaid \"hi\"\n",
+			wantContents: []string{"name\tnote\nAda\t\"said \"\"hi\"\"\""},
+			wantRows:     []string{"2-2"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc, text, err := extractDocument(chromem.Document{
+				ID:       tt.id,
+				Metadata: map[string]string{"filename": filepath.Base(tt.id)},
+			}, []byte(tt.data), extractOptions{tableRowsPerChunk: 2})
+			if err != nil {
+				t.Fatalf("extractDocument() error = %v", err)
+			}
+			if len(text.warnings) != tt.wantWarnings {
+				t.Errorf("warnings = %q, want %d", text.warnings, tt.wantWarnings)
+			}
+
+			// The tiny chunks are kept whole rather than merged.
+			chunks := chunkSections(doc, text.sections, heuristicTokenizer{}, 8, 2, 100)
+			var contents, rows []string
+			for _, c := range chunks {
+				content, _ := splitChunkHeader(c.Content, c.Metadata)
+				contents = append(contents, content)
+				rows = append(rows, c.Metadata[rowsKey])
+			}
+			if !slices.Equal(contents, tt.wantContents) {
+				t.Errorf("contents = %q, want %q", contents, tt.wantContents)
+			}
+			if !slices.Equal(rows, tt.wantRows) {
+				t.Errorf("rows = %q, want %q", rows, tt.wantRows)
+			}
+		})
+	}
+}
+
+func TestExtractXLSX(t *testing.T) {
+	files := map[string]string{
+		"xl/workbook.xml": `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" ` +
+			`xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets>` +
+			`<sheet name="Budget" sheetId="1" r:id="rId1"/><sheet name="Empty" sheetId="2" r:id="rId2"/></sheets></workbook>`,
+		"xl/_rels/workbook.xml.rels": `<Relationships><Relationship Id="rId1" Target="worksheets/sheet1.xml"/>` +
+			`<Relationship Id="rId2" Target="/xl/worksheets/sheet2.xml"/></Relationships>`,
+		"xl/sharedStrings.xml": `<sst><si><t>Item</t></si><si><t>Cost</t></si><si><r><t>Ren</t></r><r><t>t</t></r></si>` +
+			`<si><t>Food | drinks</t></si></sst>`,
+		"xl/worksheets/sheet1.xml": `<worksheet><sheetData>
+<row r="1"><c r="A1" t="s"><v>0</v></c><c r="B1" t="s"><v>1</v></c></row>
+<row r="2"><c r="A2" t="s"><v>2</v></c><c r="B2"><v>1200</v></c></row>
+<row r="4"><c r="A4" t="s"><v>3</v></c><c r="C4" t="inlineStr"><is><t>weekly</t></is></c></row>
+<row r="5"><c r="A5" t="str"><v>Total</v></c><c r="B5"><f>SUM(B2:B4)</f><v>1500</v></c><c r="C5" t="b"><v>1</v></c></row>
+</sheetData></worksheet>`,
+		"xl/worksheets/sheet2.xml": `<worksheet><sheetData/></worksheet>`,
+	}
+
+	doc, text, err := extractDocument(chromem.Document{
+		ID:       "/docs/budget.xlsx",
+		Metadata: map[string]string{"filename": "budget.xlsx"},
+	}, testZip(t, files), extractOptions{tableRowsPerChunk: 2, maxSpreadsheetCells: 100})
+	if err != nil {
+		t.Fatalf("extractDocument() error = %v", err)
+	}
+
+	chunks := chunkSections(doc, text.sections, heuristicTokenizer{}, 8, 2, 100)
+	want := []string{
+		"# Budget\n\n| Item | Cost |  |\n| --- | --- | --- |\n| Rent | 1200 |  |\n| Food \\| drinks |  | weekly |",
+		"# Budget\n\n| Item | Cost |  |\n| --- | --- | --- |\n| Total | 1500 | TRUE |",
+	}
+	var contents []string
+	for _, c := range chunks {
+		content, _ := splitChunkHeader(c.Content, c.Metadata)
+		contents = append(contents, content)
+	}
+	if !slices.Equal(contents, want) {
+		t.Fatalf("contents = %q, want %q", contents, want)
+	}
+	if got := sourceName(chunks[0].Metadata); got != "budget.xlsx – Budget – rows 2-4" {
+		t.Errorf("sourceName() = %q, want %q", got, "budget.xlsx – Budget – rows 2-4")
+	}
+
+	_, _, err = extractDocument(chromem.Document{ID: "/docs/budget.xlsx"}, testZip(t, files),
+		extractOptions{tableRowsPerChunk: 2, maxSpreadsheetCells: 5})
+	if err == nil {
+		t.Error("extractDocument() over the cell limit error = nil, want an error")
+	}
+}
+
+func TestExtractIPYNB(t *testing.T) {
+	nb := `{
+ "cells": [
+  {"cell_type": "markdown", "source": ["# Analysis\n", "Load the data."]},
+  {"cell_type": "code", "source": "import pandas as pd\ndf = pd.read_csv('a.csv')", "outputs": []},
+  {"cell_type": "code", "source": ["df.shape"], "outputs": [
+   {"output_type": "execute_result", "data": {"text/plain": ["(120, 4)"]}}
+  ]},
+  {"cell_type": "code", "source": "df.plot()", "outputs": [
+   {"output_type": "display_data", "data": {"image/png": "iVBORw0KGgo=", "text/plain": "<Figure size 640x480>"}},
+   {"output_type": "stream", "name": "stdout", "text": "` + strings.Repeat("x", maxNotebookOutputChars+1) + `"}
+  ]},
+  {"cell_type": "markdown", "source": ""},
+  {"cell_type": "markdown", "source": "## Results\nThe mean is high."}
+ ],
+ "metadata": {"kernelspec": {"language": "python"}},
+ "nbformat": 4
+}`
+
+	doc, text, err := extractDocument(chromem.Document{
+		ID:       "/docs/analysis.ipynb",
+		Metadata: map[string]string{"filename": "analysis.ipynb"},
+	}, []byte(nb), extractOptions{})
+	if err != nil {
+		t.Fatalf("extractDocument() error = %v", err)
+	}
+	if doc.Metadata[formatKey] != formatMarkdown {
+		t.Errorf("format = %q, want %q", doc.Metadata[formatKey], formatMarkdown)
+	}
+
+	want := []extractedSection{
+		{
+			content: "# Analysis\nLoad the data.\n\n```python\nimport pandas as pd\ndf = pd.read_csv('a.csv')\n```\n\n" +
+				"```python\ndf.shape\n```\n\nOutput:\n\n```\n(120, 4)\n```\n\n```python\ndf.plot()\n```",
+			metadata: map[string]string{cellsKey: "1-4"},
+		},
+		{content: "## Results\nThe mean is high.", metadata: map[string]string{cellsKey: "6-6"}},
+	}
+	if len(text.sections) != len(want) {
+		t.Fatalf("sections = %v, want %v", text.sections, want)
+	}
+	for i, s := range text.sections {
+		if s.content != want[i].content || s.metadata[cellsKey] != want[i].metadata[cellsKey] {
+			t.Errorf("section %d = %q %v, want %q %v", i, s.content, s.metadata, want[i].content, want[i].metadata)
+		}
+	}
+
+	if _, _, err := extractDocument(chromem.Document{ID: "/docs/broken.ipynb"}, []byte(`{"cells": [`), extractOptions{}); err == nil {
+		t.Error("extractDocument() of a truncated notebook error = nil, want an error")
+	}
+}
+
+// visionLLM transcribes the images sent to it as their size.
+type visionLLM struct{}
+
+func (visionLLM) chat(_ context.Context, cs []chat) llmResponse {
+	if !hasImages(cs) {
+		return llmResponse{err: errors.New("no image")}
+	}
+	img := cs[len(cs)-1].images[0]
+	return llmResponse{content: fmt.Sprintf("Receipt of the corner shop, %s of %d bytes, total paid by card.",
+		img.mimeType, len(img.data))}
+}
+
+func (l visionLLM) chatStream(ctx context.Context, cs []chat) <-chan llmResponse {
+	res := make(chan llmResponse, 1)
+	res <- l.chat(ctx, cs)
+	close(res)
+	return res
+}
+
+func TestScanOCR(t *testing.T) {
+	tempDir := t.TempDir()
+	docDir := filepath.Join(tempDir, "docs")
+	if err := os.Mkdir(docDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	notes := strings.Repeat("The notes are long enough to be embedded on their own. ", 3)
+	if err := os.WriteFile(filepath.Join(docDir, "notes.md"), []byte(notes), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(docDir, "receipt.png"), []byte("\x89PNG fake image"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	settings := defaultRAGSettings()
+	settings.OCRBackend = ocrBackendVision
+	settings.MinChunkChars = 0
+	vectordb := setupTestVectorDB(t, tempDir)
+	r := newRAG(vectordb, visionLLM{}, nil, testEmbedder{},
+		llmSetting{Provider: "test", Model: "vision"}, llmSetting{Provider: "test", Model: "test"}, nil, settings)
+
+	chunkFiles := func(doc document) map[string]chromem.Result {
+		t.Helper()
+		coll := vectordb.GetCollection(doc.vectorDBCollectionName(), testEmbedder{}.embeddingFunc())
+		results, err := coll.QueryEmbedding(context.Background(), []float32{1, 1}, coll.Count(), nil, nil)
+		if err != nil {
+			t.Fatalf("QueryEmbedding() error = %v", err)
+		}
+		files := make(map[string]chromem.Result)
+		for _, res := range results {
+			files[res.Metadata["filename"]] = res
+		}
+		return files
+	}
+
+	doc := document{ID: 1, Name: "docs", Path: docDir, OCR: true}
+	states, _ := scanTestDocument(t, r, &doc, nil)
+	files := chunkFiles(doc)
+	receipt, ok := files["receipt.png"]
+	if !ok {
+		t.Fatalf("chunks of %v, want receipt.png read with OCR", slices.Collect(maps.Keys(files)))
+	}
+	if !strings.Contains(receipt.Content, "image/png of 15 bytes") || receipt.Metadata[ocrKey] != "test/vision" {
+		t.Errorf("receipt.png chunk = %q with OCR %q", receipt.Content, receipt.Metadata[ocrKey])
+	}
+
+	// The images of the previous scan are removed once OCR is off.
+	doc.OCR = false
+	scanTestDocument(t, r, &doc, states)
+	files = chunkFiles(doc)
+	if _, ok := files["receipt.png"]; ok || len(files) != 1 {
+		t.Errorf("chunks of %v after OCR is off, want only notes.md", slices.Collect(maps.Keys(files)))
+	}
+}
+
+func TestScanTranscribesRecordings(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/audio/transcriptions" || r.FormValue("response_format") != "verbose_json" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"text": "", "segments": [
+			{"start": 0, "end": 12, "text": " Welcome to the planning meeting."},
+			{"start": 12, "end": 29.5, "text": " First the budget."},
+			{"start": 31, "end": 40, "text": " Then the hiring plan for the next quarter."},
+			{"start": 3765, "end": 3770, "text": " Thanks everyone."}
+		]}`)
+	}))
+	defer server.Close()
+
+	tempDir := t.TempDir()
+	docDir := filepath.Join(tempDir, "docs")
+	if err := os.Mkdir(docDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(docDir, "meeting.mp3"), []byte("ID3 fake recording"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(docDir, "long.wav"), make([]byte, 1<<20+1), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	settings := defaultRAGSettings()
+	settings.MinChunkChars = 0
+	settings.TranscriptionURL = server.URL + "/v1"
+	settings.MaxAudioMB = 1
+	vectordb := setupTestVectorDB(t, tempDir)
+	r := newRAG(vectordb, nil, nil, testEmbedder{},
+		llmSetting{}, llmSetting{Provider: "test", Model: "test"}, nil, settings)
+
+	doc := document{ID: 1, Name: "docs", Path: docDir, Transcribe: true}
+	scanTestDocument(t, r, &doc, nil)
+
+	coll := vectordb.GetCollection(doc.vectorDBCollectionName(), testEmbedder{}.embeddingFunc())
+	results, err := coll.QueryEmbedding(context.Background(), []float32{1, 1}, coll.Count(), nil, nil)
+	if err != nil {
+		t.Fatalf("QueryEmbedding() error = %v", err)
+	}
+	got := make(map[string]string)
+	for _, res := range results {
+		content, _ := splitChunkHeader(res.Content, res.Metadata)
+		got[sourceName(res.Metadata)] = content
+	}
+	want := map[string]string{
+		"meeting.mp3 @ 0:00":    "Welcome to the planning meeting. First the budget.",
+		"meeting.mp3 @ 0:31":    "Then the hiring plan for the next quarter.",
+		"meeting.mp3 @ 1:02:45": "Thanks everyone.",
+	}
+	if !maps.Equal(got, want) {
+		t.Errorf("chunks = %q, want %q", got, want)
+	}
+}
+
+func TestScanRespectsGitignore(t *testing.T) {
+	tempDir := t.TempDir()
+	docDir := filepath.Join(tempDir, "docs")
+	for name, data := range map[string]string{
+		".gitignore":          "# Build outputs\n/dist/\n*.log\n!keep.log\n",
+		"README.md":           testFileContent,
+		"app.log":             testFileContent,
+		"keep.log":            testFileContent,
+		"dist/bundle.js":      testFileContent,
+		"src/main.go":         testFileContent,
+		"src/.gitignore":      "generated/\nlocal.md\n",
+		"src/local.md":        testFileContent,
+		"src/generated/a.go":  testFileContent,
+		"src/dist/notes.md":   testFileContent,
+		"docs/src/local.md":   testFileContent,
+		"docs/nested/app.log": testFileContent,
+	} {
+		file := filepath.Join(docDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	settings := defaultRAGSettings()
+	settings.MinChunkChars = 0
+	vectordb := setupTestVectorDB(t, tempDir)
+	r := newRAG(vectordb, nil, nil, testEmbedder{},
+		llmSetting{}, llmSetting{Provider: "test", Model: "test"}, nil, settings)
+
+	// The hidden files and the dist directories are only left out by the
+	// ignore rules here.
+	doc := document{ID: 1, Name: "docs", Path: docDir, IncludeHidden: true}
+	_, logs := scanTestDocument(t, r, &doc, nil)
+	paths, summary := collectionPaths(t, vectordb, doc), scanSummary(logs)
+	want := []string{".gitignore", "README.md", "docs/src/local.md", "keep.log", "src/.gitignore", "src/dist/notes.md", "src/main.go"}
+	if !slices.Equal(paths, want) {
+		t.Errorf("scanned %q, want %q", paths, want)
+	}
+	if !strings.Contains(summary, "3 files and 2 directories excluded by the ignore rules") {
+		t.Errorf("summary = %q, want the excluded files and directories", summary)
+	}
+
+	doc = document{ID: 2, Name: "all", Path: docDir, IncludeIgnored: true, IncludeHidden: true}
+	_, logs = scanTestDocument(t, r, &doc, nil)
+	paths, summary = collectionPaths(t, vectordb, doc), scanSummary(logs)
+	if len(paths) != 12 || strings.Contains(summary, "ignore rules") {
+		t.Errorf("scanned %q with %q, want all the files", paths, summary)
+	}
+}
+
+func TestScanGlobPatterns(t *testing.T) {
+	if _, err := parseGlobPatterns("docs/[a-"); err == nil {
+		t.Error("parseGlobPatterns() of a malformed pattern succeeded")
+	}
+
+	tempDir := t.TempDir()
+	docDir := filepath.Join(tempDir, "docs")
+	for _, name := range []string{
+		"README.md", "docs/guide.md", "docs/api/users.md", "docs/api/users.txt",
+		"docs/testdata/sample.md", "docs/draft.md", "src/main.go",
+	} {
+		file := filepath.Join(docDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(testFileContent), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	include, err := parseGlobPatterns("docs/**/*.md, ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exclude, err := parseGlobPatterns("**/testdata/**,draft.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings := defaultRAGSettings()
+	settings.MinChunkChars = 0
+	vectordb := setupTestVectorDB(t, tempDir)
+	r := newRAG(vectordb, nil, nil, testEmbedder{},
+		llmSetting{}, llmSetting{Provider: "test", Model: "test"}, nil, settings)
+	doc := document{ID: 1, Name: "docs", Path: docDir, IncludePatterns: include, ExcludePatterns: exclude}
+
+	_, msgs := scanTestDocument(t, r, &doc, nil)
+	logs := scanLogContents(msgs)
+	for _, want := range []string{
+		"Scanning the files including docs/**/*.md, excluding **/testdata/**, draft.md",
+		"Left out 3 files not matching docs/**/*.md, 1 files excluded by **/testdata/**, 1 files excluded by draft.md",
+	} {
+		if !slices.Contains(logs, want) {
+			t.Errorf("scan log %q, want %q", logs, want)
+		}
+	}
+
+	paths := collectionPaths(t, vectordb, doc)
+	if want := []string{"docs/api/users.md", "docs/guide.md"}; !slices.Equal(paths, want) {
+		t.Errorf("scanned %q, want %q", paths, want)
+	}
+}
+
+func TestScanSkipsBinaryAndOversizedFiles(t *testing.T) {
+	// A rune cut by the end of the checked start is still text.
+	cut := strings.Repeat("a", binarySniffLen-1) + "é and more"
+	for data, want := range map[string]bool{
+		"plain text":          false,
+		"héllo, wörld":        false,
+		cut:                   false,
+		"PK\x03\x04\x00\x00":  true,
+		"\xff\xfeh\x00i\x00":  true,
+		"text\x00with a null": true,
+	} {
+		if got := isBinary([]byte(data)); got != want {
+			t.Errorf("isBinary(%.20q) = %t, want %t", data, got, want)
+		}
+	}
+
+	tempDir := t.TempDir()
+	docDir := filepath.Join(tempDir, "docs")
+	if err := os.Mkdir(docDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range map[string]string{
+		"notes.md":    testFileContent,
+		"archive.bin": "\x1f\x8b\x08\x00" + testFileContent,
+		"huge.txt":    strings.Repeat(testFileContent, 1<<20/len(testFileContent)+1),
+	} {
+		if err := os.WriteFile(filepath.Join(docDir, name), []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	settings := defaultRAGSettings()
+	settings.MaxFileMB = 1
+	vectordb := setupTestVectorDB(t, tempDir)
+	r := newRAG(vectordb, nil, nil, testEmbedder{},
+		llmSetting{}, llmSetting{Provider: "test", Model: "test"}, nil, settings)
+	doc := document{ID: 1, Name: "docs", Path: docDir}
+
+	_, msgs := scanTestDocument(t, r, &doc, nil)
+	if doc.ScannedFileCount != 1 {
+		t.Errorf("scanned %d files, want only notes.md", doc.ScannedFileCount)
+	}
+	logs := scanLogContents(msgs)
+	for _, want := range []string{
+		"Warning: skipped " + filepath.Join(docDir, "huge.txt") + ": it's over the 1 MB file size limit",
+		"Skipped " + filepath.Join(docDir, "archive.bin") + ": it's a binary file",
+		"1 oversized files skipped, 1 binary files skipped",
+	} {
+		if !slices.ContainsFunc(logs, func(l string) bool { return strings.Contains(l, want) }) {
+			t.Errorf("scan log %q, want %q", logs, want)
+		}
+	}
+}
+
+func TestScanSingleFile(t *testing.T) {
+	tempDir := t.TempDir()
+	content := strings.Repeat("The handbook has enough words to answer a question. ", 3)
+	handbook := filepath.Join(tempDir, "handbook.txt")
+	if err := os.WriteFile(handbook, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(tempDir, "other.txt"), []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	vectordb := setupTestVectorDB(t, tempDir)
+	r := newRAG(vectordb, nil, nil, testEmbedder{},
+		llmSetting{}, llmSetting{Provider: "test", Model: "test"}, nil, defaultRAGSettings())
+	doc := document{ID: 1, Name: "handbook", Path: handbook}
+	scanTestDocument(t, r, &doc, nil)
+
+	coll := vectordb.GetCollection(doc.vectorDBCollectionName(), testEmbedder{}.embeddingFunc())
+	results, err := coll.QueryEmbedding(context.Background(), []float32{1, 1}, coll.Count(), nil, nil)
+	if err != nil {
+		t.Fatalf("QueryEmbedding() error = %v", err)
+	}
+	for _, res := range results {
+		if res.Metadata["path"] != "handbook.txt" || res.Metadata["filename"] != "handbook.txt" {
+			t.Errorf("chunk of %q (%q), want handbook.txt", res.Metadata["path"], res.Metadata["filename"])
+		}
+	}
+	if len(results) == 0 || doc.ScannedFileCount != 1 {
+		t.Errorf("scanned %d files into %d chunks, want the handbook", doc.ScannedFileCount, len(results))
+	}
+	if desc := doc.Description(); !strings.HasPrefix(desc, "1 file; ") {
+		t.Errorf("Description() = %q, want 1 file", desc)
+	}
+}
+
+func TestScanCrawlsURL(t *testing.T) {
+	words := strings.Repeat("The page has enough words to answer a question. ", 3)
+	pages := map[string]string{
+		"/docs/": `<html><head><title>Docs</title></head><body><p>` + words + `</p>
+			<a href="install">Install</a> <a href="/docs/usage#flags">Usage</a>
+			<a href="https://elsewhere.example/">Elsewhere</a> <a href="mailto:team@example.com">Mail</a></body></html>`,
+		"/docs/install": `<html><head><title>Install</title></head><body><p>` + words + `</p>
+			<a href="/docs/deep">Deep</a></body></html>`,
+		"/docs/usage": `<html><head><title>Usage</title></head><body><p>` + words + `</p>
+			<a href="/docs/missing">Missing</a></body></html>`,
+		"/docs/deep": `<html><head><title>Deep</title></head><body><p>` + words + `</p></body></html>`,
+	}
+	var mu sync.Mutex
+	var fetched []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetched = append(fetched, r.URL.Path)
+		mu.Unlock()
+		page, ok := pages[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, page)
+	}))
+	defer server.Close()
+
+	tempDir := t.TempDir()
+	vectordb := setupTestVectorDB(t, tempDir)
+	r := newRAG(vectordb, nil, nil, testEmbedder{},
+		llmSetting{}, llmSetting{Provider: "test", Model: "test"}, nil, defaultRAGSettings())
+
+	depth := 1
+	doc := document{ID: 1, Name: "docs", Path: server.URL + "/docs/", Source: documentSourceURL, CrawlDepth: &depth}
+	scanTestDocument(t, r, &doc, nil)
+	if want := []string{"/docs/", "/docs/install", "/docs/usage"}; !slices.Equal(fetched, want) {
+		t.Errorf("fetched %q, want %q", fetched, want)
+	}
+
+	coll := vectordb.GetCollection(doc.vectorDBCollectionName(), testEmbedder{}.embeddingFunc())
+	results, err := coll.QueryEmbedding(context.Background(), []float32{1, 1}, coll.Count(), nil, nil)
+	if err != nil {
+		t.Fatalf("QueryEmbedding() error = %v", err)
+	}
+	got := make(map[string]string)
+	for _, res := range results {
+		got[res.Metadata[urlKey]] = sourceName(res.Metadata)
+	}
+	want := map[string]string{
+		server.URL + "/docs/":        "docs – Docs",
+		server.URL + "/docs/install": "install – Install",
+		server.URL + "/docs/usage":   "usage – Usage",
+	}
+	if !maps.Equal(got, want) {
+		t.Errorf("pages = %q, want %q", got, want)
+	}
+
+	// The page limit stops the crawl.
+	fetched = nil
+	doc = document{ID: 2, Name: "limited", Path: server.URL + "/docs/", Source: documentSourceURL, MaxPages: 2}
+	scanTestDocument(t, r, &doc, nil)
+	if len(fetched) != 2 || doc.ScannedFileCount != 2 {
+		t.Errorf("fetched %q into %d pages, want 2", fetched, doc.ScannedFileCount)
+	}
+}
+
+func TestScanProgress(t *testing.T) {
+	p := scanProgress{filesRead: 312, filesTotal: 2410, filesStart: time.Now().Add(-time.Minute)}
+	if view := p.View(); !strings.Contains(view, "312/2,410 files · 6% · ETA 6m4") {
+		t.Errorf("View() = %q, want the files read with their time left", view)
+	}
+
+	tempDir := t.TempDir()
+	docDir := filepath.Join(tempDir, "docs")
+	if err := os.Mkdir(docDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.md", "b.md", "c.md"} {
+		if err := os.WriteFile(filepath.Join(docDir, name), []byte(testFileContent), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	vectordb := setupTestVectorDB(t, tempDir)
+	r := newRAG(vectordb, nil, nil, testEmbedder{},
+		llmSetting{}, llmSetting{Provider: "test", Model: "test"}, nil, defaultRAGSettings())
+
+	doc := document{ID: 1, Name: "docs", Path: docDir}
+	_, logs := scanTestDocument(t, r, &doc, nil)
+	p = scanProgress{filesStart: time.Now()}
+	for _, msg := range logs {
+		p = p.update(msg)
+		if p.filesRead == p.filesTotal && p.filesTotal > 0 && p.chunksTotal == 0 && p.fraction() != 0.5 {
+			t.Errorf("fraction() = %g once the files are read, want 0.5", p.fraction())
+		}
+	}
+	if p.filesRead != 3 || p.filesTotal != 3 || p.chunksEmbedded != p.chunksTotal || p.chunksTotal == 0 {
+		t.Errorf("progress = %+v, want the 3 files read and their chunks embedded", p)
+	}
+	if !strings.Contains(p.View(), "100%") {
+		t.Errorf("View() = %q once done, want 100%%", p.View())
+	}
+}
+
+// cancellingEmbedder cancels the scan once it embeds a chunk.
+type cancellingEmbedder struct {
+	cancel context.CancelFunc
+}
+
+func (e cancellingEmbedder) embeddingFunc() chromem.EmbeddingFunc {
+	return func(_ context.Context, text string) ([]float32, error) {
+		e.cancel()
+		return []float32{1, float32(len(text)%10) + 1}, nil
+	}
+}
+
+func TestCancelledScan(t *testing.T) {
+	tempDir := t.TempDir()
+	docDir := filepath.Join(tempDir, "docs")
+	if err := os.Mkdir(docDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(docDir, "a.md"), []byte(testFileContent), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	vectordb := setupTestVectorDB(t, tempDir)
+	embedderSetting := llmSetting{Provider: "test", Model: "test"}
+	r := newRAG(vectordb, nil, nil, testEmbedder{}, llmSetting{}, embedderSetting, nil, defaultRAGSettings())
+	doc := document{ID: 1, Name: "docs", Path: docDir}
+	states, _ := scanTestDocument(t, r, &doc, nil)
+	count := vectordb.GetCollection(doc.vectorDBCollectionName(), testEmbedder{}.embeddingFunc()).Count()
+
+	// A scan cancelled before it writes the collection keeps the previous
+	// chunks.
+	if err := os.WriteFile(filepath.Join(docDir, "b.md"), []byte(testFileContent+"More."), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r = newRAG(vectordb, nil, nil, cancellingEmbedder{cancel: cancel}, llmSetting{}, embedderSetting, nil, defaultRAGSettings())
+	progress := make(chan documentScanLogMsg)
+	go r.scanDocument(ctx, doc, states, progress)
+	var last documentScanLogMsg
+	for msg := range progress {
+		if msg.err != nil || msg.done {
+			last = msg
+			break
+		}
+	}
+	if !errors.Is(last.err, errScanCancelled) || last.discarded {
+		t.Errorf("last message = %q (%v, discarded %t), want the cancelled scan", last.content, last.err, last.discarded)
+	}
+	coll := vectordb.GetCollection(doc.vectorDBCollectionName(), testEmbedder{}.embeddingFunc())
+	if coll == nil || coll.Count() != count {
+		t.Errorf("collection after the cancelled scan = %v, want its %d chunks", coll, count)
+	}
+
+	// Once it wrote to the collection, the collection is discarded.
+	progress = make(chan documentScanLogMsg, 1)
+	r.cancelScan(doc.vectorDBCollectionName(), true, progress)
+	if msg := <-progress; msg.content != "Scan cancelled, partial index discarded" || !msg.discarded {
+		t.Errorf("cancelScan() message = %q (discarded %t), want the partial index discarded", msg.content, msg.discarded)
+	}
+	if coll := vectordb.GetCollection(doc.vectorDBCollectionName(), testEmbedder{}.embeddingFunc()); coll != nil {
+		t.Errorf("collection after the discarded scan has %d chunks, want none", coll.Count())
+	}
+}
+
+func TestScanConcurrency(t *testing.T) {
+	var settings ragSettings
+	if got := settings.scanConcurrency(); got != runtime.NumCPU() {
+		t.Errorf("default scan concurrency = %d, want %d", got, runtime.NumCPU())
+	}
+
+	settings.ScanConcurrency = 3
+	if got := settings.embeddingConcurrency(); got != 3 {
+		t.Errorf("embedding concurrency = %d, want the scan concurrency 3", got)
+	}
+	settings.EmbeddingConcurrency = 5
+	if got := settings.embeddingConcurrency(); got != 5 {
+		t.Errorf("embedding concurrency = %d, want 5", got)
+	}
+
+	for _, s := range []string{"0", "-1", "abc", strconv.Itoa(maxScanConcurrency + 1)} {
+		if _, err := parseScanConcurrency(s); err == nil {
+			t.Errorf("parseScanConcurrency(%q) expected an error", s)
+		}
+	}
+	if n, err := parseScanConcurrency(" "); err != nil || n != 0 {
+		t.Errorf("parseScanConcurrency(\" \") = %d, %v, want 0, nil", n, err)
+	}
+}
+
+func TestAutoRescan(t *testing.T) {
+	db, tempDir := setupTestDB(t)
+	defer os.RemoveAll(tempDir)
+	defer db.Close()
+
+	docDir := filepath.Join(tempDir, "notes")
+	if err := os.Mkdir(docDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	content := strings.Repeat("The notes have enough words to answer a question. ", 3)
+	if err := os.WriteFile(filepath.Join(docDir, "a.md"), []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	doc := document{Name: "notes", Path: docDir, RescanInterval: rescanHourly, LastScanTime: now.Add(-2 * time.Hour)}
+	if err := saveDocument(db, &doc); err != nil {
+		t.Fatal(err)
+	}
+	if !doc.rescanDue(now) || doc.rescanDue(now.Add(-90*time.Minute)) {
+		t.Errorf("rescanDue() is not due an hour after the last scan")
+	}
+	if off := (document{Path: docDir}); off.rescanDue(now) {
+		t.Errorf("rescanDue() = true without an interval")
+	}
+
+	vectordb := setupTestVectorDB(t, tempDir)
+	m := mainModel{db: db, keymap: newKeymap(), width: 120, height: 60}
+	m.rag = newRAG(vectordb, nil, nil, testEmbedder{}, llmSetting{}, llmSetting{Provider: "test", Model: "test"},
+		nil, defaultRAGSettings())
+	m, err := m.initDocuments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m = m.initDocumentScan().setViewState(viewStateDocuments)
+
+	m = m.startDueAutoScan(now)
+	if m.autoScanDocumentID != doc.ID {
+		t.Fatalf("autoScanDocumentID = %d, want %d", m.autoScanDocumentID, doc.ID)
+	}
+	if desc := m.documents[0].Description(); !strings.Contains(desc, "Rescanning") {
+		t.Errorf("Description() = %q, want the rescan status", desc)
+	}
+
+	// A manual scan doesn't run along the automatic one.
+	if manual := m.scanDocument(false); manual.err == nil || manual.documentScanDocumentID != 0 {
+		t.Errorf("scanDocument() during the automatic rescan error = %v, want an error", manual.err)
+	}
+
+	for m.autoScanDocumentID != 0 {
+		msg := <-m.autoScanProgress
+		if msg.err != nil {
+			t.Fatalf("automatic rescan failed: %v", msg.err)
+		}
+		m = m.handleAutoScanMsg(autoScanMsg(msg))
+	}
+
+	got := m.documents[0]
+	if got.ScannedFileCount != 1 || !got.LastScanTime.After(doc.LastScanTime) || got.rescanStatus != "" {
+		t.Errorf("rescanned document = %d files at %s (%q), want the file rescanned",
+			got.ScannedFileCount, got.LastScanTime, got.rescanStatus)
+	}
+	if got.rescanDue(time.Now()) {
+		t.Errorf("rescanDue() = true right after the rescan")
+	}
+	if m.viewState != viewStateDocuments || len(m.documentScanLogs) != 0 {
+		t.Errorf("the automatic rescan changed the view to %v with %d scan logs", m.viewState, len(m.documentScanLogs))
+	}
+	saved, err := loadDocuments(db)
+	if err != nil || len(saved) != 1 || saved[0].ScannedFileCount != 1 {
+		t.Errorf("saved documents = %v (%v), want the rescanned document", saved, err)
+	}
+}
+
+func TestWatchDocument(t *testing.T) {
+	db, tempDir := setupTestDB(t)
+	defer os.RemoveAll(tempDir)
+	defer db.Close()
+
+	docDir := filepath.Join(tempDir, "notes")
+	if err := os.Mkdir(docDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	content := strings.Repeat("The notes have enough words to answer a question. ", 3)
+	if err := os.WriteFile(filepath.Join(docDir, "a.md"), []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	doc := document{Name: "notes", Path: docDir, Watch: true, LastScanTime: time.Now()}
+	if err := saveDocument(db, &doc); err != nil {
+		t.Fatal(err)
+	}
+
+	vectordb := setupTestVectorDB(t, tempDir)
+	m := mainModel{db: db, keymap: newKeymap(), width: 120, height: 60}
+	m.rag = newRAG(vectordb, nil, nil, testEmbedder{}, llmSetting{}, llmSetting{Provider: "test", Model: "test"},
+		nil, defaultRAGSettings())
+	m, err := m.initDocuments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m = m.initDocumentScan().updateWatcher(0)
+	defer m.stopWatchers()
+	if _, ok := m.watchers[doc.ID]; !ok {
+		t.Fatalf("the document is not watched")
+	}
+	if desc := m.documents[0].Description(); !strings.Contains(desc, "Watching, last synced") {
+		t.Errorf("Description() = %q, want the watching badge", desc)
+	}
+
+	// The files of a new directory are watched too.
+	subDir := filepath.Join(docDir, "daily")
+	if err := os.Mkdir(subDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err := os.WriteFile(filepath.Join(subDir, "b.md"), []byte(content+"More."), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	var id int
+	select {
+	case id = <-m.watchChanges:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no change reported by the watcher")
+	}
+	if id != doc.ID {
+		t.Fatalf("changed document = %d, want %d", id, doc.ID)
+	}
+
+	m = m.handleDocumentChangedMsg(documentChangedMsg(id))
+	if !m.autoScanSync || !strings.Contains(m.documents[0].Description(), "Syncing") {
+		t.Errorf("Description() = %q, want the document syncing", m.documents[0].Description())
+	}
+	for m.autoScanDocumentID != 0 {
+		msg := <-m.autoScanProgress
+		if msg.err != nil {
+			t.Fatalf("sync failed: %v", msg.err)
+		}
+		m = m.handleAutoScanMsg(autoScanMsg(msg))
+	}
+	if got := m.documents[0].ScannedFileCount; got != 2 {
+		t.Errorf("ScannedFileCount after the sync = %d, want 2", got)
+	}
+
+	// Turning the watch off stops the watcher.
+	w := m.watchers[doc.ID]
+	m.documents[0].Watch = false
+	m = m.updateWatcher(0)
+	if _, ok := m.watchers[doc.ID]; ok {
+		t.Errorf("the document is still watched")
+	}
+	select {
+	case <-w.done:
+	default:
+		t.Errorf("the watcher goroutine didn't return")
+	}
+}
+
+func TestScanSymlinks(t *testing.T) {
+	tempDir := t.TempDir()
+	docDir, extDir := filepath.Join(tempDir, "docs"), filepath.Join(tempDir, "ext")
+	for _, dir := range []string{docDir, extDir} {
+		if err := os.Mkdir(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	content := strings.Repeat("The notes have enough words to answer a question. ", 3)
+	if err := os.WriteFile(filepath.Join(docDir, "a.md"), []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(extDir, "b.md"), []byte(content+"More."), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	links := map[string]string{
+		filepath.Join(docDir, "linked"): extDir,
+		filepath.Join(docDir, "self"):   docDir,
+		filepath.Join(docDir, "broken"): filepath.Join(tempDir, "missing"),
+		filepath.Join(extDir, "loop"):   extDir,
+		filepath.Join(extDir, "up"):     tempDir,
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, link); err != nil {
+			t.Skipf("symlinks are not supported: %v", err)
+		}
+	}
+
+	// The vector database is out of the linked directories.
+	vectordb := setupTestVectorDB(t, t.TempDir())
+	r := newRAG(vectordb, nil, nil, testEmbedder{},
+		llmSetting{}, llmSetting{Provider: "test", Model: "test"}, nil, defaultRAGSettings())
+	for _, follow := range []bool{false, true} {
+		doc := document{ID: 1, Name: "docs", Path: docDir, FollowSymlinks: follow}
+		_, msgs := scanTestDocument(t, r, &doc, nil)
+		logs := scanLogContents(msgs)
+
+		scanned := collectionPaths(t, vectordb, doc)
+		want := []string{"a.md"}
+		if follow {
+			want = []string{"a.md", "linked/b.md"}
+		}
+		if !slices.Equal(scanned, want) {
+			t.Errorf("follow %t: scanned %v, want %v", follow, scanned, want)
+		}
+		log := strings.Join(logs, "\n")
+		if n := strings.Count(log, "Warning: skipped the broken link"); n != 1 {
+			t.Errorf("follow %t: the broken link was reported %d times, want once", follow, n)
+		}
+		if !follow && !strings.Contains(log, "2 linked directories skipped") {
+			t.Errorf("follow false: log %q, want the 2 linked directories skipped", log)
+		}
+		if follow && !strings.Contains(log, "Following the link "+filepath.Join(docDir, "linked")) {
+			t.Errorf("follow true: log %q, want the followed link", log)
+		}
+	}
+}
+
+func TestScanContinuesAfterFileErrors(t *testing.T) {
+	tempDir := t.TempDir()
+	docDir := filepath.Join(tempDir, "docs")
+	lockedDir := filepath.Join(docDir, "locked")
+	if err := os.MkdirAll(lockedDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	content := strings.Repeat("The notes have enough words to answer a question. ", 3)
+	files := map[string]string{
+		filepath.Join(docDir, "a.md"):     content,
+		filepath.Join(docDir, "bad.docx"): "not a zip archive",
+		filepath.Join(lockedDir, "c.md"):  content,
+	}
+	for path, data := range files {
+		if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The permissions don't stop root.
+	wantFailed := 1
+	if os.Geteuid() != 0 {
+		if err := os.Chmod(lockedDir, 0); err != nil {
+			t.Fatal(err)
+		}
+		defer os.Chmod(lockedDir, 0o755)
+		wantFailed = 2
+	}
+
+	vectordb := setupTestVectorDB(t, t.TempDir())
+	r := newRAG(vectordb, nil, nil, testEmbedder{},
+		llmSetting{}, llmSetting{Provider: "test", Model: "test"}, nil, defaultRAGSettings())
+	doc := document{ID: 1, Name: "docs", Path: docDir}
+	_, msgs := scanTestDocument(t, r, &doc, nil)
+	logs := scanLogContents(msgs)
+
+	if len(doc.FailedFiles) != wantFailed || !strings.HasPrefix(doc.FailedFiles[0], filepath.Join(docDir, "bad.docx")+" (") {
+		t.Errorf("FailedFiles = %v, want %d failed files with bad.docx", doc.FailedFiles, wantFailed)
+	}
+	if !slices.Contains(logs, "Warning: "+formatFailures(doc.FailedFiles)) {
+		t.Errorf("logs %q, want the summary of the failed files", logs)
+	}
+	want := fmt.Sprintf("%d indexed, %d failed; ", doc.ScannedFileCount, wantFailed)
+	if desc := doc.Description(); doc.ScannedFileCount == 0 || !strings.HasPrefix(desc, want) {
+		t.Errorf("Description() = %q, want it to start with %q", desc, want)
+	}
+
+	failed := []string{"a (x)", "b (x)", "c (x)", "d (x)", "e (x)", "f (x)", "g (x)"}
+	if got := formatFailures(failed); got != "7 files failed: a (x), b (x), c (x), d (x), e (x) and 2 more" {
+		t.Errorf("formatFailures() = %q", got)
+	}
+}
+
+func TestDocumentFreshness(t *testing.T) {
+	tempDir := t.TempDir()
+	docDir := filepath.Join(tempDir, "docs")
+	if err := os.Mkdir(docDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	content := strings.Repeat("The notes have enough words to answer a question. ", 3)
+	modTime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for _, name := range []string{"a.md", "b.md", ".gitignore"} {
+		path := filepath.Join(docDir, name)
+		data := content
+		if name == ".gitignore" {
+			data = "build/\n"
+		}
+		if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime.Add(-time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chtimes(filepath.Join(docDir, "b.md"), modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+
+	vectordb := setupTestVectorDB(t, t.TempDir())
+	r := newRAG(vectordb, nil, nil, testEmbedder{},
+		llmSetting{}, llmSetting{Provider: "test", Model: "test"}, nil, defaultRAGSettings())
+	doc := document{ID: 1, Name: "docs", Path: docDir}
+	scanTestDocument(t, r, &doc, nil)
+
+	if !doc.NewestFileTime.Equal(modTime) {
+		t.Errorf("NewestFileTime = %s, want %s", doc.NewestFileTime, modTime)
+	}
+	coll := vectordb.GetCollection(doc.vectorDBCollectionName(), testEmbedder{}.embeddingFunc())
+	results, err := coll.QueryEmbedding(context.Background(), []float32{1, 1}, coll.Count(), nil, nil)
+	if err != nil {
+		t.Fatalf("QueryEmbedding() error = %v", err)
+	}
+	want := map[string]string{"a.md": "2024-05-01T11:00:00Z", "b.md": "2024-05-01T12:00:00Z"}
+	for _, res := range results {
+		if got := res.Metadata[modTimeKey]; got != want[res.Metadata["path"]] {
+			t.Errorf("modTime of the chunk of %s = %q, want %q", res.Metadata["path"], got, want[res.Metadata["path"]])
+		}
+	}
+	if desc := doc.Description(); !strings.Contains(desc, "; newest file: "+doc.NewestFileTime.Format(time.RFC1123)) {
+		t.Errorf("Description() = %q, want the newest file time", desc)
+	}
+
+	// The ignored files don't make the document stale.
+	if err := os.Mkdir(filepath.Join(docDir, "build"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(docDir, "build", "out.md"), []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	future := doc.LastScanTime.Add(time.Minute)
+	if err := os.Chtimes(filepath.Join(docDir, "build", "out.md"), future, future); err != nil {
+		t.Fatal(err)
+	}
+	if stale, err := changedSince(doc, defaultRAGSettings(), doc.LastScanTime); err != nil || stale {
+		t.Errorf("changedSince() = %t, %v, want false for an ignored file", stale, err)
+	}
+	if err := os.Chtimes(filepath.Join(docDir, "a.md"), future, future); err != nil {
+		t.Fatal(err)
+	}
+	if stale, err := changedSince(doc, defaultRAGSettings(), doc.LastScanTime); err != nil || !stale {
+		t.Errorf("changedSince() = %t, %v, want true", stale, err)
+	}
+
+	m := mainModel{documents: []document{doc}, documentsList: list.New([]list.Item{doc}, list.NewDefaultDelegate(), 0, 0)}
+	m = m.handleDocumentFreshnessMsg(documentFreshnessMsg{id: doc.ID, stale: true})
+	if desc := m.documents[0].Description(); !strings.Contains(desc, "files changed since, rescan it") {
+		t.Errorf("Description() = %q, want the stale flag", desc)
+	}
+}
+
+func TestScanSkipsHiddenFiles(t *testing.T) {
+	tempDir := t.TempDir()
+	// A hidden root is still scanned.
+	docDir := filepath.Join(tempDir, ".notes")
+	content := strings.Repeat("The notes have enough words to answer a question. ", 3)
+	for _, name := range []string{"a.md", ".draft.md", ".venv/lib.md", "node_modules/pkg/readme.md",
+		"src/build/out.md", "src/b.md", "cache/c.md"} {
+		path := filepath.Join(docDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content+name), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	vectordb := setupTestVectorDB(t, t.TempDir())
+	newTestRAG := func(settings ragSettings) *rag {
+		return newRAG(vectordb, nil, nil, testEmbedder{},
+			llmSetting{}, llmSetting{Provider: "test", Model: "test"}, nil, settings)
+	}
+
+	doc := document{ID: 1, Name: "notes", Path: docDir}
+	_, logs := scanTestDocument(t, newTestRAG(defaultRAGSettings()), &doc, nil)
+	want := []string{"a.md", "cache/c.md", "src/b.md"}
+	if paths := collectionPaths(t, vectordb, doc); !slices.Equal(paths, want) {
+		t.Errorf("scanned %q, want %q", paths, want)
+	}
+	if summary := scanSummary(logs); !strings.Contains(summary, "1 hidden files and 3 hidden or dependency directories skipped") {
+		t.Errorf("summary = %q, want the skipped entries", summary)
+	}
+
+	settings := defaultRAGSettings()
+	settings.SkippedDirs, _ = parseSkippedDirs(".*, cache")
+	doc = document{ID: 2, Name: "notes", Path: docDir}
+	scanTestDocument(t, newTestRAG(settings), &doc, nil)
+	want = []string{"a.md", "node_modules/pkg/readme.md", "src/b.md", "src/build/out.md"}
+	if paths := collectionPaths(t, vectordb, doc); !slices.Equal(paths, want) {
+		t.Errorf("scanned %q with the skipped directories %q, want %q", paths, settings.SkippedDirs, want)
+	}
+
+	doc = document{ID: 3, Name: "notes", Path: docDir, IncludeHidden: true}
+	scanTestDocument(t, newTestRAG(defaultRAGSettings()), &doc, nil)
+	if paths := collectionPaths(t, vectordb, doc); len(paths) != 7 {
+		t.Errorf("scanned %q with the hidden files, want all 7 files", paths)
+	}
+
+	if dirs, err := parseSkippedDirs(" "); err != nil || dirs == nil || len(dirs) != 0 {
+		t.Errorf("parseSkippedDirs(\" \") = %q, %v, want no directory", dirs, err)
+	}
+	for _, s := range []string{"src/build", "[a"} {
+		if _, err := parseSkippedDirs(s); err == nil {
+			t.Errorf("parseSkippedDirs(%q) expected an error", s)
+		}
+	}
+}
+
+func TestScanArchives(t *testing.T) {
+	tempDir := t.TempDir()
+	docDir := filepath.Join(tempDir, "docs")
+	if err := os.Mkdir(docDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	content := strings.Repeat("The archived notes have enough words to answer a question. ", 3)
+	writeZip := func(name string, files map[string]string, order ...string) {
+		var buf bytes.Buffer
+		w := zip.NewWriter(&buf)
+		for _, f := range order {
+			fw, err := w.Create(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := fw.Write([]byte(files[f])); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(docDir, name), buf.Bytes(), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeZip("guide.zip", map[string]string{
+		"guide/intro.md": content,
+		"nested.zip":     "PK",
+		"photo.png":      "\x89PNG",
+	}, "guide/intro.md", "nested.zip", "photo.png")
+	// The second file is over the 1 MB archive size limit with the first one.
+	large := strings.Repeat(content, 600000/len(content))
+	writeZip("large.zip", map[string]string{"a.md": large, "b.md": large + "More."}, "a.md", "b.md")
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	if err := tw.WriteHeader(&tar.Header{Name: "./notes/c.md", Mode: 0o600, Size: int64(len(content)), ModTime: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(docDir, "notes.tgz"), buf.Bytes(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	settings := defaultRAGSettings()
+	settings.MaxArchiveMB = 1
+	vectordb := setupTestVectorDB(t, tempDir)
+	r := newRAG(vectordb, nil, nil, testEmbedder{},
+		llmSetting{}, llmSetting{Provider: "test", Model: "test"}, nil, settings)
+	scanned := func(states map[string]fileState) []string {
+		var paths []string
+		for path := range states {
+			rel, _ := filepath.Rel(docDir, path)
+			paths = append(paths, filepath.ToSlash(rel))
+		}
+		slices.Sort(paths)
+		return paths
+	}
+
+	doc := document{ID: 1, Name: "docs", Path: docDir}
+	if states, _ := scanTestDocument(t, r, &doc, nil); len(states) != 0 {
+		t.Errorf("scanned %q without indexing the archives, want none", scanned(states))
+	}
+
+	doc = document{ID: 2, Name: "docs", Path: docDir, ScanArchives: true}
+	states, _ := scanTestDocument(t, r, &doc, nil)
+	want := []string{"guide.zip!/guide/intro.md", "large.zip!/a.md", "notes.tgz!/notes/c.md"}
+	if paths := scanned(states); !slices.Equal(paths, want) {
+		t.Errorf("scanned %q, want %q", paths, want)
+	}
+	if paths := collectionPaths(t, vectordb, doc); !slices.Equal(paths, want) {
+		t.Errorf("chunk paths = %q, want %q", paths, want)
+	}
+
+	// An unchanged archive is not read again, this one would fail.
+	archive := filepath.Join(docDir, "guide.zip")
+	info, err := os.Stat(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(archive, bytes.Repeat([]byte{0}, int(info.Size())), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(archive, info.ModTime(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	states, _ = scanTestDocument(t, r, &doc, states)
+	if paths := scanned(states); !slices.Equal(paths, want) {
+		t.Errorf("rescanned %q, want %q", paths, want)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/charmbracelet/huh"
+)
+
+type mistralProvider struct {
+	APIKey string `json:"apiKey"`
+	Proxy  string `json:"proxy"`
+
+	rateLimitSettings
+}
+
+type mistral struct {
+	openai
+}
+
+const (
+	mistralAPIEndpoint = "https://api.mistral.ai/v1"
+)
+
+func (m mistralProvider) Title() string {
+	if m.isConfigured() {
+		return fmt.Sprintf("%s (configured)", providerMistral)
+	}
+	return fmt.Sprintf("%s (not configured)", providerMistral)
+}
+
+func (m mistralProvider) Description() string {
+	return "Configure Mistral connection"
+}
+
+func (m mistralProvider) FilterValue() string {
+	return providerMistral
+}
+
+func (m mistralProvider) name() string {
+	return providerMistral
+}
+
+func (m mistralProvider) availableModels() ([]string, error) {
+	return listOpenAIModels(newOpenAICompatClient(m.APIKey, mistralAPIEndpoint, m.Proxy))
+}
+
+func (m mistralProvider) isConfigured() bool {
+	return m.APIKey != ""
+}
+
+func (m mistralProvider) testConnection() error {
+	_, err := m.availableModels()
+	return err
+}
+
+func (m mistralProvider) form(width, height int, keymap *huh.KeyMap) *huh.Form {
+	proxy := m.Proxy
+	apiKey := m.APIKey
+	if apiKey == "" {
+		apiKey = os.Getenv("MISTRAL_API_KEY")
+	}
+	rateLimit := m.rateLimitSettings
+	return huh.NewForm(
+		huh.NewGroup(
+			huh.NewInput().
+				Key("mistralAPIKey").
+				Title("API Key").
+				Description("Enter the API key for Mistral.").
+				Placeholder("API Key").
+				Value(&apiKey),
+			proxyField("mistralProxy", "Mistral", &proxy),
+			requestsPerMinuteField("mistral", &rateLimit.RequestsPerMinute),
+			tokensPerMinuteField("mistral", &rateLimit.TokensPerMinute),
+			testConnectionField("mistralTest", func() error {
+				return mistralProvider{APIKey: apiKey, Proxy: proxy}.testConnection()
+			}),
+			huh.NewConfirm().
+				Key("mistralConfirm").
+				Title("Confirm").
+				Description("Save this Mistral settings?").
+				Affirmative("Yes").
+				Negative("Back"),
+		),
+	).
+		WithWidth(width).
+		WithHeight(height).
+		WithTheme(huh.ThemeCatppuccin()).
+		WithKeyMap(keymap).
+		WithShowErrors(true).
+		WithShowHelp(true)
+}
+
+func (m mistralProvider) saveForm(form *huh.Form) (llmProvider, bool) {
+	if !form.GetBool("mistralConfirm") {
+		return m, false
+	}
+
+	apiKey := form.GetString("mistralAPIKey")
+
+	if apiKey == "" {
+		return m, false
+	}
+
+	m.APIKey = apiKey
+	m.Proxy = form.GetString("mistralProxy")
+	m.rateLimitSettings = rateLimitSettingsFromForm(form, "mistral")
+
+	return m, true
+}
+
+func (m mistralProvider) new(setting llmSetting) llm {
+	return mistral{
+		openai: openai{
+			apiKey:           m.APIKey,
+			model:            setting.Model,
+			temperature:      setting.Temperature,
+			topP:             setting.TopP,
+			frequencyPenalty: setting.FrequencyPenalty,
+			presencePenalty:  setting.PresencePenalty,
+			stop:             setting.StopSequences,
+			client:           newOpenAICompatClient(m.APIKey, mistralAPIEndpoint, m.Proxy),
+		},
+	}
+}
+
+func (m mistralProvider) supportEmbedding() bool {
+	return true
+}
+
+func (m mistralProvider) newEmbedder(setting llmSetting) embedder {
+	return mistral{
+		openai: openai{
+			apiKey: m.APIKey,
+			model:  setting.Model,
+			client: newOpenAICompatClient(m.APIKey, mistralAPIEndpoint, m.Proxy),
+		},
+	}
+}
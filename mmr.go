@@ -0,0 +1,49 @@
+package main
+
+import (
+	"math"
+	"slices"
+
+	"github.com/philippgille/chromem-go"
+)
+
+const (
+	// defaultMMRLambda weighs the similarity to the question as much as the
+	// difference from the chunks already taken.
+	defaultMMRLambda = 0.5
+)
+
+// mmrWindow returns the needed results in the order of their maximal marginal
+// relevance, and the others from the most similar. Each next result is the one
+// whose similarity to the question weighted by lambda, minus its highest
+// similarity to the results taken before it weighted by 1 - lambda, is the
+// highest. A lambda of 1 keeps the ranking by similarity to the question, the
+// lower ones favor the chunks unlike the ones taken, so the prompt doesn't get
+// several chunks saying the same thing.
+func mmrWindow(results []chromem.Result, lambda float32, needed int) ([]chromem.Result, []chromem.Result) {
+	rest := slices.Clone(results)
+	sortResults(rest)
+
+	// redundancy is the highest similarity of each remaining result to the
+	// results taken.
+	redundancy := make([]float64, len(rest))
+	var window []chromem.Result
+	for len(window) < needed && len(rest) > 0 {
+		best, bestScore := 0, math.Inf(-1)
+		for i, r := range rest {
+			score := float64(lambda)*float64(r.Similarity) - float64(1-lambda)*redundancy[i]
+			if score > bestScore {
+				best, bestScore = i, score
+			}
+		}
+
+		taken := rest[best]
+		window = append(window, taken)
+		rest = slices.Delete(rest, best, best+1)
+		redundancy = slices.Delete(redundancy, best, best+1)
+		for i, r := range rest {
+			redundancy[i] = max(redundancy[i], cosineSimilarity(r.Embedding, taken.Embedding))
+		}
+	}
+	return window, rest
+}
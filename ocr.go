@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+const (
+	ocrBackendTesseract = "tesseract"
+	ocrBackendVision    = "vision"
+
+	// ocrKey is the metadata of the OCR backend that read the text of an
+	// image.
+	ocrKey = "ocr"
+
+	// visionOCRNoText is answered by the vision model for the images without
+	// text.
+	visionOCRNoText = "NO_TEXT"
+
+	visionOCRPrompt = `Transcribe all the text of this image, e.g. a scanned page, a receipt or a whiteboard photo.
+Keep its reading order and its lines, use markdown for its headings, lists and tables.
+Answer with the text only, without describing the image. Answer ` + visionOCRNoText + ` when the image has no text.`
+)
+
+// errImagesUnsupported is returned by the LLMs that can't be sent images.
+var errImagesUnsupported = errors.New("the provider doesn't support images, use a vision model of OpenAI, an OpenAI compatible provider or Ollama")
+
+// imageMIMETypes are the images read by OCR, by their extension.
+var imageMIMETypes = map[string]string{
+	".png":  "image/png",
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".tif":  "image/tiff",
+	".tiff": "image/tiff",
+}
+
+// chatImage is an image sent with a chat, only to the vision models.
+type chatImage struct {
+	data     []byte
+	mimeType string
+}
+
+// imageReader reads the text of an image.
+type imageReader struct {
+	backend string
+	read    func(ctx context.Context, data []byte, mimeType string) (string, error)
+}
+
+// ocrBackendName names the backend in the forms.
+func ocrBackendName(backend string) string {
+	if backend == ocrBackendVision {
+		return "the vision model of the Convo LLM"
+	}
+	return "tesseract"
+}
+
+func (s ragSettings) ocrBackend() string {
+	if s.OCRBackend == "" {
+		return ocrBackendTesseract
+	}
+	return s.OCRBackend
+}
+
+// newImageReader returns the reader of the OCR backend of the settings, or an
+// error when it's not available.
+func (r *rag) newImageReader() (*imageReader, error) {
+	switch r.settings.ocrBackend() {
+	case ocrBackendVision:
+		if r.convoLLM == nil {
+			return nil, errors.New("the Convo LLM is not set, it reads the images of the vision OCR backend")
+		}
+		return &imageReader{
+			backend: fmt.Sprintf("%s/%s", r.convoLLMSetting.Provider, r.convoLLMSetting.Model),
+			read: func(ctx context.Context, data []byte, mimeType string) (string, error) {
+				return visionOCR(ctx, r.convoLLM, data, mimeType)
+			},
+		}, nil
+	default:
+		if _, err := exec.LookPath("tesseract"); err != nil {
+			return nil, fmt.Errorf("tesseract is not installed: %w", err)
+		}
+		return &imageReader{
+			backend: ocrBackendTesseract,
+			read: func(ctx context.Context, data []byte, _ string) (string, error) {
+				return tesseractOCR(ctx, data)
+			},
+		}, nil
+	}
+}
+
+// tesseractOCR reads the text of the image with the tesseract binary.
+func tesseractOCR(ctx context.Context, data []byte) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "tesseract", "stdin", "stdout")
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("error running tesseract: %w: %s", err, msg)
+		}
+		return "", fmt.Errorf("error running tesseract: %w", err)
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// visionOCR asks the vision model to transcribe the text of the image.
+func visionOCR(ctx context.Context, l llm, data []byte, mimeType string) (string, error) {
+	res := l.chat(ctx, []chat{{
+		Role:    roleUser,
+		Content: visionOCRPrompt,
+		images:  []chatImage{{data: data, mimeType: mimeType}},
+	}})
+	if res.err != nil {
+		return "", fmt.Errorf("error reading the image: %w", res.err)
+	}
+	text := strings.TrimSpace(res.content)
+	if text == visionOCRNoText {
+		return "", nil
+	}
+	return text, nil
+}
+
+// imageExtractor returns the extractor of the images of the MIME type, which
+// reads their text with the image reader of the options.
+func imageExtractor(mimeType string) func(data []byte, opts extractOptions) (extractedText, error) {
+	return func(data []byte, opts extractOptions) (extractedText, error) {
+		if opts.imageReader == nil {
+			return extractedText{}, errors.New("OCR is off")
+		}
+		text, err := opts.imageReader.read(opts.ctx, data, mimeType)
+		if err != nil {
+			return extractedText{}, err
+		}
+		return extractedText{
+			content:  text,
+			metadata: map[string]string{ocrKey: opts.imageReader.backend},
+		}, nil
+	}
+}
+
+func hasImages(chats []chat) bool {
+	for _, c := range chats {
+		if len(c.images) > 0 {
+			return true
+		}
+	}
+	return false
+}
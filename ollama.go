@@ -4,25 +4,42 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/charmbracelet/huh"
 	"github.com/ollama/ollama/api"
 	"github.com/philippgille/chromem-go"
-	bolt "go.etcd.io/bbolt"
 )
 
 type ollamaProvider struct {
-	Host string `json:"host"`
+	Host      string `json:"host"`
+	KeepAlive string `json:"keepAlive"`
+	// Headers are sent with every request, e.g. "Authorization: Bearer <token>"
+	// for an instance behind an authenticating reverse proxy. One header per
+	// line.
+	Headers string `json:"headers"`
+
+	rateLimitSettings
 }
 
 type ollama struct {
 	host        string
 	model       string
 	temperature float64
+	// The sampling parameters are only sent when they are set, so the model
+	// defaults apply otherwise.
+	topP             *float64
+	frequencyPenalty *float64
+	presencePenalty  *float64
+	stop             []string
+	keepAlive        *api.Duration
 
 	client *api.Client
 }
@@ -38,22 +55,26 @@ func (o ollama) chat(ctx context.Context, chats []chat) llmResponse {
 			Role:    chat.Role,
 			Content: chat.Content,
 		}
+		for _, img := range chat.images {
+			msgs[i].Images = append(msgs[i].Images, api.ImageData(img.data))
+		}
 	}
 
 	f := false
 	req := api.ChatRequest{
-		Model:    o.model,
-		Messages: msgs,
-		Stream:   &f,
-		Options: map[string]interface{}{
-			"temperature": o.temperature,
-		},
+		Model:     o.model,
+		Messages:  msgs,
+		Stream:    &f,
+		KeepAlive: o.keepAlive,
+		Options:   o.options(),
 	}
 
 	var llmResp llmResponse
 
 	if err := o.client.Chat(ctx, &req, func(res api.ChatResponse) error {
 		llmResp.content = res.Message.Content
+		llmResp.promptTokens = res.PromptEvalCount
+		llmResp.completionTokens = res.EvalCount
 		return nil
 	}); err != nil {
 		return llmResponse{
@@ -64,6 +85,25 @@ func (o ollama) chat(ctx context.Context, chats []chat) llmResponse {
 	return llmResp
 }
 
+func (o ollama) options() map[string]interface{} {
+	options := map[string]interface{}{
+		"temperature": o.temperature,
+	}
+	if o.topP != nil {
+		options["top_p"] = *o.topP
+	}
+	if o.frequencyPenalty != nil {
+		options["frequency_penalty"] = *o.frequencyPenalty
+	}
+	if o.presencePenalty != nil {
+		options["presence_penalty"] = *o.presencePenalty
+	}
+	if len(o.stop) > 0 {
+		options["stop"] = o.stop
+	}
+	return options
+}
+
 func (o ollama) chatStream(ctx context.Context, chats []chat) <-chan llmResponse {
 	responseChan := make(chan llmResponse)
 
@@ -80,17 +120,19 @@ func (o ollama) chatStream(ctx context.Context, chats []chat) <-chan llmResponse
 
 		t := true
 		req := api.ChatRequest{
-			Model:    o.model,
-			Messages: msgs,
-			Stream:   &t,
-			Options: map[string]interface{}{
-				"temperature": o.temperature,
-			},
+			Model:     o.model,
+			Messages:  msgs,
+			Stream:    &t,
+			KeepAlive: o.keepAlive,
+			Options:   o.options(),
 		}
 
 		if err := o.client.Chat(ctx, &req, func(res api.ChatResponse) error {
+			// The counts are only set on the last response, once it's done.
 			responseChan <- llmResponse{
-				content: res.Message.Content,
+				content:          res.Message.Content,
+				promptTokens:     res.PromptEvalCount,
+				completionTokens: res.EvalCount,
 			}
 
 			return nil
@@ -119,8 +161,9 @@ func (o ollama) embeddingFunc() chromem.EmbeddingFunc {
 
 	return func(ctx context.Context, text string) ([]float32, error) {
 		req := api.EmbedRequest{
-			Model: o.model,
-			Input: text,
+			Model:     o.model,
+			Input:     text,
+			KeepAlive: o.keepAlive,
 		}
 
 		// Send the request.
@@ -155,6 +198,39 @@ func (o ollama) embeddingFunc() chromem.EmbeddingFunc {
 	}
 }
 
+// embeddingContextLength returns the context length of the model, from the
+// <architecture>.context_length of its info, lowered by its num_ctx parameter.
+func (o ollama) embeddingContextLength(ctx context.Context) (int, error) {
+	return ollamaContextLength(ctx, o.client, o.model)
+}
+
+func ollamaContextLength(ctx context.Context, client *api.Client, model string) (int, error) {
+	resp, err := client.Show(ctx, &api.ShowRequest{Model: model})
+	if err != nil {
+		return 0, fmt.Errorf("error showing model %s: %w", model, err)
+	}
+
+	var contextLength int
+	for k, v := range resp.ModelInfo {
+		if n, ok := v.(float64); ok && strings.HasSuffix(k, ".context_length") {
+			contextLength = int(n)
+			break
+		}
+	}
+
+	for _, line := range strings.Split(resp.Parameters, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || fields[0] != "num_ctx" {
+			continue
+		}
+		if n, err := strconv.Atoi(fields[1]); err == nil && n > 0 && (contextLength == 0 || n < contextLength) {
+			contextLength = n
+		}
+	}
+
+	return contextLength, nil
+}
+
 func (o ollamaProvider) Title() string {
 	if o.isConfigured() {
 		return fmt.Sprintf("%s (configured)", providerOllama)
@@ -174,16 +250,16 @@ func (ollamaProvider) name() string {
 	return providerOllama
 }
 
-func (o ollamaProvider) availableModels() []string {
+func (o ollamaProvider) availableModels() ([]string, error) {
 	u, err := url.Parse(o.Host)
 	if err != nil {
-		return []string{}
+		return nil, fmt.Errorf("error parsing host: %w", err)
 	}
-	client := api.NewClient(u, &http.Client{})
+	client := api.NewClient(u, o.httpClient())
 
 	resp, err := client.List(context.Background())
 	if err != nil {
-		return []string{}
+		return nil, fmt.Errorf("error listing models: %w", err)
 	}
 
 	models := make([]string, len(resp.Models))
@@ -191,13 +267,88 @@ func (o ollamaProvider) availableModels() []string {
 		models[i] = model.Name
 	}
 
-	return models
+	return models, nil
+}
+
+// httpClient returns the client used to talk to ollama, sending the configured
+// headers with every request.
+func (o ollamaProvider) httpClient() *http.Client {
+	headers, err := parseHeaders(o.Headers)
+	if err != nil {
+		slog.Warn("invalid ollama headers, sending requests without them", "error", err)
+	}
+	if len(headers) == 0 {
+		return newProxyHTTPClient("")
+	}
+	return &http.Client{
+		Transport: headerTransport{
+			headers: headers,
+			base:    proxyTransport(""),
+		},
+	}
+}
+
+// parseHeaders parses the headers in "Name: value" form, one per line.
+func parseHeaders(s string) (http.Header, error) {
+	headers := make(http.Header)
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(line, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid header %q, use the Name: value form", line)
+		}
+		headers.Add(name, strings.TrimSpace(value))
+	}
+	return headers, nil
+}
+
+// keepAlive returns the keep alive duration to send with the requests, nil lets
+// ollama use its default.
+func (o ollamaProvider) keepAlive() *api.Duration {
+	d, err := parseOllamaKeepAlive(o.KeepAlive)
+	if err != nil {
+		slog.Warn("invalid ollama keep alive, using the ollama default", "keepAlive", o.KeepAlive, "error", err)
+		return nil
+	}
+	return d
+}
+
+// parseOllamaKeepAlive parses a keep alive value the way ollama does, either a
+// duration like "10m" or a number of seconds, where a negative value keeps the
+// model loaded forever.
+func parseOllamaKeepAlive(s string) (*api.Duration, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+
+	if secs, err := strconv.Atoi(s); err == nil {
+		if secs < 0 {
+			return &api.Duration{Duration: -1}, nil
+		}
+		return &api.Duration{Duration: time.Duration(secs) * time.Second}, nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid keep alive %q, use a duration like 10m or -1", s)
+	}
+	return &api.Duration{Duration: d}, nil
 }
 
 func (o ollamaProvider) isConfigured() bool {
 	return o.Host != ""
 }
 
+func (o ollamaProvider) testConnection() error {
+	_, err := o.availableModels()
+	return err
+}
+
 func (o ollamaProvider) form(width, height int, keymap *huh.KeyMap) *huh.Form {
 	host := o.Host
 	if host == "" {
@@ -206,6 +357,9 @@ func (o ollamaProvider) form(width, height int, keymap *huh.KeyMap) *huh.Form {
 	if host == "" {
 		host = defaultOllamaHost
 	}
+	keepAlive := o.KeepAlive
+	headers := o.Headers
+	rateLimit := o.rateLimitSettings
 	return huh.NewForm(
 		huh.NewGroup(
 			huh.NewInput().
@@ -214,6 +368,31 @@ func (o ollamaProvider) form(width, height int, keymap *huh.KeyMap) *huh.Form {
 				Description("Enter the host for ollama.").
 				Placeholder("Host").
 				Value(&host),
+			huh.NewInput().
+				Key("ollamaKeepAlive").
+				Title("Keep Alive").
+				Description("How long the model stays loaded after a request, e.g. 10m, 1h, or -1 to never unload. Leave empty for the ollama default.").
+				Placeholder("5m").
+				Validate(func(s string) error {
+					_, err := parseOllamaKeepAlive(s)
+					return err
+				}).
+				Value(&keepAlive),
+			huh.NewText().
+				Key("ollamaHeaders").
+				Title("Headers").
+				Description("Optional headers sent with every request, one per line, e.g. Authorization: Bearer <token>.").
+				Placeholder("Authorization: Bearer <token>").
+				Validate(func(s string) error {
+					_, err := parseHeaders(s)
+					return err
+				}).
+				Value(&headers),
+			requestsPerMinuteField("ollama", &rateLimit.RequestsPerMinute),
+			tokensPerMinuteField("ollama", &rateLimit.TokensPerMinute),
+			testConnectionField("ollamaTest", func() error {
+				return ollamaProvider{Host: host, Headers: headers}.testConnection()
+			}),
 			huh.NewConfirm().
 				Key("ollamaConfirm").
 				Title("Confirm").
@@ -230,23 +409,22 @@ func (o ollamaProvider) form(width, height int, keymap *huh.KeyMap) *huh.Form {
 		WithShowHelp(true)
 }
 
-func (o ollamaProvider) saveForm(db *bolt.DB, form *huh.Form) (llmProvider, bool, error) {
+func (o ollamaProvider) saveForm(form *huh.Form) (llmProvider, bool) {
 	if !form.GetBool("ollamaConfirm") {
-		return o, false, nil
+		return o, false
 	}
 
 	host := form.GetString("ollamaHost")
 	if host == "" {
-		return o, false, nil
+		return o, false
 	}
 
 	o.Host = host
+	o.KeepAlive = form.GetString("ollamaKeepAlive")
+	o.Headers = form.GetString("ollamaHeaders")
+	o.rateLimitSettings = rateLimitSettingsFromForm(form, "ollama")
 
-	if err := saveOllamaSettings(db, o); err != nil {
-		return o, false, fmt.Errorf("error saving ollama settings: %w", err)
-	}
-
-	return o, true, nil
+	return o, true
 }
 
 func (o ollamaProvider) new(setting llmSetting) llm {
@@ -256,11 +434,26 @@ func (o ollamaProvider) new(setting llmSetting) llm {
 	}
 
 	return ollama{
-		host:        o.Host,
-		model:       setting.Model,
-		temperature: setting.Temperature,
-		client:      api.NewClient(u, &http.Client{}),
+		host:             o.Host,
+		model:            setting.Model,
+		temperature:      setting.Temperature,
+		topP:             setting.TopP,
+		frequencyPenalty: setting.FrequencyPenalty,
+		presencePenalty:  setting.PresencePenalty,
+		stop:             setting.StopSequences,
+		keepAlive:        o.keepAlive(),
+		client:           api.NewClient(u, o.httpClient()),
+	}
+}
+
+// modelContextWindow returns the context length of the model, the same way as
+// for the embedding models.
+func (o ollamaProvider) modelContextWindow(ctx context.Context, model string) (int, error) {
+	u, err := url.Parse(o.Host)
+	if err != nil {
+		return 0, fmt.Errorf("error parsing host: %w", err)
 	}
+	return ollamaContextLength(ctx, api.NewClient(u, o.httpClient()), model)
 }
 
 func (o ollamaProvider) supportEmbedding() bool {
@@ -276,6 +469,7 @@ func (o ollamaProvider) newEmbedder(setting llmSetting) embedder {
 		host:        o.Host,
 		model:       setting.Model,
 		temperature: setting.Temperature,
-		client:      api.NewClient(u, &http.Client{}),
+		keepAlive:   o.keepAlive(),
+		client:      api.NewClient(u, o.httpClient()),
 	}
 }
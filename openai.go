@@ -2,54 +2,49 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
+	"net/http"
 	"os"
+	"strings"
+	"sync"
 
 	"github.com/charmbracelet/huh"
 	"github.com/philippgille/chromem-go"
 	goopenai "github.com/sashabaranov/go-openai"
-	bolt "go.etcd.io/bbolt"
 )
 
 type openaiProvider struct {
-	APIKey string `json:"apiKey"`
+	APIKey  string `json:"apiKey"`
+	OrgID   string `json:"orgID"`
+	BaseURL string `json:"baseURL"`
+	Timeout string `json:"timeout"`
+	Proxy   string `json:"proxy"`
+
+	rateLimitSettings
 }
 
 type openai struct {
 	apiKey      string
 	model       string
 	temperature float64
+	// The sampling parameters are only sent when they are set, so the model
+	// defaults apply otherwise.
+	topP             *float64
+	frequencyPenalty *float64
+	presencePenalty  *float64
+	stop             []string
+	// streamUsage requests the token usage at the end of a stream, only for the
+	// APIs that accept the stream_options parameter.
+	streamUsage bool
 
 	client *goopenai.Client
 }
 
 func (o openai) chat(ctx context.Context, chats []chat) llmResponse {
-	systemChat, cs := extractSystemChat(chats)
-
-	msgs := make([]goopenai.ChatCompletionMessage, 0, len(cs)+1)
-	if systemChat != "" {
-		msgs = append(msgs, goopenai.ChatCompletionMessage{
-			Role:    goopenai.ChatMessageRoleSystem,
-			Content: systemChat,
-		})
-	}
-
-	for _, chat := range cs {
-		msgs = append(msgs, goopenai.ChatCompletionMessage{
-			Role:    chat.Role,
-			Content: chat.Content,
-		})
-	}
-
-	resp, err := o.client.CreateChatCompletion(
-		ctx,
-		goopenai.ChatCompletionRequest{
-			Model:       o.model,
-			Messages:    msgs,
-			Temperature: float32(o.temperature),
-		},
-	)
+	resp, err := o.client.CreateChatCompletion(ctx, o.chatRequest(chats))
 	if err != nil {
 		return llmResponse{
 			err: fmt.Errorf("error creating chat completion: %w", err),
@@ -63,7 +58,9 @@ func (o openai) chat(ctx context.Context, chats []chat) llmResponse {
 	}
 
 	return llmResponse{
-		content: resp.Choices[0].Message.Content,
+		content:          resp.Choices[0].Message.Content,
+		promptTokens:     resp.Usage.PromptTokens,
+		completionTokens: resp.Usage.CompletionTokens,
 	}
 }
 
@@ -73,33 +70,22 @@ func (o openai) chatStream(ctx context.Context, chats []chat) <-chan llmResponse
 	go func() {
 		defer close(responseChan)
 
-		systemChat, cs := extractSystemChat(chats)
-
-		msgs := make([]goopenai.ChatCompletionMessage, 0, len(cs)+1)
-		if systemChat != "" {
-			msgs = append(msgs, goopenai.ChatCompletionMessage{
-				Role:    goopenai.ChatMessageRoleSystem,
-				Content: systemChat,
-			})
-		}
-
-		for _, chat := range cs {
-			msgs = append(msgs, goopenai.ChatCompletionMessage{
-				Role:    chat.Role,
-				Content: chat.Content,
-			})
+		req := o.chatRequest(chats)
+		req.Stream = true
+		if o.streamUsage {
+			// The usage is sent in a last chunk without choices.
+			req.StreamOptions = &goopenai.StreamOptions{
+				IncludeUsage: true,
+			}
 		}
 
-		stream, err := o.client.CreateChatCompletionStream(
-			ctx,
-			goopenai.ChatCompletionRequest{
-				Model:       o.model,
-				Messages:    msgs,
-				Temperature: float32(o.temperature),
-				Stream:      true,
-			},
-		)
+		stream, err := o.client.CreateChatCompletionStream(ctx, req)
 		if err != nil {
+			if isOpenAIReasoningModel(o.model) && isStreamUnsupportedError(err) {
+				// Some reasoning models can't stream, their answer is sent at once.
+				responseChan <- o.chat(ctx, chats)
+				return
+			}
 			responseChan <- llmResponse{
 				err: fmt.Errorf("error creating chat completion stream: %w", err),
 			}
@@ -122,19 +108,158 @@ func (o openai) chatStream(ctx context.Context, chats []chat) <-chan llmResponse
 				return
 			}
 
+			// Reasoning models like deepseek-reasoner stream their chain of thought
+			// in a separate field before the answer. It is not part of the answer,
+			// so it is dropped instead of being sent along with the content.
 			if len(response.Choices) > 0 && response.Choices[0].Delta.Content != "" {
 				responseChan <- llmResponse{
 					content: response.Choices[0].Delta.Content,
 				}
 			}
+
+			if response.Usage != nil {
+				responseChan <- llmResponse{
+					promptTokens:     response.Usage.PromptTokens,
+					completionTokens: response.Usage.CompletionTokens,
+				}
+			}
 		}
 	}()
 
 	return responseChan
 }
 
+// reasoningMaxCompletionTokens is the token limit of the answers of the
+// reasoning models, their reasoning tokens count towards it so it leaves room
+// for a long chain of thought before the answer.
+const reasoningMaxCompletionTokens = 32768
+
+// chatRequest returns the chat completion request for the chats.
+//
+// The reasoning models reject the system role, max_tokens and any temperature
+// but the default, so the system prompt is folded into the first user message,
+// the temperature and the sampling parameters are left out, and the limit is
+// sent as max_completion_tokens.
+func (o openai) chatRequest(chats []chat) goopenai.ChatCompletionRequest {
+	systemChat, cs := extractSystemChat(chats)
+	reasoning := isOpenAIReasoningModel(o.model)
+
+	msgs := make([]goopenai.ChatCompletionMessage, 0, len(cs)+1)
+	if systemChat != "" && !reasoning {
+		msgs = append(msgs, goopenai.ChatCompletionMessage{
+			Role:    goopenai.ChatMessageRoleSystem,
+			Content: systemChat,
+		})
+	}
+
+	folded := !reasoning || systemChat == ""
+	for _, chat := range cs {
+		content := chat.Content
+		if !folded && chat.Role == roleUser {
+			content = systemChat + "\n\n" + content
+			folded = true
+		}
+		msg := goopenai.ChatCompletionMessage{
+			Role:    chat.Role,
+			Content: content,
+		}
+		// The images are sent as data URLs, along with the text.
+		if len(chat.images) > 0 {
+			msg.Content = ""
+			msg.MultiContent = []goopenai.ChatMessagePart{{Type: goopenai.ChatMessagePartTypeText, Text: content}}
+			for _, img := range chat.images {
+				msg.MultiContent = append(msg.MultiContent, goopenai.ChatMessagePart{
+					Type: goopenai.ChatMessagePartTypeImageURL,
+					ImageURL: &goopenai.ChatMessageImageURL{
+						URL: "data:" + img.mimeType + ";base64," + base64.StdEncoding.EncodeToString(img.data),
+					},
+				})
+			}
+		}
+		msgs = append(msgs, msg)
+	}
+
+	req := goopenai.ChatCompletionRequest{
+		Model:    o.model,
+		Messages: msgs,
+	}
+	if !reasoning {
+		req.Temperature = float32(o.temperature)
+		if o.topP != nil {
+			req.TopP = float32(*o.topP)
+		}
+		if o.frequencyPenalty != nil {
+			req.FrequencyPenalty = float32(*o.frequencyPenalty)
+		}
+		if o.presencePenalty != nil {
+			req.PresencePenalty = float32(*o.presencePenalty)
+		}
+		req.Stop = o.stop
+	} else {
+		req.MaxCompletionTokens = reasoningMaxCompletionTokens
+	}
+
+	return req
+}
+
+// embeddingFunc returns an EmbeddingFunc that uses the client, so the embeddings
+// are sent with the same organization and base URL as the chats.
 func (o openai) embeddingFunc() chromem.EmbeddingFunc {
-	return chromem.NewEmbeddingFuncOpenAI(o.apiKey, chromem.EmbeddingModelOpenAI(o.model))
+	var checkedNormalized bool
+	checkNormalized := sync.Once{}
+
+	return func(ctx context.Context, text string) ([]float32, error) {
+		vs, err := o.embedBatch(ctx, []string{text})
+		if err != nil {
+			return nil, err
+		}
+
+		// OpenAI embeddings are normalized, but the models behind a gateway may
+		// not be.
+		v := vs[0]
+		checkNormalized.Do(func() {
+			checkedNormalized = isNormalized(v)
+		})
+		if !checkedNormalized {
+			v = normalizeVector(v)
+		}
+
+		return v, nil
+	}
+}
+
+// embedBatch embeds the texts in a single request, the embeddings endpoint
+// accepts an array of inputs. The embeddings are not normalized, chromem-go does
+// it when they are added to a collection.
+func (o openai) embedBatch(ctx context.Context, texts []string) ([][]float32, error) {
+	resp, err := o.client.CreateEmbeddings(ctx, goopenai.EmbeddingRequest{
+		Input: texts,
+		Model: goopenai.EmbeddingModel(o.model),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error creating embeddings: %w", err)
+	}
+
+	if len(resp.Data) != len(texts) {
+		return nil, fmt.Errorf("got %d embeddings for %d texts", len(resp.Data), len(texts))
+	}
+
+	// The embeddings carry the index of their input, which is the only order
+	// the API guarantees.
+	vs := make([][]float32, len(texts))
+	for _, d := range resp.Data {
+		if d.Index < 0 || d.Index >= len(texts) || len(d.Embedding) == 0 {
+			return nil, errors.New("no embeddings found in the response")
+		}
+		vs[d.Index] = d.Embedding
+	}
+	for _, v := range vs {
+		if v == nil {
+			return nil, errors.New("no embeddings found in the response")
+		}
+	}
+
+	return vs, nil
 }
 
 func (o openaiProvider) Title() string {
@@ -156,31 +281,50 @@ func (o openaiProvider) name() string {
 	return providerOpenAI
 }
 
-func (o openaiProvider) availableModels() []string {
-	client := goopenai.NewClient(o.APIKey)
+func (o openaiProvider) availableModels() ([]string, error) {
+	return o.listModels(isOpenAIChatModel)
+}
 
-	mList, err := client.ListModels(context.Background())
+func (o openaiProvider) availableEmbeddingModels() ([]string, error) {
+	return o.listModels(isOpenAIEmbeddingModel)
+}
+
+// listModels returns the OpenAI models that satisfy the given capability filter.
+func (o openaiProvider) listModels(filter func(string) bool) ([]string, error) {
+	listed, err := listOpenAIModels(o.client())
 	if err != nil {
-		return []string{}
+		return nil, err
 	}
 
-	res := make([]string, len(mList.Models))
-	for i, m := range mList.Models {
-		res[i] = m.ID
+	var models []string
+	for _, m := range listed {
+		if filter(m) {
+			models = append(models, m)
+		}
 	}
 
-	return res
+	return models, nil
 }
 
 func (o openaiProvider) isConfigured() bool {
 	return o.APIKey != ""
 }
 
+func (o openaiProvider) testConnection() error {
+	_, err := listOpenAIModels(o.client())
+	return err
+}
+
 func (o openaiProvider) form(width, height int, keymap *huh.KeyMap) *huh.Form {
+	orgID := o.OrgID
+	baseURL := o.BaseURL
+	timeout := o.Timeout
+	proxy := o.Proxy
 	apiKey := o.APIKey
 	if apiKey == "" {
 		apiKey = os.Getenv("OPENAI_API_KEY")
 	}
+	rateLimit := o.rateLimitSettings
 	return huh.NewForm(
 		huh.NewGroup(
 			huh.NewInput().
@@ -189,6 +333,34 @@ func (o openaiProvider) form(width, height int, keymap *huh.KeyMap) *huh.Form {
 				Description("Enter the API key for OpenAI.").
 				Placeholder("API Key").
 				Value(&apiKey),
+			huh.NewInput().
+				Key("openaiOrgID").
+				Title("Organization ID").
+				Description("Optional organization ID the API key is scoped to.").
+				Placeholder("org-...").
+				Value(&orgID),
+			huh.NewInput().
+				Key("openaiBaseURL").
+				Title("Base URL").
+				Description("Optional base URL of an OpenAI-compatible gateway, leave empty to use api.openai.com.").
+				Placeholder("https://api.openai.com/v1").
+				Value(&baseURL),
+			huh.NewInput().
+				Key("openaiTimeout").
+				Title("Timeout").
+				Description("Fail a request when OpenAI sends nothing for this long, e.g. 120s or 5m.").
+				Placeholder(defaultRequestTimeout.String()).
+				Validate(func(s string) error {
+					_, err := parseRequestTimeout(s)
+					return err
+				}).
+				Value(&timeout),
+			proxyField("openaiProxy", "OpenAI", &proxy),
+			requestsPerMinuteField("openai", &rateLimit.RequestsPerMinute),
+			tokensPerMinuteField("openai", &rateLimit.TokensPerMinute),
+			testConnectionField("openaiTest", func() error {
+				return openaiProvider{APIKey: apiKey, OrgID: orgID, BaseURL: baseURL, Proxy: proxy}.testConnection()
+			}),
 			huh.NewConfirm().
 				Key("openaiConfirm").
 				Title("Confirm").
@@ -205,33 +377,38 @@ func (o openaiProvider) form(width, height int, keymap *huh.KeyMap) *huh.Form {
 		WithShowHelp(true)
 }
 
-func (o openaiProvider) saveForm(db *bolt.DB, form *huh.Form) (llmProvider, bool, error) {
+func (o openaiProvider) saveForm(form *huh.Form) (llmProvider, bool) {
 	if !form.GetBool("openaiConfirm") {
-		return o, false, nil
+		return o, false
 	}
 
 	apiKey := form.GetString("openaiAPIKey")
 
 	if apiKey == "" {
-		return o, false, nil
+		return o, false
 	}
 
 	o.APIKey = apiKey
+	o.OrgID = form.GetString("openaiOrgID")
+	o.BaseURL = form.GetString("openaiBaseURL")
+	o.Timeout = form.GetString("openaiTimeout")
+	o.Proxy = form.GetString("openaiProxy")
+	o.rateLimitSettings = rateLimitSettingsFromForm(form, "openai")
 
-	if err := saveOpenAISettings(db, o); err != nil {
-		return o, false, fmt.Errorf("error saving openai settings: %w", err)
-	}
-
-	return o, true, nil
+	return o, true
 }
 
 func (o openaiProvider) new(setting llmSetting) llm {
-	client := goopenai.NewClient(o.APIKey)
 	return openai{
-		apiKey:      o.APIKey,
-		model:       setting.Model,
-		temperature: setting.Temperature,
-		client:      client,
+		apiKey:           o.APIKey,
+		model:            setting.Model,
+		temperature:      setting.Temperature,
+		topP:             setting.TopP,
+		frequencyPenalty: setting.FrequencyPenalty,
+		presencePenalty:  setting.PresencePenalty,
+		stop:             setting.StopSequences,
+		streamUsage:      true,
+		client:           o.client(),
 	}
 }
 
@@ -240,10 +417,91 @@ func (o openaiProvider) supportEmbedding() bool {
 }
 
 func (o openaiProvider) newEmbedder(setting llmSetting) embedder {
-	client := goopenai.NewClient(o.APIKey)
 	return &openai{
 		apiKey: o.APIKey,
 		model:  setting.Model,
-		client: client,
+		client: o.client(),
+	}
+}
+
+// tokenizer returns the tiktoken tokenizer of the embedding model.
+func (o openaiProvider) tokenizer(model string) tokenizer {
+	return newTiktokenTokenizer(model)
+}
+
+// client returns the go-openai client for the provider settings, shared by the
+// chats, the embedder and the model listing so they all go through the same
+// endpoint.
+func (o openaiProvider) client() *goopenai.Client {
+	cfg := goopenai.DefaultConfig(o.APIKey)
+	cfg.OrgID = o.OrgID
+	if o.BaseURL != "" {
+		cfg.BaseURL = strings.TrimRight(o.BaseURL, "/")
+	}
+	cfg.HTTPClient = newTimeoutHTTPClient(requestTimeout(o.Timeout), o.Proxy)
+	return goopenai.NewClientWithConfig(cfg)
+}
+
+// newOpenAICompatClient returns a go-openai client for providers that expose an
+// OpenAI-compatible API at baseURL, sending the requests through the proxy.
+func newOpenAICompatClient(apiKey, baseURL, proxy string) *goopenai.Client {
+	cfg := goopenai.DefaultConfig(apiKey)
+	cfg.BaseURL = baseURL
+	cfg.HTTPClient = newProxyHTTPClient(proxy)
+	return goopenai.NewClientWithConfig(cfg)
+}
+
+// listOpenAIModels returns the IDs of the models listed by the client.
+func listOpenAIModels(client *goopenai.Client) ([]string, error) {
+	mList, err := client.ListModels(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("error listing models: %w", err)
+	}
+
+	res := make([]string, len(mList.Models))
+	for i, m := range mList.Models {
+		res[i] = m.ID
 	}
+
+	return res, nil
+}
+
+// isOpenAIEmbeddingModel reports whether the OpenAI model ID is an embedding model.
+func isOpenAIEmbeddingModel(model string) bool {
+	return strings.HasPrefix(model, "text-embedding-")
+}
+
+// isOpenAIReasoningModel reports whether the OpenAI model ID is one of the o-series
+// reasoning models.
+func isOpenAIReasoningModel(model string) bool {
+	return strings.HasPrefix(model, "o1") ||
+		strings.HasPrefix(model, "o3") ||
+		strings.HasPrefix(model, "o4")
+}
+
+// isStreamUnsupportedError reports whether the error rejects the stream
+// parameter of the request.
+func isStreamUnsupportedError(err error) bool {
+	var apiErr *goopenai.APIError
+	if !errors.As(err, &apiErr) || apiErr.HTTPStatusCode != http.StatusBadRequest {
+		return false
+	}
+	return apiErr.Param != nil && *apiErr.Param == "stream"
+}
+
+// isOpenAIChatModel reports whether the OpenAI model ID can be used with the chat
+// completions API. The models endpoint also lists image, audio, moderation and
+// legacy completion models, which would fail when used to chat.
+func isOpenAIChatModel(model string) bool {
+	if !strings.HasPrefix(model, "gpt-") &&
+		!strings.HasPrefix(model, "chatgpt-") &&
+		!isOpenAIReasoningModel(model) {
+		return false
+	}
+	for _, s := range []string{"instruct", "audio", "realtime", "transcribe", "tts", "image"} {
+		if strings.Contains(model, s) {
+			return false
+		}
+	}
+	return true
 }
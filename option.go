@@ -1,6 +1,9 @@
 package main
 
 import (
+	"fmt"
+	"log/slog"
+
 	"github.com/charmbracelet/bubbles/key"
 	"github.com/charmbracelet/bubbles/list"
 	tea "github.com/charmbracelet/bubbletea"
@@ -18,6 +21,9 @@ const (
 	optionConvoLLMTitle    = "Convo LLM"
 	optionGenTitleLLMTitle = "Generate Title LLM"
 	optionEmbedderTitle    = "Embedder LLM"
+	optionRAGSettingsTitle = "RAG Settings"
+	optionPromptTitle      = "RAG Prompt Template"
+	optionDebugTitle       = "Debug Provider Traffic"
 )
 
 var llmOptionItems = []optionItem{
@@ -52,6 +58,25 @@ func (m mainModel) initOptions() mainModel {
 	if m.providersIsConfigured() {
 		m.options = append(m.options, llmOptionItems...)
 	}
+	m.options = append(m.options, optionItem{
+		title: optionRAGSettingsTitle,
+		description: fmt.Sprintf("Chunks of %d tokens with %d of overlap, %d results per document above %g similarity, "+
+			"%d chunks in the prompt ranked %s, answers in %s",
+			m.ragSettings.ChunkSize, m.ragSettings.ChunkOverlap, m.ragSettings.ResultsCount, m.ragSettings.SimilarityThreshold,
+			m.ragSettings.NeededCount, m.ragSettings.retrievalStrategyDescription(), m.ragSettings.answerLanguageDescription()),
+	})
+	promptDescription := "The built-in system prompt of the questions about the documents"
+	if m.ragSettings.PromptTemplate != "" {
+		promptDescription = fmt.Sprintf("A custom system prompt of %d characters", len(m.ragSettings.PromptTemplate))
+	}
+	m.options = append(m.options, optionItem{
+		title:       optionPromptTitle,
+		description: promptDescription,
+	})
+	m.options = append(m.options, optionItem{
+		title:       optionDebugTitle,
+		description: "Log the requests and responses of the providers to doconvo.log, with the API keys redacted",
+	})
 
 	items := make([]list.Item, len(m.options))
 	for i, item := range m.options {
@@ -82,6 +107,12 @@ func (m mainModel) initOptions() mainModel {
 			} else {
 				it.title += " (not configured)"
 			}
+		case optionDebugTitle:
+			if debugTraffic.Load() {
+				it.title += " (on)"
+			} else {
+				it.title += " (off)"
+			}
 		}
 
 		items[i] = it
@@ -147,19 +178,42 @@ func (m mainModel) selectOption(index int) (mainModel, tea.Cmd) {
 
 	switch option.title {
 	case optionDocumentsTitle:
-		return m.setViewState(viewStateDocuments).updateDocumentsSize(), nil
+		return m.setViewState(viewStateDocuments).updateDocumentsSize().checkDocumentsFreshness()
 	case optionProvidersTitle:
-		return m.setViewState(viewStateProviders).updateProvidersSize(), nil
+		return m.setViewState(viewStateProviders).updateProvidersSize().checkProviders()
 	case optionConvoLLMTitle:
 		return m.setViewState(viewStateConvoLLMForm).updateFormSize().newConvoLLMForm()
 	case optionGenTitleLLMTitle:
 		return m.setViewState(viewStateGenTitleLLMForm).updateFormSize().newGenTitleLLMForm()
 	case optionEmbedderTitle:
 		return m.setViewState(viewStateEmbedderLLMForm).updateFormSize().newEmbedderLLMForm()
+	case optionRAGSettingsTitle:
+		return m.setViewState(viewStateRAGSettingsForm).updateFormSize().newRAGSettingsForm()
+	case optionPromptTitle:
+		return m.setViewState(viewStatePromptTemplateForm).updateFormSize().newPromptTemplateForm()
+	case optionDebugTitle:
+		return m.toggleDebugTraffic(), nil
 	}
 	return m, nil
 }
 
+// toggleDebugTraffic enables or disables the logging of the provider traffic,
+// keeping the selected option.
+func (m mainModel) toggleDebugTraffic() mainModel {
+	enabled := !debugTraffic.Load()
+	if err := saveDebugTraffic(m.db, enabled); err != nil {
+		m.err = fmt.Errorf("error saving debug traffic setting: %w", err)
+		slog.Error(m.err.Error())
+		return m.updateOptionsSize()
+	}
+	setDebugTraffic(enabled)
+
+	index := m.optionsList.Index()
+	m = m.initOptions()
+	m.optionsList.Select(index)
+	return m.updateOptionsSize()
+}
+
 func (c optionItem) Title() string {
 	return c.title
 }
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/charmbracelet/bubbles/key"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/huh"
+	"github.com/charmbracelet/lipgloss"
+	"github.com/philippgille/chromem-go"
+)
+
+const (
+	// knowledgePlaceholder is replaced by the chunks retrieved for the
+	// question, filenamesPlaceholder by the names of their files.
+	knowledgePlaceholder = "{{knowledge}}"
+	filenamesPlaceholder = "{{filenames}}"
+
+	maxPromptTemplateChars = 8000
+
+	promptTemplateActionSave  = "save"
+	promptTemplateActionReset = "reset"
+	promptTemplateActionBack  = "back"
+
+	defaultPromptTemplate = `
+I am an AI assistant who deeply understands and embodies this knowledge:
+
+` + knowledgePlaceholder + `
+
+GUIDELINES:
+1. Speak naturally as if this knowledge is your own experience and expertise
+2. Never use phrases like "based on documents", "according to", "from the documents", or similar references
+3. You can expand the conversation with relevant external knowledge
+4. Answer directly and confidently, as if you're sharing your own knowledge
+5. Be conversational and engaging
+
+RESPONSE FORMAT:
+- Provide your complete answer
+- Do not add a Sources line or a list of the filenames, the sources are shown with your answer separately`
+)
+
+var placeholderRegexp = regexp.MustCompile(`\{\{[^{}]*\}\}`)
+
+// validatePromptTemplate checks that the template has the knowledge
+// placeholder, and no other placeholder than the known ones. An empty template
+// is the built-in one.
+func validatePromptTemplate(s string) error {
+	if strings.TrimSpace(s) == "" {
+		return nil
+	}
+	if !strings.Contains(s, knowledgePlaceholder) {
+		return fmt.Errorf("the template must contain %s, where the chunks of the documents go", knowledgePlaceholder)
+	}
+	for _, p := range placeholderRegexp.FindAllString(s, -1) {
+		if p != knowledgePlaceholder && p != filenamesPlaceholder {
+			return fmt.Errorf("unknown placeholder %s, use %s and %s", p, knowledgePlaceholder, filenamesPlaceholder)
+		}
+	}
+	return nil
+}
+
+// ragSystemPrompt renders the template with the results retrieved for the
+// question, the built-in template when it's empty.
+func ragSystemPrompt(docs []chromem.Result, template string) string {
+	if strings.TrimSpace(template) == "" {
+		template = defaultPromptTemplate
+	}
+
+	knowledge := ""
+	var filenames []string
+	for _, doc := range docs {
+		filename := ""
+		if name := sourceName(doc.Metadata); name != "" {
+			filename = "[" + name + "]"
+		}
+		if doc.Metadata[keywordMatchKey] != "" {
+			filename += " (keyword match)"
+		}
+		knowledge += "\n---\n" + filename + "\n" + doc.Content + "\n"
+
+		if name := doc.Metadata["filename"]; name != "" && !slices.Contains(filenames, name) {
+			filenames = append(filenames, name)
+		}
+	}
+
+	return strings.NewReplacer(
+		knowledgePlaceholder, knowledge,
+		filenamesPlaceholder, strings.Join(filenames, ", "),
+	).Replace(template)
+}
+
+func (m mainModel) newPromptTemplateForm() (mainModel, tea.Cmd) {
+	template := m.ragSettings.PromptTemplate
+	if template == "" {
+		template = defaultPromptTemplate
+	}
+	template = strings.TrimPrefix(template, "\n")
+	action := promptTemplateActionSave
+
+	m.promptTemplateForm = huh.NewForm(
+		huh.NewGroup(
+			huh.NewText().
+				Key("promptTemplate").
+				Title("RAG Prompt Template").
+				Description(fmt.Sprintf("The system prompt of the questions about the documents. %s is replaced "+
+					"by the chunks retrieved for the question and %s by the names of their files.",
+					knowledgePlaceholder, filenamesPlaceholder)).
+				Lines(12).
+				CharLimit(maxPromptTemplateChars).
+				Validate(validatePromptTemplate).
+				Value(&template),
+			huh.NewSelect[string]().
+				Key("promptTemplateAction").
+				Title("Save this template?").
+				Options(
+					huh.NewOption("Save", promptTemplateActionSave),
+					huh.NewOption("Reset to default", promptTemplateActionReset),
+					huh.NewOption("Back", promptTemplateActionBack),
+				).
+				Value(&action),
+		),
+	).
+		WithWidth(m.formWidth).
+		WithHeight(m.formHeight).
+		WithTheme(huh.ThemeCatppuccin()).
+		WithKeyMap(m.keymap.formKeymap).
+		WithShowErrors(true).
+		WithShowHelp(true)
+
+	return m, m.promptTemplateForm.PrevField()
+}
+
+func (m mainModel) handlePromptTemplateFormEvents(msg tea.Msg) (mainModel, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.WindowSizeMsg:
+		m = m.updateFormSize()
+	case tea.KeyMsg:
+		if key.Matches(msg, m.keymap.escape) {
+			return m.setViewState(viewStateOptions), nil
+		}
+	}
+
+	form, cmd := m.promptTemplateForm.Update(msg)
+	if f, ok := form.(*huh.Form); ok {
+		m.promptTemplateForm = f
+	}
+
+	if m.promptTemplateForm.State != huh.StateCompleted {
+		return m, cmd
+	}
+
+	settings := m.ragSettings
+	switch m.promptTemplateForm.GetString("promptTemplateAction") {
+	case promptTemplateActionSave:
+		settings.PromptTemplate = m.promptTemplateForm.GetString("promptTemplate")
+		// The built-in template is kept as empty, so it follows the next
+		// versions.
+		if strings.TrimSpace(settings.PromptTemplate) == strings.TrimSpace(defaultPromptTemplate) {
+			settings.PromptTemplate = ""
+		}
+	case promptTemplateActionReset:
+		settings.PromptTemplate = ""
+	default:
+		return m.setViewState(viewStateOptions), nil
+	}
+
+	if err := saveRAGSettings(m.db, settings); err != nil {
+		m.err = fmt.Errorf("error saving rag settings: %w", err)
+		slog.Error(m.err.Error())
+		return m.updateFormSize(), nil
+	}
+	m.ragSettings = settings
+	if m.rag != nil {
+		m.rag.settings = settings
+	}
+
+	return m.initOptions().updateOptionsSize().setViewState(viewStateOptions), nil
+}
+
+func (m mainModel) promptTemplateFormView() string {
+	return lipgloss.JoinVertical(lipgloss.Left,
+		logoView(),
+		titleStyle.Render("RAG Prompt Template"),
+		m.promptTemplateForm.View(),
+	)
+}
@@ -1,8 +1,14 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/charmbracelet/bubbles/key"
 	"github.com/charmbracelet/bubbles/list"
@@ -14,11 +20,12 @@ import (
 
 type llmProvider interface {
 	name() string
-	availableModels() []string
+	availableModels() ([]string, error)
 	isConfigured() bool
+	testConnection() error
 
 	form(int, int, *huh.KeyMap) *huh.Form
-	saveForm(*bolt.DB, *huh.Form) (llmProvider, bool, error)
+	saveForm(*huh.Form) (llmProvider, bool)
 
 	Title() string
 	Description() string
@@ -30,27 +37,346 @@ type llmProvider interface {
 	newEmbedder(llmSetting) embedder
 }
 
+// namedProvider is an instance of a provider type, with the name the user gave
+// it. The name is what the llm settings reference, so there can be more than one
+// instance of the same type, e.g. two Ollama hosts.
+type namedProvider struct {
+	llmProvider
+
+	instanceName string
+	// status is the result of the last reachability check, shown instead of the
+	// description in the providers list.
+	status string
+}
+
+// providerStatusMsg is the result of the reachability check of a provider.
+type providerStatusMsg struct {
+	name string
+	err  error
+}
+
+// providerInstance is a provider instance as stored in the database.
+type providerInstance struct {
+	Type     string          `json:"type"`
+	Name     string          `json:"name"`
+	Settings json.RawMessage `json:"settings,omitempty"`
+}
+
+// providerType is a type of provider the instances are created from.
+type providerType struct {
+	name string
+	// legacyKey is the key the settings of the type were stored under, before
+	// the providers were stored as a list of instances.
+	legacyKey string
+	decode    func([]byte) (llmProvider, error)
+}
+
+// embeddingModelsLister is implemented by providers that can tell their
+// embedding models apart from their chat models, so the Embedder LLM form
+// only lists the former.
+type embeddingModelsLister interface {
+	availableEmbeddingModels() ([]string, error)
+}
+
+// embeddingOnlyProvider is implemented by providers that only serve embedding
+// models, so they are left out of the chat LLM forms.
+type embeddingOnlyProvider interface {
+	embeddingOnly() bool
+}
+
+var providerTypes = []providerType{
+	{providerOllama, "ollama", decodeProvider[ollamaProvider]},
+	{providerAnthropic, "anthropic", decodeProvider[anthropicProvider]},
+	{providerOpenAI, "openai", decodeProvider[openaiProvider]},
+	{providerAzureOpenAI, "azureOpenAI", decodeProvider[azureOpenAIProvider]},
+	{providerGroq, "groq", decodeProvider[groqProvider]},
+	{providerMistral, "mistral", decodeProvider[mistralProvider]},
+	{providerBedrock, "bedrock", decodeProvider[bedrockProvider]},
+	{providerCohere, "cohere", decodeProvider[cohereProvider]},
+	{providerLMStudio, "lmStudio", decodeProvider[lmStudioProvider]},
+	{providerDeepSeek, "deepSeek", decodeProvider[deepSeekProvider]},
+	{providerXAI, "xAI", decodeProvider[xAIProvider]},
+	{providerGemini, "gemini", decodeProvider[geminiProvider]},
+	{providerVoyage, "voyage", decodeProvider[voyageProvider]},
+	{providerLocal, "local", decodeProvider[localProvider]},
+}
+
 const (
-	providerOllama    = "Ollama"
-	providerAnthropic = "Anthropic"
-	providerOpenAI    = "OpenAI"
+	// providerStatusTimeout is shorter than the connection test of the forms,
+	// as the checks run every time the providers list is opened.
+	providerStatusTimeout = 5 * time.Second
+
+	connectionTestTimeout = 15 * time.Second
 )
 
-func loadLLMProviders(db *bolt.DB) ([]llmProvider, error) {
-	o, err := loadOllamaSettings(db)
-	if err != nil {
-		return nil, fmt.Errorf("failed to load ollama settings: %w", err)
+const (
+	providerOllama      = "Ollama"
+	providerAnthropic   = "Anthropic"
+	providerOpenAI      = "OpenAI"
+	providerAzureOpenAI = "Azure OpenAI"
+	providerGroq        = "Groq"
+	providerMistral     = "Mistral"
+	providerBedrock     = "AWS Bedrock"
+	providerCohere      = "Cohere"
+	providerLMStudio    = "LM Studio"
+	providerDeepSeek    = "DeepSeek"
+	providerXAI         = "xAI"
+	providerGemini      = "Gemini"
+	providerVoyage      = "Voyage AI"
+	providerLocal       = "Local"
+)
+
+// testConnectionField returns the form field that runs the test before the
+// settings are saved. A failure is shown as the field error, with the choice to
+// skip the test.
+func testConnectionField(key string, test func() error) *huh.Confirm {
+	var result string
+	return huh.NewConfirm().
+		Key(key).
+		Title("Test Connection").
+		DescriptionFunc(func() string {
+			if result == "" {
+				return "Send a request to check these settings before saving them."
+			}
+			return result
+		}, &result).
+		Affirmative("Test").
+		Negative("Skip").
+		Validate(func(run bool) error {
+			result = ""
+			if !run {
+				return nil
+			}
+
+			if err := runConnectionTest(test, connectionTestTimeout); err != nil {
+				return fmt.Errorf("connection failed: %w", err)
+			}
+
+			result = "Connection succeeded."
+			return nil
+		})
+}
+
+// runConnectionTest runs the connection test, failing it when there is no
+// result after the timeout.
+func runConnectionTest(test func() error, timeout time.Duration) error {
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- test()
+	}()
+
+	select {
+	case err := <-errChan:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("no response after %s", timeout)
 	}
-	a, err := loadAnthropicSettings(db)
+}
+
+// proxyField returns the optional proxy input of a cloud provider form.
+func proxyField(key, provider string, value *string) *huh.Input {
+	return huh.NewInput().
+		Key(key).
+		Title("Proxy").
+		Description(fmt.Sprintf("Optional proxy URL for %s (http, https or socks5), leave empty to use HTTPS_PROXY.", provider)).
+		Placeholder("http://proxy:8080").
+		Validate(func(s string) error {
+			_, err := parseProxyURL(s)
+			return err
+		}).
+		Value(value)
+}
+
+// parseRequestTimeout parses a request timeout setting, an empty value uses the
+// default timeout.
+func parseRequestTimeout(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return defaultRequestTimeout, nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid timeout %q, use a positive duration like 120s or 5m", s)
+	}
+	return d, nil
+}
+
+// requestTimeout returns the timeout of the setting, falling back to the default
+// when the setting is invalid.
+func requestTimeout(s string) time.Duration {
+	d, err := parseRequestTimeout(s)
 	if err != nil {
-		return nil, fmt.Errorf("failed to load anthropic settings: %w", err)
+		return defaultRequestTimeout
+	}
+	return d
+}
+
+// supportChat reports whether the provider can be used for the chat roles.
+func supportChat(p llmProvider) bool {
+	if e, ok := p.(embeddingOnlyProvider); ok {
+		return !e.embeddingOnly()
 	}
-	oa, err := loadOpenAISettings(db)
+	return true
+}
+
+// loadLLMProviders returns the stored provider instances. On the first run
+// after the providers were stored as a list, the settings of each provider type
+// are migrated to an instance named after the type, which keeps the existing llm
+// settings pointing at them.
+func loadLLMProviders(db *bolt.DB) ([]llmProvider, error) {
+	instances, found, err := loadProviderInstances(db)
 	if err != nil {
-		return nil, fmt.Errorf("failed to load openai settings: %w", err)
+		return nil, fmt.Errorf("failed to load provider instances: %w", err)
+	}
+
+	if !found {
+		for _, t := range providerTypes {
+			settings, err := loadLegacyProviderSettings(db, t.legacyKey)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load %s settings: %w", t.name, err)
+			}
+			instances = append(instances, providerInstance{
+				Type:     t.name,
+				Name:     t.name,
+				Settings: settings,
+			})
+		}
+		if err := saveProviderInstances(db, instances); err != nil {
+			return nil, fmt.Errorf("failed to migrate provider settings: %w", err)
+		}
 	}
 
-	return []llmProvider{o, a, oa}, nil
+	// The Local provider is built in, so it's added to the instances stored
+	// before it existed.
+	if !slices.ContainsFunc(instances, func(i providerInstance) bool {
+		return i.Type == providerLocal || i.Name == providerLocal
+	}) {
+		instances = append(instances, providerInstance{
+			Type: providerLocal,
+			Name: providerLocal,
+		})
+	}
+
+	providers := make([]llmProvider, 0, len(instances))
+	for _, instance := range instances {
+		idx := slices.IndexFunc(providerTypes, func(t providerType) bool {
+			return t.name == instance.Type
+		})
+		if idx == -1 {
+			slog.Warn("skipping provider of unknown type", "name", instance.Name, "type", instance.Type)
+			continue
+		}
+
+		p, err := providerTypes[idx].decode(instance.Settings)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode %s settings: %w", instance.Name, err)
+		}
+		providers = append(providers, namedProvider{
+			llmProvider:  p,
+			instanceName: instance.Name,
+		})
+	}
+
+	return providers, nil
+}
+
+func saveLLMProviders(db *bolt.DB, providers []llmProvider) error {
+	instances := make([]providerInstance, 0, len(providers))
+	for _, p := range providers {
+		n, ok := p.(namedProvider)
+		if !ok {
+			n = namedProvider{llmProvider: p, instanceName: p.name()}
+		}
+
+		settings, err := json.Marshal(n.llmProvider)
+		if err != nil {
+			return fmt.Errorf("error encoding %s settings: %w", n.name(), err)
+		}
+		instances = append(instances, providerInstance{
+			Type:     n.typeName(),
+			Name:     n.name(),
+			Settings: settings,
+		})
+	}
+
+	return saveProviderInstances(db, instances)
+}
+
+func decodeProvider[T llmProvider](data []byte) (llmProvider, error) {
+	var p T
+	if len(data) == 0 {
+		return p, nil
+	}
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (n namedProvider) name() string {
+	return n.instanceName
+}
+
+// typeName returns the name of the provider type of the instance.
+func (n namedProvider) typeName() string {
+	return n.llmProvider.name()
+}
+
+func (n namedProvider) Title() string {
+	if n.isConfigured() {
+		return fmt.Sprintf("%s (configured)", n.instanceName)
+	}
+	return fmt.Sprintf("%s (not configured)", n.instanceName)
+}
+
+func (n namedProvider) Description() string {
+	if n.status != "" {
+		return n.status
+	}
+	return n.llmProvider.Description()
+}
+
+func (n namedProvider) FilterValue() string {
+	return n.instanceName
+}
+
+func (n namedProvider) saveForm(form *huh.Form) (llmProvider, bool) {
+	p, confirmed := n.llmProvider.saveForm(form)
+	n.llmProvider = p
+	return n, confirmed
+}
+
+func (n namedProvider) availableEmbeddingModels() ([]string, error) {
+	if lister, ok := n.llmProvider.(embeddingModelsLister); ok {
+		return lister.availableEmbeddingModels()
+	}
+	return n.availableModels()
+}
+
+func (n namedProvider) embeddingOnly() bool {
+	return !supportChat(n.llmProvider)
+}
+
+func (n namedProvider) modelContextWindow(ctx context.Context, model string) (int, error) {
+	if c, ok := n.llmProvider.(contextWindowProvider); ok {
+		return c.modelContextWindow(ctx, model)
+	}
+	return 0, nil
+}
+
+func (n namedProvider) tokenizer(model string) tokenizer {
+	if t, ok := n.llmProvider.(tokenizerProvider); ok {
+		return t.tokenizer(model)
+	}
+	return nil
+}
+
+func (n namedProvider) rateLimits() rateLimitSettings {
+	if r, ok := n.llmProvider.(rateLimitedProvider); ok {
+		return r.rateLimits()
+	}
+	return rateLimitSettings{}
 }
 
 func (m mainModel) providersIsConfigured() bool {
@@ -76,10 +402,14 @@ func (m mainModel) initProviders() (mainModel, error) {
 
 	m.providersList = defaultList("Providers", m.keymap, func() []key.Binding {
 		return []key.Binding{
+			m.keymap.new,
 			m.keymap.escape,
 		}
 	}, func() []key.Binding {
 		return []key.Binding{
+			m.keymap.new,
+			m.keymap.delete,
+			m.keymap.reset,
 			m.keymap.pick,
 			m.keymap.escape,
 		}
@@ -110,6 +440,14 @@ func (m mainModel) handleProvidersEvents(msg tea.Msg) (mainModel, tea.Cmd) {
 		switch {
 		case key.Matches(msg, m.keymap.escape):
 			return m.setViewState(viewStateOptions).updateOptionsSize(), nil
+		case key.Matches(msg, m.keymap.new):
+			return m.setViewState(viewStateProviderInstanceForm).
+				updateFormSize().
+				newProviderInstanceForm()
+		case key.Matches(msg, m.keymap.delete):
+			return m.deleteProvider(m.providersList.Index()), nil
+		case key.Matches(msg, m.keymap.reset):
+			return m.resetProvider(m.providersList.Index()), nil
 		case key.Matches(msg, m.keymap.pick):
 			return m.selectProvider(m.providersList.Index())
 		}
@@ -161,22 +499,24 @@ func (m mainModel) handleProviderFormEvents(msg tea.Msg) (mainModel, tea.Cmd) {
 		return m, cmd
 	}
 
-	provider, confirmed, err := m.providers[m.selectedProviderIndex].saveForm(m.db, m.providerForm)
-	if err != nil {
+	provider, confirmed := m.providers[m.selectedProviderIndex].saveForm(m.providerForm)
+	if !confirmed {
+		return m.setViewState(viewStateProviders), nil
+	}
+
+	providers := slices.Clone(m.providers)
+	providers[m.selectedProviderIndex] = provider
+	if err := saveLLMProviders(m.db, providers); err != nil {
 		m.err = fmt.Errorf("error saving provider settings: %w", err)
 		slog.Error(m.err.Error())
 		return m.updateFormSize(), nil
 	}
 
-	if !confirmed {
-		return m.setViewState(viewStateProviders), nil
-	}
-
-	m.providers[m.selectedProviderIndex] = provider
+	m.providers = providers
 	m.providersList.SetItem(m.selectedProviderIndex, provider)
 
 	// We need to refresh the optionsList
-	return m.initOptions().setViewState(viewStateProviders), nil
+	return m.initOptions().setViewState(viewStateProviders).checkProviders()
 }
 
 func (m mainModel) providerFormView() string {
@@ -192,3 +532,270 @@ func (m mainModel) providerFormView() string {
 		m.providerForm.View(),
 	)
 }
+
+func (m mainModel) deleteProvider(index int) mainModel {
+	provider := m.providers[index]
+
+	if n, ok := provider.(namedProvider); ok && n.typeName() == providerLocal {
+		m.err = fmt.Errorf("can't delete %s, it's built in", provider.name())
+		return m.updateProvidersSize()
+	}
+
+	for role, setting := range map[string]llmSetting{
+		optionConvoLLMTitle:    m.convoLLMSetting,
+		optionGenTitleLLMTitle: m.genTitleLLMSetting,
+		optionEmbedderTitle:    m.embedderLLMSetting,
+	} {
+		if setting.Provider == provider.name() {
+			m.err = fmt.Errorf("can't delete %s, it's used by the %s", provider.name(), role)
+			return m.updateProvidersSize()
+		}
+	}
+
+	providers := slices.Delete(slices.Clone(m.providers), index, index+1)
+	if err := saveLLMProviders(m.db, providers); err != nil {
+		m.err = fmt.Errorf("error deleting provider: %w", err)
+		slog.Error(m.err.Error())
+		return m.updateProvidersSize()
+	}
+
+	m.err = nil
+	m.providers = providers
+	m.providersList.RemoveItem(index)
+
+	return m.initOptions().updateProvidersSize()
+}
+
+// resetProvider clears the settings of the provider, which makes it not
+// configured again. The roles that use it are cleared too, so they are picked
+// again instead of failing on the missing settings.
+func (m mainModel) resetProvider(index int) mainModel {
+	n, ok := m.providers[index].(namedProvider)
+	if !ok {
+		n = namedProvider{llmProvider: m.providers[index], instanceName: m.providers[index].name()}
+	}
+
+	idx := slices.IndexFunc(providerTypes, func(t providerType) bool {
+		return t.name == n.typeName()
+	})
+	if idx == -1 {
+		return m
+	}
+	p, err := providerTypes[idx].decode(nil)
+	if err != nil {
+		m.err = fmt.Errorf("error resetting provider: %w", err)
+		slog.Error(m.err.Error())
+		return m.updateProvidersSize()
+	}
+	n.llmProvider = p
+	n.status = ""
+
+	providers := slices.Clone(m.providers)
+	providers[index] = n
+	if err := saveLLMProviders(m.db, providers); err != nil {
+		m.err = fmt.Errorf("error resetting provider: %w", err)
+		slog.Error(m.err.Error())
+		return m.updateProvidersSize()
+	}
+	m.providers = providers
+	m.providersList.SetItem(index, n)
+
+	var cleared []string
+	for _, r := range []struct {
+		title   string
+		role    string
+		setting *llmSetting
+	}{
+		{optionConvoLLMTitle, roleConvo, &m.convoLLMSetting},
+		{optionGenTitleLLMTitle, roleTitleGen, &m.genTitleLLMSetting},
+		{optionEmbedderTitle, roleEmbedder, &m.embedderLLMSetting},
+	} {
+		if r.setting.Provider != n.name() {
+			continue
+		}
+		r.setting.Provider = ""
+		r.setting.Model = ""
+		if err := saveLLMSettings(m.db, r.role, *r.setting); err != nil {
+			m.err = fmt.Errorf("error saving %s settings: %w", r.title, err)
+			slog.Error(m.err.Error())
+			return m.updateProvidersSize()
+		}
+		cleared = append(cleared, r.title)
+	}
+
+	m.err = nil
+	if len(cleared) > 0 {
+		m.err = fmt.Errorf("%s was reset, pick the %s again", n.name(), strings.Join(cleared, " and "))
+	}
+
+	return m.initOptions().updateProvidersSize()
+}
+
+func (m mainModel) newProviderInstanceForm() (mainModel, tea.Cmd) {
+	options := make([]huh.Option[string], len(providerTypes))
+	for i, t := range providerTypes {
+		options[i] = huh.NewOption(t.name, t.name)
+	}
+
+	var typeName, name string
+	m.providerInstanceForm = huh.NewForm(
+		huh.NewGroup(
+			huh.NewSelect[string]().
+				Key("providerType").
+				Title("Provider").
+				Description("Select the type of the new provider").
+				Options(options...).
+				Value(&typeName).
+				Height(8),
+			huh.NewInput().
+				Key("providerName").
+				Title("Name").
+				Description("Enter the name of the new provider, e.g. Ollama (gpu-box).").
+				Placeholder("Name").
+				Validate(func(s string) error {
+					if strings.TrimSpace(s) == "" {
+						return errors.New("name is required")
+					}
+					if slices.ContainsFunc(m.providers, func(p llmProvider) bool {
+						return p.name() == strings.TrimSpace(s)
+					}) {
+						return fmt.Errorf("provider %s already exists", s)
+					}
+					return nil
+				}).
+				Value(&name),
+			huh.NewConfirm().
+				Key("providerConfirm").
+				Title("Confirm").
+				Description("Add this provider?").
+				Affirmative("Yes").
+				Negative("Back"),
+		),
+	).
+		WithWidth(m.formWidth).
+		WithHeight(m.formHeight).
+		WithTheme(huh.ThemeCatppuccin()).
+		WithKeyMap(m.keymap.formKeymap).
+		WithShowErrors(true).
+		WithShowHelp(true)
+
+	return m, m.providerInstanceForm.PrevField()
+}
+
+func (m mainModel) handleProviderInstanceFormEvents(msg tea.Msg) (mainModel, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.WindowSizeMsg:
+		m = m.updateFormSize()
+	case tea.KeyMsg:
+		if key.Matches(msg, m.keymap.escape) {
+			return m.setViewState(viewStateProviders), nil
+		}
+	}
+
+	form, cmd := m.providerInstanceForm.Update(msg)
+	if f, ok := form.(*huh.Form); ok {
+		m.providerInstanceForm = f
+	}
+
+	if m.providerInstanceForm.State != huh.StateCompleted {
+		return m, cmd
+	}
+
+	if !m.providerInstanceForm.GetBool("providerConfirm") {
+		return m.setViewState(viewStateProviders), nil
+	}
+
+	typeName := m.providerInstanceForm.GetString("providerType")
+	idx := slices.IndexFunc(providerTypes, func(t providerType) bool {
+		return t.name == typeName
+	})
+	if idx == -1 {
+		m.err = fmt.Errorf("unknown provider type: %s", typeName)
+		slog.Error(m.err.Error())
+		return m.setViewState(viewStateProviders).updateProvidersSize(), nil
+	}
+
+	p, _ := providerTypes[idx].decode(nil)
+	provider := namedProvider{
+		llmProvider:  p,
+		instanceName: strings.TrimSpace(m.providerInstanceForm.GetString("providerName")),
+	}
+
+	providers := append(slices.Clone(m.providers), provider)
+	if err := saveLLMProviders(m.db, providers); err != nil {
+		m.err = fmt.Errorf("error adding provider: %w", err)
+		slog.Error(m.err.Error())
+		return m.setViewState(viewStateProviders).updateProvidersSize(), nil
+	}
+
+	m.providers = providers
+	newIndex := len(m.providers) - 1
+
+	var cmds []tea.Cmd
+
+	// As with the new documents, the InsertItem command must be returned from
+	// the main model so the providers list keeps the new item.
+	cmds = append(cmds, m.providersList.InsertItem(newIndex, provider))
+
+	m, cmd = m.selectProvider(newIndex)
+	cmds = append(cmds, cmd)
+
+	return m, tea.Batch(cmds...)
+}
+
+func (m mainModel) providerInstanceFormView() string {
+	return lipgloss.JoinVertical(lipgloss.Left,
+		logoView(),
+		titleStyle.Render("New Provider"),
+		m.providerInstanceForm.View(),
+	)
+}
+
+// checkProviders starts the reachability checks of the configured providers in
+// the background, their results are sent as providerStatusMsg.
+func (m mainModel) checkProviders() (mainModel, tea.Cmd) {
+	var cmds []tea.Cmd
+	for i, p := range m.providers {
+		n, ok := p.(namedProvider)
+		if !ok || !n.isConfigured() {
+			continue
+		}
+
+		n.status = "checking…"
+		m.providers[i] = n
+		m.providersList.SetItem(i, n)
+
+		cmds = append(cmds, func() tea.Msg {
+			return providerStatusMsg{
+				name: n.name(),
+				err:  runConnectionTest(n.testConnection, providerStatusTimeout),
+			}
+		})
+	}
+
+	return m, tea.Batch(cmds...)
+}
+
+func (m mainModel) handleProviderStatusMsg(msg providerStatusMsg) mainModel {
+	// The provider may have been deleted while it was checked.
+	idx := slices.IndexFunc(m.providers, func(p llmProvider) bool {
+		return p.name() == msg.name
+	})
+	if idx == -1 {
+		return m
+	}
+	n, ok := m.providers[idx].(namedProvider)
+	if !ok {
+		return m
+	}
+
+	n.status = "reachable"
+	if msg.err != nil {
+		// The list shows a single line of description.
+		n.status = "unreachable: " + strings.Join(strings.Fields(msg.err.Error()), " ")
+	}
+	m.providers[idx] = n
+	m.providersList.SetItem(idx, n)
+
+	return m
+}
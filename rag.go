@@ -6,11 +6,14 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"maps"
 	"os"
+	"path"
 	"path/filepath"
 	"runtime"
 	"slices"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -22,22 +25,58 @@ type rag struct {
 
 	convoLLM    llm
 	genTitleLLM llm
+	// convoLLMSetting and providers find the context window of the convo LLM,
+	// it's looked up on the first chat and kept in convoContextWindow.
+	convoLLMSetting    llmSetting
+	providers          []llmProvider
+	convoContextWindow int
 
 	embedder embedder
+	// embedderSetting identifies the embedder, it's recorded with the scanned
+	// documents so the questions are checked against it.
+	embedderSetting llmSetting
+	// tokenizer sizes the chunks of the documents in tokens of the embedder.
+	tokenizer tokenizer
+	settings  ragSettings
 
 	chats []chat
 }
 
 const (
-	ragResultsCount         = 20
-	ragSimiliarityThreshold = 0.5
-	ragNeededCount          = 10
-
-	chunkSize    = 500 // characters per chunk
-	chunkOverlap = 50  // overlap between chunks
+	defaultRAGResultsCount        = 20
+	defaultRAGSimilarityThreshold = 0.5
+	defaultRAGNeededCount         = 10
+
+	defaultChunkSize    = 128 // tokens per chunk
+	defaultChunkOverlap = 16  // tokens of overlap between chunks
+	// defaultMinChunkChars is the characters under which the last chunk of a
+	// file is merged into the previous one, and a file is skipped.
+	defaultMinChunkChars = 100
+
+	// legacyChunkOverlap is the overlap of the chunks of the documents scanned
+	// before the chunks were sized in tokens, in bytes.
+	legacyChunkOverlap = 50
+
+	// tokenEstimateBytes is the bytes per token used to estimate the tokens of a
+	// chunk, lower than the usual 4 so the estimate errs on the side of more
+	// tokens.
+	tokenEstimateBytes = 3
+
+	// contextPairs is the number of the last exchanges of the session searched
+	// along with the question.
+	contextPairs = 2
+
+	// embeddingBatchSize is the number of chunks embedded in a request by the
+	// embedders that support batches.
+	embeddingBatchSize = 100
 )
 
-func generateSessionTitle(ctx context.Context, llm llm, chats []chat) (string, error) {
+// errScanCancelled is the error of the scans cancelled by the user.
+var errScanCancelled = errors.New("scan cancelled")
+
+// generateSessionTitle generates the title of the conversation, in the answer
+// language.
+func generateSessionTitle(ctx context.Context, llm llm, chats []chat, language string) (string, error) {
 	cs := []chat{
 		{
 			Role: roleSystem,
@@ -62,7 +101,8 @@ Bad titles (don't do these):
 * Technical Infrastructure Review (has bullet point)
 Implementation of ML Models (too technical)
 This is a very long title about programming (too many words)
-      `,
+
+` + titleLanguageInstruction(language),
 		},
 	}
 
@@ -85,82 +125,72 @@ This is a very long title about programming (too many words)
 	return res.content, nil
 }
 
-func ragSystemPrompt(docs []chromem.Result) string {
-	knowledge := ""
-	for _, doc := range docs {
-		filename := ""
-		if name, ok := doc.Metadata["filename"]; ok {
-			filename = "[" + name + "]"
-		}
-		knowledge += "\n---\n" + filename + "\n" + doc.Content + "\n"
+// sourceName returns the name of the file of a chunk. The chunks of the
+// markdown sections name their headings, and the chunks of code their symbols,
+// so the answers can point to them. The HTML pages name their title, the books
+// their chapter, the spreadsheets their sheet, the tables their rows, the
+// notebooks their cells and the recordings their time.
+func sourceName(metadata map[string]string) string {
+	name, ok := metadata["filename"]
+	if !ok {
+		return ""
 	}
-
-	return `
-I am an AI assistant who deeply understands and embodies this knowledge:
-
-` + knowledge + `
-
-GUIDELINES:
-1. Speak naturally as if this knowledge is your own experience and expertise
-2. Never use phrases like "based on documents", "according to", "from the documents", or similar references
-3. You can expand the conversation with relevant external knowledge
-4. Answer directly and confidently, as if you're sharing your own knowledge
-5. Be conversational and engaging
-
-RESPONSE FORMAT:
-- First provide your complete answer
-- Then, if and only if you used specific information from the provided documents, add:
-  * Start a new line
-  * Add "Sources: " followed by the relevant filenames in square brackets
-  * Example: "Sources: [file1.txt] [file2.md]"
-- If you didn't use any specific information from the documents, do not add a Sources line at all`
-}
-
-func chunkDocument(doc chromem.Document) []chromem.Document {
-	content := doc.Content
-	var chunks []chromem.Document
-
-	if len(content) <= chunkSize {
-		return []chromem.Document{doc}
+	if title := metadata[titleKey]; title != "" {
+		name += " – " + title
 	}
-
-	for i := 0; i < len(content); i += chunkSize - chunkOverlap {
-		end := i + chunkSize
-		if end > len(content) {
-			end = len(content)
-		}
-
-		chunk := chromem.Document{
-			ID:      fmt.Sprintf("%s-chunk-%d", doc.ID, len(chunks)),
-			Content: content[i:end],
-			Metadata: map[string]string{
-				"filename":   doc.Metadata["filename"],
-				"originalID": doc.ID,
-				"chunkIndex": fmt.Sprintf("%d", len(chunks)),
-			},
-		}
-		chunks = append(chunks, chunk)
-
-		if end == len(content) {
-			break
-		}
+	if chapter := metadata[chapterKey]; chapter != "" {
+		name += " – " + chapter
+	}
+	if sheet := metadata[sheetKey]; sheet != "" {
+		name += " – " + sheet
+	}
+	if rows := metadata[rowsKey]; rows != "" {
+		name += " – rows " + rows
+	}
+	if cells := metadata[cellsKey]; cells != "" {
+		name += " – cells " + cells
+	}
+	if timestamp := metadata[timestampKey]; timestamp != "" {
+		name += " @ " + timestamp
+	}
+	if path := metadata["headingPath"]; path != "" {
+		name += ":" + path
+	} else if symbol := metadata["symbol"]; symbol != "" {
+		name += ":" + symbol
 	}
-	return chunks
+	return name
 }
 
-func newRAG(vectordb *chromem.DB, convoLLM, genTitleLLM llm, embedder embedder) *rag {
+func newRAG(
+	vectordb *chromem.DB,
+	convoLLM, genTitleLLM llm,
+	embedder embedder,
+	convoLLMSetting, embedderSetting llmSetting,
+	providers []llmProvider,
+	settings ragSettings,
+) *rag {
 	return &rag{
-		vectordb:    vectordb,
-		convoLLM:    convoLLM,
-		genTitleLLM: genTitleLLM,
-		embedder:    embedder,
+		vectordb:        vectordb,
+		convoLLM:        convoLLM,
+		genTitleLLM:     genTitleLLM,
+		convoLLMSetting: convoLLMSetting,
+		providers:       providers,
+		embedder:        embedder,
+		embedderSetting: embedderSetting,
+		tokenizer:       tokenizerFromSetting(embedderSetting, providers),
+		settings:        settings,
 	}
 }
 
-func (r *rag) clearChats() {
-	r.chats = nil
+// loadChats replaces the conversation with the one of the opened session, so
+// the chats of the previous session don't leak into its retrieval and prompts.
+func (r *rag) loadChats(sess session) {
+	r.chats = conversationChats(sess.Chats)
 }
 
+// mergeChunks merges the adjacent chunks of the same file into one result,
+// whose similarity is the best of its chunks. The chunks of a file that are not
+// adjacent stay separate results.
 func mergeChunks(docs []chromem.Result) []chromem.Result {
 	// Group chunks by originalID
 	chunkGroups := make(map[string][]chromem.Result)
@@ -172,7 +202,6 @@ func mergeChunks(docs []chromem.Result) []chromem.Result {
 		chunkGroups[originalID] = append(chunkGroups[originalID], doc)
 	}
 
-	// Merge chunks and compute average similarity
 	var mergedDocs []chromem.Result
 	for _, chunks := range chunkGroups {
 		if len(chunks) == 1 {
@@ -180,90 +209,171 @@ func mergeChunks(docs []chromem.Result) []chromem.Result {
 			continue
 		}
 
-		// Sort chunks by chunkIndex
+		// Sort chunks by chunkIndex, and the parts of a split chunk by part
 		slices.SortFunc(chunks, func(a, b chromem.Result) int {
-			aCI, _ := strconv.Atoi(a.Metadata["chunkIndex"])
-			bCI, _ := strconv.Atoi(b.Metadata["chunkIndex"])
-			return cmp.Compare(aCI, bCI)
+			aCI, aPart := chunkPosition(a.Metadata)
+			bCI, bPart := chunkPosition(b.Metadata)
+			if c := cmp.Compare(aCI, bCI); c != 0 {
+				return c
+			}
+			return cmp.Compare(aPart, bPart)
 		})
 
-		// Merge content and compute average similarity
-		var totalSim float32
-		var mergedContent string
-
-		for i, chunk := range chunks {
-			totalSim++
-			if i == 0 {
-				// For first chunk, use it completely
-				mergedContent = chunk.Content
+		merged := chunks[0]
+		mergedIDs := []string{merged.ID}
+		_, header := splitChunkHeader(merged.Content, merged.Metadata)
+		for i, chunk := range chunks[1:] {
+			if !followsChunk(chunks[i].Metadata, chunk.Metadata) {
+				// A gap between the chunks starts another result, so the
+				// content after it isn't lost.
+				mergedDocs = append(mergedDocs, withMergedIDs(merged, mergedIDs))
+				merged = chunk
+				mergedIDs = []string{merged.ID}
+				_, header = splitChunkHeader(merged.Content, merged.Metadata)
 				continue
 			}
-
-			currentChunkIndex, _ := strconv.Atoi(chunk.Metadata["chunkIndex"])
-			previousChunkIndex, _ := strconv.Atoi(chunks[i-1].Metadata["chunkIndex"])
-			if previousChunkIndex+1 != currentChunkIndex {
-				// If the chunk index is not sequential, skip it
-				continue
+			mergedIDs = append(mergedIDs, chunk.ID)
+
+			// For subsequent chunks, remove the overlapping part, its size is
+			// recorded since the chunks are sized in tokens.
+			currentContent, chunkHeader := splitChunkHeader(chunk.Content, chunk.Metadata)
+			overlap := legacyChunkOverlap
+			if o, err := strconv.Atoi(chunk.Metadata["overlap"]); err == nil {
+				overlap = o
 			}
-
-			// For subsequent chunks, remove the overlapping part
-			currentContent := chunk.Content
-			if len(currentContent) > chunkOverlap {
-				// Skip the first chunkOverlap characters as they're duplicates
-				mergedContent += currentContent[chunkOverlap:]
+			currentContent = currentContent[seamOverlap(merged.Content, currentContent, overlap):]
+
+			// The header is only repeated when the section changes.
+			if chunkHeader != "" && chunkHeader != header {
+				if !strings.HasSuffix(merged.Content, "\n") {
+					merged.Content += "\n"
+				}
+				merged.Content += chunkHeader + "\n"
+				header = chunkHeader
 			}
+			merged.Content += currentContent
+			merged.Similarity = max(merged.Similarity, chunk.Similarity)
 		}
-
-		mergedDocs = append(mergedDocs, chromem.Result{
-			ID:         chunks[0].ID,
-			Content:    mergedContent,
-			Similarity: totalSim / float32(len(chunks)),
-			Metadata:   chunks[0].Metadata,
-		})
+		mergedDocs = append(mergedDocs, withMergedIDs(merged, mergedIDs))
 	}
 	return mergedDocs
 }
 
-func getContextString(chats []chat) string {
-	if len(chats) == 0 {
-		return ""
+// seamOverlap returns the bytes at the start of the next chunk that repeat the
+// end of the merged content. The recorded overlap is taken when the content
+// repeats it, otherwise the longest repeat up to it is, as the last chunk of a
+// file can be shorter than the overlap and the legacy overlaps are a constant.
+// The bytes are compared, so an overlap ending inside a character is kept
+// whole.
+func seamOverlap(merged, next string, recorded int) int {
+	for n := min(recorded, len(next), len(merged)); n > 0; n-- {
+		if strings.HasSuffix(merged, next[:n]) {
+			return n
+		}
 	}
+	return 0
+}
 
-	// Get last few message pairs (user + assistant) for context
-	// Start from the most recent and work backwards
-	contextPairs := 2 // Number of user-assistant pairs to include
-	context := ""
+// withMergedIDs records the IDs of the chunks merged into the result, for the
+// retrieval debug. The result of a single chunk is left as it is.
+func withMergedIDs(merged chromem.Result, ids []string) chromem.Result {
+	if len(ids) < 2 {
+		return merged
+	}
+	merged.Metadata = maps.Clone(merged.Metadata)
+	merged.Metadata[mergedIDsKey] = strings.Join(ids, "\n")
+	return merged
+}
 
-	for i := len(chats) - 1; i >= 0 && contextPairs > 0; i-- {
-		if chats[i].Role == roleUser {
-			context = "User: " + chats[i].Content + "\n" + context
-			if i+1 < len(chats) && chats[i+1].Role == roleAssistant {
-				context = "Assistant: " + chats[i+1].Content + "\n" + context
-				contextPairs--
-			}
+// sortResults sorts the results from the most similar. Ties are ordered by ID,
+// as the merged chunks come out of a map, so the same documents always build
+// the same system prompt and the provider's prompt cache can hit.
+func sortResults(docs []chromem.Result) {
+	slices.SortFunc(docs, func(a, b chromem.Result) int {
+		if c := cmp.Compare(b.Similarity, a.Similarity); c != 0 {
+			return c
 		}
-	}
+		return cmp.Compare(a.ID, b.ID)
+	})
+}
 
-	return context
+// chunkPosition returns the index of the chunk and its part, the part is 0 for
+// the chunks that weren't split.
+func chunkPosition(metadata map[string]string) (int, int) {
+	index, _ := strconv.Atoi(metadata["chunkIndex"])
+	part, _ := strconv.Atoi(metadata["part"])
+	return index, part
 }
 
-func (r *rag) chat(ctx context.Context, msg string, index int, documents []document, responses chan<- llmResponseMsg) {
-	r.chats = append(r.chats, chat{
-		Role:    roleUser,
-		Content: msg,
-	})
+// followsChunk reports whether the chunk with the next metadata starts where
+// the chunk with the prev metadata ends.
+func followsChunk(prev, next map[string]string) bool {
+	prevIndex, prevPart := chunkPosition(prev)
+	nextIndex, nextPart := chunkPosition(next)
+	if nextIndex == prevIndex {
+		return nextPart == prevPart+1
+	}
+	if nextIndex != prevIndex+1 || nextPart != 0 {
+		return false
+	}
+	// A split chunk is followed by the next chunk after its last part.
+	if parts, err := strconv.Atoi(prev["parts"]); err == nil {
+		return prevPart == parts-1
+	}
+	return true
+}
 
-	var ragDocs []chromem.Result
+// getContextString returns the last contextPairs exchanges of the chats, a
+// user chat followed by its answer, in the order they happened. The user chats
+// without an answer, like the ones whose answer failed, are left out.
+func getContextString(chats []chat) string {
+	var pairs [][2]chat
+	for i := 0; i+1 < len(chats); i++ {
+		question, answer := chats[i], chats[i+1]
+		if question.Role != roleUser || answer.Role != roleAssistant || answer.Failed {
+			continue
+		}
+		pairs = append(pairs, [2]chat{question, answer})
+		i++
+	}
+	pairs = pairs[max(0, len(pairs)-contextPairs):]
 
-	// Combine current message with context from previous messages
-	contextString := getContextString(r.chats[:len(r.chats)-1]) // Exclude current message
-	searchText := msg
-	if contextString != "" {
-		searchText = contextString + "\n" + msg
+	var sb strings.Builder
+	for _, p := range pairs {
+		sb.WriteString("User: " + p[0].Content + "\n")
+		sb.WriteString("Assistant: " + p[1].Content + "\n")
 	}
+	return sb.String()
+}
 
-	for _, doc := range documents {
-		rds, err := doc.retrieve(ctx, r.vectordb, searchText, r.embedder.embeddingFunc())
+func (r *rag) chat(
+	ctx context.Context,
+	msg string,
+	index int,
+	documents []document,
+	sess session,
+	responses chan<- llmResponseMsg,
+	debug chan<- ragDebugMsg,
+) {
+	// The conversation is the one of the session, ending with the message. It
+	// was loaded when the session was opened, it is rebuilt as the message and
+	// the cancelled answers are only kept in the session.
+	r.loadChats(sess)
+
+	// A plain chat session talks to the model without the documents.
+	systemPrompt := ""
+	var sources []chatSource
+	var searched, skipped []string
+	var retrievalPath string
+	if !sess.PlainChat {
+		responses <- llmResponseMsg{
+			chatIndex: index,
+			stage:     chatStageRetrieving,
+		}
+		start := time.Now()
+		retrieved, err := r.retrieveDocuments(ctx, msg, documents, sess.RetrievalFilter)
+		slog.Info("Retrieved the chunks for the question", "results", len(retrieved.results),
+			"duration", time.Since(start))
 		if err != nil {
 			responses <- llmResponseMsg{
 				chatIndex: index,
@@ -271,44 +381,66 @@ func (r *rag) chat(ctx context.Context, msg string, index int, documents []docum
 			}
 			return
 		}
-		ragDocs = append(ragDocs, rds...)
+		systemPrompt = ragSystemPrompt(retrieved.results, r.settings.PromptTemplate)
+		if retrieved.path == retrievalNothing {
+			systemPrompt = nothingFoundSystemPrompt
+		}
+		systemPrompt = withAnswerLanguage(systemPrompt, r.settings.answerLanguage())
+		sources = newChatSources(retrieved.results)
+		searched, skipped, retrievalPath = retrieved.searched, retrieved.skipped, retrieved.path
+
+		// The debug channel is only given while the retrieval debug is on.
+		if debug != nil {
+			debug <- ragDebugMsg{
+				question:   msg,
+				path:       retrieved.path,
+				candidates: retrieved.candidates,
+			}
+		}
 	}
 
-	// First sort by similarity to get the best matches
-	slices.SortFunc(ragDocs, func(a, b chromem.Result) int {
-		return cmp.Compare(b.Similarity, a.Similarity)
-	})
-
-	// Take more results initially to account for merging
-	initialCount := ragNeededCount * 2
-	if len(ragDocs) > initialCount {
-		ragDocs = ragDocs[:initialCount]
+	// The oldest chats that don't fit in the context window of the model are
+	// left out, the session keeps them.
+	if r.convoContextWindow == 0 {
+		r.convoContextWindow = r.convoLLMSetting.contextWindow(ctx, r.providers)
 	}
 
-	// Merge overlapping chunks
-	ragDocs = mergeChunks(ragDocs)
-
-	// Final sort and trim after merging
-	slices.SortFunc(ragDocs, func(a, b chromem.Result) int {
-		return cmp.Compare(b.Similarity, a.Similarity)
-	})
-
-	if len(ragDocs) > ragNeededCount {
-		ragDocs = ragDocs[:ragNeededCount]
+	// When the history is summarized, the summary takes the place of the
+	// oldest chats.
+	history := r.chats[:len(r.chats)-1]
+	summary, summarizedCount := sess.Summary, sess.SummarizedCount
+	if r.settings.SummarizeHistory {
+		summary, summarizedCount = r.summarizeHistory(ctx, sess, systemPrompt, msg)
+		systemPrompt = withConversationSummary(systemPrompt, summary)
+		history = conversationChats(sess.Chats[summarizedCount : len(sess.Chats)-1])
 	}
 
-	ragPrompt := ragSystemPrompt(ragDocs)
+	history, trimmed := trimHistory(history, historyBudget(r.convoContextWindow, systemPrompt, msg))
+	if trimmed > 0 {
+		slog.Info("Trimmed the oldest chats to fit the context window",
+			"trimmed", trimmed, "contextWindow", r.convoContextWindow)
+	}
 
-	cs := make([]chat, len(r.chats))
-	copy(cs, r.chats)
+	conversation := append(history[:len(history):len(history)], r.chats[len(r.chats)-1])
+	if trimmed > 0 {
+		conversation = markOmittedHistory(conversation)
+	}
 
-	cs = slices.Insert(cs, 0, chat{
-		Role:    roleSystem,
-		Content: ragPrompt,
-	})
+	cs := make([]chat, 0, len(conversation)+1)
+	if systemPrompt != "" {
+		cs = append(cs, chat{
+			Role:    roleSystem,
+			Content: systemPrompt,
+		})
+	}
+	cs = append(cs, conversation...)
 
 	slog.Info("RAG prompt", "chats", cs)
 
+	responses <- llmResponseMsg{
+		chatIndex: index,
+		stage:     chatStageGenerating,
+	}
 	res := r.convoLLM.chatStream(ctx, cs)
 
 	newChat := chat{
@@ -324,21 +456,155 @@ func (r *rag) chat(ctx context.Context, msg string, index int, documents []docum
 		}
 
 		responses <- llmResponseMsg{
-			chatIndex:  index,
-			content:    r.content,
-			isThinking: false,
+			chatIndex:        index,
+			content:          r.content,
+			isThinking:       r.thinking != "",
+			thinking:         r.thinking,
+			promptTokens:     r.promptTokens,
+			completionTokens: r.completionTokens,
 		}
 		newChat.Content += r.content
 	}
 	r.chats = append(r.chats, newChat)
 
 	responses <- llmResponseMsg{
-		done: true,
+		done:            true,
+		sources:         sources,
+		searched:        searched,
+		skipped:         skipped,
+		retrievalPath:   retrievalPath,
+		summary:         summary,
+		summarizedCount: summarizedCount,
 	}
 }
 
+// retrieval is the chunks retrieved for a question, with the names of the
+// documents searched for them and of the ones skipped by their summary. The
+// path is set when no chunk was similar enough to the question, candidates are
+// all the chunks considered, for the retrieval debug.
+type retrieval struct {
+	results    []chromem.Result
+	searched   []string
+	skipped    []string
+	path       string
+	candidates []ragDebugCandidate
+}
+
+// retrieveDocuments returns the chunks of the documents most similar to the
+// message and the chats before it, the adjacent chunks merged.
+func (r *rag) retrieveDocuments(
+	ctx context.Context,
+	msg string,
+	documents []document,
+	filter retrievalFilter,
+) (retrieval, error) {
+	var docResults [][]chromem.Result
+	var ragDocs, rejected []chromem.Result
+
+	// Combine current message with context from previous messages
+	contextString := getContextString(r.chats[:len(r.chats)-1]) // Exclude current message
+	searchText := msg
+	if contextString != "" {
+		searchText = contextString + "\n" + msg
+	}
+
+	// The question is embedded once for all the documents.
+	var queryEmbedding []float32
+	embedFunc := r.embedder.embeddingFunc()
+	if len(documents) > 0 {
+		var err error
+		queryEmbedding, err = embedFunc(ctx, searchText)
+		if err != nil {
+			return retrieval{}, fmt.Errorf("error embedding the question: %w", err)
+		}
+	}
+
+	// Only the documents about the question are searched.
+	documents, skipped := routeDocuments(queryEmbedding, documents)
+	if len(skipped) > 0 {
+		slog.Info("Skipped the documents not about the question", "skipped", documentNames(skipped))
+	}
+
+	for _, doc := range documents {
+		rds, below, err := doc.retrieve(ctx, r.vectordb, queryEmbedding, r.embedderSetting, embedFunc, r.settings, filter)
+		if err != nil {
+			return retrieval{}, err
+		}
+		docResults = append(docResults, rds)
+		ragDocs = append(ragDocs, rds...)
+		rejected = append(rejected, below...)
+	}
+
+	if len(ragDocs) == 0 && len(documents) > 0 {
+		res, err := r.retrieveKeywords(ctx, msg, queryEmbedding, documents, skipped, filter)
+		if err != nil {
+			return retrieval{}, err
+		}
+		res.candidates = debugCandidates(nil, rejected, nil, res.results)
+		return res, nil
+	}
+
+	sel := selectResults(docResults, r.settings.retrievalStrategy(), r.settings.NeededCount, r.settings.mmrLambda())
+	if sel.duplicates > 0 {
+		slog.Info("Dropped duplicate chunks", "count", sel.duplicates)
+	}
+
+	return retrieval{
+		results:    sel.results,
+		searched:   documentNames(documents),
+		skipped:    documentNames(skipped),
+		candidates: debugCandidates(ragDocs, rejected, sel.merged, sel.results),
+	}, nil
+}
+
+// retrieveKeywords returns the chunks of the documents that contain keywords of
+// the message, for the questions no chunk is similar enough to.
+func (r *rag) retrieveKeywords(
+	ctx context.Context,
+	msg string,
+	queryEmbedding []float32,
+	documents, skipped []document,
+	filter retrievalFilter,
+) (retrieval, error) {
+	res := retrieval{
+		searched: documentNames(documents),
+		skipped:  documentNames(skipped),
+		path:     retrievalNothing,
+	}
+
+	keywords := questionKeywords(msg)
+	if len(keywords) == 0 {
+		slog.Info("No chunk is similar enough to the question, and it has no keywords")
+		return res, nil
+	}
+
+	embedFunc := r.embedder.embeddingFunc()
+	var hits []keywordHit
+	for _, doc := range documents {
+		hs, err := doc.keywordSearch(ctx, r.vectordb, queryEmbedding, embedFunc, keywords, r.settings, filter)
+		if err != nil {
+			return retrieval{}, err
+		}
+		hits = append(hits, hs...)
+	}
+	sortKeywordHits(hits)
+
+	candidates := make([]chromem.Result, len(hits))
+	for i, h := range hits {
+		candidates[i] = h.result
+	}
+	res.results, _ = appendDistinct(nil, candidates, r.settings.NeededCount)
+	if len(res.results) > 0 {
+		res.path = retrievalKeyword
+	}
+
+	slog.Info("No chunk is similar enough to the question, searched its keywords",
+		"keywords", keywords, "found", len(res.results))
+	return res, nil
+}
+
 func (r *rag) genTitle() (string, error) {
-	title, err := generateSessionTitle(context.Background(), r.genTitleLLM, r.chats)
+	title, err := generateSessionTitle(context.Background(), r.genTitleLLM, r.chats, r.settings.answerLanguage())
 	if err != nil {
 		return "", fmt.Errorf("error generating session title: %w", err)
 	}
@@ -348,24 +614,117 @@ func (r *rag) genTitle() (string, error) {
 	return title, nil
 }
 
-func (r *rag) scanDocument(ctx context.Context, doc document, progress chan<- documentScanLogMsg) {
-	documents := make(chan chromem.Document)
+// scanDocument scans the files of the document into its collection, the files
+// unchanged since their state in fileStates are not embedded again.
+func (r *rag) scanDocument(ctx context.Context, doc document, fileStates map[string]fileState, progress chan<- documentScanLogMsg) {
+	// The chunks of the files that didn't change since the last scan are kept,
+	// when it used the same embedder and chunk settings. Otherwise the
+	// collection is created again.
+	var coll *chromem.Collection
+	if len(fileStates) > 0 && doc.scannedWith(r.embedderSetting, r.settings) {
+		coll = r.vectordb.GetCollection(doc.vectorDBCollectionName(), r.embedder.embeddingFunc())
+	}
+	if coll == nil && len(fileStates) > 0 {
+		// The states of the previous scan don't match the collection once it's
+		// replaced, even if this scan fails.
+		progress <- documentScanLogMsg{
+			content:         "Replacing the chunks of the previous scan",
+			clearFileStates: true,
+		}
+		fileStates = nil
+	}
+
+	files := make(chan scannedFile)
+	exclusions := &scanExclusions{}
 
-	go r.scanFiles(doc.Path, documents, progress)
-	go r.storeDocument(ctx, doc, documents, progress)
+	if doc.isURL() {
+		go r.crawlPages(ctx, doc, exclusions, files, progress)
+	} else {
+		go r.scanFiles(ctx, doc, fileStates, exclusions, files, progress)
+	}
+	go r.storeDocument(ctx, doc, coll, fileStates, exclusions, files, progress)
 }
 
-func (r *rag) scanFiles(path string, documents chan<- chromem.Document, progress chan<- documentScanLogMsg) {
+func (r *rag) scanFiles(
+	ctx context.Context,
+	doc document,
+	fileStates map[string]fileState,
+	exclusions *scanExclusions,
+	files chan<- scannedFile,
+	progress chan<- documentScanLogMsg,
+) {
+	root := doc.Path
 	progress <- documentScanLogMsg{
-		content: fmt.Sprintf("Scanning %s", path),
+		content: fmt.Sprintf("Scanning %s, reading %d files at once and embedding with %d concurrent requests",
+			root, r.settings.scanConcurrency(), r.settings.embeddingConcurrency()),
 	}
 
-	var wg sync.WaitGroup
-	semaphore := make(chan struct{}, runtime.NumCPU())
+	opts := extractOptions{
+		ctx:                 ctx,
+		tableRowsPerChunk:   r.settings.tableRowsPerChunk(),
+		maxSpreadsheetCells: r.settings.maxSpreadsheetCells(),
+	}
+	if doc.OCR {
+		reader, err := r.newImageReader()
+		if err != nil {
+			progress <- documentScanLogMsg{
+				content: fmt.Sprintf("Warning: OCR is on but %s, the images are skipped", err),
+			}
+		} else {
+			opts.imageReader = reader
+			progress <- documentScanLogMsg{
+				content: fmt.Sprintf("OCR is on, the text of the images is read with %s, it can take a while", reader.backend),
+			}
+		}
+	}
+	if doc.Transcribe {
+		transcriber, err := r.newAudioTranscriber()
+		if err != nil {
+			progress <- documentScanLogMsg{
+				content: fmt.Sprintf("Warning: the transcription is on but %s, the recordings are skipped", err),
+			}
+		} else {
+			opts.transcriber = transcriber
+			progress <- documentScanLogMsg{
+				content: fmt.Sprintf("The recordings are transcribed with %s, it can take a while", transcriber.backend),
+			}
+		}
+	}
+	maxAudioBytes := int64(r.settings.maxAudioMB()) << 20
+	maxFileBytes := int64(r.settings.maxFileMB()) << 20
+	maxArchiveBytes := int64(r.settings.maxArchiveMB()) << 20
+	hidden := newHiddenSkipper(doc, r.settings)
+	var ignores *ignoreMatcher
+	if !doc.IncludeIgnored {
+		ignores = &ignoreMatcher{}
+	}
+	var filter *pathFilter
+	if len(doc.IncludePatterns) > 0 || len(doc.ExcludePatterns) > 0 {
+		filter = newPathFilter(doc.IncludePatterns, doc.ExcludePatterns)
+		progress <- documentScanLogMsg{
+			content: fmt.Sprintf("Scanning the files %s", filter.patterns()),
+		}
+	}
 
-	if err := filepath.Walk(path, func(path string, f os.FileInfo, err error) error {
+	// The files are listed before they are read, for the progress of the
+	// scan.
+	var walked []walkedFile
+	walker := &linkWalker{followLinks: doc.FollowSymlinks, exclusions: exclusions, progress: progress}
+	walker.fn = func(path string, f os.FileInfo, err error) error {
 		if err != nil {
-			return err
+			// Only the root fails the scan, the unreadable files and
+			// directories under it are skipped.
+			if path == root {
+				return err
+			}
+			exclusions.failures.add(path, err)
+			progress <- documentScanLogMsg{
+				content: fmt.Sprintf("Warning: failed to read %s: %s", path, err),
+			}
+			if f != nil && f.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
 		}
 
 		// Skip git directories
@@ -373,107 +732,784 @@ func (r *rag) scanFiles(path string, documents chan<- chromem.Document, progress
 			return filepath.SkipDir
 		}
 
+		// The patterns match the paths relative to the document.
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		// A document of a single file is only that file.
+		if rel == "." && !f.IsDir() {
+			rel = filepath.Base(path)
+		}
+
+		if hidden != nil && path != root && hidden.skipped(filepath.Base(path), f.IsDir()) {
+			if f.IsDir() {
+				exclusions.hiddenDirs++
+				return filepath.SkipDir
+			}
+			exclusions.hiddenFiles++
+			return nil
+		}
+
+		// The files matched by the .gitignore files are skipped, the rules of
+		// a directory are loaded when the walk enters it.
+		if ignores != nil {
+			if rel != "." && ignores.ignored(rel, f.IsDir()) {
+				if f.IsDir() {
+					exclusions.ignoredDirs++
+					return filepath.SkipDir
+				}
+				exclusions.ignoredFiles++
+				return nil
+			}
+			if f.IsDir() {
+				ignores.loadGitignore(root, rel)
+			}
+		}
+
 		if f.IsDir() {
 			return nil
 		}
 
+		if filter != nil && !filter.keep(rel) {
+			return nil
+		}
+
+		// The images are only scanned with OCR and the recordings with the
+		// transcription, the ones of the previous scans are removed once it's
+		// off.
+		ext := strings.ToLower(filepath.Ext(path))
+		_, isImage := imageMIMETypes[ext]
+		if isImage && opts.imageReader == nil {
+			return nil
+		}
+		isAudio := audioExtensions[ext]
+		if isAudio && opts.transcriber == nil {
+			return nil
+		}
+		if isAudio && f.Size() > maxAudioBytes {
+			progress <- documentScanLogMsg{
+				content: fmt.Sprintf("Warning: skipped %s: it's over the %d MB limit of the transcription", path, maxAudioBytes>>20),
+			}
+			return nil
+		}
+		// The archives are read whole in memory, under their own limit.
+		if doc.ScanArchives && isArchive(path) {
+			if f.Size() > maxArchiveBytes {
+				exclusions.oversizedFiles++
+				progress <- documentScanLogMsg{
+					content: fmt.Sprintf("Warning: skipped %s: it's over the %d MB archive size limit", path, maxArchiveBytes>>20),
+				}
+				return nil
+			}
+			walked = append(walked, walkedFile{path: path, info: f})
+			return nil
+		}
+		// The other files are read whole, the large ones are skipped before.
+		if !isAudio && f.Size() > maxFileBytes {
+			exclusions.oversizedFiles++
+			progress <- documentScanLogMsg{
+				content: fmt.Sprintf("Warning: skipped %s: it's over the %d MB file size limit", path, maxFileBytes>>20),
+			}
+			return nil
+		}
+
+		walked = append(walked, walkedFile{path: path, info: f})
+		return nil
+	}
+	if err := walker.walkDocument(root); err != nil {
+		progress <- documentScanLogMsg{
+			content: fmt.Sprintf("Error scanning %s: %s", root, err),
+			err:     err,
+		}
+		return
+	}
+
+	if filter != nil {
+		progress <- documentScanLogMsg{
+			content: fmt.Sprintf("Left out %s", filter.counts()),
+		}
+	}
+	total := len(walked)
+	progress <- documentScanLogMsg{
+		content:    fmt.Sprintf("Found %s to scan", formatFileCount(total)),
+		filesTotal: total,
+	}
+
+	var mu sync.Mutex
+	read := 0
+	lastReport := time.Now()
+	fileRead := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		read++
+		if read == total || time.Since(lastReport) >= scanProgressInterval {
+			lastReport = time.Now()
+			progress <- documentScanLogMsg{filesRead: read, filesTotal: total}
+		}
+	}
+
+	// scanData extracts the data of the file id, rel is its path relative to
+	// the document. The files of the archives are scanned alike.
+	scanData := func(id, rel string, data []byte, modTime time.Time, state fileState) {
+		// Avoid processing empty files
+		if len(data) == 0 {
+			return
+		}
+		ext := strings.ToLower(filepath.Ext(id))
+		_, isImage := imageMIMETypes[ext]
+		isAudio := audioExtensions[ext]
+		// The files without an extractor are read as text, the binary ones
+		// would be embedded as gibberish.
+		if _, ok := extractors[ext]; !ok && isBinary(data) {
+			exclusions.binaryFiles.Add(1)
+			progress <- documentScanLogMsg{
+				content: fmt.Sprintf("Skipped %s: it's a binary file", id),
+			}
+			return
+		}
+
+		start := time.Now()
+		extracted, text, err := extractDocument(chromem.Document{
+			ID: id,
+			Metadata: map[string]string{
+				"filename": path.Base(rel),
+				"ext":      strings.TrimPrefix(ext, "."),
+				"path":     rel,
+				modTimeKey: modTime.UTC().Format(time.RFC3339),
+			},
+		}, data, opts)
+		if err != nil {
+			exclusions.failures.add(id, err)
+			progress <- documentScanLogMsg{
+				content: fmt.Sprintf("Warning: skipped %s: %s", id, err),
+			}
+			return
+		}
+		switch {
+		case isImage:
+			progress <- documentScanLogMsg{
+				content: fmt.Sprintf("Read the text of %s with OCR in %s", id, time.Since(start).Round(time.Millisecond)),
+			}
+		case isAudio:
+			progress <- documentScanLogMsg{
+				content: fmt.Sprintf("Transcribed %s in %s", id, time.Since(start).Round(time.Millisecond)),
+			}
+		}
+		for _, warning := range text.warnings {
+			progress <- documentScanLogMsg{
+				content: fmt.Sprintf("Warning: %s: %s", id, warning),
+			}
+		}
+		if strings.TrimSpace(extracted.Content) == "" {
+			return
+		}
+
+		state.Hash = contentHash(string(data))
+		files <- scannedFile{
+			doc:      extracted,
+			sections: text.sections,
+			state:    state,
+		}
+	}
+
+	// The files of an archive have the state of the archive, they are
+	// unchanged along with it.
+	var archiveEntries map[string][]string
+	archives := archiveReader{
+		maxFileBytes:    maxFileBytes,
+		maxAudioBytes:   maxAudioBytes,
+		maxArchiveBytes: maxArchiveBytes,
+		opts:            opts,
+		exclusions:      exclusions,
+		progress:        progress,
+	}
+	if doc.ScanArchives {
+		archiveEntries = archiveEntryStates(fileStates)
+	}
+
+	var wg sync.WaitGroup
+	semaphore := make(chan struct{}, r.settings.scanConcurrency())
+	for _, w := range walked {
+		archive := doc.ScanArchives && isArchive(w.path)
+		if entries := archiveEntries[w.path]; archive && archiveUnchanged(w.info, entries, fileStates) {
+			for _, id := range entries {
+				files <- scannedFile{
+					doc:       chromem.Document{ID: id},
+					state:     fileStates[id],
+					unchanged: true,
+				}
+			}
+			fileRead()
+			continue
+		}
+
+		// The files with the modification time and the size of the last scan
+		// are not read.
+		if previous, ok := fileStates[w.path]; ok && !archive && unchangedSince(w.info, previous) {
+			files <- scannedFile{
+				doc:       chromem.Document{ID: w.path},
+				state:     previous,
+				unchanged: true,
+			}
+			fileRead()
+			continue
+		}
+
 		wg.Add(1)
-		go func(p string) {
+		go func(p string, f os.FileInfo) {
 			semaphore <- struct{}{}
 			defer func() {
 				<-semaphore
+				fileRead()
 				wg.Done()
 			}()
 
 			fileData, err := os.ReadFile(p)
 			if err != nil {
+				exclusions.failures.add(p, err)
+				progress <- documentScanLogMsg{
+					content: fmt.Sprintf("Warning: failed to read %s: %s", p, err),
+				}
 				return
 			}
 
-			// Avoid processing empty files
-			if len(fileData) == 0 {
-				return
+			// The extension and the path relative to the document are
+			// recorded for the retrieval filters.
+			rel, err := filepath.Rel(root, p)
+			if err != nil || rel == "." {
+				rel = filepath.Base(p)
 			}
+			rel = filepath.ToSlash(rel)
+			state := fileState{ModTime: f.ModTime(), Size: f.Size()}
 
-			documents <- chromem.Document{
-				ID:      p,
-				Content: string(fileData),
-				Metadata: map[string]string{
-					"filename": filepath.Base(path),
-				},
+			if !archive {
+				scanData(p, rel, fileData, f.ModTime(), state)
+				return
+			}
+			err = archives.read(p, fileData, f.ModTime(), func(name string, data []byte, modTime time.Time) {
+				scanData(p+archiveSeparator+name, rel+archiveSeparator+name, data, modTime, state)
+			})
+			if err != nil {
+				exclusions.failures.add(p, err)
+				progress <- documentScanLogMsg{
+					content: fmt.Sprintf("Warning: skipped %s: %s", p, err),
+				}
 			}
-		}(path)
+		}(w.path, w.info)
+	}
+	wg.Wait()
 
-		return nil
-	}); err != nil {
+	close(files)
+}
+
+func (r *rag) storeDocument(
+	ctx context.Context,
+	doc document,
+	coll *chromem.Collection,
+	fileStates map[string]fileState,
+	exclusions *scanExclusions,
+	files <-chan scannedFile,
+	progress chan<- documentScanLogMsg,
+) {
+	ctx = withRateLimitNotify(ctx, func(delay time.Duration) {
 		progress <- documentScanLogMsg{
-			content: fmt.Sprintf("Error scanning %s: %s", path, err),
-			err:     err,
+			content: fmt.Sprintf("Waiting for rate limit… (%s)", delay.Round(time.Second)),
+		}
+	})
+
+	var maxTokens int
+	if c, ok := r.embedder.(contextLimitedEmbedder); ok {
+		var err error
+		maxTokens, err = c.embeddingContextLength(ctx)
+		if err != nil {
+			progress <- documentScanLogMsg{
+				content: fmt.Sprintf("Warning: can't get the context length of the embedding model, chunks are not checked: %s", err),
+			}
 		}
-		return
 	}
 
-	wg.Wait()
+	collName := doc.vectorDBCollectionName()
+	docName := doc.Name
+	embedFunc := r.embedder.embeddingFunc()
 
-	close(documents)
-}
+	// The collection of the last scan is updated, otherwise it's created
+	// after the chunks are embedded.
+	incremental := coll != nil
 
-func (r *rag) storeDocument(ctx context.Context, doc document, documents <-chan chromem.Document, progress chan<- documentScanLogMsg) {
+	scanStart := time.Now()
 	var chunkedDocs []chromem.Document
-	originalFileCount := 0
+	var changedFiles []string
+	var counts scanCounts
+	states := make(map[string]fileState)
+	splitCount := 0
+
+	chunkFile := func(file scannedFile) []chromem.Document {
+		docItem := file.doc
+		var chunks []chromem.Document
+		if len(file.sections) > 0 {
+			chunks = chunkSections(docItem, file.sections, r.tokenizer,
+				r.settings.ChunkSize, r.settings.ChunkOverlap, r.settings.MinChunkChars)
+		} else {
+			chunks = chunkDocument(docItem, r.tokenizer, r.settings.ChunkSize, r.settings.ChunkOverlap, r.settings.MinChunkChars)
+		}
+		if maxTokens > 0 {
+			var split int
+			chunks, split = splitOversizedChunks(chunks, maxTokens)
+			if split > 0 {
+				splitCount += split
+				progress <- documentScanLogMsg{
+					content: fmt.Sprintf("Warning: %s has %d chunks over the %d tokens context of the embedding model, they were split",
+						docItem.ID, split, maxTokens),
+				}
+			}
+		}
+		return chunks
+	}
+	// The files too small to answer a question are only embedded when the
+	// document has nothing else.
+	var tinyFiles []scannedFile
 
-	for docItem := range documents {
+	for file := range files {
 		if ctx.Err() != nil {
-			progress <- documentScanLogMsg{
-				content: fmt.Sprintf("Error adding documents to collection: %s", ctx.Err()),
-				err:     fmt.Errorf("error adding documents to collection: %w", ctx.Err()),
-			}
+			r.cancelScan(collName, false, progress)
 			return
 		}
 
-		chunks := chunkDocument(docItem)
+		docItem := file.doc
+		states[docItem.ID] = file.state
+		previous, known := fileStates[docItem.ID]
+		switch {
+		case file.unchanged:
+			counts.unchanged++
+			continue
+		case !known:
+			counts.added++
+		case previous.Hash == file.state.Hash:
+			counts.unchanged++
+			if incremental {
+				continue
+			}
+		default:
+			counts.updated++
+			if incremental {
+				changedFiles = append(changedFiles, docItem.ID)
+			}
+		}
+
+		if isTinyFile(docItem.Content, r.settings.MinChunkChars) {
+			tinyFiles = append(tinyFiles, file)
+			continue
+		}
+
+		chunks := chunkFile(file)
 		chunkedDocs = append(chunkedDocs, chunks...)
-		originalFileCount++
 
 		progress <- documentScanLogMsg{
 			content: fmt.Sprintf("Scanning %s (created %d chunks)", docItem.ID, len(chunks)),
 		}
 	}
+	skippedTiny := 0
+	if len(chunkedDocs) == 0 && (!incremental || coll.Count() == 0) {
+		for _, file := range tinyFiles {
+			chunkedDocs = append(chunkedDocs, chunkFile(file)...)
+		}
+	} else {
+		skippedTiny = len(tinyFiles)
+	}
+	for path := range fileStates {
+		if _, ok := states[path]; !ok {
+			counts.removed++
+			if incremental {
+				changedFiles = append(changedFiles, path)
+			}
+		}
+	}
 
+	summary := fmt.Sprintf("Scanned %s into %d chunks", formatFileCount(len(states)), len(chunkedDocs))
+	if incremental {
+		summary = fmt.Sprintf("Scanned %s: %s, %d chunks", formatFileCount(len(states)), counts, len(chunkedDocs))
+	}
+	if splitCount > 0 {
+		summary += fmt.Sprintf(", %d oversized chunks were split", splitCount)
+	}
+	if skippedTiny > 0 {
+		summary += fmt.Sprintf(", %d files under %d characters were skipped", skippedTiny, r.settings.MinChunkChars)
+	}
+	if excluded := exclusions.String(); excluded != "" {
+		summary += ", " + excluded
+	}
+	concurrency := r.settings.embeddingConcurrency()
 	progress <- documentScanLogMsg{
-		content: fmt.Sprintf("Scanned %d files into %d chunks, embedding...", originalFileCount, len(chunkedDocs)),
+		content:     fmt.Sprintf("%s, embedding with %d concurrent requests...", summary, concurrency),
+		chunksTotal: len(chunkedDocs),
 	}
+	scanDuration := time.Since(scanStart)
+	embedStart := time.Now()
 
-	collName := doc.vectorDBCollectionName()
-	docName := doc.Name
+	for _, c := range chunkedDocs {
+		c.Metadata[embedderProviderKey] = r.embedderSetting.Provider
+		c.Metadata[embedderModelKey] = r.embedderSetting.Model
+	}
 
-	coll, err := r.vectordb.CreateCollection(collName,
-		map[string]string{"docName": docName}, r.embedder.embeddingFunc())
+	// All the chunks are embedded before the collection is changed, so a
+	// failed scan leaves the chunks of the previous one.
+	var err error
+	if b, ok := r.embedder.(batchEmbedder); ok {
+		err = embedChunks(ctx, b, chunkedDocs, concurrency, progress)
+	} else {
+		err = embedEachChunk(ctx, embedFunc, chunkedDocs, concurrency, progress)
+	}
+	if ctx.Err() != nil {
+		r.cancelScan(collName, false, progress)
+		return
+	}
 	if err != nil {
 		progress <- documentScanLogMsg{
-			content: fmt.Sprintf("Error creating collection: %s", err),
-			err:     fmt.Errorf("error creating collection: %w", err),
+			content: fmt.Sprintf("Error embedding documents: %s", err),
+			err:     fmt.Errorf("error embedding documents: %w", err),
 		}
 		return
 	}
 
-	if err := coll.AddDocuments(ctx, chunkedDocs, runtime.NumCPU()); err != nil {
+	dimensions := 0
+	if incremental {
+		dimensions = doc.EmbeddingDimensions
+	}
+	if len(chunkedDocs) > 0 {
+		dimensions = len(chunkedDocs[0].Embedding)
+	}
+
+	if incremental && doc.EmbeddingDimensions > 0 && dimensions != doc.EmbeddingDimensions {
+		// The kept chunks can't be searched along with the new ones, the
+		// next scan embeds all the files.
+		err := fmt.Errorf("the embedding model now returns %d dimensions instead of %d, rescan to embed all the files again",
+			dimensions, doc.EmbeddingDimensions)
 		progress <- documentScanLogMsg{
-			content: fmt.Sprintf("Error adding documents to collection: %s", err),
-			err:     fmt.Errorf("error adding documents to collection: %w", err),
+			content:         fmt.Sprintf("Error embedding documents: %s", err),
+			err:             fmt.Errorf("error embedding documents: %w", err),
+			clearFileStates: true,
 		}
 		return
 	}
 
+	// The collection is written from here, a cancelled scan discards it.
+	if coll == nil {
+		// CreateCollection replaces the collection of the previous scan but
+		// leaves its chunks on disk, which are loaded again on the next start.
+		if err := r.vectordb.DeleteCollection(collName); err != nil {
+			progress <- documentScanLogMsg{
+				content: fmt.Sprintf("Error deleting the previous collection: %s", err),
+				err:     fmt.Errorf("error deleting the previous collection: %w", err),
+			}
+			return
+		}
+
+		coll, err = r.vectordb.CreateCollection(collName, map[string]string{
+			"docName":             docName,
+			embedderProviderKey:   r.embedderSetting.Provider,
+			embedderModelKey:      r.embedderSetting.Model,
+			"embeddingDimensions": strconv.Itoa(dimensions),
+		}, embedFunc)
+		if err != nil {
+			progress <- documentScanLogMsg{
+				content: fmt.Sprintf("Error creating collection: %s", err),
+				err:     fmt.Errorf("error creating collection: %w", err),
+			}
+			return
+		}
+	}
+
+	for _, path := range changedFiles {
+		if err := deleteFileChunks(ctx, coll, path); err != nil {
+			if ctx.Err() != nil {
+				r.cancelScan(collName, true, progress)
+				return
+			}
+			progress <- documentScanLogMsg{
+				content: fmt.Sprintf("Error removing the chunks of %s: %s", path, err),
+				err:     fmt.Errorf("error removing the chunks of %s: %w", path, err),
+			}
+			return
+		}
+	}
+
+	if len(chunkedDocs) > 0 {
+		// AddDocuments stops without an error once the context is cancelled.
+		if err := coll.AddDocuments(ctx, chunkedDocs, runtime.NumCPU()); err != nil && ctx.Err() == nil {
+			progress <- documentScanLogMsg{
+				content: fmt.Sprintf("Error adding documents to collection: %s", err),
+				err:     fmt.Errorf("error adding documents to collection: %w", err),
+			}
+			return
+		}
+	}
+	if ctx.Err() != nil {
+		r.cancelScan(collName, true, progress)
+		return
+	}
+
+	embedDuration := time.Since(embedStart)
+
+	// The summary routes the questions to the documents about them, it's
+	// kept when no file changed.
+	summary, summaryEmbedding := doc.Summary, doc.SummaryEmbedding
+	changed := !incremental || counts.updated+counts.added+counts.removed > 0
+	if r.genTitleLLM != nil && (changed || summary == "") {
+		progress <- documentScanLogMsg{
+			content: "Summarizing the document...",
+		}
+		s, e, err := r.summarizeScannedDocument(ctx, doc, coll, states)
+		if err != nil {
+			progress <- documentScanLogMsg{
+				content: fmt.Sprintf("Warning: %s, the summary of the previous scan is kept", err),
+			}
+		} else {
+			summary, summaryEmbedding = s, e
+		}
+	}
+
+	var newestFileTime time.Time
+	for _, state := range states {
+		if state.ModTime.After(newestFileTime) {
+			newestFileTime = state.ModTime
+		}
+	}
+	failedFiles := exclusions.failures.list()
+	if len(failedFiles) > 0 {
+		progress <- documentScanLogMsg{
+			content: "Warning: " + formatFailures(failedFiles),
+		}
+	}
+	progress <- documentScanLogMsg{
+		content: fmt.Sprintf("Embedded %s chunks in %s, the files were scanned in %s",
+			formatCount(len(chunkedDocs)), embedDuration.Round(time.Millisecond), scanDuration.Round(time.Millisecond)),
+		done:                true,
+		scannedFileCount:    len(states),
+		lastScanTime:        time.Now(),
+		newestFileTime:      newestFileTime,
+		embedderProvider:    r.embedderSetting.Provider,
+		embedderModel:       r.embedderSetting.Model,
+		embeddingDimensions: dimensions,
+		chunkSize:           r.settings.ChunkSize,
+		chunkOverlap:        r.settings.ChunkOverlap,
+		minChunkChars:       r.settings.MinChunkChars,
+		tableRowsPerChunk:   r.settings.tableRowsPerChunk(),
+		fileStates:          states,
+		failedFiles:         failedFiles,
+		summary:             summary,
+		summaryEmbedding:    summaryEmbedding,
+	}
+}
+
+// cancelScan reports the cancelled scan of the collection. The collection is
+// deleted once the scan has written to it, as its chunks are only a part of the
+// document, the document is scanned again from nothing.
+func (r *rag) cancelScan(collName string, written bool, progress chan<- documentScanLogMsg) {
+	if !written {
+		progress <- documentScanLogMsg{
+			content: "Scan cancelled, the chunks of the previous scan are kept",
+			err:     errScanCancelled,
+		}
+		return
+	}
+	if err := r.vectordb.DeleteCollection(collName); err != nil {
+		progress <- documentScanLogMsg{
+			content: fmt.Sprintf("Error discarding the partial index of the cancelled scan: %s", err),
+			err:     fmt.Errorf("error discarding the partial index of the cancelled scan: %w", err),
+		}
+		return
+	}
 	progress <- documentScanLogMsg{
-		content:          "Embedding complete",
-		done:             true,
-		scannedFileCount: originalFileCount,
-		lastScanTime:     time.Now(),
+		content:   "Scan cancelled, partial index discarded",
+		err:       errScanCancelled,
+		discarded: true,
+	}
+}
+
+// splitOversizedChunks splits the chunks whose estimated tokens exceed
+// maxTokens into parts that fit, and returns how many chunks were split.
+func splitOversizedChunks(chunks []chromem.Document, maxTokens int) ([]chromem.Document, int) {
+	maxBytes := maxTokens * tokenEstimateBytes
+
+	var res []chromem.Document
+	split := 0
+	for _, c := range chunks {
+		if len(c.Content) <= maxBytes {
+			res = append(res, c)
+			continue
+		}
+
+		split++
+		first := len(res)
+		content := c.Content
+		for part := 0; content != ""; part++ {
+			// Don't cut a character in half.
+			end := graphemeCut(content, maxBytes)
+
+			metadata := maps.Clone(c.Metadata)
+			if metadata == nil {
+				metadata = make(map[string]string)
+			}
+			// The parts of an unchunked file are removed with its chunks.
+			if metadata["originalID"] == "" {
+				metadata["originalID"] = c.ID
+			}
+			metadata["part"] = strconv.Itoa(part)
+			// Only the first part repeats the end of the previous chunk.
+			if part > 0 {
+				metadata["overlap"] = "0"
+			}
+
+			res = append(res, chromem.Document{
+				ID:       fmt.Sprintf("%s-part-%d", c.ID, part),
+				Content:  content[:end],
+				Metadata: metadata,
+			})
+			content = content[end:]
+		}
+		// The parts count tells mergeChunks where the chunk ends.
+		for i := first; i < len(res); i++ {
+			res[i].Metadata["parts"] = strconv.Itoa(len(res) - first)
+		}
+	}
+
+	return res, split
+}
+
+// embedChunks sets the embeddings of the chunks, embedding embeddingBatchSize
+// chunks per request and sending up to concurrency requests at once.
+func embedChunks(
+	ctx context.Context,
+	b batchEmbedder,
+	chunks []chromem.Document,
+	concurrency int,
+	progress chan<- documentScanLogMsg,
+) error {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	semaphore := make(chan struct{}, concurrency)
+	embedded := 0
+	startTime := time.Now()
+
+	for start := 0; start < len(chunks); start += embeddingBatchSize {
+		if ctx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(start, end int) {
+			defer func() {
+				<-semaphore
+				wg.Done()
+			}()
+
+			texts := make([]string, end-start)
+			for i, c := range chunks[start:end] {
+				texts[i] = c.Content
+			}
+
+			vs, err := b.embedBatch(ctx, texts)
+			if err != nil {
+				cancel(err)
+				return
+			}
+			for i, v := range vs {
+				chunks[start+i].Embedding = v
+			}
+
+			mu.Lock()
+			embedded += end - start
+			progress <- documentScanLogMsg{
+				content:        embeddingProgress(embedded, len(chunks), time.Since(startTime)),
+				chunksEmbedded: embedded,
+				chunksTotal:    len(chunks),
+			}
+			mu.Unlock()
+		}(start, min(start+embeddingBatchSize, len(chunks)))
+	}
+	wg.Wait()
+
+	return context.Cause(ctx)
+}
+
+// embeddingProgress reports the chunks embedded so far, with the time left
+// estimated from the throughput since the embedding started.
+func embeddingProgress(embedded, total int, elapsed time.Duration) string {
+	res := fmt.Sprintf("Embedded %s/%s chunks (%d%%)", formatCount(embedded), formatCount(total), embedded*100/max(total, 1))
+	if embedded > 0 && embedded < total {
+		eta := elapsed * time.Duration(total-embedded) / time.Duration(embedded)
+		res += fmt.Sprintf(" – ETA %s", eta.Round(time.Second))
+	}
+	return res
+}
+
+// embedEachChunk sets the embeddings of the chunks, embedding up to concurrency
+// chunks at once.
+func embedEachChunk(
+	ctx context.Context,
+	embed chromem.EmbeddingFunc,
+	chunks []chromem.Document,
+	concurrency int,
+	progress chan<- documentScanLogMsg,
+) error {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	semaphore := make(chan struct{}, concurrency)
+	embedded := 0
+	startTime := time.Now()
+	lastReport := startTime
+
+	for i := range chunks {
+		if ctx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(i int) {
+			defer func() {
+				<-semaphore
+				wg.Done()
+			}()
+
+			v, err := embed(ctx, chunks[i].Content)
+			if err != nil {
+				cancel(err)
+				return
+			}
+			chunks[i].Embedding = v
+
+			mu.Lock()
+			embedded++
+			// The chunks are reported like the batches, or every second
+			// for the slow embedders.
+			if embedded%embeddingBatchSize == 0 || embedded == len(chunks) || time.Since(lastReport) >= time.Second {
+				lastReport = time.Now()
+				progress <- documentScanLogMsg{
+					content:        embeddingProgress(embedded, len(chunks), time.Since(startTime)),
+					chunksEmbedded: embedded,
+					chunksTotal:    len(chunks),
+				}
+			}
+			mu.Unlock()
+		}(i)
 	}
+	wg.Wait()
+
+	return context.Cause(ctx)
 }
 
 func (m mainModel) refreshRAG() (mainModel, error) {
+	m = m.clearUnavailableRoles()
 	if !m.llmIsConfigured() {
 		return m, nil
 	}
@@ -493,7 +1529,7 @@ func (m mainModel) refreshRAG() (mainModel, error) {
 		return mainModel{}, fmt.Errorf("failed to load embedder llm: %w", err)
 	}
 
-	m.rag = newRAG(m.vectordb, convo, genTitle, embedder)
+	m.rag = newRAG(m.vectordb, convo, genTitle, embedder, m.convoLLMSetting, m.embedderLLMSetting, m.providers, m.ragSettings)
 
 	return m, nil
 }
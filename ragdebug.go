@@ -0,0 +1,253 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/charmbracelet/bubbles/key"
+	"github.com/charmbracelet/bubbles/viewport"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+	"github.com/philippgille/chromem-go"
+)
+
+// ragDebugCandidate is a chunk considered for a question, with what the
+// retrieval did with it.
+type ragDebugCandidate struct {
+	id         string
+	name       string
+	similarity float32
+	// passed is set for the chunks as similar to the question as the
+	// threshold, merged for the ones merged with the adjacent chunks of their
+	// file, and inPrompt for the ones given to the LLM.
+	passed   bool
+	merged   bool
+	inPrompt bool
+	// keyword is set for the chunks found by the keywords of the question.
+	keyword bool
+}
+
+// ragDebugMsg carries the candidates of the retrieval of a question to the UI
+// while the retrieval debug is on. They are not saved with the session.
+type ragDebugMsg struct {
+	question   string
+	path       string
+	candidates []ragDebugCandidate
+}
+
+const (
+	// mergedIDsKey records the IDs of the chunks of a merged result, separated
+	// by new lines.
+	mergedIDsKey = "mergedIDs"
+)
+
+// debugCandidates returns the candidates of a retrieval from the chunks that
+// passed the threshold, the ones that didn't, the results of the merge of the
+// ones that passed and the results given to the LLM. The results found by
+// their keywords are added when they are not among the candidates.
+func debugCandidates(passed, rejected, merged, selected []chromem.Result) []ragDebugCandidate {
+	mergedIDs := make(map[string]bool)
+	for _, r := range merged {
+		if r.Metadata[mergedIDsKey] == "" {
+			continue
+		}
+		for _, id := range resultIDs(r) {
+			mergedIDs[id] = true
+		}
+	}
+	promptIDs := make(map[string]bool)
+	for _, r := range selected {
+		for _, id := range resultIDs(r) {
+			promptIDs[id] = true
+		}
+	}
+
+	var candidates []ragDebugCandidate
+	seen := make(map[string]bool)
+	add := func(r chromem.Result, isPassed bool) {
+		seen[r.ID] = true
+		candidates = append(candidates, ragDebugCandidate{
+			id:         r.ID,
+			name:       sourceName(r.Metadata),
+			similarity: r.Similarity,
+			passed:     isPassed,
+			merged:     mergedIDs[r.ID],
+			inPrompt:   promptIDs[r.ID],
+			keyword:    r.Metadata[keywordMatchKey] != "",
+		})
+	}
+	for _, r := range passed {
+		add(r, true)
+	}
+	for _, r := range rejected {
+		add(r, false)
+	}
+	for _, r := range selected {
+		if seen[r.ID] {
+			i := slices.IndexFunc(candidates, func(c ragDebugCandidate) bool { return c.id == r.ID })
+			candidates[i].keyword = r.Metadata[keywordMatchKey] != ""
+			continue
+		}
+		add(r, false)
+	}
+
+	slices.SortStableFunc(candidates, func(a, b ragDebugCandidate) int {
+		if c := cmp.Compare(b.similarity, a.similarity); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.id, b.id)
+	})
+	return candidates
+}
+
+// resultIDs returns the IDs of the chunks of a result, several when it's
+// merged.
+func resultIDs(r chromem.Result) []string {
+	if ids := r.Metadata[mergedIDsKey]; ids != "" {
+		return strings.Split(ids, "\n")
+	}
+	return []string{r.ID}
+}
+
+func (m mainModel) initRAGDebug() mainModel {
+	m.ragDebugViewport = viewport.New(0, 0)
+	m.ragDebugViewport.KeyMap = m.keymap.viewportKeymap
+
+	m.ragDebugs = make(chan ragDebugMsg)
+
+	return m
+}
+
+// toggleRAGDebug turns the retrieval debug on or off, while it's on the
+// candidates of every retrieval are shown before the answer.
+func (m mainModel) toggleRAGDebug() mainModel {
+	m.ragDebugEnabled = !m.ragDebugEnabled
+	return m.updateChatSize()
+}
+
+// handleRAGDebugMsg keeps the candidates of the last retrieval, and shows them
+// if the chat is still open.
+func (m mainModel) handleRAGDebugMsg(msg ragDebugMsg) mainModel {
+	m.ragDebug = msg
+	if m.viewState != viewStateChat {
+		return m
+	}
+	return m.setViewState(viewStateRAGDebug).updateRAGDebugSize()
+}
+
+func (m mainModel) updateRAGDebugSize() mainModel {
+	titleHeight := lipgloss.Height(titleStyle.Render(""))
+	helpHeight := lipgloss.Height(m.helpModel.View(m.keymap))
+	height := m.height - titleHeight - helpHeight
+
+	if m.err != nil {
+		height -= errHeight(m.width, m.err)
+	}
+
+	m.ragDebugViewport.Width = m.width
+	m.ragDebugViewport.Height = height
+
+	m.ragDebugViewport.SetContent(m.ragDebugContent())
+
+	return m
+}
+
+// ragDebugContent lists the candidates of the last retrieval, from the most
+// similar.
+func (m mainModel) ragDebugContent() string {
+	var sb strings.Builder
+	sb.WriteString(chatUsageStyle.Render(excerpt(m.ragDebug.question, m.width-10)))
+	sb.WriteString("\n")
+	switch m.ragDebug.path {
+	case retrievalKeyword:
+		sb.WriteString(chatUsageStyle.Render("No chunk was similar enough, the chunks were found by their keywords."))
+		sb.WriteString("\n")
+	case retrievalNothing:
+		sb.WriteString(chatUsageStyle.Render("No chunk was similar enough, and none has the keywords of the question."))
+		sb.WriteString("\n")
+	}
+	sb.WriteString("\n")
+
+	if len(m.ragDebug.candidates) == 0 {
+		sb.WriteString(chatUsageStyle.Render("No chunk was retrieved."))
+		return sb.String()
+	}
+
+	for i, c := range m.ragDebug.candidates {
+		flags := []string{"below threshold"}
+		if c.passed {
+			flags[0] = "passed"
+		}
+		if c.keyword {
+			flags = append(flags, "keyword match")
+		}
+		if c.merged {
+			flags = append(flags, "merged")
+		}
+		if c.inPrompt {
+			flags = append(flags, "in prompt")
+		} else {
+			flags = append(flags, "left out")
+		}
+
+		line := fmt.Sprintf("%d. %.3f %s", i+1, c.similarity, strings.Join(flags, ", "))
+		if c.inPrompt {
+			sb.WriteString(chatEntityStyle.Render(line))
+		} else {
+			sb.WriteString(chatContentStyle.Render(line))
+		}
+		sb.WriteString("\n")
+		if c.name != "" {
+			sb.WriteString(chatUsageStyle.Render("[" + c.name + "] " + c.id))
+		} else {
+			sb.WriteString(chatUsageStyle.Render(c.id))
+		}
+		sb.WriteString("\n\n")
+	}
+	return sb.String()
+}
+
+func (m mainModel) handleRAGDebugEvents(msg tea.Msg) (mainModel, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.WindowSizeMsg:
+		m = m.updateRAGDebugSize()
+	case tea.KeyMsg:
+		switch {
+		case key.Matches(msg, m.keymap.escape):
+			m = m.setViewState(viewStateChat).updateChatSize()
+			if m.chatIsThinking {
+				// The spinner stopped ticking while the candidates were shown.
+				return m, m.chatSpinner.Tick
+			}
+			return m, nil
+		case key.Matches(msg, m.keymap.openHelp):
+			m.keymap.openHelp.SetEnabled(false)
+			m.keymap.closeHelp.SetEnabled(true)
+			m.helpModel.ShowAll = true
+			return m.updateRAGDebugSize(), nil
+		case key.Matches(msg, m.keymap.closeHelp):
+			m.keymap.closeHelp.SetEnabled(false)
+			m.keymap.openHelp.SetEnabled(true)
+			m.helpModel.ShowAll = false
+			return m.updateRAGDebugSize(), nil
+		}
+	case llmResponseMsg:
+		// The answer is streamed while its retrieval is shown.
+		m, cmd := m.handleChatsResponse(msg)
+		return m.updateRAGDebugSize(), cmd
+	}
+
+	var cmd tea.Cmd
+	m.ragDebugViewport, cmd = m.ragDebugViewport.Update(msg)
+	return m, cmd
+}
+
+func (m mainModel) ragDebugView() string {
+	return lipgloss.JoinVertical(lipgloss.Left,
+		titleStyle.Render("Retrieval of the last question"),
+		m.ragDebugViewport.View(),
+		m.helpModel.View(m.keymap),
+	)
+}
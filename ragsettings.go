@@ -0,0 +1,670 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/charmbracelet/bubbles/key"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/huh"
+	"github.com/charmbracelet/lipgloss"
+)
+
+// ragSettings are the settings of the chunking and the retrieval of the
+// documents.
+type ragSettings struct {
+	// ChunkSize and ChunkOverlap are in tokens, they are used by the next
+	// scans of the documents.
+	ChunkSize    int `json:"chunkSize"`
+	ChunkOverlap int `json:"chunkOverlap"`
+	// MinChunkChars is the characters under which the last chunk of a file is
+	// merged into the previous one, and a file is skipped unless the document
+	// has nothing else. It's used by the next scans too, 0 keeps them all.
+	MinChunkChars int `json:"minChunkChars"`
+	// TableRowsPerChunk is the number of rows of the chunks of the tables, the
+	// CSV, TSV and spreadsheet files, defaultTableRowsPerChunk when it's not set. It's used
+	// by the next scans too.
+	TableRowsPerChunk int `json:"tableRowsPerChunk,omitempty"`
+	// MaxSpreadsheetCells is the cells over which a spreadsheet is skipped by
+	// the scans, defaultMaxSpreadsheetCells when it's not set.
+	MaxSpreadsheetCells int `json:"maxSpreadsheetCells,omitempty"`
+	// MaxFileMB is the size over which a file is skipped by the scans, except
+	// the recordings, defaultMaxFileMB when it's not set.
+	MaxFileMB int `json:"maxFileMB,omitempty"`
+	// MaxArchiveMB is the size over which an archive is skipped by the scans
+	// reading the archives, and the size of its files read from it,
+	// defaultMaxArchiveMB when it's not set.
+	MaxArchiveMB int `json:"maxArchiveMB,omitempty"`
+	// SkippedDirs are the globs of the names of the directories skipped along
+	// with the hidden files by the scans of the documents that skip them,
+	// defaultSkippedDirs when it's not set. It's not omitted when it's empty,
+	// as it skips none then.
+	SkippedDirs []string `json:"skippedDirs"`
+	// OCRBackend reads the text of the images of the documents with OCR on,
+	// ocrBackendTesseract when it's not set.
+	OCRBackend string `json:"ocrBackend,omitempty"`
+	// TranscriptionURL is the base URL of the OpenAI compatible transcription
+	// API of the recordings, e.g. a local whisper server. The OpenAI API of the
+	// first OpenAI provider is used when it's not set.
+	TranscriptionURL string `json:"transcriptionURL,omitempty"`
+	// TranscriptionModel is defaultTranscriptionModel when it's not set.
+	TranscriptionModel string `json:"transcriptionModel,omitempty"`
+	// MaxAudioMB is the size over which a recording is not transcribed,
+	// defaultMaxAudioMB when it's not set.
+	MaxAudioMB int `json:"maxAudioMB,omitempty"`
+	// ResultsCount is the number of chunks retrieved from each document, the
+	// ones below the SimilarityThreshold are left out.
+	ResultsCount        int     `json:"resultsCount"`
+	SimilarityThreshold float32 `json:"similarityThreshold"`
+	// NeededCount is the number of chunks of all the documents given to the
+	// LLM for a question.
+	NeededCount int `json:"neededCount"`
+	// SummarizeHistory replaces the oldest chats that don't fit in the context
+	// window with their summary, instead of leaving them out.
+	SummarizeHistory bool `json:"summarizeHistory"`
+	// ScanConcurrency is the number of files read at once by the scans, the
+	// number of CPUs when it's not set.
+	ScanConcurrency int `json:"scanConcurrency,omitempty"`
+	// EmbeddingConcurrency is the number of embedding requests sent at once by
+	// the scans, the ScanConcurrency when it's not set.
+	EmbeddingConcurrency int `json:"embeddingConcurrency,omitempty"`
+	// RetrievalStrategy is how the chunks of the documents are ranked for the
+	// prompt, retrievalStrategyGlobal when it's not set.
+	RetrievalStrategy string `json:"retrievalStrategy,omitempty"`
+	// MMRLambda weighs the similarity to the question against the difference
+	// from the chunks already taken for retrievalStrategyMMR, defaultMMRLambda
+	// when it's not set.
+	MMRLambda float32 `json:"mmrLambda,omitempty"`
+	// PromptTemplate is the system prompt of the questions about the
+	// documents, with the knowledge and filenames placeholders. The built-in
+	// defaultPromptTemplate is used when it's empty.
+	PromptTemplate string `json:"promptTemplate,omitempty"`
+	// AnswerLanguage is the code of the language of the answers about the
+	// documents and of the session titles, answerLanguageAuto when it's not
+	// set.
+	AnswerLanguage string `json:"answerLanguage,omitempty"`
+}
+
+const (
+	minChunkSize = 16
+	maxChunkSize = 8192
+
+	maxMinChunkChars = 1000
+
+	defaultTableRowsPerChunk = 20
+	maxTableRowsPerChunk     = 1000
+
+	defaultMaxSpreadsheetCells = 200000
+	maxMaxSpreadsheetCells     = 10000000
+
+	defaultMaxFileMB = 5
+	maxMaxFileMB     = 1024
+
+	maxRAGResultsCount = 100
+
+	maxScanConcurrency      = 128
+	maxEmbeddingConcurrency = 64
+)
+
+func defaultRAGSettings() ragSettings {
+	return ragSettings{
+		ChunkSize:           defaultChunkSize,
+		ChunkOverlap:        defaultChunkOverlap,
+		MinChunkChars:       defaultMinChunkChars,
+		ResultsCount:        defaultRAGResultsCount,
+		SimilarityThreshold: defaultRAGSimilarityThreshold,
+		NeededCount:         defaultRAGNeededCount,
+	}
+}
+
+func parseChunkSize(s string) (int, error) {
+	n, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || n < minChunkSize || n > maxChunkSize {
+		return 0, fmt.Errorf("invalid chunk size %q, use a number of tokens from %d to %d", s, minChunkSize, maxChunkSize)
+	}
+	return n, nil
+}
+
+// parseChunkOverlap parses the overlap, which must leave at least half of the
+// chunk new.
+func parseChunkOverlap(s string, chunkSize int) (int, error) {
+	n, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || n < 0 || n > chunkSize/2 {
+		return 0, fmt.Errorf("invalid chunk overlap %q, use a number of tokens from 0 to half of the chunk size (%d)", s, chunkSize/2)
+	}
+	return n, nil
+}
+
+func parseMinChunkChars(s string) (int, error) {
+	n, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || n < 0 || n > maxMinChunkChars {
+		return 0, fmt.Errorf("invalid minimum chunk characters %q, use a number from 0 to %d", s, maxMinChunkChars)
+	}
+	return n, nil
+}
+
+func parseTableRowsPerChunk(s string) (int, error) {
+	n, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || n < 1 || n > maxTableRowsPerChunk {
+		return 0, fmt.Errorf("invalid table rows per chunk %q, use a number from 1 to %d", s, maxTableRowsPerChunk)
+	}
+	return n, nil
+}
+
+func (s ragSettings) tableRowsPerChunk() int {
+	if s.TableRowsPerChunk == 0 {
+		return defaultTableRowsPerChunk
+	}
+	return s.TableRowsPerChunk
+}
+
+func parseMaxSpreadsheetCells(s string) (int, error) {
+	n, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || n < 1 || n > maxMaxSpreadsheetCells {
+		return 0, fmt.Errorf("invalid spreadsheet cell limit %q, use a number from 1 to %d", s, maxMaxSpreadsheetCells)
+	}
+	return n, nil
+}
+
+func (s ragSettings) maxSpreadsheetCells() int {
+	if s.MaxSpreadsheetCells == 0 {
+		return defaultMaxSpreadsheetCells
+	}
+	return s.MaxSpreadsheetCells
+}
+
+func parseMaxFileMB(s string) (int, error) {
+	n, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || n < 1 || n > maxMaxFileMB {
+		return 0, fmt.Errorf("invalid file size limit %q, use a number of MB from 1 to %d", s, maxMaxFileMB)
+	}
+	return n, nil
+}
+
+func (s ragSettings) maxFileMB() int {
+	if s.MaxFileMB == 0 {
+		return defaultMaxFileMB
+	}
+	return s.MaxFileMB
+}
+
+func parseMaxAudioMB(s string) (int, error) {
+	n, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || n < 1 || n > maxMaxAudioMB {
+		return 0, fmt.Errorf("invalid audio size limit %q, use a number of MB from 1 to %d", s, maxMaxAudioMB)
+	}
+	return n, nil
+}
+
+func parseTranscriptionURL(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return "", nil
+	}
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("invalid transcription URL %q, use an http or https URL like http://localhost:8000/v1", s)
+	}
+	return s, nil
+}
+
+func parseRAGResultsCount(s string) (int, error) {
+	n, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || n < 1 || n > maxRAGResultsCount {
+		return 0, fmt.Errorf("invalid results count %q, use a number from 1 to %d", s, maxRAGResultsCount)
+	}
+	return n, nil
+}
+
+// parseScanConcurrency parses the concurrency, empty leaves it to the number of
+// CPUs.
+func parseScanConcurrency(s string) (int, error) {
+	if strings.TrimSpace(s) == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || n < 1 || n > maxScanConcurrency {
+		return 0, fmt.Errorf("invalid scan concurrency %q, use a number from 1 to %d", s, maxScanConcurrency)
+	}
+	return n, nil
+}
+
+func (s ragSettings) scanConcurrency() int {
+	if s.ScanConcurrency > 0 {
+		return s.ScanConcurrency
+	}
+	return runtime.NumCPU()
+}
+
+// parseEmbeddingConcurrency parses the concurrency, empty leaves it to the
+// scan concurrency.
+func parseEmbeddingConcurrency(s string) (int, error) {
+	if strings.TrimSpace(s) == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || n < 1 || n > maxEmbeddingConcurrency {
+		return 0, fmt.Errorf("invalid embedding concurrency %q, use a number from 1 to %d", s, maxEmbeddingConcurrency)
+	}
+	return n, nil
+}
+
+func (s ragSettings) embeddingConcurrency() int {
+	if s.EmbeddingConcurrency > 0 {
+		return s.EmbeddingConcurrency
+	}
+	return s.scanConcurrency()
+}
+
+func (s ragSettings) retrievalStrategy() string {
+	if s.RetrievalStrategy == "" {
+		return retrievalStrategyGlobal
+	}
+	return s.RetrievalStrategy
+}
+
+// retrievalStrategyDescription describes the strategy in the options, with the
+// lambda of MMR.
+func (s ragSettings) retrievalStrategyDescription() string {
+	if s.retrievalStrategy() == retrievalStrategyMMR {
+		return fmt.Sprintf("by MMR with a lambda of %g", s.mmrLambda())
+	}
+	return s.retrievalStrategy()
+}
+
+func (s ragSettings) answerLanguage() string {
+	if s.AnswerLanguage == "" {
+		return answerLanguageAuto
+	}
+	return s.AnswerLanguage
+}
+
+// answerLanguageDescription describes the answer language in the options.
+func (s ragSettings) answerLanguageDescription() string {
+	if s.answerLanguage() == answerLanguageAuto {
+		return "the language of the question"
+	}
+	return answerLanguageName(s.answerLanguage())
+}
+
+func (s ragSettings) mmrLambda() float32 {
+	if s.MMRLambda == 0 {
+		return defaultMMRLambda
+	}
+	return s.MMRLambda
+}
+
+// parseMMRLambda parses the lambda, 0 would leave the question out of the
+// ranking.
+func parseMMRLambda(s string) (float32, error) {
+	f, err := strconv.ParseFloat(strings.TrimSpace(s), 32)
+	if err != nil || f <= 0 || f > 1 {
+		return 0, fmt.Errorf("invalid MMR lambda %q, use a number above 0 up to 1", s)
+	}
+	return float32(f), nil
+}
+
+func parseRAGNeededCount(s string) (int, error) {
+	n, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || n < 1 || n > maxRAGResultsCount {
+		return 0, fmt.Errorf("invalid prompt chunks %q, use a number from 1 to %d", s, maxRAGResultsCount)
+	}
+	return n, nil
+}
+
+func parseSimilarityThreshold(s string) (float32, error) {
+	f, err := strconv.ParseFloat(strings.TrimSpace(s), 32)
+	if err != nil || f < 0 || f > 1 {
+		return 0, fmt.Errorf("invalid similarity threshold %q, use a number from 0 to 1", s)
+	}
+	return float32(f), nil
+}
+
+func (m mainModel) newRAGSettingsForm() (mainModel, tea.Cmd) {
+	chunkSize := strconv.Itoa(m.ragSettings.ChunkSize)
+	chunkOverlap := strconv.Itoa(m.ragSettings.ChunkOverlap)
+	minChunkChars := strconv.Itoa(m.ragSettings.MinChunkChars)
+	tableRows := strconv.Itoa(m.ragSettings.tableRowsPerChunk())
+	maxCells := strconv.Itoa(m.ragSettings.maxSpreadsheetCells())
+	maxFile := strconv.Itoa(m.ragSettings.maxFileMB())
+	maxArchive := strconv.Itoa(m.ragSettings.maxArchiveMB())
+	skippedDirs := strings.Join(m.ragSettings.skippedDirs(), ", ")
+	ocrBackend := m.ragSettings.ocrBackend()
+	transcriptionURL := m.ragSettings.TranscriptionURL
+	transcriptionModel := m.ragSettings.transcriptionModel()
+	maxAudio := strconv.Itoa(m.ragSettings.maxAudioMB())
+	resultsCount := strconv.Itoa(m.ragSettings.ResultsCount)
+	neededCount := strconv.Itoa(m.ragSettings.NeededCount)
+	threshold := strconv.FormatFloat(float64(m.ragSettings.SimilarityThreshold), 'g', -1, 32)
+	summarize := m.ragSettings.SummarizeHistory
+	language := m.ragSettings.answerLanguage()
+	strategy := m.ragSettings.retrievalStrategy()
+	lambda := strconv.FormatFloat(float64(m.ragSettings.mmrLambda()), 'g', -1, 32)
+	scanConcurrency := ""
+	if m.ragSettings.ScanConcurrency > 0 {
+		scanConcurrency = strconv.Itoa(m.ragSettings.ScanConcurrency)
+	}
+	concurrency := ""
+	if m.ragSettings.EmbeddingConcurrency > 0 {
+		concurrency = strconv.Itoa(m.ragSettings.EmbeddingConcurrency)
+	}
+
+	m.ragSettingsForm = huh.NewForm(
+		huh.NewGroup(
+			huh.NewInput().
+				Key("ragChunkSize").
+				Title("Chunk Size").
+				Description("Tokens per chunk of the documents, smaller chunks suit code and larger ones prose. "+
+					"Used by the next scans.").
+				Validate(func(s string) error {
+					_, err := parseChunkSize(s)
+					return err
+				}).
+				Value(&chunkSize),
+			huh.NewInput().
+				Key("ragChunkOverlap").
+				Title("Chunk Overlap").
+				Description("Tokens a chunk repeats from the previous one. Used by the next scans.").
+				Validate(func(s string) error {
+					size, err := parseChunkSize(chunkSize)
+					if err != nil {
+						return nil
+					}
+					_, err = parseChunkOverlap(s, size)
+					return err
+				}).
+				Value(&chunkOverlap),
+			huh.NewInput().
+				Key("ragMinChunkChars").
+				Title("Minimum Chunk Characters").
+				Description("The last chunk of a file under this is merged into the previous one, and the files "+
+					"under this are skipped unless the document has nothing else. 0 keeps them. Used by the next scans.").
+				Validate(func(s string) error {
+					_, err := parseMinChunkChars(s)
+					return err
+				}).
+				Value(&minChunkChars),
+			huh.NewInput().
+				Key("ragTableRowsPerChunk").
+				Title("Table Rows Per Chunk").
+				Description("Rows of the CSV, TSV and spreadsheet files in a chunk, each chunk starts with their "+
+					"header row. Used by the next scans.").
+				Validate(func(s string) error {
+					_, err := parseTableRowsPerChunk(s)
+					return err
+				}).
+				Value(&tableRows),
+			huh.NewInput().
+				Key("ragMaxSpreadsheetCells").
+				Title("Spreadsheet Cell Limit").
+				Description("The spreadsheets with more cells than this are skipped by the scans, with a warning.").
+				Validate(func(s string) error {
+					_, err := parseMaxSpreadsheetCells(s)
+					return err
+				}).
+				Value(&maxCells),
+			huh.NewInput().
+				Key("ragMaxFileMB").
+				Title("File Size Limit").
+				Description("The files over this size in MB are skipped by the scans, with a warning. "+
+					"The recordings have their own limit.").
+				Validate(func(s string) error {
+					_, err := parseMaxFileMB(s)
+					return err
+				}).
+				Value(&maxFile),
+			huh.NewInput().
+				Key("ragMaxArchiveMB").
+				Title("Archive Size Limit").
+				Description("The archives over this size in MB are skipped by the documents indexing them, "+
+					"and their files are read up to this size in total.").
+				Validate(func(s string) error {
+					_, err := parseMaxArchiveMB(s)
+					return err
+				}).
+				Value(&maxArchive),
+			huh.NewInput().
+				Key("ragSkippedDirs").
+				Title("Skipped Directories").
+				Description("The comma-separated globs of the names of the directories skipped along with the "+
+					"hidden files by the scans, unless the document includes them. "+
+					fmt.Sprintf("Add to the list or empty it, the default is %s.", strings.Join(defaultSkippedDirs, ", "))).
+				Validate(func(s string) error {
+					_, err := parseSkippedDirs(s)
+					return err
+				}).
+				Value(&skippedDirs),
+			huh.NewSelect[string]().
+				Key("ragOCRBackend").
+				Title("OCR Backend").
+				Description("Reads the text of the images of the documents with OCR on. Tesseract must be "+
+					"installed, the vision model is the Convo LLM, an OpenAI, OpenAI compatible or Ollama model "+
+					"that accepts images.").
+				Options(
+					huh.NewOption("Tesseract", ocrBackendTesseract),
+					huh.NewOption("Vision model", ocrBackendVision),
+				).
+				Value(&ocrBackend),
+			huh.NewInput().
+				Key("ragTranscriptionURL").
+				Title("Transcription URL").
+				Description("The OpenAI compatible API that transcribes the recordings of the documents with the "+
+					"transcription on, e.g. a local whisper server. Leave it empty to use the OpenAI API of the "+
+					"OpenAI provider.").
+				Placeholder("http://localhost:8000/v1").
+				Validate(func(s string) error {
+					_, err := parseTranscriptionURL(s)
+					return err
+				}).
+				Value(&transcriptionURL),
+			huh.NewInput().
+				Key("ragTranscriptionModel").
+				Title("Transcription Model").
+				Description("The model of the transcription API.").
+				Placeholder(defaultTranscriptionModel).
+				Value(&transcriptionModel),
+			huh.NewInput().
+				Key("ragMaxAudioMB").
+				Title("Audio Size Limit").
+				Description("The recordings over this size in MB are skipped with a warning. "+
+					"The OpenAI API accepts up to 25 MB.").
+				Validate(func(s string) error {
+					_, err := parseMaxAudioMB(s)
+					return err
+				}).
+				Value(&maxAudio),
+			huh.NewInput().
+				Key("ragResultsCount").
+				Title("Results Count").
+				Description("Chunks retrieved from each document for a question.").
+				Validate(func(s string) error {
+					_, err := parseRAGResultsCount(s)
+					return err
+				}).
+				Value(&resultsCount),
+			huh.NewInput().
+				Key("ragSimilarityThreshold").
+				Title("Similarity Threshold").
+				Description("Chunks less similar to the question than this, from 0 to 1, are left out.").
+				Validate(func(s string) error {
+					_, err := parseSimilarityThreshold(s)
+					return err
+				}).
+				Value(&threshold),
+			huh.NewInput().
+				Key("ragNeededCount").
+				Title("Prompt Chunks").
+				Description("Chunks of all the documents given to the LLM for a question, fewer for the small "+
+					"context windows and more for the large ones.").
+				Validate(func(s string) error {
+					_, err := parseRAGNeededCount(s)
+					return err
+				}).
+				Value(&neededCount),
+			huh.NewSelect[string]().
+				Key("ragRetrievalStrategy").
+				Title("Retrieval Strategy").
+				Description("Global takes the chunks most similar to the question from all the documents. "+
+					"Balanced first takes an equal share of the prompt chunks from each document, so a large "+
+					"document doesn't crowd out a small one. MMR takes the chunks similar to the question but "+
+					"unlike the ones already taken, so the prompt doesn't repeat a section.").
+				Options(
+					huh.NewOption("Global", retrievalStrategyGlobal),
+					huh.NewOption("Balanced", retrievalStrategyBalanced),
+					huh.NewOption("MMR", retrievalStrategyMMR),
+				).
+				Value(&strategy),
+			huh.NewInput().
+				Key("ragMMRLambda").
+				Title("MMR Lambda").
+				Description("Only used by MMR, above 0 up to 1: 1 ranks the chunks by their similarity to the question "+
+					"alone, the lower values favor the chunks unlike the ones already taken.").
+				Validate(func(s string) error {
+					_, err := parseMMRLambda(s)
+					return err
+				}).
+				Value(&lambda),
+			huh.NewInput().
+				Key("ragScanConcurrency").
+				Title("Scan Concurrency").
+				Description("Files read at once by the scans, fewer for the spinning disks and the network mounts "+
+					"and more for the SSDs. Leave it empty to use the number of CPUs.").
+				Placeholder(strconv.Itoa(runtime.NumCPU())).
+				Validate(func(s string) error {
+					_, err := parseScanConcurrency(s)
+					return err
+				}).
+				Value(&scanConcurrency),
+			huh.NewInput().
+				Key("ragEmbeddingConcurrency").
+				Title("Embedding Concurrency").
+				Description("Embedding requests sent at once by the scans, fewer for the rate limited APIs and more "+
+					"for the local servers. Leave it empty to use the scan concurrency; the requests per minute are "+
+					"limited in the provider settings.").
+				Placeholder(strconv.Itoa(m.ragSettings.scanConcurrency())).
+				Validate(func(s string) error {
+					_, err := parseEmbeddingConcurrency(s)
+					return err
+				}).
+				Value(&concurrency),
+			huh.NewSelect[string]().
+				Key("ragAnswerLanguage").
+				Title("Answer Language").
+				Description("The language of the answers about the documents and of the session titles. "+
+					"Auto answers in the language of the question.").
+				Options(answerLanguageOptions()...).
+				Value(&language),
+			huh.NewConfirm().
+				Key("ragSummarizeHistory").
+				Title("Summarize History").
+				Description("Summarize the oldest chats of a long session with the Gen Title LLM, "+
+					"instead of leaving them out when they don't fit in the context window.").
+				Affirmative("Yes").
+				Negative("No").
+				Value(&summarize),
+			huh.NewConfirm().
+				Key("ragConfirm").
+				Title("Confirm").
+				Description("Save this RAG settings?").
+				Affirmative("Yes").
+				Negative("Back"),
+		),
+	).
+		WithWidth(m.formWidth).
+		WithHeight(m.formHeight).
+		WithTheme(huh.ThemeCatppuccin()).
+		WithKeyMap(m.keymap.formKeymap).
+		WithShowErrors(true).
+		WithShowHelp(true)
+
+	return m, m.ragSettingsForm.PrevField()
+}
+
+func (m mainModel) handleRAGSettingsFormEvents(msg tea.Msg) (mainModel, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.WindowSizeMsg:
+		m = m.updateFormSize()
+	case tea.KeyMsg:
+		if key.Matches(msg, m.keymap.escape) {
+			return m.setViewState(viewStateOptions), nil
+		}
+	}
+
+	form, cmd := m.ragSettingsForm.Update(msg)
+	if f, ok := form.(*huh.Form); ok {
+		m.ragSettingsForm = f
+	}
+
+	if m.ragSettingsForm.State != huh.StateCompleted {
+		return m, cmd
+	}
+
+	if !m.ragSettingsForm.GetBool("ragConfirm") {
+		return m.setViewState(viewStateOptions), nil
+	}
+
+	// The values are validated by the form.
+	settings := m.ragSettings
+	settings.ChunkSize, _ = parseChunkSize(m.ragSettingsForm.GetString("ragChunkSize"))
+	settings.ChunkOverlap, _ = parseChunkOverlap(m.ragSettingsForm.GetString("ragChunkOverlap"), settings.ChunkSize)
+	settings.MinChunkChars, _ = parseMinChunkChars(m.ragSettingsForm.GetString("ragMinChunkChars"))
+	settings.TableRowsPerChunk, _ = parseTableRowsPerChunk(m.ragSettingsForm.GetString("ragTableRowsPerChunk"))
+	settings.MaxSpreadsheetCells, _ = parseMaxSpreadsheetCells(m.ragSettingsForm.GetString("ragMaxSpreadsheetCells"))
+	settings.MaxFileMB, _ = parseMaxFileMB(m.ragSettingsForm.GetString("ragMaxFileMB"))
+	settings.MaxArchiveMB, _ = parseMaxArchiveMB(m.ragSettingsForm.GetString("ragMaxArchiveMB"))
+	settings.SkippedDirs, _ = parseSkippedDirs(m.ragSettingsForm.GetString("ragSkippedDirs"))
+	settings.OCRBackend = m.ragSettingsForm.GetString("ragOCRBackend")
+	settings.TranscriptionURL, _ = parseTranscriptionURL(m.ragSettingsForm.GetString("ragTranscriptionURL"))
+	settings.TranscriptionModel = strings.TrimSpace(m.ragSettingsForm.GetString("ragTranscriptionModel"))
+	settings.MaxAudioMB, _ = parseMaxAudioMB(m.ragSettingsForm.GetString("ragMaxAudioMB"))
+	settings.ResultsCount, _ = parseRAGResultsCount(m.ragSettingsForm.GetString("ragResultsCount"))
+	settings.SimilarityThreshold, _ = parseSimilarityThreshold(m.ragSettingsForm.GetString("ragSimilarityThreshold"))
+	settings.NeededCount, _ = parseRAGNeededCount(m.ragSettingsForm.GetString("ragNeededCount"))
+	settings.RetrievalStrategy = m.ragSettingsForm.GetString("ragRetrievalStrategy")
+	settings.MMRLambda, _ = parseMMRLambda(m.ragSettingsForm.GetString("ragMMRLambda"))
+	settings.SummarizeHistory = m.ragSettingsForm.GetBool("ragSummarizeHistory")
+	settings.AnswerLanguage = m.ragSettingsForm.GetString("ragAnswerLanguage")
+	settings.ScanConcurrency, _ = parseScanConcurrency(m.ragSettingsForm.GetString("ragScanConcurrency"))
+	settings.EmbeddingConcurrency, _ = parseEmbeddingConcurrency(m.ragSettingsForm.GetString("ragEmbeddingConcurrency"))
+
+	if err := saveRAGSettings(m.db, settings); err != nil {
+		m.err = fmt.Errorf("error saving rag settings: %w", err)
+		slog.Error(m.err.Error())
+		return m.updateFormSize(), nil
+	}
+
+	chunkingChanged := settings.ChunkSize != m.ragSettings.ChunkSize || settings.ChunkOverlap != m.ragSettings.ChunkOverlap ||
+		settings.MinChunkChars != m.ragSettings.MinChunkChars || settings.tableRowsPerChunk() != m.ragSettings.tableRowsPerChunk()
+	m.ragSettings = settings
+	if m.rag != nil {
+		m.rag.settings = settings
+	}
+
+	if chunkingChanged && m.hasScannedDocuments() {
+		m.err = errors.New("the chunk settings changed, rescan the documents with r in the documents list for them to take effect")
+	}
+
+	return m.initOptions().updateOptionsSize().setViewState(viewStateOptions), nil
+}
+
+func (m mainModel) hasScannedDocuments() bool {
+	for _, d := range m.documents {
+		if d.ScannedFileCount > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (m mainModel) ragSettingsFormView() string {
+	return lipgloss.JoinVertical(lipgloss.Left,
+		logoView(),
+		titleStyle.Render("RAG Settings"),
+		m.ragSettingsForm.View(),
+	)
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/huh"
+	"github.com/philippgille/chromem-go"
+)
+
+// rateLimitSettings are the optional rate limits of a provider, embedded in the
+// settings of the providers that have them.
+type rateLimitSettings struct {
+	RequestsPerMinute string `json:"requestsPerMinute,omitempty"`
+	TokensPerMinute   string `json:"tokensPerMinute,omitempty"`
+}
+
+// rateLimitedProvider is implemented by the providers with rate limit settings.
+type rateLimitedProvider interface {
+	rateLimits() rateLimitSettings
+}
+
+// rateLimiter limits the requests and the estimated tokens per minute, it is
+// shared by all the llms and embedders created from a provider, so the
+// document scans and the chats cooperate.
+type rateLimiter struct {
+	mu       sync.Mutex
+	requests *tokenBucket
+	tokens   *tokenBucket
+
+	requestsPerMinute int
+	tokensPerMinute   int
+}
+
+// tokenBucket refills its capacity over a minute.
+type tokenBucket struct {
+	capacity  float64
+	available float64
+	last      time.Time
+}
+
+// rateLimitedLLM waits for the rate limiter of its provider before every chat.
+type rateLimitedLLM struct {
+	llm
+
+	limiter *rateLimiter
+}
+
+// rateLimitedEmbedder waits for the rate limiter of its provider before every
+// embedding request.
+type rateLimitedEmbedder struct {
+	embedder
+
+	limiter *rateLimiter
+}
+
+// rateLimitedBatchEmbedder is the rateLimitedEmbedder of a batchEmbedder, it
+// waits before the batches as well.
+type rateLimitedBatchEmbedder struct {
+	rateLimitedEmbedder
+
+	batch batchEmbedder
+}
+
+type rateLimitNotifyKey struct{}
+
+// providerRateLimiters holds the rate limiters of the providers, keyed by the
+// provider name.
+var providerRateLimiters = struct {
+	sync.Mutex
+	limiters map[string]*rateLimiter
+}{
+	limiters: make(map[string]*rateLimiter),
+}
+
+func (s rateLimitSettings) rateLimits() rateLimitSettings {
+	return s
+}
+
+// rateLimitSettingsFromForm returns the rate limit settings of the form fields
+// with the given key prefix.
+func rateLimitSettingsFromForm(form *huh.Form, prefix string) rateLimitSettings {
+	return rateLimitSettings{
+		RequestsPerMinute: form.GetString(prefix + "RequestsPerMinute"),
+		TokensPerMinute:   form.GetString(prefix + "TokensPerMinute"),
+	}
+}
+
+// requestsPerMinuteField returns the optional requests per minute input of a
+// provider form.
+func requestsPerMinuteField(prefix string, value *string) *huh.Input {
+	return huh.NewInput().
+		Key(prefix + "RequestsPerMinute").
+		Title("Requests Per Minute").
+		Description("Optional limit of the requests sent per minute, shared by the chats and the document scans.").
+		Placeholder("Unlimited").
+		Validate(func(s string) error {
+			_, err := parseRateLimit(s)
+			return err
+		}).
+		Value(value)
+}
+
+// tokensPerMinuteField returns the optional tokens per minute input of a
+// provider form.
+func tokensPerMinuteField(prefix string, value *string) *huh.Input {
+	return huh.NewInput().
+		Key(prefix + "TokensPerMinute").
+		Title("Tokens Per Minute").
+		Description("Optional limit of the estimated input tokens sent per minute.").
+		Placeholder("Unlimited").
+		Validate(func(s string) error {
+			_, err := parseRateLimit(s)
+			return err
+		}).
+		Value(value)
+}
+
+// parseRateLimit parses a per minute limit, an empty value is no limit.
+func parseRateLimit(s string) (int, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+
+	n, err := strconv.Atoi(s)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid limit %q, use a positive number or leave it empty", s)
+	}
+	return n, nil
+}
+
+// providerRateLimiter returns the rate limiter of the provider, nil when it has
+// no limits. The limiter is reused while the limits don't change, so the llms
+// and embedders created from the provider share it.
+func providerRateLimiter(p llmProvider) *rateLimiter {
+	r, ok := p.(rateLimitedProvider)
+	if !ok {
+		return nil
+	}
+
+	settings := r.rateLimits()
+	// The limits are validated by the form, invalid ones are ignored.
+	requests, _ := parseRateLimit(settings.RequestsPerMinute)
+	tokens, _ := parseRateLimit(settings.TokensPerMinute)
+
+	providerRateLimiters.Lock()
+	defer providerRateLimiters.Unlock()
+
+	if requests == 0 && tokens == 0 {
+		delete(providerRateLimiters.limiters, p.name())
+		return nil
+	}
+
+	l, ok := providerRateLimiters.limiters[p.name()]
+	if ok && l.requestsPerMinute == requests && l.tokensPerMinute == tokens {
+		return l
+	}
+
+	l = newRateLimiter(requests, tokens)
+	providerRateLimiters.limiters[p.name()] = l
+	return l
+}
+
+func newRateLimiter(requestsPerMinute, tokensPerMinute int) *rateLimiter {
+	return &rateLimiter{
+		requests:          newTokenBucket(requestsPerMinute),
+		tokens:            newTokenBucket(tokensPerMinute),
+		requestsPerMinute: requestsPerMinute,
+		tokensPerMinute:   tokensPerMinute,
+	}
+}
+
+// newTokenBucket returns a full bucket of the given capacity, nil for no limit.
+func newTokenBucket(perMinute int) *tokenBucket {
+	if perMinute == 0 {
+		return nil
+	}
+	return &tokenBucket{
+		capacity:  float64(perMinute),
+		available: float64(perMinute),
+		last:      time.Now(),
+	}
+}
+
+// reserve takes n from the bucket if it has them, or else returns how long to
+// wait until it does. A request larger than the capacity only waits for the
+// full bucket, as it would never fit otherwise.
+func (b *tokenBucket) reserve(now time.Time, n float64) time.Duration {
+	if b == nil {
+		return 0
+	}
+
+	b.available = min(b.capacity, b.available+now.Sub(b.last).Minutes()*b.capacity)
+	b.last = now
+
+	n = min(n, b.capacity)
+	if b.available >= n {
+		return 0
+	}
+	return time.Duration((n - b.available) / b.capacity * float64(time.Minute))
+}
+
+func (b *tokenBucket) take(n float64) {
+	if b != nil {
+		b.available -= min(n, b.capacity)
+	}
+}
+
+// withRateLimitNotify returns a context that calls notify with the delay every
+// time a request has to wait for the rate limit.
+func withRateLimitNotify(ctx context.Context, notify func(time.Duration)) context.Context {
+	return context.WithValue(ctx, rateLimitNotifyKey{}, notify)
+}
+
+// wait blocks until the request with the estimated tokens fits in the limits.
+func (l *rateLimiter) wait(ctx context.Context, tokens int) error {
+	for {
+		l.mu.Lock()
+		now := time.Now()
+		delay := max(l.requests.reserve(now, 1), l.tokens.reserve(now, float64(tokens)))
+		if delay == 0 {
+			l.requests.take(1)
+			l.tokens.take(float64(tokens))
+			l.mu.Unlock()
+			return nil
+		}
+		l.mu.Unlock()
+
+		if notify, ok := ctx.Value(rateLimitNotifyKey{}).(func(time.Duration)); ok {
+			notify(delay)
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// estimateTokens estimates the tokens of the texts from their length, the same
+// way the chunks are checked against the context of the embedding model.
+func estimateTokens(texts ...string) int {
+	n := 0
+	for _, t := range texts {
+		n += len(t)
+	}
+	return (n + tokenEstimateBytes - 1) / tokenEstimateBytes
+}
+
+func chatsTokens(chats []chat) int {
+	texts := make([]string, len(chats))
+	for i, c := range chats {
+		texts[i] = c.Content
+	}
+	return estimateTokens(texts...)
+}
+
+func (r rateLimitedLLM) chat(ctx context.Context, chats []chat) llmResponse {
+	if err := r.limiter.wait(ctx, chatsTokens(chats)); err != nil {
+		return llmResponse{
+			err: fmt.Errorf("error waiting for the rate limit: %w", err),
+		}
+	}
+	return r.llm.chat(ctx, chats)
+}
+
+func (r rateLimitedLLM) chatStream(ctx context.Context, chats []chat) <-chan llmResponse {
+	responseChan := make(chan llmResponse)
+
+	go func() {
+		defer close(responseChan)
+
+		if err := r.limiter.wait(ctx, chatsTokens(chats)); err != nil {
+			if errors.Is(err, context.Canceled) {
+				return
+			}
+			responseChan <- llmResponse{
+				err: fmt.Errorf("error waiting for the rate limit: %w", err),
+			}
+			return
+		}
+
+		for res := range r.llm.chatStream(ctx, chats) {
+			responseChan <- res
+		}
+	}()
+
+	return responseChan
+}
+
+// newRateLimitedEmbedder wraps the embedder, keeping it a batchEmbedder when it
+// is one.
+func newRateLimitedEmbedder(e embedder, limiter *rateLimiter) embedder {
+	r := rateLimitedEmbedder{embedder: e, limiter: limiter}
+	if b, ok := e.(batchEmbedder); ok {
+		return rateLimitedBatchEmbedder{rateLimitedEmbedder: r, batch: b}
+	}
+	return r
+}
+
+func (r rateLimitedEmbedder) embeddingFunc() chromem.EmbeddingFunc {
+	embed := r.embedder.embeddingFunc()
+
+	return func(ctx context.Context, text string) ([]float32, error) {
+		if err := r.limiter.wait(ctx, estimateTokens(text)); err != nil {
+			return nil, fmt.Errorf("error waiting for the rate limit: %w", err)
+		}
+		return embed(ctx, text)
+	}
+}
+
+// embeddingContextLength returns the context length of the wrapped embedder, if
+// it knows it.
+func (r rateLimitedEmbedder) embeddingContextLength(ctx context.Context) (int, error) {
+	if c, ok := r.embedder.(contextLimitedEmbedder); ok {
+		return c.embeddingContextLength(ctx)
+	}
+	return 0, nil
+}
+
+func (r rateLimitedBatchEmbedder) embedBatch(ctx context.Context, texts []string) ([][]float32, error) {
+	if err := r.limiter.wait(ctx, estimateTokens(texts...)); err != nil {
+		return nil, fmt.Errorf("error waiting for the rate limit: %w", err)
+	}
+	return r.batch.embedBatch(ctx, texts)
+}
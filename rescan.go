@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/philippgille/chromem-go"
+)
+
+// fileState is a scanned file, the file isn't read again by the next scan when
+// its modification time and size are the same.
+type fileState struct {
+	Hash    string    `json:"hash"`
+	ModTime time.Time `json:"modTime"`
+	Size    int64     `json:"size"`
+}
+
+// scannedFile is a file found by a scan, the content of the unchanged ones is
+// not read.
+type scannedFile struct {
+	doc       chromem.Document
+	sections  []extractedSection
+	state     fileState
+	unchanged bool
+}
+
+// unchangedSince reports whether the file has the modification time and the
+// size of its previous state.
+func unchangedSince(info os.FileInfo, previous fileState) bool {
+	return previous.Hash != "" && !previous.ModTime.IsZero() &&
+		previous.ModTime.Equal(info.ModTime()) && previous.Size == info.Size()
+}
+
+// scanCounts are the files of a rescan by how they changed since the last
+// scan.
+type scanCounts struct {
+	unchanged int
+	updated   int
+	added     int
+	removed   int
+}
+
+func (c scanCounts) String() string {
+	return fmt.Sprintf("%s unchanged, %s updated, %s new, %s removed",
+		formatCount(c.unchanged), formatCount(c.updated), formatCount(c.added), formatCount(c.removed))
+}
+
+// scanExclusions counts the paths left out by a scan, they are set by the walk
+// of the files before the scanned files are closed. The binary files are
+// counted by the readers of the files.
+type scanExclusions struct {
+	ignoredFiles   int
+	ignoredDirs    int
+	oversizedFiles int
+	hiddenFiles    int
+	hiddenDirs     int
+	binaryFiles    atomic.Int64
+	// oversizedEntries are the files of the archives over the size limits,
+	// counted by the readers of the archives.
+	oversizedEntries atomic.Int64
+	// brokenLinks are the links without a target, skippedLinks the links to
+	// the directories that are not followed or already scanned.
+	brokenLinks  int
+	skippedLinks int
+	failures     scanFailures
+}
+
+// scanFailures are the files a scan failed to read, the scan goes on without
+// them. They are added by the walk and the readers of the files.
+type scanFailures struct {
+	mu    sync.Mutex
+	files []string
+}
+
+// maxListedFailures is the number of failed files named by the scan log, the
+// document keeps them all.
+const maxListedFailures = 5
+
+func (f *scanFailures) add(path string, err error) {
+	// The path errors repeat the path.
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		err = pathErr.Err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.files = append(f.files, fmt.Sprintf("%s (%s)", path, err))
+}
+
+// list returns the failed files with their error, sorted.
+func (f *scanFailures) list() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Sorted(slices.Values(f.files))
+}
+
+// formatFailures summarizes the failed files for the scan log, like
+// "3 files failed: a.md (permission denied), …".
+func formatFailures(failed []string) string {
+	listed := failed[:min(len(failed), maxListedFailures)]
+	s := fmt.Sprintf("%s failed: %s", formatFileCount(len(failed)), strings.Join(listed, ", "))
+	if more := len(failed) - len(listed); more > 0 {
+		s += fmt.Sprintf(" and %s more", formatCount(more))
+	}
+	return s
+}
+
+func (e *scanExclusions) String() string {
+	var parts []string
+	if e.ignoredFiles > 0 || e.ignoredDirs > 0 {
+		parts = append(parts, fmt.Sprintf("%s files and %s directories excluded by the ignore rules",
+			formatCount(e.ignoredFiles), formatCount(e.ignoredDirs)))
+	}
+	if e.hiddenFiles > 0 || e.hiddenDirs > 0 {
+		parts = append(parts, fmt.Sprintf("%s hidden files and %s hidden or dependency directories skipped",
+			formatCount(e.hiddenFiles), formatCount(e.hiddenDirs)))
+	}
+	if n := e.oversizedFiles + int(e.oversizedEntries.Load()); n > 0 {
+		parts = append(parts, fmt.Sprintf("%s oversized files skipped", formatCount(n)))
+	}
+	if n := e.binaryFiles.Load(); n > 0 {
+		parts = append(parts, fmt.Sprintf("%s binary files skipped", formatCount(int(n))))
+	}
+	if e.brokenLinks > 0 {
+		parts = append(parts, fmt.Sprintf("%s broken links skipped", formatCount(e.brokenLinks)))
+	}
+	if e.skippedLinks > 0 {
+		parts = append(parts, fmt.Sprintf("%s linked directories skipped", formatCount(e.skippedLinks)))
+	}
+	if n := len(e.failures.list()); n > 0 {
+		parts = append(parts, fmt.Sprintf("%s failed", formatFileCount(n)))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// formatFileCount formats the number of files, like "1 file" or "4,990 files".
+func formatFileCount(n int) string {
+	if n == 1 {
+		return "1 file"
+	}
+	return formatCount(n) + " files"
+}
+
+func contentHash(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+// formatCount formats the number with thousands separators, like 4,990.
+func formatCount(n int) string {
+	s := strconv.Itoa(n)
+	start := 0
+	if n < 0 {
+		start = 1
+	}
+	for i := len(s) - 3; i > start; i -= 3 {
+		s = s[:i] + "," + s[i:]
+	}
+	return s
+}
+
+// deleteFileChunks deletes the chunks of the file from the collection, the
+// file itself when it wasn't chunked.
+func deleteFileChunks(ctx context.Context, coll *chromem.Collection, path string) error {
+	if err := coll.Delete(ctx, map[string]string{"originalID": path}, nil); err != nil {
+		return err
+	}
+	return coll.Delete(ctx, nil, nil, path)
+}
+
+// scannedWith reports whether the last scan of the document used the embedder
+// and the chunk settings, so the chunks of its unchanged files can be kept.
+func (d document) scannedWith(embedder llmSetting, settings ragSettings) bool {
+	return d.EmbedderProvider == embedder.Provider && d.EmbedderModel == embedder.Model &&
+		d.ChunkSize == settings.ChunkSize && d.ChunkOverlap == settings.ChunkOverlap &&
+		d.MinChunkChars == settings.MinChunkChars && d.tableRowsPerChunk() == settings.tableRowsPerChunk()
+}
+
+// tableRowsPerChunk returns the rows per chunk of the tables of the last scan,
+// the default ones for the scans before the setting.
+func (d document) tableRowsPerChunk() int {
+	if d.TableRowsPerChunk == 0 {
+		return defaultTableRowsPerChunk
+	}
+	return d.TableRowsPerChunk
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// retrievalFilter narrows the chunks retrieved for the questions of a session
+// to the files with an extension or under a path of the documents, and leaves
+// out the files matching its exclusions.
+type retrievalFilter struct {
+	Ext  string `json:"ext,omitempty"`
+	Path string `json:"path,omitempty"`
+	// Exclude are file names, paths relative to the documents or patterns of
+	// them, like "CHANGELOG.md", "vendor/" or "*.lock".
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+const (
+	filterCommand  = "/filter"
+	excludeCommand = "/exclude"
+)
+
+// parseRetrievalFilter parses the terms of the filter command, like
+// "ext:md path:docs/". No terms clear the filter.
+func parseRetrievalFilter(s string) (retrievalFilter, error) {
+	var f retrievalFilter
+	for _, term := range strings.Fields(s) {
+		name, value, ok := strings.Cut(term, ":")
+		if !ok || value == "" {
+			return retrievalFilter{}, fmt.Errorf("invalid filter %q, use ext:<extension> or path:<path>", term)
+		}
+		switch strings.ToLower(name) {
+		case "ext":
+			f.Ext = strings.ToLower(strings.TrimPrefix(value, "."))
+		case "path":
+			f.Path = strings.TrimPrefix(path.Clean("/"+value), "/")
+			if strings.HasSuffix(value, "/") && f.Path != "" {
+				f.Path += "/"
+			}
+		default:
+			return retrievalFilter{}, fmt.Errorf("unknown filter %q, use ext:<extension> or path:<path>", name)
+		}
+	}
+	return f, nil
+}
+
+func (f retrievalFilter) String() string {
+	var terms []string
+	if f.Ext != "" {
+		terms = append(terms, "ext:"+f.Ext)
+	}
+	if f.Path != "" {
+		terms = append(terms, "path:"+f.Path)
+	}
+	if len(f.Exclude) > 0 {
+		terms = append(terms, "exclude:"+strings.Join(f.Exclude, ","))
+	}
+	return strings.Join(terms, " ")
+}
+
+// parseExclusions parses the terms of the exclude command, added to the
+// exclusions. No terms clear them.
+func parseExclusions(s string, exclusions []string) ([]string, error) {
+	terms := strings.Fields(s)
+	if len(terms) == 0 {
+		return nil, nil
+	}
+
+	res := slices.Clone(exclusions)
+	for _, term := range terms {
+		term = strings.TrimPrefix(filepath.ToSlash(term), "./")
+		if _, err := path.Match(strings.TrimSuffix(term, "/"), ""); err != nil {
+			return nil, fmt.Errorf("invalid exclusion %q: %w", term, err)
+		}
+		if !slices.Contains(res, term) {
+			res = append(res, term)
+		}
+	}
+	return res, nil
+}
+
+// afterQuery reports whether the chunks are filtered after the query, so all
+// the chunks must be ranked.
+func (f retrievalFilter) afterQuery() bool {
+	return f.Path != "" || len(f.Exclude) > 0
+}
+
+// where returns the metadata filter of chromem-go for the extension, the path
+// is matched by matchesPath as chromem-go only matches whole values.
+func (f retrievalFilter) where() map[string]string {
+	if f.Ext == "" {
+		return nil
+	}
+	return map[string]string{"ext": f.Ext}
+}
+
+// matchesPath reports whether the chunk is in a file under the path of the
+// filter, relative to its document, and not excluded.
+func (f retrievalFilter) matchesPath(metadata map[string]string) bool {
+	if f.Path != "" && !strings.HasPrefix(metadata["path"], f.Path) {
+		return false
+	}
+	for _, e := range f.Exclude {
+		if excludes(e, metadata) {
+			return false
+		}
+	}
+	return true
+}
+
+// excludes reports whether the exclusion matches the file of the chunk, by its
+// name or its path, ignoring the case. An exclusion ending with a slash
+// matches the files under the path.
+func excludes(exclusion string, metadata map[string]string) bool {
+	exclusion = strings.ToLower(exclusion)
+	name := strings.ToLower(metadata["filename"])
+	rel := strings.ToLower(metadata["path"])
+
+	if dir, ok := strings.CutSuffix(exclusion, "/"); ok {
+		return strings.HasPrefix(rel, dir+"/") || slices.Contains(strings.Split(path.Dir(rel), "/"), dir)
+	}
+	if name == exclusion || rel == exclusion {
+		return true
+	}
+	if ok, _ := path.Match(exclusion, name); ok {
+		return true
+	}
+	ok, _ := path.Match(exclusion, rel)
+	return ok
+}
+
+// handleFilterCommand sets the retrieval filter of the selected session from
+// the filter command, or its exclusions from the exclude command, for its next
+// questions.
+func (m mainModel) handleFilterCommand(msg string) (mainModel, tea.Cmd) {
+	selectedSession := m.sessions[m.selectedSessionIndex]
+	filter := selectedSession.RetrievalFilter
+
+	command, terms, _ := strings.Cut(strings.TrimSpace(msg), " ")
+	var err error
+	if command == excludeCommand {
+		filter.Exclude, err = parseExclusions(terms, filter.Exclude)
+	} else {
+		var f retrievalFilter
+		f, err = parseRetrievalFilter(terms)
+		filter.Ext, filter.Path = f.Ext, f.Path
+	}
+	if err != nil {
+		m.err = err
+		return m.updateChatSize(), nil
+	}
+
+	selectedSession.RetrievalFilter = filter
+	if err := saveSession(m.db, &selectedSession); err != nil {
+		m.err = fmt.Errorf("error saving session: %w", err)
+		slog.Error(m.err.Error())
+		return m.updateChatSize(), nil
+	}
+	m.sessions[m.selectedSessionIndex] = selectedSession
+	m.sessionList.SetItem(m.selectedSessionIndex, selectedSession)
+
+	m.err = nil
+	m.chatTextArea.Reset()
+	return m.updateChatSize(), nil
+}
+
+// isFilterCommand reports whether the message is the filter or the exclude
+// command instead of a question.
+func isFilterCommand(msg string) bool {
+	fields := strings.Fields(msg)
+	return len(fields) > 0 && (fields[0] == filterCommand || fields[0] == excludeCommand)
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/ollama/ollama/api"
+	"github.com/philippgille/chromem-go"
+	goopenai "github.com/sashabaranov/go-openai"
+)
+
+// retryingLLM retries the chats of the wrapped llm on rate limits and transient
+// errors. A stream is only retried before any of its content is received.
+type retryingLLM struct {
+	llm
+}
+
+// retryingEmbedder retries the embedding requests of the wrapped embedder on
+// rate limits and transient errors, so a document scan isn't aborted by them.
+type retryingEmbedder struct {
+	embedder
+}
+
+// retryingBatchEmbedder is the retryingEmbedder of a batchEmbedder, it retries
+// the batches as well.
+type retryingBatchEmbedder struct {
+	retryingEmbedder
+
+	batch batchEmbedder
+}
+
+const (
+	maxRetryAttempts = 3
+	retryBaseDelay   = time.Second
+	retryMaxDelay    = 30 * time.Second
+)
+
+func (r retryingLLM) chat(ctx context.Context, chats []chat) llmResponse {
+	var res llmResponse
+	for attempt := 1; ; attempt++ {
+		res = r.llm.chat(ctx, chats)
+		if !shouldRetry(ctx, res.err, attempt) {
+			return res
+		}
+		if err := waitRetry(ctx, res.err, attempt); err != nil {
+			return res
+		}
+	}
+}
+
+func (r retryingLLM) chatStream(ctx context.Context, chats []chat) <-chan llmResponse {
+	responseChan := make(chan llmResponse)
+
+	go func() {
+		defer close(responseChan)
+
+		for attempt := 1; ; attempt++ {
+			stream := r.llm.chatStream(ctx, chats)
+
+			first, ok := <-stream
+			if !ok {
+				return
+			}
+			if shouldRetry(ctx, first.err, attempt) {
+				// Drain the failed stream so its goroutine can finish.
+				for range stream {
+				}
+				if err := waitRetry(ctx, first.err, attempt); err == nil {
+					continue
+				}
+			}
+
+			responseChan <- first
+			for res := range stream {
+				responseChan <- res
+			}
+			return
+		}
+	}()
+
+	return responseChan
+}
+
+func (r retryingEmbedder) embeddingFunc() chromem.EmbeddingFunc {
+	embed := r.embedder.embeddingFunc()
+
+	return func(ctx context.Context, text string) ([]float32, error) {
+		for attempt := 1; ; attempt++ {
+			v, err := embed(ctx, text)
+			if !shouldRetry(ctx, err, attempt) {
+				return v, err
+			}
+			if err := waitRetry(ctx, err, attempt); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// embeddingContextLength returns the context length of the wrapped embedder, if
+// it knows it.
+func (r retryingEmbedder) embeddingContextLength(ctx context.Context) (int, error) {
+	if c, ok := r.embedder.(contextLimitedEmbedder); ok {
+		return c.embeddingContextLength(ctx)
+	}
+	return 0, nil
+}
+
+func (r retryingBatchEmbedder) embedBatch(ctx context.Context, texts []string) ([][]float32, error) {
+	for attempt := 1; ; attempt++ {
+		vs, err := r.batch.embedBatch(ctx, texts)
+		if !shouldRetry(ctx, err, attempt) {
+			return vs, err
+		}
+		if err := waitRetry(ctx, err, attempt); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func shouldRetry(ctx context.Context, err error, attempt int) bool {
+	if err == nil || attempt >= maxRetryAttempts || ctx.Err() != nil {
+		return false
+	}
+	return isRetryableError(err)
+}
+
+// waitRetry waits before the next attempt, for as long as the server asked in
+// its Retry-After header or else with an exponential backoff and jitter.
+func waitRetry(ctx context.Context, err error, attempt int) error {
+	delay := retryBaseDelay << (attempt - 1)
+	delay += time.Duration(rand.Int64N(int64(delay)))
+
+	var statusErr *httpStatusError
+	if errors.As(err, &statusErr) && statusErr.RetryAfter > 0 {
+		delay = statusErr.RetryAfter
+	}
+	delay = min(delay, retryMaxDelay)
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// isRetryableError reports whether the error is a connection error or a rate
+// limit or server error response, which may succeed when sent again.
+func isRetryableError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	if code, ok := errorStatusCode(err); ok {
+		return code == http.StatusTooManyRequests || code >= 500
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// errorStatusCode returns the HTTP status code of the error, for the error
+// types of the clients used by the providers.
+func errorStatusCode(err error) (int, bool) {
+	var statusErr *httpStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode, true
+	}
+
+	var apiErr *goopenai.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.HTTPStatusCode, true
+	}
+
+	var reqErr *goopenai.RequestError
+	if errors.As(err, &reqErr) {
+		return reqErr.HTTPStatusCode, true
+	}
+
+	var ollamaErr api.StatusError
+	if errors.As(err, &ollamaErr) {
+		return ollamaErr.StatusCode, true
+	}
+
+	// The AWS SDK and the Anthropic stream errors expose the status code
+	// through this method.
+	var awsErr interface{ HTTPStatusCode() int }
+	if errors.As(err, &awsErr) {
+		return awsErr.HTTPStatusCode(), true
+	}
+
+	return 0, false
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/lipgloss"
+)
+
+const (
+	// scanProgressInterval is the time between the progress updates of the
+	// files read by a scan.
+	scanProgressInterval = 100 * time.Millisecond
+
+	scanProgressBarWidth = 30
+)
+
+var (
+	scanProgressFilledStyle = lipgloss.NewStyle().
+				Foreground(lipgloss.AdaptiveColor{Light: "#7287fd", Dark: "#b4befe"}) // Lavender
+	scanProgressEmptyStyle = lipgloss.NewStyle().
+				Foreground(lipgloss.AdaptiveColor{Light: "#9ca0b0", Dark: "#6c7086"}) // Overlay0
+)
+
+// walkedFile is a file listed by the walk of a document, to be read.
+type walkedFile struct {
+	path string
+	info os.FileInfo
+}
+
+// scanProgress is the progress of a scan, the files read and then the chunks
+// embedded. Each phase fills half of the bar.
+type scanProgress struct {
+	filesRead      int
+	filesTotal     int
+	chunksEmbedded int
+	chunksTotal    int
+	// filesStart and chunksStart are the start times of the phases, for their
+	// time left.
+	filesStart  time.Time
+	chunksStart time.Time
+	done        bool
+}
+
+// update records the counts of the log message, the ones that have some.
+func (p scanProgress) update(msg documentScanLogMsg) scanProgress {
+	if msg.filesTotal > 0 || msg.filesRead > 0 {
+		p.filesRead, p.filesTotal = msg.filesRead, msg.filesTotal
+	}
+	if msg.chunksTotal > 0 {
+		if p.chunksTotal == 0 {
+			p.chunksStart = time.Now()
+		}
+		p.chunksEmbedded, p.chunksTotal = msg.chunksEmbedded, msg.chunksTotal
+	}
+	if msg.done {
+		p.done = true
+	}
+	return p
+}
+
+// fraction is the part of the scan that is done, from 0 to 1.
+func (p scanProgress) fraction() float64 {
+	switch {
+	case p.done:
+		return 1
+	case p.chunksTotal > 0:
+		return 0.5 + 0.5*float64(p.chunksEmbedded)/float64(p.chunksTotal)
+	case p.filesTotal > 0:
+		return 0.5 * float64(p.filesRead) / float64(p.filesTotal)
+	}
+	return 0
+}
+
+// View renders the bar with the counts of the current phase and its time left,
+// like "312/2,410 files · 13% · ETA 4m0s".
+func (p scanProgress) View() string {
+	filled := int(p.fraction() * scanProgressBarWidth)
+	bar := scanProgressFilledStyle.Render(strings.Repeat("█", filled)) +
+		scanProgressEmptyStyle.Render(strings.Repeat("░", scanProgressBarWidth-filled))
+
+	parts := []string{fmt.Sprintf("%s/%s files", formatCount(p.filesRead), formatCount(p.filesTotal))}
+	if p.filesTotal == 0 {
+		// The pages of a website are not known before they are crawled.
+		parts[0] = formatFileCount(p.filesRead)
+	}
+	done, total, start := p.filesRead, p.filesTotal, p.filesStart
+	if p.chunksTotal > 0 {
+		parts = append(parts, fmt.Sprintf("%s/%s chunks", formatCount(p.chunksEmbedded), formatCount(p.chunksTotal)))
+		done, total, start = p.chunksEmbedded, p.chunksTotal, p.chunksStart
+	}
+	parts = append(parts, fmt.Sprintf("%d%%", int(p.fraction()*100)))
+	if !p.done && done > 0 && done < total {
+		eta := time.Since(start) * time.Duration(total-done) / time.Duration(done)
+		parts = append(parts, "ETA "+eta.Round(time.Second).String())
+	}
+	return bar + " " + strings.Join(parts, " · ")
+}
@@ -18,6 +18,14 @@ type session struct {
 	Created time.Time `json:"created"`
 
 	Chats []chat `json:"chats"`
+	// RetrievalFilter narrows the documents searched for the questions.
+	RetrievalFilter retrievalFilter `json:"retrievalFilter"`
+	// PlainChat sends the conversation without searching the documents.
+	PlainChat bool `json:"plainChat,omitempty"`
+	// Summary sums up the SummarizedCount oldest chats, it's sent in place of
+	// them when the history is summarized. The chats are kept.
+	Summary         string `json:"summary,omitempty"`
+	SummarizedCount int    `json:"summarizedCount,omitempty"`
 }
 
 func (m mainModel) initSessions() (mainModel, error) {
@@ -114,7 +122,7 @@ func (m mainModel) newSession() (mainModel, tea.Cmd) {
 
 func (m mainModel) selectSession(index int) mainModel {
 	m.selectedSessionIndex = index
-	m.rag.clearChats()
+	m.rag.loadChats(m.sessions[index])
 
 	m.chatTextArea.Reset()
 	m.chatTextArea.Focus()
@@ -145,7 +153,17 @@ func (s session) Title() string {
 }
 
 func (s session) Description() string {
-	return s.Created.Format(time.RFC1123)
+	var promptTokens, completionTokens int
+	for _, c := range s.Chats {
+		promptTokens += c.PromptTokens
+		completionTokens += c.CompletionTokens
+	}
+
+	created := s.Created.Format(time.RFC1123)
+	if promptTokens == 0 && completionTokens == 0 {
+		return created
+	}
+	return created + " " + formatTokenUsage(promptTokens, completionTokens)
 }
 
 func (s session) FilterValue() string {
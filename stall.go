@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// stallingLLM cancels a stream of the wrapped llm when it sends nothing for the
+// timeout, e.g. when a proxy drops the connection without closing it, so the
+// chat doesn't wait for it forever.
+type stallingLLM struct {
+	llm
+
+	timeout time.Duration
+}
+
+const (
+	defaultStallTimeout = 60 * time.Second
+)
+
+var errStreamStalled = errors.New("stream stalled")
+
+func (s stallingLLM) chatStream(ctx context.Context, chats []chat) <-chan llmResponse {
+	responseChan := make(chan llmResponse)
+
+	go func() {
+		defer close(responseChan)
+
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		stream := s.llm.chatStream(ctx, chats)
+
+		timer := time.NewTimer(s.timeout)
+		defer timer.Stop()
+
+		for {
+			select {
+			case res, ok := <-stream:
+				if !ok {
+					return
+				}
+				responseChan <- res
+				timer.Reset(s.timeout)
+			case <-timer.C:
+				cancel()
+				// The stream may still send once it sees the cancellation, drain
+				// it so its goroutine can finish.
+				go func() {
+					for range stream {
+					}
+				}()
+				responseChan <- llmResponse{
+					err: fmt.Errorf("no response from the LLM for %s, the request was cancelled: %w", s.timeout, errStreamStalled),
+				}
+				return
+			}
+		}
+	}()
+
+	return responseChan
+}
+
+// parseStallTimeout parses a stall timeout setting, an empty value uses the
+// default timeout.
+func parseStallTimeout(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return defaultStallTimeout, nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid stall timeout %q, use a positive duration like 60s or 5m", s)
+	}
+	return d, nil
+}
+
+// stallTimeout returns the stall timeout of the setting, falling back to the
+// default when the setting is invalid.
+func stallTimeout(s string) time.Duration {
+	d, err := parseStallTimeout(s)
+	if err != nil {
+		return defaultStallTimeout
+	}
+	return d
+}
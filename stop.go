@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"strings"
+)
+
+// stoppingLLM cuts the answers of the wrapped llm at the first stop sequence.
+// The stop sequences are sent to the providers that support them, but the
+// providers without them, and some local servers, still send the sequence and
+// what follows it.
+type stoppingLLM struct {
+	llm
+
+	stop []string
+}
+
+func (s stoppingLLM) chat(ctx context.Context, chats []chat) llmResponse {
+	res := s.llm.chat(ctx, chats)
+	if i := s.index(res.content); i >= 0 {
+		res.content = res.content[:i]
+	}
+	return res
+}
+
+func (s stoppingLLM) chatStream(ctx context.Context, chats []chat) <-chan llmResponse {
+	responseChan := make(chan llmResponse)
+
+	go func() {
+		defer close(responseChan)
+
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		stream := s.llm.chatStream(ctx, chats)
+
+		// pending holds the end of the content that may be the start of a stop
+		// sequence, it's only sent once the next content shows it isn't.
+		var pending string
+		for res := range stream {
+			pending += res.content
+
+			if i := s.index(pending); i >= 0 {
+				res.content = pending[:i]
+				responseChan <- res
+
+				// The rest of the answer is not needed, drain the stream so its
+				// goroutine can finish.
+				cancel()
+				for range stream {
+				}
+				return
+			}
+
+			keep := 0
+			if res.err == nil {
+				keep = s.partialSuffix(pending)
+			}
+			res.content = pending[:len(pending)-keep]
+			pending = pending[len(pending)-keep:]
+			if res.content == "" && res.thinking == "" && res.err == nil &&
+				res.promptTokens == 0 && res.completionTokens == 0 {
+				continue
+			}
+			responseChan <- res
+		}
+
+		if pending != "" {
+			responseChan <- llmResponse{
+				content: pending,
+			}
+		}
+	}()
+
+	return responseChan
+}
+
+// index returns the index of the first stop sequence in the content, or -1.
+func (s stoppingLLM) index(content string) int {
+	first := -1
+	for _, seq := range s.stop {
+		if i := strings.Index(content, seq); i >= 0 && (first == -1 || i < first) {
+			first = i
+		}
+	}
+	return first
+}
+
+// partialSuffix returns the length of the longest end of the content that is
+// the start of a stop sequence.
+func (s stoppingLLM) partialSuffix(content string) int {
+	longest := 0
+	for _, seq := range s.stop {
+		for n := min(len(seq)-1, len(content)); n > longest; n-- {
+			if strings.HasSuffix(content, seq[:n]) {
+				longest = n
+				break
+			}
+		}
+	}
+	return longest
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+)
+
+const (
+	// summaryKeptChats is the number of the most recent chats sent as they are
+	// when the older ones are summarized.
+	summaryKeptChats = 4
+
+	summaryHeading = "Conversation so far:"
+)
+
+// summarizeConversation returns the summary of the chats, continuing the
+// previous summary of the chats before them.
+func summarizeConversation(ctx context.Context, llm llm, summary string, chats []chat) (string, error) {
+	cs := []chat{
+		{
+			Role: roleSystem,
+			Content: `
+Summarize the conversation between the user and the assistant for the assistant to continue it.
+
+Rules for the summary:
+1. Keep the facts, the names, the decisions and the open questions
+2. Keep what the user asked for and what the assistant answered
+3. At most 300 words, in plain sentences
+4. NO introduction, reply with the summary only
+      `,
+		},
+	}
+
+	if summary != "" {
+		cs = append(cs, chat{
+			Role:    roleUser,
+			Content: "The summary of the conversation before:\n" + summary,
+		})
+	}
+
+	var sb strings.Builder
+	for _, c := range chats {
+		sb.WriteString(c.displayName())
+		sb.WriteString(": ")
+		sb.WriteString(c.Content)
+		sb.WriteString("\n\n")
+	}
+	cs = append(cs, chat{
+		Role:    roleUser,
+		Content: "The conversation to summarize:\n" + sb.String(),
+	})
+
+	slog.Info("Summary Prompt", "chats", cs)
+
+	res := llm.chat(ctx, cs)
+	if res.err != nil {
+		return "", res.err
+	}
+	if strings.TrimSpace(res.content) == "" {
+		return "", errors.New("empty summary generated")
+	}
+
+	return strings.TrimSpace(res.content), nil
+}
+
+// summarizeHistory returns the summary of the oldest chats of the session and
+// how many of its chats it covers. The chats after the ones the session summary
+// covers are summarized too when they don't fit in the context window along
+// with the system prompt and the message, except the summaryKeptChats most
+// recent ones.
+func (r *rag) summarizeHistory(ctx context.Context, sess session, systemPrompt, msg string) (string, int) {
+	summary := sess.Summary
+	count := min(sess.SummarizedCount, len(sess.Chats)-1)
+	history := sess.Chats[count : len(sess.Chats)-1]
+
+	budget := historyBudget(r.convoContextWindow, withConversationSummary(systemPrompt, summary), msg)
+	if len(history) <= summaryKeptChats || chatsTokens(conversationChats(history)) <= budget {
+		return summary, count
+	}
+
+	// The kept chats start with a user chat, like the trimmed ones.
+	cut := len(history) - summaryKeptChats
+	for cut < len(history) && history[cut].Role != roleUser {
+		cut++
+	}
+
+	newSummary, err := summarizeConversation(ctx, r.genTitleLLM, summary, conversationChats(history[:cut]))
+	if err != nil {
+		slog.Warn("Failed to summarize the oldest chats, they are left out instead", "error", err)
+		return summary, count
+	}
+
+	slog.Info("Summarized the oldest chats", "chats", cut, "summarized", count+cut)
+	return newSummary, count + cut
+}
+
+// withConversationSummary adds the summary of the oldest chats to the system
+// prompt. It's not sent as a chat of its own, as most providers only take a
+// system prompt at the start of the conversation.
+func withConversationSummary(systemPrompt, summary string) string {
+	if summary == "" {
+		return systemPrompt
+	}
+	if systemPrompt == "" {
+		return summaryHeading + "\n" + summary
+	}
+	return systemPrompt + "\n\n" + summaryHeading + "\n" + summary
+}
+
+// conversationChats returns the chats of a session sent to the LLM, without the
+// failed answers, which are error messages of the application.
+func conversationChats(chats []chat) []chat {
+	res := make([]chat, 0, len(chats))
+	for _, c := range chats {
+		if c.Role == roleAssistant && c.Failed {
+			continue
+		}
+		res = append(res, c)
+	}
+	return res
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// linkWalker walks the tree of a document like filepath.Walk, the symbolic
+// links to the files are read through and the ones to the directories are
+// followed when followLinks is set. A directory is walked once, so the links
+// to a parent don't loop, by its file identity as the paths of a directory
+// differ through the links.
+type linkWalker struct {
+	followLinks bool
+	exclusions  *scanExclusions
+	progress    chan<- documentScanLogMsg
+	fn          filepath.WalkFunc
+
+	// realRoot is the document without the links, the links to its
+	// directories are walked anyway.
+	realRoot string
+	// visited are the root and the directories walked through the links.
+	visited []os.FileInfo
+}
+
+// walkDocument walks the tree of the document root with fn, the root itself is
+// followed when it's a link.
+func (w *linkWalker) walkDocument(root string) error {
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return fmt.Errorf("error resolving %s: %w", root, err)
+	}
+	w.realRoot = realRoot
+	if info, err := os.Stat(realRoot); err == nil && info.IsDir() {
+		w.visited = append(w.visited, info)
+	}
+	return w.walk(realRoot, root, false)
+}
+
+// walk walks the directory dir, giving its paths to fn as the ones under as.
+// linked is set when dir was reached through a link.
+func (w *linkWalker) walk(dir, as string, linked bool) error {
+	return filepath.Walk(dir, func(path string, f os.FileInfo, err error) error {
+		rel, relErr := filepath.Rel(dir, path)
+		if relErr != nil {
+			return relErr
+		}
+		path = filepath.Join(as, rel)
+		if err != nil {
+			return w.fn(path, f, err)
+		}
+
+		if f.Mode()&os.ModeSymlink == 0 {
+			// The directories of a linked tree may be reached by another link.
+			if linked && f.IsDir() {
+				if w.seen(f) {
+					return filepath.SkipDir
+				}
+				w.visited = append(w.visited, f)
+			}
+			return w.fn(path, f, nil)
+		}
+		return w.followLink(path)
+	})
+}
+
+// followLink walks the target of the link, or reports why it's skipped.
+func (w *linkWalker) followLink(path string) error {
+	target, err := os.Stat(path)
+	if err != nil {
+		w.exclusions.brokenLinks++
+		w.progress <- documentScanLogMsg{
+			content: fmt.Sprintf("Warning: skipped the broken link %s: %s", path, err),
+		}
+		return nil
+	}
+	if !target.IsDir() {
+		return w.fn(path, target, nil)
+	}
+	if !w.followLinks {
+		w.exclusions.skippedLinks++
+		w.progress <- documentScanLogMsg{
+			content: fmt.Sprintf("Skipped the linked directory %s, turn on Follow Symlinks to scan it", path),
+		}
+		return nil
+	}
+
+	realDir, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		w.exclusions.brokenLinks++
+		w.progress <- documentScanLogMsg{
+			content: fmt.Sprintf("Warning: skipped the broken link %s: %s", path, err),
+		}
+		return nil
+	}
+	if realDir == w.realRoot || strings.HasPrefix(realDir, w.realRoot+string(filepath.Separator)) || w.seen(target) {
+		w.exclusions.skippedLinks++
+		w.progress <- documentScanLogMsg{
+			content: fmt.Sprintf("Skipped the link %s, %s is already scanned", path, realDir),
+		}
+		return nil
+	}
+
+	w.visited = append(w.visited, target)
+	w.progress <- documentScanLogMsg{
+		content: fmt.Sprintf("Following the link %s to %s", path, realDir),
+	}
+	if err := w.fn(path, target, nil); err != nil {
+		if err == filepath.SkipDir {
+			return nil
+		}
+		return err
+	}
+	return w.walkChildren(realDir, path)
+}
+
+// walkChildren walks the entries of the linked directory, the directory itself
+// was given to fn by followLink with the path of its link.
+func (w *linkWalker) walkChildren(realDir, as string) error {
+	entries, err := os.ReadDir(realDir)
+	if err != nil {
+		return w.fn(as, nil, err)
+	}
+	for _, entry := range entries {
+		err := w.walk(filepath.Join(realDir, entry.Name()), filepath.Join(as, entry.Name()), true)
+		if err != nil && err != filepath.SkipDir {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *linkWalker) seen(dir os.FileInfo) bool {
+	return slices.ContainsFunc(w.visited, func(v os.FileInfo) bool { return os.SameFile(v, dir) })
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/pkoukk/tiktoken-go"
+	tiktokenloader "github.com/pkoukk/tiktoken-go-loader"
+	"github.com/rivo/uniseg"
+)
+
+// tokenizer splits a text into tokens, it returns the byte offsets where the
+// tokens end. The offsets are always at the end of a grapheme cluster, a
+// character as it's displayed, so a text cut at them is valid UTF-8 and keeps
+// the accented letters and the emoji sequences whole.
+type tokenizer interface {
+	tokenize(text string) []int
+}
+
+// tokenizerProvider is implemented by the providers whose embedding models use
+// a known tokenizer.
+type tokenizerProvider interface {
+	tokenizer(model string) tokenizer
+}
+
+// tiktokenTokenizer uses the tiktoken encoding of the OpenAI models. The
+// encoding is loaded on the first use, as it takes a while.
+type tiktokenTokenizer struct {
+	model string
+
+	once sync.Once
+	enc  *tiktoken.Tiktoken
+}
+
+// heuristicTokenizer approximates the tokenizers of the other models: a word is
+// a token every heuristicTokenChars characters, and every punctuation mark,
+// symbol and ideograph is a token.
+type heuristicTokenizer struct{}
+
+const (
+	heuristicTokenChars = 4
+
+	defaultTiktokenEncoding = "cl100k_base"
+)
+
+var setTiktokenLoader sync.Once
+
+func newTiktokenTokenizer(model string) *tiktokenTokenizer {
+	return &tiktokenTokenizer{
+		model: model,
+	}
+}
+
+// tokenizerFromSetting returns the tokenizer of the embedding model of the
+// setting, the heuristic one when its tokenizer is not known.
+func tokenizerFromSetting(setting llmSetting, providers []llmProvider) tokenizer {
+	for _, p := range providers {
+		if p.name() != setting.Provider {
+			continue
+		}
+		if t, ok := p.(tokenizerProvider); ok {
+			if tok := t.tokenizer(setting.Model); tok != nil {
+				return tok
+			}
+		}
+		break
+	}
+	return heuristicTokenizer{}
+}
+
+func (t *tiktokenTokenizer) tokenize(text string) []int {
+	t.once.Do(func() {
+		// The encodings are embedded, so the scans don't have to download them.
+		setTiktokenLoader.Do(func() {
+			tiktoken.SetBpeLoader(tiktokenloader.NewOfflineLoader())
+		})
+
+		enc, err := tiktoken.EncodingForModel(t.model)
+		if err != nil {
+			enc, err = tiktoken.GetEncoding(defaultTiktokenEncoding)
+		}
+		if err != nil {
+			slog.Warn("Failed to load the tiktoken encoding, the tokens are estimated", "model", t.model, "error", err)
+			return
+		}
+		t.enc = enc
+	})
+	if t.enc == nil {
+		return heuristicTokenizer{}.tokenize(text)
+	}
+
+	ids := t.enc.EncodeOrdinary(text)
+	graphemes := graphemeEnds(text)
+	ends := make([]int, 0, len(ids))
+	offset, g := 0, 0
+	for _, id := range ids {
+		offset += len(t.enc.Decode([]int{id}))
+		// A token may end inside a multi-byte character, or between the runes
+		// of a character like an emoji sequence, the boundary then moves to the
+		// end of the token that completes it.
+		for g < len(graphemes) && graphemes[g] < offset {
+			g++
+		}
+		if g == len(graphemes) || graphemes[g] != offset {
+			continue
+		}
+		ends = append(ends, offset)
+	}
+	if len(ends) > 0 && ends[len(ends)-1] < len(text) {
+		ends = append(ends, len(text))
+	}
+	return ends
+}
+
+func (heuristicTokenizer) tokenize(text string) []int {
+	var ends []int
+
+	inWord := false
+	wordChars := 0
+	state := -1
+	for i, rest := 0, text; rest != ""; {
+		var cluster string
+		cluster, rest, _, state = uniseg.FirstGraphemeClusterInString(rest, state)
+		size := len(cluster)
+
+		// The combining marks and the modifiers of a character count with it.
+		r, _ := utf8.DecodeRuneInString(cluster)
+		switch {
+		case unicode.IsSpace(r):
+			// The spaces belong to the next token.
+			if inWord {
+				ends = append(ends, i)
+				inWord = false
+			}
+		case (unicode.IsLetter(r) || unicode.IsDigit(r)) && !isIdeograph(r):
+			if !inWord {
+				inWord = true
+				wordChars = 0
+			} else if wordChars == heuristicTokenChars {
+				ends = append(ends, i)
+				wordChars = 0
+			}
+			wordChars++
+		default:
+			if inWord {
+				ends = append(ends, i)
+				inWord = false
+			}
+			ends = append(ends, i+size)
+		}
+		i += size
+	}
+	if len(text) > 0 && (len(ends) == 0 || ends[len(ends)-1] < len(text)) {
+		ends = append(ends, len(text))
+	}
+
+	return ends
+}
+
+// graphemeEnds returns the byte offsets where the grapheme clusters of the text
+// end.
+func graphemeEnds(text string) []int {
+	ends := make([]int, 0, len(text))
+	state := -1
+	for offset, rest := 0, text; rest != ""; {
+		var cluster string
+		cluster, rest, _, state = uniseg.FirstGraphemeClusterInString(rest, state)
+		offset += len(cluster)
+		ends = append(ends, offset)
+	}
+	return ends
+}
+
+// graphemeCut returns the last end of a grapheme cluster of the text at most
+// limit bytes in, or the end of the first cluster when it's longer than limit.
+func graphemeCut(text string, limit int) int {
+	cut := 0
+	state := -1
+	for rest := text; rest != ""; {
+		var cluster string
+		cluster, rest, _, state = uniseg.FirstGraphemeClusterInString(rest, state)
+		if cut > 0 && cut+len(cluster) > limit {
+			break
+		}
+		cut += len(cluster)
+	}
+	return cut
+}
+
+func isIdeograph(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul)
+}
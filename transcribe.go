@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	goopenai "github.com/sashabaranov/go-openai"
+)
+
+const (
+	// timestampKey is the metadata of the time of a transcript chunk in its
+	// recording, like "12:45", named in the chunk headers and the sources.
+	timestampKey = "timestamp"
+
+	// transcriptWindow is the time of the recording in a section of its
+	// transcript.
+	transcriptWindow = 30 * time.Second
+
+	defaultTranscriptionModel = "whisper-1"
+	// defaultMaxAudioMB is the upload limit of the OpenAI transcriptions.
+	defaultMaxAudioMB = 25
+	maxMaxAudioMB     = 1024
+)
+
+// audioExtensions are the recordings transcribed by the scans.
+var audioExtensions = map[string]bool{".mp3": true, ".wav": true, ".m4a": true}
+
+// transcriptSegment is a part of a transcript, with its time in the recording.
+type transcriptSegment struct {
+	start time.Duration
+	text  string
+}
+
+// audioTranscriber transcribes the recordings with an OpenAI compatible
+// transcription API.
+type audioTranscriber struct {
+	backend string
+	client  *goopenai.Client
+	model   string
+}
+
+func (s ragSettings) transcriptionModel() string {
+	if s.TranscriptionModel == "" {
+		return defaultTranscriptionModel
+	}
+	return s.TranscriptionModel
+}
+
+func (s ragSettings) maxAudioMB() int {
+	if s.MaxAudioMB == 0 {
+		return defaultMaxAudioMB
+	}
+	return s.MaxAudioMB
+}
+
+// newAudioTranscriber returns the transcriber of the transcription URL of the
+// settings, or of the OpenAI API with the key of the first OpenAI provider when
+// it's not set.
+func (r *rag) newAudioTranscriber() (*audioTranscriber, error) {
+	model := r.settings.transcriptionModel()
+	if url := strings.TrimRight(r.settings.TranscriptionURL, "/"); url != "" {
+		return &audioTranscriber{
+			backend: fmt.Sprintf("%s at %s", model, url),
+			client:  newOpenAICompatClient("", url, ""),
+			model:   model,
+		}, nil
+	}
+
+	for _, p := range r.providers {
+		if o, ok := p.(openaiProvider); ok && o.isConfigured() {
+			return &audioTranscriber{
+				backend: fmt.Sprintf("OpenAI/%s", model),
+				client:  o.client(),
+				model:   model,
+			}, nil
+		}
+	}
+	return nil, errors.New("no OpenAI provider is configured and the transcription URL is not set")
+}
+
+// transcribe returns the segments of the transcript of the recording, the name
+// of the file tells its format to the API.
+func (t *audioTranscriber) transcribe(ctx context.Context, data []byte, filename string) ([]transcriptSegment, error) {
+	resp, err := t.client.CreateTranscription(ctx, goopenai.AudioRequest{
+		Model:    t.model,
+		FilePath: filename,
+		Reader:   bytes.NewReader(data),
+		Format:   goopenai.AudioResponseFormatVerboseJSON,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error transcribing the recording: %w", err)
+	}
+
+	// The servers without the segments only return the text.
+	if len(resp.Segments) == 0 {
+		return []transcriptSegment{{text: strings.TrimSpace(resp.Text)}}, nil
+	}
+	segments := make([]transcriptSegment, len(resp.Segments))
+	for i, s := range resp.Segments {
+		segments[i] = transcriptSegment{
+			start: time.Duration(s.Start * float64(time.Second)),
+			text:  strings.TrimSpace(s.Text),
+		}
+	}
+	return segments, nil
+}
+
+// audioExtractor returns the extractor of the recordings of the extension,
+// which transcribes them with the transcriber of the options. The transcript
+// is split into sections of transcriptWindow, which record their time.
+func audioExtractor(ext string) func(data []byte, opts extractOptions) (extractedText, error) {
+	return func(data []byte, opts extractOptions) (extractedText, error) {
+		if opts.transcriber == nil {
+			return extractedText{}, errors.New("the transcription is off")
+		}
+		segments, err := opts.transcriber.transcribe(opts.ctx, data, "recording"+ext)
+		if err != nil {
+			return extractedText{}, err
+		}
+		return extractedText{sections: transcriptSections(segments)}, nil
+	}
+}
+
+// transcriptSections groups the segments by transcriptWindow of the
+// recording, a section starts at its first segment.
+func transcriptSections(segments []transcriptSegment) []extractedSection {
+	var sections []extractedSection
+	var texts []string
+	var start time.Duration
+	window := time.Duration(-1)
+
+	flush := func() {
+		if len(texts) == 0 {
+			return
+		}
+		sections = append(sections, extractedSection{
+			content:  strings.Join(texts, " "),
+			metadata: map[string]string{timestampKey: formatTimestamp(start)},
+		})
+		texts = nil
+	}
+
+	for _, s := range segments {
+		if s.text == "" {
+			continue
+		}
+		if w := s.start / transcriptWindow; w != window {
+			flush()
+			window, start = w, s.start
+		}
+		texts = append(texts, s.text)
+	}
+	flush()
+
+	return sections
+}
+
+// formatTimestamp formats the time of a recording like "12:45", or "1:02:45"
+// from an hour.
+func formatTimestamp(d time.Duration) string {
+	seconds := int(math.Floor(d.Seconds()))
+	if seconds >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", seconds/3600, seconds/60%60, seconds%60)
+	}
+	return fmt.Sprintf("%d:%02d", seconds/60, seconds%60)
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// headerTransport adds the headers to every request sent through it.
+type headerTransport struct {
+	headers http.Header
+	base    http.RoundTripper
+}
+
+// timeoutTransport fails a request when the server sends nothing for the
+// timeout, either while waiting for the response or between the reads of its
+// body. Unlike http.Client.Timeout it doesn't cut a long stream that keeps
+// sending data.
+type timeoutTransport struct {
+	timeout time.Duration
+	base    http.RoundTripper
+}
+
+// timeoutBody is the response body of a timeoutTransport request, every read
+// pushes the deadline back.
+type timeoutBody struct {
+	io.ReadCloser
+
+	timer   *time.Timer
+	timeout time.Duration
+	fired   *timeoutFlag
+	cancel  context.CancelFunc
+}
+
+// httpStatusError is returned for an unexpected response status, with the
+// delay requested by its Retry-After header.
+type httpStatusError struct {
+	StatusCode int
+	Body       string
+	RetryAfter time.Duration
+}
+
+type timeoutFlag struct {
+	mu    sync.Mutex
+	fired bool
+}
+
+const (
+	defaultRequestTimeout = 120 * time.Second
+)
+
+var errRequestTimeout = errors.New("request timed out")
+
+// proxyTransports caches the transports by proxy setting, so the clients of a
+// provider share their connections.
+var proxyTransports sync.Map
+
+// newHTTPStatusError reads the error from the response without closing its body.
+func newHTTPStatusError(resp *http.Response) *httpStatusError {
+	body, _ := io.ReadAll(resp.Body)
+
+	var retryAfter time.Duration
+	if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs > 0 {
+		retryAfter = time.Duration(secs) * time.Second
+	}
+
+	return &httpStatusError{
+		StatusCode: resp.StatusCode,
+		Body:       string(body),
+		RetryAfter: retryAfter,
+	}
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("unexpected status code: %d, body: %s", e.StatusCode, e.Body)
+}
+
+func (t headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// RoundTrip must not modify the request, so the headers are set on a clone.
+	req = req.Clone(req.Context())
+	for k, v := range t.headers {
+		req.Header[k] = v
+	}
+	return t.base.RoundTrip(req)
+}
+
+func (t timeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(req.Context())
+	fired := &timeoutFlag{}
+	timer := time.AfterFunc(t.timeout, func() {
+		fired.set()
+		cancel()
+	})
+
+	resp, err := t.base.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		timer.Stop()
+		cancel()
+		if fired.get() {
+			return nil, timeoutError(t.timeout)
+		}
+		return nil, err
+	}
+
+	// The timer keeps running, it is reset by the body reads from now on.
+	timer.Reset(t.timeout)
+	resp.Body = &timeoutBody{
+		ReadCloser: resp.Body,
+		timer:      timer,
+		timeout:    t.timeout,
+		fired:      fired,
+		cancel:     cancel,
+	}
+
+	return resp, nil
+}
+
+func (b *timeoutBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && b.fired.get() {
+		return n, timeoutError(b.timeout)
+	}
+	if n > 0 {
+		b.timer.Reset(b.timeout)
+	}
+	return n, err
+}
+
+func (b *timeoutBody) Close() error {
+	b.timer.Stop()
+	b.cancel()
+	return b.ReadCloser.Close()
+}
+
+func (f *timeoutFlag) set() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.fired = true
+}
+
+func (f *timeoutFlag) get() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.fired
+}
+
+func timeoutError(timeout time.Duration) error {
+	return fmt.Errorf("%w: no response from the server for %s", errRequestTimeout, timeout)
+}
+
+// newTimeoutHTTPClient returns a client whose requests go through the proxy and
+// fail after the timeout without any response from the server.
+func newTimeoutHTTPClient(timeout time.Duration, proxy string) *http.Client {
+	return &http.Client{
+		Transport: timeoutTransport{
+			timeout: timeout,
+			base:    proxyTransport(proxy),
+		},
+	}
+}
+
+// newProxyHTTPClient returns a client whose requests go through the proxy.
+func newProxyHTTPClient(proxy string) *http.Client {
+	return &http.Client{
+		Transport: proxyTransport(proxy),
+	}
+}
+
+// proxyTransport returns the transport for a proxy setting. An empty setting
+// uses the HTTPS_PROXY, HTTP_PROXY and NO_PROXY environment variables, like the
+// default transport. The traffic is logged while its debugging is enabled.
+func proxyTransport(proxy string) http.RoundTripper {
+	proxy = strings.TrimSpace(proxy)
+	if proxy == "" {
+		return debugTransport{base: http.DefaultTransport}
+	}
+
+	if t, ok := proxyTransports.Load(proxy); ok {
+		return debugTransport{base: t.(http.RoundTripper)}
+	}
+
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = proxyFunc(proxy)
+	actual, _ := proxyTransports.LoadOrStore(proxy, t)
+	return debugTransport{base: actual.(http.RoundTripper)}
+}
+
+// proxyFunc returns the Proxy function of a transport for a proxy setting. An
+// invalid setting fails every request with the parse error instead of going
+// around the proxy.
+func proxyFunc(proxy string) func(*http.Request) (*url.URL, error) {
+	u, err := parseProxyURL(proxy)
+	if err != nil {
+		return func(*http.Request) (*url.URL, error) {
+			return nil, err
+		}
+	}
+	if u == nil {
+		return http.ProxyFromEnvironment
+	}
+	return http.ProxyURL(u)
+}
+
+// parseProxyURL parses a proxy setting, an empty value returns nil.
+func parseProxyURL(s string) (*url.URL, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy %q, use a URL like http://proxy:8080", s)
+	}
+
+	switch u.Scheme {
+	case "http", "https", "socks5":
+		return u, nil
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q, use http, https or socks5", u.Scheme)
+	}
+}
@@ -136,6 +136,20 @@ var (
 				Foreground(lipgloss.AdaptiveColor{Light: "#4c4f69", Dark: "#cdd6f4"}). // Text
 				Padding(0, 4)
 
+	chatThinkingStyle = lipgloss.NewStyle().
+				Foreground(lipgloss.AdaptiveColor{Light: "#9ca0b0", Dark: "#6c7086"}). // Overlay0
+				Faint(true).
+				Padding(0, 4)
+
+	chatUsageStyle = lipgloss.NewStyle().
+			Foreground(lipgloss.AdaptiveColor{Light: "#9ca0b0", Dark: "#a6adc8"}). // Overlay0
+			Italic(true).
+			Padding(0, 4)
+
+	chatSourcesStyle = lipgloss.NewStyle().
+				Foreground(lipgloss.AdaptiveColor{Light: "#179299", Dark: "#94e2d5"}). // Teal
+				Padding(0, 4)
+
 	chatTextareaStyle = lipgloss.NewStyle().
 				Border(lipgloss.RoundedBorder()).
 				BorderForeground(lipgloss.AdaptiveColor{Light: "#dc8a78", Dark: "#f2cdcd"}). // Rosewater
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/charmbracelet/huh"
+	"github.com/philippgille/chromem-go"
+)
+
+type voyageProvider struct {
+	APIKey string `json:"apiKey"`
+	Proxy  string `json:"proxy"`
+
+	rateLimitSettings
+}
+
+type voyage struct {
+	apiKey string
+	model  string
+
+	client *http.Client
+}
+
+type voyageEmbeddingRequest struct {
+	Input []string `json:"input"`
+	Model string   `json:"model"`
+}
+
+type voyageEmbeddingResponse struct {
+	Data []struct {
+		Embedding []float32 `json:"embedding"`
+	} `json:"data"`
+}
+
+const (
+	voyageAPIEndpoint = "https://api.voyageai.com/v1"
+)
+
+// voyageModels is the list of Voyage embedding models, Voyage doesn't provide an
+// endpoint to list them.
+var voyageModels = []string{
+	"voyage-3-large",
+	"voyage-3",
+	"voyage-3-lite",
+	"voyage-code-3",
+	"voyage-finance-2",
+	"voyage-law-2",
+	"voyage-multilingual-2",
+}
+
+// embeddingFunc returns an EmbeddingFunc that uses the Voyage embeddings API.
+//
+// Voyage embeddings are normalized, so the vectors are returned as is.
+func (v voyage) embeddingFunc() chromem.EmbeddingFunc {
+	return func(ctx context.Context, text string) ([]float32, error) {
+		jsonBody, err := json.Marshal(voyageEmbeddingRequest{
+			Input: []string{text},
+			Model: v.model,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error marshaling request: %w", err)
+		}
+
+		req, err := http.NewRequestWithContext(ctx, "POST", voyageAPIEndpoint+"/embeddings", bytes.NewBuffer(jsonBody))
+		if err != nil {
+			return nil, fmt.Errorf("error creating request: %w", err)
+		}
+
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+v.apiKey)
+
+		resp, err := v.client.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("error sending request: %w", err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return nil, newHTTPStatusError(resp)
+		}
+
+		var response voyageEmbeddingResponse
+		if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+			return nil, fmt.Errorf("error decoding response: %w", err)
+		}
+
+		if len(response.Data) == 0 || len(response.Data[0].Embedding) == 0 {
+			return nil, errors.New("no embeddings found in the response")
+		}
+
+		return response.Data[0].Embedding, nil
+	}
+}
+
+func (v voyageProvider) Title() string {
+	if v.isConfigured() {
+		return fmt.Sprintf("%s (configured)", providerVoyage)
+	}
+	return fmt.Sprintf("%s (not configured)", providerVoyage)
+}
+
+func (v voyageProvider) Description() string {
+	return "Configure Voyage AI connection (embeddings only)"
+}
+
+func (v voyageProvider) FilterValue() string {
+	return providerVoyage
+}
+
+func (v voyageProvider) name() string {
+	return providerVoyage
+}
+
+func (v voyageProvider) availableModels() ([]string, error) {
+	return voyageModels, nil
+}
+
+func (v voyageProvider) isConfigured() bool {
+	return v.APIKey != ""
+}
+
+func (v voyageProvider) testConnection() error {
+	// Voyage can't list its models, so a tiny embedding is the cheapest request.
+	embed := voyage{
+		apiKey: v.APIKey,
+		model:  "voyage-3-lite",
+		client: newProxyHTTPClient(v.Proxy),
+	}.embeddingFunc()
+	_, err := embed(context.Background(), "test")
+	return err
+}
+
+func (v voyageProvider) form(width, height int, keymap *huh.KeyMap) *huh.Form {
+	proxy := v.Proxy
+	apiKey := v.APIKey
+	if apiKey == "" {
+		apiKey = os.Getenv("VOYAGE_API_KEY")
+	}
+	rateLimit := v.rateLimitSettings
+	return huh.NewForm(
+		huh.NewGroup(
+			huh.NewInput().
+				Key("voyageAPIKey").
+				Title("API Key").
+				Description("Enter the API key for Voyage AI.").
+				Placeholder("API Key").
+				Value(&apiKey),
+			proxyField("voyageProxy", "Voyage AI", &proxy),
+			requestsPerMinuteField("voyage", &rateLimit.RequestsPerMinute),
+			tokensPerMinuteField("voyage", &rateLimit.TokensPerMinute),
+			testConnectionField("voyageTest", func() error {
+				return voyageProvider{APIKey: apiKey, Proxy: proxy}.testConnection()
+			}),
+			huh.NewConfirm().
+				Key("voyageConfirm").
+				Title("Confirm").
+				Description("Save this Voyage AI settings?").
+				Affirmative("Yes").
+				Negative("Back"),
+		),
+	).
+		WithWidth(width).
+		WithHeight(height).
+		WithTheme(huh.ThemeCatppuccin()).
+		WithKeyMap(keymap).
+		WithShowErrors(true).
+		WithShowHelp(true)
+}
+
+func (v voyageProvider) saveForm(form *huh.Form) (llmProvider, bool) {
+	if !form.GetBool("voyageConfirm") {
+		return v, false
+	}
+
+	apiKey := form.GetString("voyageAPIKey")
+
+	if apiKey == "" {
+		return v, false
+	}
+
+	v.APIKey = apiKey
+	v.Proxy = form.GetString("voyageProxy")
+	v.rateLimitSettings = rateLimitSettingsFromForm(form, "voyage")
+
+	return v, true
+}
+
+// new returns nil, Voyage has no chat API. The provider is never offered for the
+// chat roles, see embeddingOnly.
+func (v voyageProvider) new(setting llmSetting) llm {
+	return nil
+}
+
+func (v voyageProvider) supportEmbedding() bool {
+	return true
+}
+
+func (v voyageProvider) embeddingOnly() bool {
+	return true
+}
+
+func (v voyageProvider) newEmbedder(setting llmSetting) embedder {
+	return voyage{
+		apiKey: v.APIKey,
+		model:  setting.Model,
+		client: newProxyHTTPClient(v.Proxy),
+	}
+}
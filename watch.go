@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchDebounce is the time a watched document must go without changes before
+// it's synced, so a burst of saves syncs it once.
+const watchDebounce = time.Second
+
+// documentChangedMsg reports the changes of the files of a watched document,
+// by its ID.
+type documentChangedMsg int
+
+// documentWatcher watches the directories of a document for the changes of its
+// files.
+type documentWatcher struct {
+	watcher *fsnotify.Watcher
+	hidden  *hiddenSkipper
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// watchDocument watches the directories of the document, its ID is sent to
+// changes once its changes settled. The hidden files and the skipped
+// directories are not watched, unless the document scans them.
+func watchDocument(doc document, hidden *hiddenSkipper, changes chan<- int) (*documentWatcher, error) {
+	info, err := os.Stat(doc.Path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", doc.Path, err)
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("error creating the watcher: %w", err)
+	}
+
+	// A single file is watched from its directory.
+	file := ""
+	if info.IsDir() {
+		err = addWatchDirs(watcher, doc.Path, hidden)
+	} else {
+		file = doc.Path
+		if err = watcher.Add(filepath.Dir(doc.Path)); err != nil {
+			err = fmt.Errorf("error watching %s: %w", filepath.Dir(doc.Path), err)
+		}
+	}
+	if err != nil {
+		watcher.Close()
+		return nil, err
+	}
+
+	w := &documentWatcher{watcher: watcher, hidden: hidden, stop: make(chan struct{}), done: make(chan struct{})}
+	go w.run(doc.ID, file, changes)
+	return w, nil
+}
+
+// addWatchDirs watches the directory and the ones under it, fsnotify doesn't
+// watch them recursively.
+func addWatchDirs(watcher *fsnotify.Watcher, dir string, hidden *hiddenSkipper) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			// The unreadable directories are skipped, like by the scans.
+			return nil
+		}
+		if d.Name() == ".git" || (hidden != nil && path != dir && hidden.skipped(d.Name(), true)) {
+			return filepath.SkipDir
+		}
+		if err := watcher.Add(path); err != nil {
+			return fmt.Errorf("error watching %s: %w", path, err)
+		}
+		return nil
+	})
+}
+
+func (w *documentWatcher) run(id int, file string, changes chan<- int) {
+	defer close(w.done)
+
+	debounce := time.NewTimer(watchDebounce)
+	debounce.Stop()
+	for {
+		select {
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			if (file != "" && event.Name != file) || event.Op == fsnotify.Chmod || filepath.Base(event.Name) == ".git" {
+				continue
+			}
+			info, statErr := os.Stat(event.Name)
+			isDir := statErr == nil && info.IsDir()
+			// The removed directories are told apart from the files by their
+			// name only.
+			if file == "" && w.hidden != nil && w.hidden.skipped(filepath.Base(event.Name), isDir) {
+				continue
+			}
+			if file == "" && event.Has(fsnotify.Create) && isDir {
+				if err := addWatchDirs(w.watcher, event.Name, w.hidden); err != nil {
+					slog.Warn("Failed to watch the new directory", "path", event.Name, "error", err)
+				}
+			}
+			debounce.Reset(watchDebounce)
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			slog.Warn("Error watching the document", "id", id, "error", err)
+		case <-debounce.C:
+			select {
+			case changes <- id:
+			case <-w.stop:
+				return
+			}
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+// close stops the watcher and waits for its goroutine to return.
+func (w *documentWatcher) close() {
+	close(w.stop)
+	w.watcher.Close()
+	<-w.done
+}
+
+// updateWatcher watches the document when its Watch is on, again if it was
+// watched already as its path may have changed.
+func (m mainModel) updateWatcher(index int) mainModel {
+	doc := m.documents[index]
+	m.unwatchDocument(doc.ID)
+	if !doc.Watch || doc.isURL() || doc.Path == "" {
+		return m
+	}
+
+	w, err := watchDocument(doc, newHiddenSkipper(doc, m.ragSettings), m.watchChanges)
+	if err != nil {
+		m.err = fmt.Errorf("error watching %s: %w", doc.Name, err)
+		slog.Error(m.err.Error())
+		return m
+	}
+	m.watchers[doc.ID] = w
+	return m
+}
+
+func (m mainModel) unwatchDocument(id int) {
+	if w, ok := m.watchers[id]; ok {
+		w.close()
+		delete(m.watchers, id)
+	}
+}
+
+// stopWatchers stops watching the documents when the app quits.
+func (m mainModel) stopWatchers() {
+	for id := range m.watchers {
+		m.unwatchDocument(id)
+	}
+}
+
+// handleDocumentChangedMsg syncs the changed document with the automatic
+// rescans, once no scan is running.
+func (m mainModel) handleDocumentChangedMsg(msg documentChangedMsg) mainModel {
+	index := slices.IndexFunc(m.documents, func(d document) bool { return d.ID == int(msg) })
+	if index < 0 {
+		return m
+	}
+	m.documents[index].changed = true
+	return m.startDueAutoScan(time.Now())
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/charmbracelet/huh"
+)
+
+type xAIProvider struct {
+	APIKey string `json:"apiKey"`
+	Proxy  string `json:"proxy"`
+
+	rateLimitSettings
+}
+
+const (
+	xAIAPIEndpoint = "https://api.x.ai/v1"
+)
+
+func (x xAIProvider) Title() string {
+	if x.isConfigured() {
+		return fmt.Sprintf("%s (configured)", providerXAI)
+	}
+	return fmt.Sprintf("%s (not configured)", providerXAI)
+}
+
+func (x xAIProvider) Description() string {
+	return "Configure xAI connection"
+}
+
+func (x xAIProvider) FilterValue() string {
+	return providerXAI
+}
+
+func (x xAIProvider) name() string {
+	return providerXAI
+}
+
+func (x xAIProvider) availableModels() ([]string, error) {
+	listed, err := listOpenAIModels(newOpenAICompatClient(x.APIKey, xAIAPIEndpoint, x.Proxy))
+	if err != nil {
+		return nil, err
+	}
+
+	var models []string
+	for _, m := range listed {
+		// xAI also lists image generation models, which can't be used for chat.
+		if strings.Contains(m, "image") {
+			continue
+		}
+		models = append(models, m)
+	}
+
+	return models, nil
+}
+
+func (x xAIProvider) isConfigured() bool {
+	return x.APIKey != ""
+}
+
+func (x xAIProvider) testConnection() error {
+	_, err := x.availableModels()
+	return err
+}
+
+func (x xAIProvider) form(width, height int, keymap *huh.KeyMap) *huh.Form {
+	proxy := x.Proxy
+	apiKey := x.APIKey
+	if apiKey == "" {
+		apiKey = os.Getenv("XAI_API_KEY")
+	}
+	rateLimit := x.rateLimitSettings
+	return huh.NewForm(
+		huh.NewGroup(
+			huh.NewInput().
+				Key("xAIAPIKey").
+				Title("API Key").
+				Description("Enter the API key for xAI.").
+				Placeholder("API Key").
+				Value(&apiKey),
+			proxyField("xAIProxy", "xAI", &proxy),
+			requestsPerMinuteField("xAI", &rateLimit.RequestsPerMinute),
+			tokensPerMinuteField("xAI", &rateLimit.TokensPerMinute),
+			testConnectionField("xAITest", func() error {
+				return xAIProvider{APIKey: apiKey, Proxy: proxy}.testConnection()
+			}),
+			huh.NewConfirm().
+				Key("xAIConfirm").
+				Title("Confirm").
+				Description("Save this xAI settings?").
+				Affirmative("Yes").
+				Negative("Back"),
+		),
+	).
+		WithWidth(width).
+		WithHeight(height).
+		WithTheme(huh.ThemeCatppuccin()).
+		WithKeyMap(keymap).
+		WithShowErrors(true).
+		WithShowHelp(true)
+}
+
+func (x xAIProvider) saveForm(form *huh.Form) (llmProvider, bool) {
+	if !form.GetBool("xAIConfirm") {
+		return x, false
+	}
+
+	apiKey := form.GetString("xAIAPIKey")
+
+	if apiKey == "" {
+		return x, false
+	}
+
+	x.APIKey = apiKey
+	x.Proxy = form.GetString("xAIProxy")
+	x.rateLimitSettings = rateLimitSettingsFromForm(form, "xAI")
+
+	return x, true
+}
+
+func (x xAIProvider) new(setting llmSetting) llm {
+	return openai{
+		apiKey:           x.APIKey,
+		model:            setting.Model,
+		temperature:      setting.Temperature,
+		topP:             setting.TopP,
+		frequencyPenalty: setting.FrequencyPenalty,
+		presencePenalty:  setting.PresencePenalty,
+		stop:             setting.StopSequences,
+		streamUsage:      true,
+		client:           newOpenAICompatClient(x.APIKey, xAIAPIEndpoint, x.Proxy),
+	}
+}
+
+func (x xAIProvider) supportEmbedding() bool {
+	return false
+}
+
+func (x xAIProvider) newEmbedder(setting llmSetting) embedder {
+	return nil
+}
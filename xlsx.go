@@ -0,0 +1,311 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// sheetKey is the metadata of the sheet of a spreadsheet in a chunk, named in
+// the chunk headers and the sources.
+const sheetKey = "sheet"
+
+type xlsxWorkbook struct {
+	Sheets []struct {
+		Name string `xml:"name,attr"`
+		// The relationship ID is the id attribute of the relationships
+		// namespace, which differs in the strict documents.
+		Attrs []xml.Attr `xml:",any,attr"`
+	} `xml:"sheets>sheet"`
+}
+
+type xlsxRelationships struct {
+	Relationships []struct {
+		ID     string `xml:"Id,attr"`
+		Target string `xml:"Target,attr"`
+	} `xml:"Relationship"`
+}
+
+// xlsxRow is a row of a sheet, with its number and its values by column.
+type xlsxRow struct {
+	number int
+	cells  []string
+}
+
+// extractXLSX converts each sheet of a workbook to a table under a heading with
+// the sheet name. The sheets are split into sections of tableRowsPerChunk rows
+// that repeat the header row, the first row of the sheet, as the CSV files.
+// The formulas are their cached values. A workbook with more than
+// maxSpreadsheetCells cells is not read.
+func extractXLSX(data []byte, opts extractOptions) (extractedText, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return extractedText{}, fmt.Errorf("error opening the workbook: %w", err)
+	}
+	files := make(map[string]*zip.File, len(zr.File))
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+
+	var workbook xlsxWorkbook
+	if err := zipDecode(files, "xl/workbook.xml", &workbook); err != nil {
+		return extractedText{}, err
+	}
+	var rels xlsxRelationships
+	if err := zipDecode(files, "xl/_rels/workbook.xml.rels", &rels); err != nil {
+		return extractedText{}, err
+	}
+	targets := make(map[string]string)
+	for _, rel := range rels.Relationships {
+		if strings.HasPrefix(rel.Target, "/") {
+			targets[rel.ID] = strings.TrimPrefix(rel.Target, "/")
+		} else {
+			targets[rel.ID] = path.Join("xl", rel.Target)
+		}
+	}
+
+	var sharedStrings []string
+	if _, ok := files["xl/sharedStrings.xml"]; ok {
+		sharedStrings, err = xlsxSharedStrings(files["xl/sharedStrings.xml"])
+		if err != nil {
+			return extractedText{}, err
+		}
+	}
+
+	var text extractedText
+	cells := 0
+	rowsPerChunk := max(opts.tableRowsPerChunk, 1)
+	for _, sheet := range workbook.Sheets {
+		rid := ""
+		for _, a := range sheet.Attrs {
+			if a.Name.Local == "id" && a.Name.Space != "" {
+				rid = a.Value
+			}
+		}
+		f, ok := files[targets[rid]]
+		if !ok {
+			return extractedText{}, fmt.Errorf("the workbook has no sheet %s", sheet.Name)
+		}
+		rows, err := xlsxSheetRows(f, sharedStrings, &cells, opts.maxSpreadsheetCells)
+		if err != nil {
+			return extractedText{}, fmt.Errorf("error reading the sheet %s: %w", sheet.Name, err)
+		}
+		if len(rows) == 0 {
+			continue
+		}
+
+		header, rows := rows[0], rows[1:]
+		width := len(header.cells)
+		for _, row := range rows {
+			width = max(width, len(row.cells))
+		}
+		for start := 0; start < len(rows) || start == 0; start += rowsPerChunk {
+			end := min(start+rowsPerChunk, len(rows))
+			metadata := map[string]string{sheetKey: sheet.Name}
+			if end > start {
+				metadata[rowsKey] = strconv.Itoa(rows[start].number) + "-" + strconv.Itoa(rows[end-1].number)
+			}
+			text.sections = append(text.sections, extractedSection{
+				content:  "# " + sheet.Name + "\n\n" + formatTable(header.cells, rows[start:end], width),
+				metadata: metadata,
+				whole:    true,
+			})
+		}
+	}
+
+	return text, nil
+}
+
+// formatTable writes the header and the rows as a markdown table of width
+// columns.
+func formatTable(header []string, rows []xlsxRow, width int) string {
+	line := func(cells []string) string {
+		values := make([]string, width)
+		for i := range values {
+			if i < len(cells) {
+				values[i] = strings.ReplaceAll(strings.Join(strings.Fields(cells[i]), " "), "|", `\|`)
+			}
+		}
+		return "| " + strings.Join(values, " | ") + " |\n"
+	}
+
+	var sb strings.Builder
+	sb.WriteString(line(header))
+	sb.WriteString("|" + strings.Repeat(" --- |", width) + "\n")
+	for _, row := range rows {
+		sb.WriteString(line(row.cells))
+	}
+	return strings.TrimSuffix(sb.String(), "\n")
+}
+
+func xlsxSharedStrings(f *zip.File) ([]string, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, fmt.Errorf("error opening the shared strings: %w", err)
+	}
+	defer rc.Close()
+
+	var stringsList []string
+	var current strings.Builder
+	inText, phonetic := false, false
+	d := xml.NewDecoder(rc)
+	for {
+		tok, err := d.Token()
+		if errors.Is(err, io.EOF) {
+			return stringsList, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading the shared strings: %w", err)
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "si":
+				current.Reset()
+			case "t":
+				inText = true
+			case "rPh":
+				// The phonetic guides repeat the text.
+				phonetic = true
+			}
+		case xml.CharData:
+			if inText && !phonetic {
+				current.Write(t)
+			}
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "si":
+				stringsList = append(stringsList, current.String())
+			case "t":
+				inText = false
+			case "rPh":
+				phonetic = false
+			}
+		}
+	}
+}
+
+// xlsxSheetRows reads the rows of a sheet with a value, adding its cells to
+// cells and failing once they are over maxCells.
+func xlsxSheetRows(f *zip.File, sharedStrings []string, cells *int, maxCells int) ([]xlsxRow, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	var rows []xlsxRow
+	var row xlsxRow
+	var cellType, value string
+	number, column := 0, 0
+	inValue := false
+	d := xml.NewDecoder(rc)
+	for {
+		tok, err := d.Token()
+		if errors.Is(err, io.EOF) {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "row":
+				// The rows without a number follow the previous one.
+				number++
+				if n, err := strconv.Atoi(xlsxAttr(t, "r")); err == nil {
+					number = n
+				}
+				row = xlsxRow{number: number}
+				column = 0
+			case "c":
+				*cells++
+				if maxCells > 0 && *cells > maxCells {
+					return nil, fmt.Errorf("the workbook has more than %d cells", maxCells)
+				}
+				cellType, value = xlsxAttr(t, "t"), ""
+				if c, ok := xlsxColumn(xlsxAttr(t, "r")); ok {
+					column = c
+				}
+			case "v", "t":
+				inValue = true
+			}
+		case xml.CharData:
+			if inValue {
+				value += string(t)
+			}
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "v", "t":
+				inValue = false
+			case "c":
+				value = xlsxCellValue(cellType, value, sharedStrings)
+				if strings.TrimSpace(value) != "" {
+					for len(row.cells) <= column {
+						row.cells = append(row.cells, "")
+					}
+					row.cells[column] = value
+				}
+				column++
+			case "row":
+				if len(row.cells) > 0 {
+					rows = append(rows, row)
+				}
+			}
+		}
+	}
+}
+
+// xlsxCellValue returns the text of the value of a cell of the type, the
+// cached value of the formulas.
+func xlsxCellValue(cellType, value string, sharedStrings []string) string {
+	switch cellType {
+	case "s":
+		i, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || i < 0 || i >= len(sharedStrings) {
+			return ""
+		}
+		return sharedStrings[i]
+	case "b":
+		if strings.TrimSpace(value) == "1" {
+			return "TRUE"
+		}
+		return "FALSE"
+	}
+	return value
+}
+
+// xlsxColumn returns the index of the column of a cell reference like "C12".
+func xlsxColumn(ref string) (int, bool) {
+	column := 0
+	letters := 0
+	for _, r := range ref {
+		if r < 'A' || r > 'Z' {
+			break
+		}
+		column = column*26 + int(r-'A'+1)
+		letters++
+	}
+	if letters == 0 {
+		return 0, false
+	}
+	return column - 1, true
+}
+
+func xlsxAttr(t xml.StartElement, name string) string {
+	for _, a := range t.Attr {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}